@@ -0,0 +1,189 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net/http"
+    "regexp"
+    "sync"
+    "sync/atomic"
+)
+
+// streamAbort lets a stream be stopped from another request. Closing the
+// upstream body stops generation in Ollama and wakes the stream's read.
+type streamAbort struct {
+    mu      sync.Mutex
+    body    io.Closer
+    aborted atomic.Bool
+}
+
+func (a *streamAbort) abort() {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.aborted.Swap(true) || a.body == nil {
+        return
+    }
+    a.body.Close()
+}
+
+// attach gives a the upstream body once Ollama has answered, closing it
+// straight away if the stream was aborted while it waited.
+func (a *streamAbort) attach(body io.Closer) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.body = body
+    if a.aborted.Load() {
+        body.Close()
+    }
+}
+
+type activeStream struct {
+    session string
+    abort   *streamAbort
+}
+
+// abortTokenHeader lets a client name its stream itself, so it can abort
+// it without a session cookie or waiting for X-Stream-ID. The token is all
+// that's needed to abort, so it has to be long enough not to be guessed.
+const abortTokenHeader = "X-Abort-Token"
+
+var abortTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+// tokenClaim is a request holding an abort token: the ID of its stream once
+// that has started, or whether it was aborted before then.
+type tokenClaim struct {
+    id      string
+    aborted bool
+}
+
+// streamRegistry tracks open /chat streams by ID so POST /chat/abort can
+// find them. Only the session that started a stream may abort it by ID;
+// anyone with its abort token may abort it by token.
+type streamRegistry struct {
+    mu      sync.Mutex
+    streams map[string]activeStream
+    tokens  map[string]*tokenClaim
+}
+
+func newStreamRegistry() *streamRegistry {
+    return &streamRegistry{streams: make(map[string]activeStream), tokens: make(map[string]*tokenClaim)}
+}
+
+// claim reserves token for a request that is about to start, or reports
+// false if another request in progress holds it. release frees it again.
+func (r *streamRegistry) claim(token string) (release func(), ok bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, taken := r.tokens[token]; taken {
+        return nil, false
+    }
+    r.tokens[token] = &tokenClaim{}
+    return func() {
+        r.mu.Lock()
+        delete(r.tokens, token)
+        r.mu.Unlock()
+    }, true
+}
+
+// bind ties a claimed token to stream id, aborting the stream right away
+// if the token was used while the request waited for it to start.
+func (r *streamRegistry) bind(token, id string) {
+    r.mu.Lock()
+    c := r.tokens[token]
+    c.id = id
+    s, aborted := r.streams[id], c.aborted
+    r.mu.Unlock()
+    if aborted {
+        s.abort.abort()
+    }
+}
+
+// abortToken stops the stream holding token, or marks it to be stopped as
+// soon as it starts, and reports whether the token is in use.
+func (r *streamRegistry) abortToken(token string) bool {
+    r.mu.Lock()
+    c, ok := r.tokens[token]
+    if !ok {
+        r.mu.Unlock()
+        return false
+    }
+    c.aborted = true
+    s, started := r.streams[c.id]
+    r.mu.Unlock()
+    if started {
+        s.abort.abort()
+    }
+    return true
+}
+
+// register records a stream and returns its ID and a func to call when the
+// stream ends. The stream can be aborted from then on; attach its upstream
+// body to the returned streamAbort once there is one.
+func (r *streamRegistry) register(session string) (string, *streamAbort, func()) {
+    b := make([]byte, 12)
+    rand.Read(b)
+    id := hex.EncodeToString(b)
+    a := &streamAbort{}
+    r.mu.Lock()
+    r.streams[id] = activeStream{session: session, abort: a}
+    r.mu.Unlock()
+    return id, a, func() {
+        r.mu.Lock()
+        delete(r.streams, id)
+        r.mu.Unlock()
+    }
+}
+
+// abort stops stream id if it belongs to session and reports whether it did.
+// A stream started without a session can only be stopped by its
+// X-Abort-Token.
+func (r *streamRegistry) abort(id, session string) bool {
+    r.mu.Lock()
+    s, ok := r.streams[id]
+    r.mu.Unlock()
+    if !ok || s.session == "" || s.session != session {
+        return false
+    }
+    s.abort.abort()
+    return true
+}
+
+// abortHandler serves POST /chat/abort {"id": "..."} with the ID from a
+// stream's X-Stream-ID header, or {"token": "..."} with the X-Abort-Token
+// the client sent. The stream ends with a "cancelled" event.
+func abortHandler(cfg *config, registry *streamRegistry) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+        var in struct {
+            ID    string `json:"id"`
+            Token string `json:"token"`
+        }
+        if err := decodeBody(r, &in, "an id or token field"); err != nil {
+            jsonError(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if in.Token != "" {
+            if !registry.abortToken(in.Token) {
+                jsonError(w, "no stream holds that token", http.StatusNotFound)
+                return
+            }
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(map[string]interface{}{"token": in.Token, "cancelled": true})
+            return
+        }
+        if !registry.abort(in.ID, existingSession(cfg, r)) {
+            jsonError(w, "no such stream", http.StatusNotFound)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"id": in.ID, "cancelled": true})
+    }
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// closeRecorder notes when the upstream body it stands in for is closed.
+type closeRecorder struct{ closed bool }
+
+func (c *closeRecorder) Close() error {
+    c.closed = true
+    return nil
+}
+
+func TestStreamRegistryTokens(t *testing.T) {
+    r := newStreamRegistry()
+    if r.abortToken("nobody-holds-this") {
+        t.Error("abortToken found an unclaimed token")
+    }
+
+    release, ok := r.claim("tok-aaaaaaaaaaaaaaaa")
+    if !ok {
+        t.Fatal("claim of a free token failed")
+    }
+    if _, ok := r.claim("tok-aaaaaaaaaaaaaaaa"); ok {
+        t.Error("a token in use was claimed twice")
+    }
+
+    id, ab, unregister := r.register("")
+    r.bind("tok-aaaaaaaaaaaaaaaa", id)
+    body := &closeRecorder{}
+    ab.attach(body)
+    if !r.abortToken("tok-aaaaaaaaaaaaaaaa") || !ab.aborted.Load() || !body.closed {
+        t.Error("abortToken did not stop the running stream")
+    }
+    unregister()
+    release()
+    if r.abortToken("tok-aaaaaaaaaaaaaaaa") {
+        t.Error("a released token still aborts")
+    }
+    if _, ok := r.claim("tok-aaaaaaaaaaaaaaaa"); !ok {
+        t.Error("a released token could not be claimed again")
+    }
+}
+
+func TestStreamRegistryAbortBeforeStart(t *testing.T) {
+    r := newStreamRegistry()
+    release, _ := r.claim("tok-bbbbbbbbbbbbbbbb")
+    defer release()
+
+    // The abort lands after the request claimed its token but before its
+    // stream exists.
+    if !r.abortToken("tok-bbbbbbbbbbbbbbbb") {
+        t.Fatal("abortToken did not find the claimed token")
+    }
+    id, ab, unregister := r.register("")
+    defer unregister()
+    r.bind("tok-bbbbbbbbbbbbbbbb", id)
+    if !ab.aborted.Load() {
+        t.Fatal("stream bound to an aborted token was not aborted")
+    }
+
+    // Ollama's answer, when it comes, is closed straight away.
+    body := &closeRecorder{}
+    ab.attach(body)
+    if !body.closed {
+        t.Error("upstream body attached to an aborted stream was left open")
+    }
+}
+
+func TestStreamRegistryAbortByID(t *testing.T) {
+    r := newStreamRegistry()
+    id, ab, unregister := r.register("session-a")
+    defer unregister()
+    if r.abort(id, "session-b") || ab.aborted.Load() {
+        t.Error("another session aborted the stream")
+    }
+    if !r.abort(id, "session-a") || !ab.aborted.Load() {
+        t.Error("the stream's own session could not abort it")
+    }
+
+    anon, _, done := r.register("")
+    defer done()
+    if r.abort(anon, "") {
+        t.Error("a stream without a session was aborted by ID")
+    }
+}
+
+// postAbort asks /chat/abort to stop the stream holding token.
+func postAbort(cfg *config, registry *streamRegistry, token string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest("POST", "/chat/abort", strings.NewReader(`{"token": "`+token+`"}`))
+    r.Header.Set("Content-Type", "application/json")
+    w := httptest.NewRecorder()
+    abortHandler(cfg, registry)(w, r)
+    return w
+}
+
+// stalledStream streams one token and then hangs until the client gives up.
+func stalledStream(w http.ResponseWriter, r *http.Request) {
+    io.WriteString(w, ndjson(ChatResponse{Response: "Once upon"}))
+    w.(http.Flusher).Flush()
+    <-r.Context().Done()
+}
+
+// streamWithToken runs a streamed /chat request holding token in the
+// background and returns its events once it ends.
+func streamWithToken(t *testing.T, chat *testChat, token string) <-chan []sseEvent {
+    done := make(chan []sseEvent, 1)
+    go func() {
+        w := chat.post(`{"prompt": "tell me a story", "stream": true}`, abortTokenHeader, token)
+        done <- parseSSE(t, w.Body.String())
+    }()
+    return done
+}
+
+func waitEvents(t *testing.T, done <-chan []sseEvent) []sseEvent {
+    t.Helper()
+    select {
+    case events := <-done:
+        return events
+    case <-time.After(5 * time.Second):
+        t.Fatal("stream still running after it was aborted")
+        return nil
+    }
+}
+
+func TestChatAbortByToken(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{"/api/generate": stalledStream})
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL)
+    chat := newTestChat(t, cfg)
+    token := "story-0123456789abcdef"
+
+    done := streamWithToken(t, chat, token)
+    deadline := time.Now().Add(2 * time.Second)
+    for len(ollama.requests("/api/generate")) == 0 {
+        if time.Now().After(deadline) {
+            t.Fatal("stream never reached Ollama")
+        }
+        time.Sleep(time.Millisecond)
+    }
+    if w := chat.post(`{"prompt": "again", "stream": true}`, abortTokenHeader, token); w.Code != http.StatusConflict {
+        t.Errorf("second request with the token = %d, want 409", w.Code)
+    }
+
+    if w := postAbort(cfg, chat.registry, token); w.Code != http.StatusOK {
+        t.Fatalf("abort = %d %q", w.Code, w.Body.String())
+    }
+    events := waitEvents(t, done)
+    if ev := last(t, events, "cancelled"); ev["reason"] != "client_abort" {
+        t.Errorf("cancelled = %v", ev)
+    }
+
+    // The token is free again once its request ends.
+    if w := postAbort(cfg, chat.registry, token); w.Code != http.StatusNotFound {
+        t.Errorf("abort after the stream ended = %d, want 404", w.Code)
+    }
+}
+
+func TestChatAbortWhileQueued(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{"/api/generate": stalledStream})
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "MAX_CONCURRENT", "1")
+    chat := newTestChat(t, cfg)
+    if err := chat.adm.acquire(context.Background(), priorityNormal, 0); err != nil {
+        t.Fatal(err)
+    }
+    token := "queued-0123456789abcdef"
+
+    done := streamWithToken(t, chat, token)
+    waitQueued(t, chat.adm, 1)
+    if w := postAbort(cfg, chat.registry, token); w.Code != http.StatusOK {
+        t.Fatalf("abort = %d %q", w.Code, w.Body.String())
+    }
+    chat.adm.release()
+
+    events := waitEvents(t, done)
+    if got := text(t, events); got != "" {
+        t.Errorf("text = %q, want nothing", got)
+    }
+    if ev := last(t, events, "cancelled"); ev["reason"] != "client_abort" {
+        t.Errorf("cancelled = %v", ev)
+    }
+}
+
+func TestChatAbortTokenChecks(t *testing.T) {
+    chat := newTestChat(t, testConfig(t))
+    tests := []struct {
+        body, token string
+        status      int
+        msg         string
+    }{
+        {`{"prompt": "hi"}`, "long-enough-0123456789", http.StatusBadRequest, "X-Abort-Token only applies to streamed replies"},
+        {`{"prompt": "hi", "stream": true}`, "short", http.StatusBadRequest, "X-Abort-Token must be 16-128 letters"},
+        {`{"prompt": "hi", "stream": true}`, "has spaces in it 0123456789", http.StatusBadRequest, "X-Abort-Token must be 16-128 letters"},
+    }
+    for _, tt := range tests {
+        w := chat.post(tt.body, abortTokenHeader, tt.token)
+        if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.msg) {
+            t.Errorf("%s with token %q = %d %q, want %d %q", tt.body, tt.token, w.Code, w.Body.String(), tt.status, tt.msg)
+        }
+    }
+}
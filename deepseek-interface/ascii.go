@@ -0,0 +1,116 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+)
+
+// ASCII modes for RESPONSE_ASCII and the per-request "ascii" field, for
+// consumers that can't handle anything but ASCII. transliterate writes
+// accented letters and typographic punctuation as their nearest ASCII and
+// drops what has none; strip drops every non-ASCII character.
+const (
+    asciiOff           = "off"
+    asciiTransliterate = "transliterate"
+    asciiStrip         = "strip"
+)
+
+func parseASCIIMode(s string) (string, error) {
+    switch s {
+    case asciiOff, asciiTransliterate, asciiStrip:
+        return s, nil
+    }
+    return "", fmt.Errorf("ascii must be off, transliterate or strip, got %q", s)
+}
+
+// asciiGroups lists characters by the ASCII they are transliterated to.
+var asciiGroups = map[string]string{
+    "A": "ÀÁÂÃÄÅĀĂĄǍ", "a": "àáâãäåāăąǎª",
+    "C": "ÇĆĈĊČ", "c": "çćĉċč",
+    "D": "ĎĐÐ", "d": "ďđð",
+    "E": "ÈÉÊËĒĔĖĘĚ", "e": "èéêëēĕėęě",
+    "G": "ĜĞĠĢ", "g": "ĝğġģ",
+    "H": "ĤĦ", "h": "ĥħ",
+    "I": "ÌÍÎÏĨĪĬĮİǏ", "i": "ìíîïĩīĭįıǐ",
+    "J": "Ĵ", "j": "ĵ",
+    "K": "Ķ", "k": "ķ",
+    "L": "ĹĻĽĿŁ", "l": "ĺļľŀł",
+    "N": "ÑŃŅŇ", "n": "ñńņňŉ",
+    "O": "ÒÓÔÕÖØŌŎŐǑ", "o": "òóôõöøōŏőǒº",
+    "R": "ŔŖŘ", "r": "ŕŗř",
+    "S": "ŚŜŞŠȘ", "s": "śŝşšș",
+    "T": "ŢŤŦȚ", "t": "ţťŧț",
+    "U": "ÙÚÛÜŨŪŬŮŰŲǓ", "u": "ùúûüũūŭůűųǔ",
+    "W": "Ŵ", "w": "ŵ",
+    "Y": "ÝŶŸ", "y": "ýÿŷ",
+    "Z": "ŹŻŽ", "z": "źżž",
+    "AE": "Æ", "ae": "æ", "OE": "Œ", "oe": "œ", "TH": "Þ", "th": "þ", "ss": "ß",
+    "'": "‘’‚‛′", "\"": "“”„‟″«»", "-": "‐‑‒–—―−", "...": "…", " ": "     ",
+    "*": "•·", "x": "×", "/": "÷", "(c)": "©", "(r)": "®", "(tm)": "™", " deg": "°",
+    "EUR": "€", "GBP": "£", "JPY": "¥", "<-": "←", "->": "→", "<=": "≤", ">=": "≥", "!=": "≠",
+}
+
+var asciiTable = func() map[rune]string {
+    t := make(map[rune]string)
+    for to, from := range asciiGroups {
+        for _, r := range from {
+            t[r] = to
+        }
+    }
+    return t
+}()
+
+// asciiFilter rewrites text to ASCII as mode says. Code, inside
+// backtick fences or inline backticks, is handled apart from prose: its
+// non-ASCII characters become \u escapes instead, so string literals and
+// the like lose nothing. It keeps track of the backticks across calls, so
+// a stream can be fed to it a token at a time.
+type asciiFilter struct {
+    mode  string
+    ticks int // backticks in the run being read
+    code  int // length of the backtick run that opened the code, or 0
+}
+
+// asciiTransform is the transform for a whole reply in mode.
+func asciiTransform(mode string) transform {
+    return func(s string) string {
+        f := &asciiFilter{mode: mode}
+        return f.feed(s)
+    }
+}
+
+func (f *asciiFilter) feed(s string) string {
+    var b strings.Builder
+    for _, r := range s {
+        if r == '`' {
+            f.ticks++
+            b.WriteRune(r)
+            continue
+        }
+        f.fence()
+        switch {
+        case r < 0x80:
+            b.WriteRune(r)
+        case f.code > 0 && r > 0xFFFF:
+            fmt.Fprintf(&b, "\\U%08X", r)
+        case f.code > 0:
+            fmt.Fprintf(&b, "\\u%04X", r)
+        case f.mode == asciiTransliterate:
+            b.WriteString(asciiTable[r])
+        }
+    }
+    return b.String()
+}
+
+// fence ends a run of backticks, which opens code, or closes the code it
+// opened when it is as long.
+func (f *asciiFilter) fence() {
+    switch {
+    case f.ticks == 0:
+    case f.code == 0:
+        f.code = f.ticks
+    case f.ticks == f.code:
+        f.code = 0
+    }
+    f.ticks = 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+)
+
+func TestASCIITransform(t *testing.T) {
+    tests := []struct {
+        mode, in, want string
+    }{
+        {asciiTransliterate, "Café über naïve", "Cafe uber naive"},
+        {asciiTransliterate, "“Quoted” — it’s…", `"Quoted" - it's...`},
+        {asciiTransliterate, "Straße, Æsir, 5 × 3 ≤ 20°C", "Strasse, AEsir, 5 x 3 <= 20 degC"},
+        {asciiTransliterate, "ok ✅ 日本", "ok  "},
+        {asciiStrip, "Café “ok” ✅", "Caf ok "},
+        {asciiTransliterate, "Use `\"é\"` here é", "Use `\"\\u00E9\"` here e"},
+        {asciiStrip, "```go\ns := \"🙂é\"\n```\nDoné", "```go\ns := \"\\U0001F642\\u00E9\"\n```\nDon"},
+        {asciiStrip, "``a ` é`` é", "``a ` \\u00E9`` "},
+        {asciiTransliterate, "plain ASCII stays", "plain ASCII stays"},
+    }
+    for _, tt := range tests {
+        if got := asciiTransform(tt.mode)(tt.in); got != tt.want {
+            t.Errorf("%s %q = %q, want %q", tt.mode, tt.in, got, tt.want)
+        }
+
+        // A token at a time gives the same, backticks split or not.
+        f := &asciiFilter{mode: tt.mode}
+        var b strings.Builder
+        for _, r := range tt.in {
+            b.WriteString(f.feed(string(r)))
+        }
+        if b.String() != tt.want {
+            t.Errorf("%s %q fed a character at a time = %q, want %q", tt.mode, tt.in, b.String(), tt.want)
+        }
+    }
+}
+
+func TestChatASCII(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "Résumé — `naïve`", Done: true, DoneReason: "stop"}),
+    })
+    tests := []struct {
+        env, body, want string
+    }{
+        {"", `{"prompt": "hi"}`, "Résumé — `naïve`"},
+        {"transliterate", `{"prompt": "hi"}`, "Resume - `na\\u00EFve`"},
+        {"transliterate", `{"prompt": "hi", "ascii": "off"}`, "Résumé — `naïve`"},
+        {"", `{"prompt": "hi", "ascii": "strip"}`, "Rsum  `na\\u00EFve`"},
+    }
+    for _, tt := range tests {
+        chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "RESPONSE_ASCII", tt.env))
+        if got := decode(t, chat.post(tt.body))["response"]; got != tt.want {
+            t.Errorf("RESPONSE_ASCII=%q %s: response = %q, want %q", tt.env, tt.body, got, tt.want)
+        }
+    }
+
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "RESPONSE_ASCII", ""))
+    if w := chat.post(`{"prompt": "hi", "ascii": "latin1"}`); w.Code != http.StatusBadRequest {
+        t.Errorf("ascii latin1 = %d, want 400", w.Code)
+    }
+}
+
+func TestStreamResponseASCII(t *testing.T) {
+    p := streamPlan()
+    p.ASCII = asciiTransliterate
+    events, _ := runStream(t, p, tokens("Ca", "fé `", "é", "` ok"), 0)
+    if got, want := text(t, events), "Cafe `\\u00E9` ok"; got != want {
+        t.Errorf("text = %q, want %q", got, want)
+    }
+}
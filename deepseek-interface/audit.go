@@ -0,0 +1,156 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "io"
+    "log"
+    "log/syslog"
+    "net/http"
+    "os"
+    "sync"
+    "time"
+)
+
+// auditFlushInterval bounds how long a buffered audit record can sit in
+// memory before it reaches the file.
+const auditFlushInterval = time.Second
+
+// auditEntry is one line of the audit log. It holds metadata only, never
+// prompt or response text.
+type auditEntry struct {
+    Time           time.Time `json:"time"`
+    Session        string    `json:"session,omitempty"`
+    IP             string    `json:"ip"`
+    Identity       string    `json:"identity,omitempty"`
+    Model          string    `json:"model,omitempty"`
+    // Metadata is the client's own correlation object, if it sent one.
+    Metadata json.RawMessage `json:"metadata,omitempty"`
+    // Tag is the request's usage tag, if it had one.
+    Tag            string    `json:"tag,omitempty"`
+    PromptLength   int       `json:"prompt_length"`
+    ResponseLength int       `json:"response_length"`
+    Status         int       `json:"status"`
+    Outcome        string    `json:"outcome"`
+    DurationMs     int64     `json:"duration_ms"`
+    // Upstream 429s waited out and retried; see postUpstream.
+    UpstreamRetries int `json:"upstream_retries"`
+}
+
+// auditLog writes one JSON line per /chat request to its own sink, apart
+// from the operational log. Files are opened append-only and written
+// through a buffer that is flushed every auditFlushInterval; syslog gets
+// each record as its own message.
+type auditLog struct {
+    mu  sync.Mutex
+    out io.WriteCloser
+    buf *bufio.Writer // nil for syslog
+}
+
+// openAuditLog opens target, which is either "syslog" or a file path. An
+// empty target disables auditing and returns nil.
+func openAuditLog(target string) (*auditLog, error) {
+    switch target {
+    case "":
+        return nil, nil
+    case "syslog":
+        w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "deepseek-audit")
+        if err != nil {
+            return nil, err
+        }
+        return &auditLog{out: w}, nil
+    }
+    f, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+    if err != nil {
+        return nil, err
+    }
+    return &auditLog{out: f, buf: bufio.NewWriter(f)}, nil
+}
+
+func (a *auditLog) record(e *auditEntry) {
+    if a == nil {
+        return
+    }
+    line, _ := json.Marshal(e)
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    var err error
+    if a.buf != nil {
+        _, err = a.buf.Write(append(line, '\n'))
+    } else {
+        _, err = a.out.Write(line)
+    }
+    if err != nil {
+        log.Printf("Audit log write failed: %v", err)
+    }
+}
+
+// run flushes the buffer periodically until ctx is done.
+func (a *auditLog) run(ctx context.Context) {
+    ticker := time.NewTicker(auditFlushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            a.flush()
+        case <-ctx.Done():
+            return
+        }
+    }
+}
+
+// close flushes what is left and closes the sink. Call it once the server
+// has drained so the last requests are recorded too.
+func (a *auditLog) close() {
+    if a == nil {
+        return
+    }
+    a.flush()
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.out.Close()
+}
+
+func (a *auditLog) flush() {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.buf == nil {
+        return
+    }
+    if err := a.buf.Flush(); err != nil {
+        log.Printf("Audit log flush failed: %v", err)
+    }
+}
+
+// statusWriter remembers the status code written through it so the audit
+// record can report it.
+type statusWriter struct {
+    http.ResponseWriter
+    status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+    s.status = code
+    s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Flush() {
+    if f, ok := s.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// auditOutcome summarises a finished request for the audit log when the
+// handler didn't set a more specific outcome.
+func auditOutcome(status int) string {
+    switch {
+    case status >= 500:
+        return "error"
+    case status >= 400:
+        return "rejected"
+    }
+    return "ok"
+}
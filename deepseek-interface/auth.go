@@ -0,0 +1,20 @@
+package main
+
+import (
+    "crypto/subtle"
+    "net/http"
+    "strings"
+)
+
+// isAdmin reports whether r carries "Authorization: Bearer <token>" matching
+// the configured admin token. An empty token disables admin access entirely.
+func isAdmin(r *http.Request, token string) bool {
+    if token == "" {
+        return false
+    }
+    got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if !ok {
+        return false
+    }
+    return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+)
+
+// A non-streaming /chat request can ask for "auto_continue": N. When its
+// reply stops at num_predict, the model is asked up to N more times to carry
+// on where it stopped, and the pieces come back as one reply. Continuations
+// go to Ollama's /api/chat with the reply so far as a final assistant
+// message, which Ollama continues in place under the model's own template,
+// as it does for a /v1 prefill. A reply that ran out while still thinking
+// is sent back with its thinking so far, so the model picks up its
+// reasoning rather than starting over.
+//
+// AUTO_CONTINUE_MAX caps N, and no continuation is asked for once the reply
+// reaches AUTO_CONTINUE_MAX_BYTES. Continuations are calls to Ollama like
+// any other, so MAX_UPSTREAM_ATTEMPTS counts them too.
+
+// Why a reply that is still cut off wasn't continued further.
+const (
+    continueStopCount    = "count"
+    continueStopSize     = "size"
+    continueStopAttempts = "attempts"
+    continueStopError    = "error"
+)
+
+// continuation is what auto_continue did, reported on the reply.
+type continuation struct {
+    Count int `json:"count"`
+    // Stopped is set when the reply is still truncated: count, size,
+    // attempts or error.
+    Stopped string `json:"stopped,omitempty"`
+}
+
+// thinkingMessage is an /api/chat message with the reasoning Ollama keeps
+// apart when "think" is set, which the /v1 code has no use for.
+type thinkingMessage struct {
+    Role     string `json:"role"`
+    Content  string `json:"content"`
+    Thinking string `json:"thinking,omitempty"`
+}
+
+// continueRequest is the /api/chat request continuing a /chat reply. It
+// carries every field of the /api/generate request it continues, so the
+// model, settings and options of each piece are those of the first. Only
+// the prompt and system prompt move, into Messages.
+type continueRequest struct {
+    ChatRequest
+    Messages []thinkingMessage
+}
+
+// MarshalJSON writes the request as /api/chat takes it. The fields are
+// copied from the JSON of ChatRequest, so one added there is carried over
+// without a change here. stream is always false: continueOnce reads one
+// reply, even when the first piece was collected from a stream.
+func (c continueRequest) MarshalJSON() ([]byte, error) {
+    upstream, err := json.Marshal(c.ChatRequest)
+    if err != nil {
+        return nil, err
+    }
+    var fields map[string]interface{}
+    if err := json.Unmarshal(upstream, &fields); err != nil {
+        return nil, err
+    }
+    delete(fields, "prompt")
+    delete(fields, "system")
+    fields["stream"] = false
+    fields["messages"] = c.Messages
+    return json.Marshal(fields)
+}
+
+// continueRequestFor asks for what follows resp, the reply so far to req.
+func continueRequestFor(req ChatRequest, resp *ChatResponse) continueRequest {
+    var messages []thinkingMessage
+    if req.System != "" {
+        messages = append(messages, thinkingMessage{Role: "system", Content: req.System})
+    }
+    messages = append(messages,
+        thinkingMessage{Role: "user", Content: req.Prompt},
+        thinkingMessage{Role: "assistant", Content: resp.Response, Thinking: resp.Thinking},
+    )
+    return continueRequest{ChatRequest: req, Messages: messages}
+}
+
+// continueReply continues resp while it is truncated by length, at most max
+// times and until its thinking and response together reach maxBytes.
+// generate makes one call and returns what the model added. Each piece's
+// thinking, text, counts and durations are added to resp, and its
+// done_reason replaces resp's.
+func continueReply(req ChatRequest, resp *ChatResponse, max, maxBytes int, generate func(continueRequest) (*ChatResponse, error)) *continuation {
+    c := &continuation{}
+    for resp.DoneReason == "length" {
+        switch {
+        case c.Count >= max:
+            c.Stopped = continueStopCount
+        case len(resp.Thinking)+len(resp.Response) >= maxBytes:
+            c.Stopped = continueStopSize
+        }
+        if c.Stopped != "" {
+            return c
+        }
+
+        more, err := generate(continueRequestFor(req, resp))
+        if err != nil {
+            c.Stopped = continueStopError
+            if errors.Is(err, errUpstreamAttempts) {
+                c.Stopped = continueStopAttempts
+            }
+            log.Printf("Stopped continuing a truncated reply after %d continuations: %v", c.Count, err)
+            return c
+        }
+        c.Count++
+        resp.Thinking += more.Thinking
+        resp.Response += more.Response
+        resp.DoneReason = more.DoneReason
+        resp.PromptEvalCount += more.PromptEvalCount
+        resp.EvalCount += more.EvalCount
+        resp.TotalDuration += more.TotalDuration
+        resp.LoadDuration += more.LoadDuration
+        resp.PromptEvalDuration += more.PromptEvalDuration
+        resp.EvalDuration += more.EvalDuration
+    }
+    return c
+}
+
+// continueOnce makes one non-streaming /api/chat call for req and returns
+// what the model added as a ChatResponse, with its done_reason filled in
+// for an Ollama too old to send one. It also returns how many upstream 429s
+// were retried.
+func continueOnce(ctx context.Context, cfg *config, client *http.Client, url string, req continueRequest, limits *rateLimitCounters) (*ChatResponse, int, error) {
+    body, _ := json.Marshal(req)
+    resp, retries, err := postUpstream(ctx, cfg, client, url, body, limits)
+    if err != nil {
+        return nil, retries, err
+    }
+    defer resp.Body.Close()
+    var out struct {
+        Message thinkingMessage `json:"message"`
+        ChatResponse
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+        return nil, retries, fmt.Errorf("invalid response: %v", err)
+    }
+    if resp.StatusCode != http.StatusOK || out.Error != "" {
+        return nil, retries, fmt.Errorf("status %d %s", resp.StatusCode, out.Error)
+    }
+    more := out.ChatResponse
+    more.Response, more.Thinking = out.Message.Content, out.Message.Thinking
+    more.DoneReason = doneReason(more.DoneReason, more.EvalCount, intOption(req.Options, "num_predict"))
+    return &more, retries, nil
+}
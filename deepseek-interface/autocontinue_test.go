@@ -0,0 +1,233 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestContinueRequestFor(t *testing.T) {
+    req := ChatRequest{
+        Model:       "llama3:8b",
+        Prompt:      "Count to ten.",
+        System:      "Be brief.",
+        Stream:      true,
+        Logprobs:    true,
+        TopLogprobs: 2,
+        KeepAlive:   "10m",
+        Think:       "high",
+        Options:     map[string]interface{}{"num_predict": 8.0, "temperature": 0.2, "stop": []interface{}{"###"}},
+    }
+    // Every field is set, so one added to ChatRequest later that isn't
+    // carried over fails here.
+    v := reflect.ValueOf(req)
+    for i := 0; i < v.NumField(); i++ {
+        if v.Field(i).IsZero() {
+            t.Fatalf("ChatRequest.%s isn't set in this test", v.Type().Field(i).Name)
+        }
+    }
+
+    c := continueRequestFor(req, &ChatResponse{Response: "1, 2, 3", Thinking: "easy"})
+    want := []thinkingMessage{
+        {Role: "system", Content: "Be brief."},
+        {Role: "user", Content: "Count to ten."},
+        {Role: "assistant", Content: "1, 2, 3", Thinking: "easy"},
+    }
+    if !reflect.DeepEqual(c.Messages, want) {
+        t.Errorf("messages = %+v, want %+v", c.Messages, want)
+    }
+
+    var upstream, sent map[string]interface{}
+    raw, _ := json.Marshal(req)
+    json.Unmarshal(raw, &upstream)
+    raw, err := json.Marshal(c)
+    if err != nil {
+        t.Fatal(err)
+    }
+    json.Unmarshal(raw, &sent)
+    for key, value := range upstream {
+        switch key {
+        case "prompt", "system":
+            if _, ok := sent[key]; ok {
+                t.Errorf("%s sent alongside the messages", key)
+            }
+        case "stream":
+            if sent[key] != false {
+                t.Errorf("stream = %v, want false for continueOnce's single reply", sent[key])
+            }
+        default:
+            if !reflect.DeepEqual(sent[key], value) {
+                t.Errorf("%s = %v, want %v as in the request continued", key, sent[key], value)
+            }
+        }
+    }
+    if _, ok := sent["messages"]; !ok {
+        t.Errorf("no messages in %s", raw)
+    }
+
+    req.System = ""
+    if got := continueRequestFor(req, &ChatResponse{}); len(got.Messages) != 2 || got.Messages[0].Role != "user" {
+        t.Errorf("messages without a system prompt = %+v", got.Messages)
+    }
+}
+
+// pieces continues a reply with each of replies in turn, each cut off at
+// num_predict but the last, and keeps the reply so far from each request.
+func pieces(sent *[]string, replies ...string) func(continueRequest) (*ChatResponse, error) {
+    return func(next continueRequest) (*ChatResponse, error) {
+        *sent = append(*sent, next.Messages[len(next.Messages)-1].Content)
+        more := &ChatResponse{Response: replies[0], DoneReason: "length", EvalCount: 2}
+        if replies = replies[1:]; len(replies) == 0 {
+            more.DoneReason = "stop"
+        }
+        return more, nil
+    }
+}
+
+func TestContinueReply(t *testing.T) {
+    req := ChatRequest{Model: "llama3:8b", Prompt: "go on"}
+    tests := []struct {
+        name      string
+        done      string
+        max, size int
+        generate  func(*[]string) func(continueRequest) (*ChatResponse, error)
+        response  string
+        reason    string
+        want      continuation
+        sent      []string
+    }{
+        {"finished", "length", 3, 100,
+            func(s *[]string) func(continueRequest) (*ChatResponse, error) { return pieces(s, "bc", "de") },
+            "abcde", "stop", continuation{Count: 2}, []string{"a", "abc"}},
+        {"not truncated", "stop", 3, 100,
+            func(s *[]string) func(continueRequest) (*ChatResponse, error) { return pieces(s, "bc") },
+            "a", "stop", continuation{}, nil},
+        {"count", "length", 2, 100,
+            func(s *[]string) func(continueRequest) (*ChatResponse, error) { return pieces(s, "bc", "de", "fg") },
+            "abcde", "length", continuation{Count: 2, Stopped: continueStopCount}, []string{"a", "abc"}},
+        {"size", "length", 3, 3,
+            func(s *[]string) func(continueRequest) (*ChatResponse, error) { return pieces(s, "bc", "de") },
+            "abc", "length", continuation{Count: 1, Stopped: continueStopSize}, []string{"a"}},
+        {"attempts", "length", 3, 100,
+            func(*[]string) func(continueRequest) (*ChatResponse, error) {
+                return func(continueRequest) (*ChatResponse, error) { return nil, errUpstreamAttempts }
+            },
+            "a", "length", continuation{Stopped: continueStopAttempts}, nil},
+        {"error", "length", 3, 100,
+            func(*[]string) func(continueRequest) (*ChatResponse, error) {
+                return func(continueRequest) (*ChatResponse, error) { return nil, errors.New("status 500") }
+            },
+            "a", "length", continuation{Stopped: continueStopError}, nil},
+    }
+    for _, tt := range tests {
+        var sent []string
+        resp := &ChatResponse{Response: "a", DoneReason: tt.done, EvalCount: 2}
+        got := continueReply(req, resp, tt.max, tt.size, tt.generate(&sent))
+        if *got != tt.want {
+            t.Errorf("%s: continuation = %+v, want %+v", tt.name, *got, tt.want)
+        }
+        if resp.Response != tt.response || resp.DoneReason != tt.reason {
+            t.Errorf("%s: reply = %q (%s), want %q (%s)", tt.name, resp.Response, resp.DoneReason, tt.response, tt.reason)
+        }
+        if resp.EvalCount != 2*(1+got.Count) {
+            t.Errorf("%s: eval_count = %d, want the %d pieces' counts added up", tt.name, resp.EvalCount, 1+got.Count)
+        }
+        if !reflect.DeepEqual(sent, tt.sent) {
+            t.Errorf("%s: continued from %q, want %q", tt.name, sent, tt.sent)
+        }
+    }
+}
+
+func TestChatAutoContinue(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "Once", Done: true, DoneReason: "length", EvalCount: 1}),
+        "/api/chat": func(w http.ResponseWriter, r *http.Request) {
+            json.NewEncoder(w).Encode(map[string]interface{}{
+                "message":     map[string]string{"role": "assistant", "content": " upon"},
+                "done":        true,
+                "done_reason": "length",
+                "eval_count":  1,
+            })
+        },
+    })
+    tests := []struct {
+        env      []string
+        body     string
+        response string
+        want     continuation
+    }{
+        {nil, `{"prompt": "story", "auto_continue": 2}`, "Once upon upon", continuation{Count: 2, Stopped: continueStopCount}},
+        {[]string{"MAX_UPSTREAM_ATTEMPTS", "2"}, `{"prompt": "story", "auto_continue": 3}`, "Once upon", continuation{Count: 1, Stopped: continueStopAttempts}},
+        {[]string{"AUTO_CONTINUE_MAX_BYTES", "8"}, `{"prompt": "story", "auto_continue": 3}`, "Once upon", continuation{Count: 1, Stopped: continueStopSize}},
+    }
+    for _, tt := range tests {
+        env := append([]string{"OLLAMA_URL", ollama.URL, "MAX_UPSTREAM_ATTEMPTS", "0", "AUTO_CONTINUE_MAX_BYTES", "65536"}, tt.env...)
+        chat := newTestChat(t, testConfig(t, env...))
+        w := chat.post(tt.body)
+        if w.Code != http.StatusOK {
+            t.Fatalf("%v: status %d: %s", tt.env, w.Code, w.Body.String())
+        }
+        var got struct {
+            Response  string
+            Continued continuation
+        }
+        json.Unmarshal(w.Body.Bytes(), &got)
+        if got.Response != tt.response || got.Continued != tt.want {
+            t.Errorf("%v: reply %q continued %+v, want %q continued %+v", tt.env, got.Response, got.Continued, tt.response, tt.want)
+        }
+    }
+
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "AUTO_CONTINUE_MAX", "3"))
+    for body, msg := range map[string]string{
+        `{"prompt": "story", "auto_continue": 4}`:                 "auto_continue must be from 0 to 3",
+        `{"prompt": "story", "auto_continue": 1, "stream": true}`: "auto_continue only applies to non-streamed replies",
+    } {
+        if w := chat.post(body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), msg) {
+            t.Errorf("%s: %d %q, want 400 %q", body, w.Code, w.Body.String(), msg)
+        }
+    }
+}
+
+func TestChatAutoContinueKeepsSettings(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "**Once**", Done: true, DoneReason: "length"}),
+        "/api/chat": func(w http.ResponseWriter, r *http.Request) {
+            json.NewEncoder(w).Encode(map[string]interface{}{
+                "message":     map[string]string{"role": "assistant", "content": " upon *a time*"},
+                "done":        true,
+                "done_reason": "stop",
+            })
+        },
+    })
+    // With PARTIAL_ON_TIMEOUT the first piece is collected from a stream,
+    // and the continuation still asks for a single reply.
+    for i, partial := range []string{"false", "true"} {
+        chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "PARTIAL_ON_TIMEOUT", partial))
+        w := chat.post(`{"prompt": "story", "system": "Be brief.", "auto_continue": 1, "format": "html",
+            "options": {"temperature": 0.2, "num_predict": 4, "seed": 7, "stop": ["###"], "keep_alive": "10m"}}`)
+        if w.Code != http.StatusOK {
+            t.Fatalf("partial %s: status %d: %s", partial, w.Code, w.Body.String())
+        }
+
+        generated, continued := ollama.requests("/api/generate")[i], ollama.requests("/api/chat")[i]
+        for _, key := range []string{"model", "options", "keep_alive", "think"} {
+            if !reflect.DeepEqual(continued[key], generated[key]) {
+                t.Errorf("partial %s: continuation %s = %v, want %v as for the first piece", partial, key, continued[key], generated[key])
+            }
+        }
+        if generated["stream"] != (partial == "true") || continued["stream"] != false {
+            t.Errorf("partial %s: stream %v then %v, want the continuation unstreamed", partial, generated["stream"], continued["stream"])
+        }
+
+        got := decode(t, w)
+        if got["response"] != "**Once** upon *a time*" || got["format"] != "html" {
+            t.Errorf("partial %s: reply %q in %v, want both pieces", partial, got["response"], got["format"])
+        }
+        if html, _ := got["html"].(string); !strings.Contains(html, "<strong>Once</strong>") || !strings.Contains(html, "<em>a time</em>") {
+            t.Errorf("partial %s: html = %q, want the whole reply rendered", partial, got["html"])
+        }
+    }
+}
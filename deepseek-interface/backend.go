@@ -0,0 +1,97 @@
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "path"
+    "strings"
+    "sync/atomic"
+)
+
+// backendSpec is one entry of the "backends" list in CONFIG_FILE.
+type backendSpec struct {
+    Name string `json:"name"`
+    URL  string `json:"url"`
+    // Models this backend can serve, as exact names or globs such as
+    // "llama3:*". Empty means any model.
+    Models []string `json:"models"`
+}
+
+// backends routes generation requests to one of several Ollama servers by
+// model capability, round-robin among the capable ones. With no backends
+// configured everything goes to OLLAMA_URL as before.
+type backends struct {
+    list []backendSpec
+    next atomic.Uint64
+}
+
+func buildBackends(specs []backendSpec) (*backends, error) {
+    for i, b := range specs {
+        u, err := url.Parse(b.URL)
+        if err != nil || u.Scheme == "" || u.Host == "" {
+            return nil, fmt.Errorf("backend %d: %q is not a valid URL", i, b.URL)
+        }
+        specs[i].URL = strings.TrimRight(b.URL, "/")
+        if specs[i].Name == "" {
+            specs[i].Name = u.Host
+        }
+        for _, m := range b.Models {
+            if _, err := path.Match(m, ""); err != nil {
+                return nil, fmt.Errorf("backend %s: bad model pattern %q", specs[i].Name, m)
+            }
+        }
+    }
+    return &backends{list: specs}, nil
+}
+
+func (b *backendSpec) serves(model string) bool {
+    if len(b.Models) == 0 {
+        return true
+    }
+    for _, m := range b.Models {
+        if ok, _ := path.Match(m, model); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// pick returns the backend to send a request for model to. Capable
+// backends take turns; the rotation is shared across models, which is
+// close enough to even at this scale.
+func (bs *backends) pick(model string) (*backendSpec, error) {
+    var capable []*backendSpec
+    for i := range bs.list {
+        if bs.list[i].serves(model) {
+            capable = append(capable, &bs.list[i])
+        }
+    }
+    if len(capable) == 0 {
+        return nil, fmt.Errorf("no configured backend can serve model %s", model)
+    }
+    return capable[bs.next.Add(1)%uint64(len(capable))], nil
+}
+
+// modelAPI returns the URL of path on a backend that can serve model.
+// Each call takes the next backend's turn, so calls that must reach the
+// same Ollama, as those for one request do, share one modelBase instead.
+func (c *config) modelAPI(model, path string) (string, error) {
+    base, err := c.modelBase(model)
+    if err != nil {
+        return "", err
+    }
+    return base + path, nil
+}
+
+// modelBase picks a backend that can serve model and returns the URL its
+// API paths go under.
+func (c *config) modelBase(model string) (string, error) {
+    if c.Backends == nil || len(c.Backends.list) == 0 {
+        return c.ollamaAPI(""), nil
+    }
+    b, err := c.Backends.pick(model)
+    if err != nil {
+        return "", err
+    }
+    return b.URL + c.OllamaAPIPrefix, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// tokenBudget caps how many tokens each session may generate per day. The
+// limit comes from DAILY_TOKEN_BUDGET or the request's role.
+// Usage is counted from Ollama's eval_count after each reply, so the
+// request that crosses the line completes and the next one is refused.
+// It lives in memory: a restart starts everyone afresh.
+type tokenBudget struct {
+    reset time.Duration
+
+    mu     sync.Mutex
+    period time.Time
+    used   map[string]int
+}
+
+func newTokenBudget(cfg *config) *tokenBudget {
+    return &tokenBudget{reset: cfg.TokenBudgetReset, used: make(map[string]int)}
+}
+
+// parseResetTime reads an "HH:MM" local time of day as an offset from
+// midnight.
+func parseResetTime(v string) (time.Duration, error) {
+    h, m, ok := strings.Cut(v, ":")
+    hh, err1 := strconv.Atoi(h)
+    mm, err2 := strconv.Atoi(m)
+    if !ok || err1 != nil || err2 != nil || hh < 0 || hh > 23 || mm < 0 || mm > 59 {
+        return 0, fmt.Errorf("%q is not a time of day such as 00:00", v)
+    }
+    return time.Duration(hh)*time.Hour + time.Duration(mm)*time.Minute, nil
+}
+
+// periodStart is the most recent reset at or before now.
+func (b *tokenBudget) periodStart(now time.Time) time.Time {
+    y, mo, d := now.Date()
+    start := time.Date(y, mo, d, 0, 0, 0, 0, now.Location()).Add(b.reset)
+    if start.After(now) {
+        start = start.AddDate(0, 0, -1)
+    }
+    return start
+}
+
+// rolloverLocked forgets the previous day's usage once the reset passes.
+func (b *tokenBudget) rolloverLocked(now time.Time) {
+    if start := b.periodStart(now); !start.Equal(b.period) {
+        b.period = start
+        b.used = make(map[string]int)
+    }
+}
+
+// remaining returns how many of its limit tokens key has left today and
+// when the budget resets.
+func (b *tokenBudget) remaining(key string, limit int) (int, time.Time) {
+    now := time.Now()
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.rolloverLocked(now)
+    left := limit - b.used[key]
+    if left < 0 {
+        left = 0
+    }
+    return left, b.period.AddDate(0, 0, 1)
+}
+
+func (b *tokenBudget) add(key string, tokens int) {
+    if tokens <= 0 {
+        return
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.rolloverLocked(time.Now())
+    b.used[key] += tokens
+}
+
+// admit reports whether key may start another generation under limit
+// (0 for none), writing a 429 with Retry-After until the reset when it may
+// not. Either way the remaining budget goes out in
+// X-Token-Budget-Remaining. send writes the rejection in the endpoint's own
+// error shape.
+func (b *tokenBudget) admit(w http.ResponseWriter, key string, limit int, send func(msg string)) bool {
+    if limit == 0 {
+        return true
+    }
+    left, resetAt := b.remaining(key, limit)
+    w.Header().Set("X-Token-Budget-Remaining", strconv.Itoa(left))
+    if left > 0 {
+        return true
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(resetAt).Seconds())+1))
+    send(fmt.Sprintf("daily token budget of %d used up; it resets at %s", limit, resetAt.Format(time.RFC3339)))
+    return false
+}
+
+// budgetKey is who a request's tokens are charged to: admins share one
+// budget, everyone else is counted per session.
+func budgetKey(role, session string) string {
+    if role == roleAdmin {
+        return roleAdmin
+    }
+    return session
+}
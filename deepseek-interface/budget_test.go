@@ -0,0 +1,111 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestTokenBudgetAccumulates(t *testing.T) {
+    b := &tokenBudget{used: make(map[string]int)}
+    b.add("a", 30)
+    b.add("a", 50)
+    b.add("a", 0)
+    b.add("b", 10)
+    if left, _ := b.remaining("a", 100); left != 20 {
+        t.Errorf("a has %d left, want 20", left)
+    }
+    if left, _ := b.remaining("b", 100); left != 90 {
+        t.Errorf("b has %d left, want 90", left)
+    }
+
+    b.add("a", 50)
+    if left, _ := b.remaining("a", 100); left != 0 {
+        t.Errorf("a has %d left after going over, want 0", left)
+    }
+    w := httptest.NewRecorder()
+    var refused string
+    if b.admit(w, "a", 100, func(msg string) { refused = msg }) || refused == "" {
+        t.Error("a was admitted with its budget used up")
+    }
+    if w.Header().Get("X-Token-Budget-Remaining") != "0" || w.Header().Get("Retry-After") == "" {
+        t.Errorf("headers = %v, want 0 remaining and a Retry-After", w.Header())
+    }
+    if !b.admit(httptest.NewRecorder(), "a", 0, nil) {
+        t.Error("a limit of 0 refused a request")
+    }
+}
+
+func TestTokenBudgetRollover(t *testing.T) {
+    b := &tokenBudget{reset: 6 * time.Hour, used: make(map[string]int)}
+    day := func(h, m int) time.Time { return time.Date(2026, 3, 10, h, m, 0, 0, time.Local) }
+
+    tests := []struct {
+        now, want time.Time
+    }{
+        {day(6, 0), day(6, 0)},
+        {day(23, 59), day(6, 0)},
+        {day(5, 59), day(6, 0).AddDate(0, 0, -1)},
+        {day(0, 0), day(6, 0).AddDate(0, 0, -1)},
+    }
+    for _, tt := range tests {
+        if got := b.periodStart(tt.now); !got.Equal(tt.want) {
+            t.Errorf("periodStart(%s) = %s, want %s", tt.now, got, tt.want)
+        }
+    }
+
+    b.rolloverLocked(day(5, 0))
+    b.used["a"] = 500
+    b.rolloverLocked(day(5, 59))
+    if b.used["a"] != 500 {
+        t.Error("usage was reset before the reset time")
+    }
+    b.rolloverLocked(day(6, 0))
+    if b.used["a"] != 0 {
+        t.Errorf("usage after the reset time = %d, want 0", b.used["a"])
+    }
+
+    if _, err := parseResetTime("24:00"); err == nil {
+        t.Error("parseResetTime(24:00) was accepted")
+    }
+    if d, err := parseResetTime("06:30"); err != nil || d != 6*time.Hour+30*time.Minute {
+        t.Errorf("parseResetTime(06:30) = %s, %v", d, err)
+    }
+}
+
+func TestChatTokenBudget(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, EvalCount: 6}),
+    })
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "DAILY_TOKEN_BUDGET", "10")
+    chat := newTestChat(t, cfg)
+    session := sessionFor("a")
+
+    post := func(cookie string) *httptest.ResponseRecorder {
+        return chat.post(`{"prompt": "hi"}`, "Cookie", sessionCookie+"="+cookie)
+    }
+    for i, want := range []struct {
+        code int
+        left string
+    }{{200, "10"}, {200, "4"}, {429, "0"}} {
+        w := post(signSession(cfg, session))
+        if w.Code != want.code || w.Header().Get("X-Token-Budget-Remaining") != want.left {
+            t.Errorf("request %d = %d with %q left, want %d with %q", i+1, w.Code, w.Header().Get("X-Token-Budget-Remaining"), want.code, want.left)
+        }
+    }
+
+    // Cookies that aren't signed by this server, made up or with no
+    // signature, all count against the client's IP, not a budget each.
+    forged := []string{sessionFor("b"), sessionFor("c") + ".00", sessionFor("d") + "." + sessionSignature(cfg, sessionFor("e"))}
+    if w := post(forged[0]); w.Code != http.StatusOK {
+        t.Fatalf("first request from the IP = %d", w.Code)
+    }
+    post(forged[1])
+    if w := post(forged[2]); w.Code != http.StatusTooManyRequests {
+        t.Errorf("third request from the IP with a new forged cookie = %d, want 429", w.Code)
+    }
+    if w := post(signSession(cfg, sessionFor("f"))); w.Code != http.StatusOK {
+        t.Errorf("a genuine new session = %d, want 200", w.Code)
+    }
+}
@@ -0,0 +1,33 @@
+package main
+
+import "sync/atomic"
+
+// cacheStats counts lookups against one cache. An eviction is a cached
+// value being thrown away, whether it expired or was invalidated.
+type cacheStats struct {
+    hits      atomic.Int64
+    misses    atomic.Int64
+    evictions atomic.Int64
+}
+
+// cacheCounts is the /stats view of a cacheStats.
+type cacheCounts struct {
+    Hits      int64   `json:"hits"`
+    Misses    int64   `json:"misses"`
+    Evictions int64   `json:"evictions"`
+    HitRatio  float64 `json:"hit_ratio"`
+}
+
+func (s *cacheStats) counts() cacheCounts {
+    c := cacheCounts{Hits: s.hits.Load(), Misses: s.misses.Load(), Evictions: s.evictions.Load()}
+    if n := c.Hits + c.Misses; n > 0 {
+        c.HitRatio = float64(c.Hits) / float64(n)
+    }
+    return c
+}
+
+// namedCache labels a cache's counters in /metrics and /stats.
+type namedCache struct {
+    name  string
+    stats *cacheStats
+}
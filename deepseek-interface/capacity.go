@@ -0,0 +1,138 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Ollama has no way to say whether a model will fit before it is pulled, so
+// GET /models/capacity reports what we can see: free space where the model
+// store is mounted (MODELS_DIR) and, from /api/ps, the VRAM held by loaded
+// models against GPU_VRAM. Either half says why when it isn't available.
+
+type diskCapacity struct {
+    Available  bool   `json:"available"`
+    Reason     string `json:"reason,omitempty"`
+    Path       string `json:"path,omitempty"`
+    FreeBytes  uint64 `json:"free_bytes,omitempty"`
+    TotalBytes uint64 `json:"total_bytes,omitempty"`
+    // PULL_MIN_FREE_DISK, below which pulls are refused.
+    MinFreeBytes uint64 `json:"min_free_bytes,omitempty"`
+}
+
+type loadedModelMemory struct {
+    Name     string `json:"name"`
+    SizeVRAM int64  `json:"size_vram"`
+}
+
+type vramCapacity struct {
+    Available  bool                `json:"available"`
+    Reason     string              `json:"reason,omitempty"`
+    TotalBytes int64               `json:"total_bytes,omitempty"`
+    UsedBytes  int64               `json:"used_bytes"`
+    FreeBytes  int64               `json:"free_bytes,omitempty"`
+    Loaded     []loadedModelMemory `json:"loaded"`
+}
+
+func diskSpace(cfg *config) diskCapacity {
+    if cfg.ModelsDir == "" {
+        return diskCapacity{Reason: "MODELS_DIR is not set"}
+    }
+    free, total, err := freeSpace(cfg.ModelsDir)
+    if err != nil {
+        return diskCapacity{Reason: err.Error(), Path: cfg.ModelsDir}
+    }
+    return diskCapacity{Available: true, Path: cfg.ModelsDir, FreeBytes: free, TotalBytes: total}
+}
+
+func vramHeadroom(ctx context.Context, cfg *config) vramCapacity {
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    v := vramCapacity{Loaded: []loadedModelMemory{}}
+    req, err := http.NewRequestWithContext(ctx, "GET", cfg.ollamaAPI("/api/ps"), nil)
+    if err != nil {
+        v.Reason = err.Error()
+        return v
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        v.Reason = fmt.Sprintf("cannot list loaded models: %v", err)
+        return v
+    }
+    defer resp.Body.Close()
+    var ps struct {
+        Models []loadedModelMemory `json:"models"`
+    }
+    if resp.StatusCode != http.StatusOK {
+        v.Reason = fmt.Sprintf("cannot list loaded models: Ollama responded with status %d", resp.StatusCode)
+        return v
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+        v.Reason = fmt.Sprintf("cannot list loaded models: %v", err)
+        return v
+    }
+    for _, m := range ps.Models {
+        v.UsedBytes += m.SizeVRAM
+        v.Loaded = append(v.Loaded, m)
+    }
+    if cfg.GPUVRAM == 0 {
+        v.Reason = "GPU_VRAM is not set, so only the memory used by loaded models is known"
+        return v
+    }
+    v.Available = true
+    v.TotalBytes = cfg.GPUVRAM
+    if v.FreeBytes = cfg.GPUVRAM - v.UsedBytes; v.FreeBytes < 0 {
+        v.FreeBytes = 0
+    }
+    return v
+}
+
+func capacityHandler(cfg *config) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        disk := diskSpace(cfg)
+        disk.MinFreeBytes = uint64(cfg.PullMinFreeDisk)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "disk": disk,
+            "vram": vramHeadroom(r.Context(), cfg),
+        })
+    }
+}
+
+// parseByteSize reads sizes such as "24GiB", "500MB" or a plain number of
+// bytes.
+func parseByteSize(s string) (int64, error) {
+    units := []struct {
+        suffix string
+        scale  int64
+    }{
+        {"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+        {"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+    }
+    num, scale := strings.TrimSpace(s), int64(1)
+    for _, u := range units {
+        if strings.HasSuffix(num, u.suffix) {
+            num, scale = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.scale
+            break
+        }
+    }
+    n, err := strconv.ParseFloat(num, 64)
+    if err != nil || n < 0 {
+        return 0, fmt.Errorf("%q is not a size such as 24GiB", s)
+    }
+    return int64(n * float64(scale)), nil
+}
+
+// formatBytes is the reverse of parseByteSize, in GB, for messages.
+func formatBytes(n uint64) string {
+    return fmt.Sprintf("%.1f GB", float64(n)/1e9)
+}
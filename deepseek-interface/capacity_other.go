@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+func freeSpace(path string) (free, total uint64, err error) {
+    return 0, 0, errors.New("free disk space can't be read on this platform")
+}
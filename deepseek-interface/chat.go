@@ -0,0 +1,995 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+type ChatRequest struct {
+    Model       string `json:"model"`
+    Prompt      string `json:"prompt"`
+    System      string `json:"system,omitempty"`
+    Stream      bool   `json:"stream"`
+    Logprobs    bool   `json:"logprobs,omitempty"`
+    TopLogprobs int    `json:"top_logprobs,omitempty"`
+
+    // KeepAlive is how long Ollama keeps the model loaded afterwards. It is
+    // a top-level field for Ollama, but clients set it as options.keep_alive.
+    KeepAlive interface{} `json:"keep_alive,omitempty"`
+
+    // Think is false, or a level from thinkValue; see parseThinkingBudget.
+    Think interface{} `json:"think,omitempty"`
+
+    Options map[string]interface{} `json:"options,omitempty"`
+}
+
+type ChatResponse struct {
+    Response   string          `json:"response"`
+    Thinking   string          `json:"thinking"`
+    Done       bool            `json:"done"`
+    DoneReason string          `json:"done_reason"`
+    Error      string          `json:"error"`
+    Logprobs   json.RawMessage `json:"logprobs,omitempty"`
+
+    // Timings and counts Ollama sends with the final chunk. Durations are
+    // in nanoseconds.
+    TotalDuration      int64 `json:"total_duration"`
+    LoadDuration       int64 `json:"load_duration"`
+    PromptEvalCount    int   `json:"prompt_eval_count"`
+    PromptEvalDuration int64 `json:"prompt_eval_duration"`
+    EvalCount          int   `json:"eval_count"`
+    EvalDuration       int64 `json:"eval_duration"`
+}
+
+// chatInput is the body accepted by /chat.
+type chatInput struct {
+    Prompt      string `json:"prompt"`
+    Logprobs    bool   `json:"logprobs"`
+    TopLogprobs int    `json:"top_logprobs"`
+    Priority    string `json:"priority"`
+    Model       string `json:"model"`
+    System      string `json:"system"`
+    Timeout     string `json:"timeout"`
+    Stream      bool   `json:"stream"`
+
+    // HideReasoning leaves out a thinking model's <think> block and only
+    // returns the answer after it.
+    HideReasoning bool `json:"hide_reasoning"`
+
+    // Format overrides RESPONSE_FORMAT: raw, markdown or html.
+    Format string `json:"format"`
+
+    // Flush overrides STREAM_FLUSH: token, newline or time.
+    Flush string `json:"flush"`
+
+    // ThinkingBudget overrides THINKING_BUDGET: off, low, medium or high.
+    ThinkingBudget string `json:"thinking_budget"`
+
+    // Metadata is an opaque JSON object for the caller's own bookkeeping.
+    // It is echoed back and audited but never sent to the model.
+    Metadata json.RawMessage `json:"metadata"`
+
+    // Passthrough overrides PASSTHROUGH: return Ollama's response as is.
+    Passthrough *bool `json:"passthrough"`
+
+    // Translate overrides TRANSLATE_RESPONSES for this request.
+    Translate *bool `json:"translate"`
+
+    // Trim overrides TRIM_RESPONSES: strip whitespace around the reply.
+    Trim *bool `json:"trim"`
+
+    // ASCII overrides RESPONSE_ASCII: off, transliterate or strip.
+    ASCII string `json:"ascii"`
+
+    // Prefill is only accepted by /v1/chat/completions, which uses Ollama's
+    // chat API; here it is rejected rather than ignored.
+    Prefill string `json:"prefill"`
+
+    // Spool writes a streamed reply to a file to download: copy or file;
+    // see spoolStore.
+    Spool string `json:"spool"`
+
+    // Tag attributes the request's usage to a team or project; see
+    // tagUsage.
+    Tag string `json:"tag"`
+
+    // AutoContinue is how many times to continue a reply cut off at
+    // num_predict; see continueReply.
+    AutoContinue int `json:"auto_continue"`
+
+    // Creativity, from 0 to 100, sets the sampling options in the config's
+    // creativity mapping that Options leaves out.
+    Creativity *float64 `json:"creativity"`
+
+    // Retrieve set to false skips document retrieval for this request.
+    Retrieve *bool `json:"retrieve"`
+    // Set by the handler: the retrieved documents, formatted to go in
+    // front of the prompt, or why retrieval failed.
+    retrieved      string
+    retrievalError error
+
+    // Options are handed to Ollama untouched (num_predict,
+    // temperature, num_ctx, ...).
+    Options map[string]interface{} `json:"options"`
+}
+
+// chatPlan is a validated /chat request resolved against the config: what
+// will be sent to Ollama and how the call will be scheduled.
+type chatPlan struct {
+    Upstream ChatRequest
+    Priority priority
+    Timeout  time.Duration
+
+    HideReasoning bool
+    Format        string
+    // STREAM_FLUSH or the request's "flush", sent every FlushInterval in
+    // the time mode.
+    Flush         string
+    FlushInterval time.Duration
+    // STREAM_PROGRESS_INTERVAL: how often a stream sends "progress".
+    Progress time.Duration
+    Metadata      json.RawMessage
+    Passthrough   bool
+    Translate     bool
+    Trim          bool
+    // RESPONSE_ASCII or the request's "ascii"; see asciiFilter.
+    ASCII string
+    // The request's "spool": copy, file, or "" for none.
+    Spool string
+    // RESPONSE_OPTIONS: add "resolved_options" to the reply.
+    ShowOptions bool
+    // Collect is set for PARTIAL_ON_TIMEOUT: Upstream.Stream asks Ollama
+    // for a stream, but the client gets one reply; see collectStream.
+    Collect bool
+
+    // REPEAT_MAX_LINES and REPEAT_ABORT; see repeatFilter.
+    RepeatMaxLines int
+    RepeatAbort    bool
+
+    // The request's "auto_continue".
+    AutoContinue int
+
+    // The caller's role and the daily token budget it gets.
+    Role        string
+    BudgetLimit int
+    // The request's "tag", for per-tag usage.
+    Tag string
+
+    // The backend chosen for the model, as the URL its API paths go
+    // under, and its /api/generate. Everything the request asks of Ollama
+    // goes to this one backend.
+    API         string
+    GenerateURL string
+
+    // Set when the prompt was cut to MaxPromptLength.
+    PromptTruncated *promptTruncation
+    // Combinations of settings that work but probably weren't meant; see
+    // conflictRules.
+    Warnings []string
+    // Set by runFallbackChain when a fallback model answered.
+    Fallback *fallbackNote
+}
+
+// requestError is a validation failure together with the status code it
+// should be reported with.
+type requestError struct {
+    status int
+    msg    string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+func badRequest(format string, args ...interface{}) error {
+    return &requestError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// errorStatus maps an error from planChat to an HTTP status.
+func errorStatus(err error) int {
+    if re, ok := err.(*requestError); ok {
+        return re.status
+    }
+    return http.StatusInternalServerError
+}
+
+// maxMetadataBytes caps the client's metadata object. It is meant for a
+// few correlation IDs, not payloads.
+const maxMetadataBytes = 1024
+
+// checkMetadata accepts a JSON object of up to maxMetadataBytes, compacted
+// so the echo and the audit line don't carry the client's formatting.
+func checkMetadata(raw json.RawMessage) (json.RawMessage, error) {
+    if len(raw) == 0 || string(raw) == "null" {
+        return nil, nil
+    }
+    var obj map[string]interface{}
+    if err := json.Unmarshal(raw, &obj); err != nil {
+        return nil, badRequest("metadata must be a JSON object")
+    }
+    var buf bytes.Buffer
+    json.Compact(&buf, raw)
+    if buf.Len() > maxMetadataBytes {
+        return nil, badRequest("metadata may not exceed %d bytes", maxMetadataBytes)
+    }
+    return buf.Bytes(), nil
+}
+
+// parseKeepAlive checks a keep_alive value the way Ollama reads it: a
+// number of seconds or a duration string such as "5m", where anything
+// negative keeps the model loaded indefinitely.
+func parseKeepAlive(v interface{}) (interface{}, error) {
+    switch v := v.(type) {
+    case float64:
+        if v != float64(int64(v)) {
+            return nil, badRequest("keep_alive must be a whole number of seconds")
+        }
+        return int64(v), nil
+    case string:
+        if _, err := time.ParseDuration(v); err != nil {
+            return nil, badRequest("keep_alive must be a duration such as \"5m\" or a number of seconds, got %q", v)
+        }
+        return v, nil
+    }
+    return nil, badRequest("keep_alive must be a duration such as \"5m\" or a number of seconds")
+}
+
+// planChat validates in and resolves defaults (model, system prompt,
+// timeout) so the handler and the debug endpoints agree on what a request
+// means.
+func planChat(cfg *config, r *http.Request, in *chatInput) (*chatPlan, error) {
+    if in.TopLogprobs < 0 || in.TopLogprobs > 20 {
+        return nil, badRequest("top_logprobs must be between 0 and 20")
+    }
+
+    prio, err := parsePriority(in.Priority)
+    if err != nil {
+        return nil, badRequest("%v", err)
+    }
+    if prio == priorityHigh && !isAdmin(r, cfg.AdminToken) {
+        return nil, &requestError{http.StatusForbidden, "high priority requires a valid admin token"}
+    }
+
+    if in.Retrieve != nil && *in.Retrieve {
+        if _, off := cfg.Retriever.(noRetriever); off {
+            return nil, badRequest("retrieval is not enabled on this server")
+        }
+    }
+
+    prompt := in.Prompt
+    if owner := existingSession(cfg, r); owner != "" && cfg.Snippets != nil {
+        if prompt, err = expandSnippets(prompt, cfg.Snippets.list(owner), cfg.SnippetMaxDepth, cfg.SnippetMaxExpanded); err != nil {
+            return nil, err
+        }
+    }
+    prompt = in.retrieved + prompt
+
+    prompt = normalizePrompt(prompt, cfg.NormalizeNewlines, cfg.ExpandTabs)
+    prompt, truncated, err := limitPrompt(prompt, cfg.MaxPromptLength, cfg.PromptOverflow)
+    if err != nil {
+        return nil, err
+    }
+
+    metadata, err := checkMetadata(in.Metadata)
+    if err != nil {
+        return nil, err
+    }
+    if err := checkTag(cfg, in.Tag); err != nil {
+        return nil, err
+    }
+
+    format := cfg.ResponseFormat
+    if in.Format != "" {
+        if format, err = parseResponseFormat(in.Format); err != nil {
+            return nil, badRequest("%v", err)
+        }
+    }
+
+    flush := cfg.StreamFlush
+    if in.Flush != "" {
+        if flush, err = parseFlushMode(in.Flush); err != nil {
+            return nil, badRequest("%v", err)
+        }
+    }
+
+    thinking := cfg.ThinkingBudget
+    if in.ThinkingBudget != "" {
+        if thinking, err = parseThinkingBudget(in.ThinkingBudget); err != nil {
+            return nil, badRequest("%v", err)
+        }
+    }
+
+    passthrough := cfg.Passthrough
+    if in.Passthrough != nil {
+        passthrough = *in.Passthrough
+    }
+
+    translate := cfg.TranslateResponses && !in.Stream
+    if in.Translate != nil {
+        if *in.Translate && cfg.TranslateModel == "" {
+            return nil, badRequest("translation is not enabled on this server")
+        }
+        translate = *in.Translate
+    }
+
+    trim := cfg.TrimResponses
+    if in.Trim != nil {
+        trim = *in.Trim
+    }
+
+    ascii := cfg.ResponseASCII
+    if in.ASCII != "" {
+        if ascii, err = parseASCIIMode(in.ASCII); err != nil {
+            return nil, badRequest("%v", err)
+        }
+    }
+    if passthrough {
+        ascii = asciiOff
+    }
+
+    spool := ""
+    if in.Spool != "" {
+        if cfg.SpoolMaxBytes == 0 {
+            return nil, badRequest("spooling is not enabled on this server")
+        }
+        if spool, err = parseSpoolMode(in.Spool); err != nil {
+            return nil, badRequest("%v", err)
+        }
+    }
+
+    if in.AutoContinue != 0 {
+        switch {
+        case cfg.AutoContinueMax == 0:
+            return nil, badRequest("auto_continue is not enabled on this server")
+        case in.AutoContinue < 0 || in.AutoContinue > cfg.AutoContinueMax:
+            return nil, badRequest("auto_continue must be from 0 to %d", cfg.AutoContinueMax)
+        case in.Stream || passthrough:
+            return nil, badRequest("auto_continue only applies to non-streamed replies")
+        case in.Logprobs || in.TopLogprobs > 0:
+            return nil, badRequest("auto_continue can't be combined with logprobs")
+        case cfg.chatMissing.Load():
+            return nil, badRequest("auto_continue needs Ollama's /api/chat, which this Ollama predates")
+        }
+    }
+
+    // Logprobs arrive per chunk in a stream, so those replies are left whole.
+    collect := cfg.PartialOnTimeout && !in.Stream && !passthrough && !in.Logprobs && in.TopLogprobs == 0
+
+    model := in.Model
+    if model == "" {
+        model = cfg.defaultModel()
+    }
+
+    timeout := cfg.modelTimeout(model)
+    if in.Timeout != "" {
+        d, err := time.ParseDuration(in.Timeout)
+        if err != nil || d <= 0 {
+            return nil, badRequest("timeout must be a positive duration such as \"90s\"")
+        }
+        if d > cfg.MaxUpstreamTimeout {
+            return nil, badRequest("timeout may not exceed %s", cfg.MaxUpstreamTimeout)
+        }
+        timeout = d
+    }
+
+    api, err := cfg.modelBase(model)
+    if err != nil {
+        return nil, &requestError{http.StatusServiceUnavailable, err.Error()}
+    }
+
+    options, dropped := cfg.Options.filter(in.Options)
+    if len(dropped) > 0 {
+        if cfg.Options.reject {
+            return nil, badRequest("options not allowed on this server: %s", strings.Join(dropped, ", "))
+        }
+        log.Printf("Stripped disallowed options: %s", strings.Join(dropped, ", "))
+    }
+    if in.Creativity != nil {
+        if *in.Creativity < 0 || *in.Creativity > 100 {
+            return nil, badRequest("creativity must be between 0 and 100")
+        }
+        options = applyCreativity(cfg.Creativity, cfg.Options, *in.Creativity, options)
+    }
+
+    role, rc := cfg.roleFor(r)
+    if options, err = rc.applyRole(role, model, options); err != nil {
+        return nil, err
+    }
+
+    var keepAlive interface{}
+    if v, ok := options["keep_alive"]; ok {
+        if keepAlive, err = parseKeepAlive(v); err != nil {
+            return nil, err
+        }
+        rest := make(map[string]interface{}, len(options)-1)
+        for k, v := range options {
+            if k != "keep_alive" {
+                rest[k] = v
+            }
+        }
+        options = rest
+    }
+
+    if defaults := cfg.Models[model].Stop; len(defaults) > 0 || options["stop"] != nil {
+        stops, err := mergeStops(options["stop"], defaults)
+        if err != nil {
+            return nil, badRequest("%v", err)
+        }
+        merged := make(map[string]interface{}, len(options)+1)
+        for k, v := range options {
+            merged[k] = v
+        }
+        merged["stop"] = stops
+        options = merged
+    }
+
+    plan := &chatPlan{
+        Upstream: ChatRequest{
+            Model:       model,
+            Prompt:      prompt,
+            System:      cfg.systemPrompt(model, in.System),
+            Stream:      in.Stream || collect,
+            Logprobs:    in.Logprobs || in.TopLogprobs > 0,
+            TopLogprobs: in.TopLogprobs,
+            KeepAlive:   keepAlive,
+            Think:       thinkValue(thinking),
+            Options:     options,
+        },
+        Priority: prio,
+        Timeout:  timeout,
+
+        HideReasoning:   in.HideReasoning,
+        Format:          format,
+        Flush:           flush,
+        FlushInterval:   cfg.StreamFlushInterval,
+        Progress:        cfg.StreamProgressInterval,
+        Metadata:        metadata,
+        Passthrough:     passthrough,
+        Translate:       translate,
+        Trim:            trim,
+        ASCII:           ascii,
+        Spool:           spool,
+        ShowOptions:     cfg.ResponseOptions,
+        Collect:         collect,
+        RepeatMaxLines:  cfg.RepeatMaxLines,
+        RepeatAbort:     cfg.RepeatAbort,
+        AutoContinue:    in.AutoContinue,
+        Role:            role,
+        BudgetLimit:     cfg.budgetLimit(rc),
+        Tag:             in.Tag,
+        API:             api,
+        GenerateURL:     api + "/api/generate",
+        PromptTruncated: truncated,
+    }
+    if plan.Warnings, err = checkConflicts(in, plan); err != nil {
+        return nil, err
+    }
+    if in.retrievalError != nil {
+        plan.Warnings = append(plan.Warnings, fmt.Sprintf("document retrieval failed, so the prompt was sent without context: %v", in.retrievalError))
+    }
+    return plan, nil
+}
+
+func chatHandler(cfg *config, adm *admission, sessions *sessionLimiter, streams *streamSlots, registry *streamRegistry, limits *rateLimitCounters, flights *flightGroup, debounces *debouncer, health *modelHealth, budget *tokenBudget, unload *unloader, audit *auditLog, lat *latencyTracker, events *natsPublisher, spools *spoolStore, ps *psCache, tags *tagUsage) http.HandlerFunc {
+    return func(rw http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        w := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+        entry := &auditEntry{Time: start, IP: cfg.clientIP(r)}
+        if isAdmin(r, cfg.AdminToken) {
+            entry.Identity = "admin"
+        }
+        if audit != nil {
+            defer func() {
+                entry.Status = w.status
+                if entry.Outcome == "" {
+                    entry.Outcome = auditOutcome(w.status)
+                }
+                entry.DurationMs = time.Since(start).Milliseconds()
+                audit.record(entry)
+            }()
+        }
+
+        if r.Method != "POST" {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+
+        if err := checkUTF8(r, cfg.InvalidUTF8); err != nil {
+            http.Error(w, err.Error(), errorStatus(err))
+            return
+        }
+        var req chatInput
+        if err := decodeBody(r, &req, "a prompt field"); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        retrieveFor(cfg, r, &req)
+
+        plan, err := planChat(cfg, r, &req)
+        if err != nil {
+            http.Error(w, err.Error(), errorStatus(err))
+            return
+        }
+        chatReq := plan.Upstream
+        stream := chatReq.Stream && !plan.Collect
+        entry.Model = chatReq.Model
+        result := newResultHeaders(cfg, start)
+        result.model(w, chatReq.Model, stream && !plan.Passthrough)
+        if plan.Role != roleUser {
+            entry.Identity = plan.Role
+        }
+        entry.Metadata = plan.Metadata
+        entry.Tag = plan.Tag
+        entry.PromptLength = len(chatReq.Prompt)
+
+        reqBody, _ := json.Marshal(chatReq)
+
+        token := r.Header.Get(abortTokenHeader)
+        if token != "" {
+            if !stream || plan.Passthrough {
+                http.Error(w, "X-Abort-Token only applies to streamed replies", http.StatusBadRequest)
+                return
+            }
+            if !abortTokenPattern.MatchString(token) {
+                http.Error(w, "X-Abort-Token must be 16-128 letters, digits, '-' or '_'", http.StatusBadRequest)
+                return
+            }
+            release, ok := registry.claim(token)
+            if !ok {
+                http.Error(w, "X-Abort-Token is already in use by another request", http.StatusConflict)
+                return
+            }
+            defer release()
+        }
+
+        if stream {
+            if !streams.acquire(w) {
+                return
+            }
+            defer streams.release()
+        }
+
+        session := sessionID(cfg, w, r)
+        entry.Session = session
+        if session == "" && plan.Spool != "" {
+            http.Error(w, "spool needs a session cookie, so that only you can download the reply", http.StatusBadRequest)
+            return
+        }
+        limited := limitKey(cfg, r)
+        charge := budgetKey(plan.Role, limited)
+        if !budget.admit(w, charge, plan.BudgetLimit, func(msg string) { http.Error(w, msg, http.StatusTooManyRequests) }) {
+            limits.local.Add(1)
+            return
+        }
+        if !sessions.acquire(limited) {
+            limits.local.Add(1)
+            http.Error(w, "too many concurrent generations for this session", http.StatusTooManyRequests)
+            return
+        }
+        defer sessions.release(limited)
+
+        // A stream can't be replayed to a second caller, so a duplicate of
+        // one still running is refused rather than generated twice. That
+        // includes replies collected from a stream for PARTIAL_ON_TIMEOUT.
+        debounce := debounces.key(session, plan, reqBody) != ""
+        if debounce && plan.Upstream.Stream {
+            done, ok := debounces.startStream(debounces.key(session, plan, reqBody))
+            if !ok {
+                http.Error(w, "an identical request from this session is already streaming", http.StatusConflict)
+                return
+            }
+            defer done()
+            debounce = false
+        }
+
+        defer unload.use(chatReq.Model)()
+
+        cold := ps.cold(r.Context(), plan.API, chatReq.Model)
+        if cold && cfg.ColdStart == coldReject {
+            wait := ps.load(plan.API, chatReq.Model)
+            log.Printf("Model %s is not loaded; asking the client to retry in %s", chatReq.Model, wait.Round(time.Second))
+            w.Header().Set("X-Model-Cold", "true")
+            w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second).Seconds())))
+            http.Error(w, fmt.Sprintf("model %s is loading, try again shortly", chatReq.Model), http.StatusServiceUnavailable)
+            return
+        }
+
+        // A stream is registered, and its spool file made, before Ollama is
+        // asked, so that a cold-model notice can open it with X-Stream-ID
+        // and X-Spool-URL already set.
+        var id string
+        var ab *streamAbort
+        var spool *spooledReply
+        streamed := false
+        if stream && !plan.Passthrough {
+            var unregister func()
+            id, ab, unregister = registry.register(session)
+            defer unregister()
+            w.Header().Set("X-Stream-ID", id)
+            if token != "" {
+                registry.bind(token, id)
+            }
+            if plan.Spool != "" {
+                if spool, err = spools.create(session); err != nil {
+                    log.Printf("Cannot create a spool file: %v", err)
+                    http.Error(w, "cannot spool the reply right now", http.StatusInternalServerError)
+                    return
+                }
+                // Known up front, so a client that drops off mid-stream can
+                // still fetch what was written.
+                w.Header().Set("X-Spool-URL", spool.url())
+                defer func() {
+                    if streamed {
+                        spool.finish()
+                    } else {
+                        spools.remove(spool)
+                    }
+                }()
+            }
+        }
+
+        // Ollama answers only once the model is loaded, so a cold model is
+        // reported before it is asked. A stream opens early to say so, which
+        // leaves failures from here on to go out as error events.
+        var sse *sseWriter
+        if cold {
+            log.Printf("Model %s is not loaded; it will load before the first token", chatReq.Model)
+            w.Header().Set("X-Model-Cold", "true")
+            if stream && !plan.Passthrough {
+                sse = newSSEWriter(w, cfg.SSEMaxFrame)
+                sse.send("cold", map[string]string{"model": chatReq.Model})
+            }
+        }
+        fail := func(msg string, status int) {
+            if sse == nil {
+                http.Error(w, msg, status)
+                return
+            }
+            sse.send("error", map[string]interface{}{"error": msg, "status": status, "partial": false, "partial_length": 0})
+        }
+
+        r = r.WithContext(withAttemptCap(r.Context(), cfg.MaxUpstreamAttempts))
+        genStart := time.Now()
+        coalesce := cfg.CoalesceRequests && coalesceKey(plan, reqBody) != ""
+        if !coalesce && !debounce {
+            if err := adm.acquire(r.Context(), plan.Priority, len(chatReq.Prompt)+len(chatReq.System)); err != nil {
+                log.Printf("Client gave up while queued: %v", err)
+                entry.Outcome = "client_gone"
+                return
+            }
+            defer adm.release()
+        }
+        // fetch makes one attempt. A coalesced or debounced request queues
+        // inside the flight, so requests that end up sharing it don't hold
+        // queue slots while they wait. Each attempt gets its own model's
+        // timeout.
+        retries := 0
+        debounced := false
+        attempt := func(p *chatPlan, body []byte) (*http.Response, bool, error) {
+            client := &http.Client{Timeout: p.Timeout}
+            if !coalesce && !debounce {
+                resp, n, err := postUpstream(r.Context(), cfg, client, p.GenerateURL, body, limits)
+                retries += n
+                return resp, false, err
+            }
+            shared := false
+            run := func() (*bufferedReply, error) {
+                if err := adm.acquire(r.Context(), p.Priority, len(p.Upstream.Prompt)+len(p.Upstream.System)); err != nil {
+                    return nil, err
+                }
+                defer adm.release()
+                resp, n, err := postUpstream(r.Context(), cfg, client, p.GenerateURL, body, limits)
+                if err != nil {
+                    return nil, err
+                }
+                reply, err := bufferReply(resp)
+                if reply != nil {
+                    reply.retries = n
+                }
+                return reply, err
+            }
+            if coalesce {
+                generate := run
+                run = func() (*bufferedReply, error) {
+                    reply, s, err := flights.do(r.Context(), coalesceKey(p, body), generate)
+                    shared = s
+                    return reply, err
+                }
+            }
+            var reply *bufferedReply
+            var err error
+            if debounce {
+                reply, debounced, err = debounces.do(r.Context(), debounces.key(session, p, body), run)
+                shared = shared || debounced
+            } else {
+                reply, err = run()
+            }
+            if err != nil {
+                return nil, shared, err
+            }
+            if !debounced {
+                retries += reply.retries
+            }
+            return reply.response(), shared, nil
+        }
+        // A model that can't think is asked again without a budget rather
+        // than failing the request over it.
+        fetch := func(p *chatPlan, body []byte) (*http.Response, bool, error) {
+            resp, shared, err := attempt(p, body)
+            if err != nil || p.Upstream.Think == nil || !thinkingUnsupported(resp) {
+                return resp, shared, err
+            }
+            resp.Body.Close()
+            log.Printf("Model %s does not support thinking budgets; sending without one", p.Upstream.Model)
+            p.Upstream.Think = nil
+            p.Warnings = append(p.Warnings, fmt.Sprintf("%s does not support thinking_budget, so it was left out", p.Upstream.Model))
+            body, _ = json.Marshal(p.Upstream)
+            return attempt(p, body)
+        }
+        // shared is true when another request's generation answered this
+        // one; its outcome is then recorded only once, by that request.
+        plan, resp, shared, err := runFallbackChain(cfg, r, &req, plan, health, fetch)
+        reportUpstreamRetries(w, r, retries)
+        entry.UpstreamRetries = retries
+        if debounced {
+            w.Header().Set("X-Debounced", "true")
+        } else if shared {
+            w.Header().Set("X-Coalesced", "true")
+        }
+        if plan.Upstream.Model != chatReq.Model {
+            defer unload.use(plan.Upstream.Model)()
+        }
+        chatReq = plan.Upstream
+        entry.Model = chatReq.Model
+        if plan.Fallback != nil {
+            w.Header().Set("X-Fallback-Model", chatReq.Model)
+            result.model(w, chatReq.Model, stream && !plan.Passthrough)
+        }
+        if err != nil {
+            if r.Context().Err() != nil {
+                log.Printf("Client gave up before Ollama replied: %v", err)
+                entry.Outcome = "client_gone"
+                return
+            }
+            if errors.Is(err, errUpstreamAttempts) {
+                log.Printf("Gave up on %s after %d upstream attempts", chatReq.Model, cfg.MaxUpstreamAttempts)
+                fail(err.Error(), http.StatusServiceUnavailable)
+                return
+            }
+            if !shared {
+                health.failure(chatReq.Model, err.Error())
+            }
+            log.Printf("Error connecting to Ollama: %v", err)
+            fail(fmt.Sprintf("Cannot connect to Ollama: %v", err), http.StatusInternalServerError)
+            return
+        }
+        defer resp.Body.Close()
+
+        if plan.Passthrough {
+            entry.ResponseLength, entry.Outcome = relayRaw(w, resp)
+            if entry.Outcome == "ok" {
+                lat.observe(chatReq.Model, time.Since(genStart))
+                logSlowPrompt(cfg, chatReq.Model, req.Prompt, time.Since(genStart))
+            }
+            return
+        }
+
+        if resp.StatusCode == http.StatusTooManyRequests {
+            w.Header().Set("Retry-After", upstreamRetryAfter(resp))
+            fail("Ollama is rate limiting requests, try again shortly", http.StatusTooManyRequests)
+            return
+        }
+        if resp.StatusCode != http.StatusOK {
+            body, _ := io.ReadAll(resp.Body)
+            log.Printf("Ollama responded with status %d: %s", resp.StatusCode, string(body))
+            if !shared {
+                health.failure(chatReq.Model, fmt.Sprintf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body))))
+            }
+            fail(fmt.Sprintf("Ollama error: %s", string(body)), http.StatusInternalServerError)
+            return
+        }
+
+        if stream {
+            ab.attach(resp.Body)
+            var tokens int
+            var record *strings.Builder
+            if events != nil {
+                record = &strings.Builder{}
+            }
+            if sse == nil {
+                sse = newSSEWriter(w, cfg.SSEMaxFrame)
+            }
+            streamed = true
+            entry.ResponseLength, entry.Outcome, tokens = streamResponse(sse, resp.Body, plan, cfg.SSEMaxFrame, ab, record, spool)
+            result.done(w, tokens)
+            budget.add(charge, tokens)
+            tags.add(plan.Tag, tokens)
+            switch entry.Outcome {
+            case "ok":
+                lat.observe(chatReq.Model, time.Since(genStart))
+                logSlowPrompt(cfg, chatReq.Model, req.Prompt, time.Since(genStart))
+                health.success(chatReq.Model)
+                if events != nil {
+                    events.publish(&publishedReply{
+                        ID: id, Session: session, Model: chatReq.Model, Prompt: req.Prompt, Response: record.String(),
+                        Tokens: tokens, Metadata: plan.Metadata, CreatedAt: time.Now().UTC(),
+                    })
+                }
+            case "upstream_error":
+                health.failure(chatReq.Model, "stream failed")
+            }
+            return
+        }
+
+        var chatResp ChatResponse
+        var timedOut *collected
+        if plan.Collect {
+            c, err := collectStream(resp.Body)
+            if err != nil && r.Context().Err() != nil {
+                log.Printf("Client gave up while the reply was collected: %v", err)
+                entry.Outcome = "client_gone"
+                return
+            }
+            if err != nil {
+                log.Printf("Collecting the reply failed: %v", err)
+                health.failure(chatReq.Model, "stream failed")
+                entry.Outcome = "upstream_error"
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+            if c.timedOut {
+                if c.chunks == 0 {
+                    log.Printf("Ollama timed out after %s without generating anything", plan.Timeout)
+                    entry.Outcome = "timeout"
+                    http.Error(w, fmt.Sprintf("Ollama generated nothing within %s", plan.Timeout), http.StatusGatewayTimeout)
+                    return
+                }
+                log.Printf("Returning %d chunks generated before the %s timeout", c.chunks, plan.Timeout)
+                timedOut = c
+            }
+            chatResp = c.ChatResponse
+        } else {
+            body, err := io.ReadAll(resp.Body)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+            if err := json.Unmarshal(body, &chatResp); err != nil {
+                log.Printf("Failed to parse Ollama response: %s", string(body))
+                if !shared {
+                    health.failure(chatReq.Model, "invalid response")
+                }
+                http.Error(w, fmt.Sprintf("Invalid response from Ollama: %v", err), http.StatusInternalServerError)
+                return
+            }
+        }
+        if timedOut == nil {
+            chatResp.DoneReason = doneReason(chatResp.DoneReason, chatResp.EvalCount, intOption(chatReq.Options, "num_predict"))
+        }
+        // A coalesced or debounced request holds no queue slot by now, so
+        // each continuation queues for one.
+        var continued *continuation
+        if plan.AutoContinue > 0 && timedOut == nil {
+            client := &http.Client{Timeout: plan.Timeout}
+            continued = continueReply(chatReq, &chatResp, plan.AutoContinue, cfg.AutoContinueMaxBytes, func(next continueRequest) (*ChatResponse, error) {
+                if coalesce || debounce {
+                    if err := adm.acquire(r.Context(), plan.Priority, len(chatReq.Prompt)+len(chatReq.System)+len(chatResp.Response)); err != nil {
+                        return nil, err
+                    }
+                    defer adm.release()
+                }
+                more, n, err := continueOnce(r.Context(), cfg, client, plan.API+"/api/chat", next, limits)
+                retries += n
+                return more, err
+            })
+            entry.UpstreamRetries = retries
+        }
+        tokens := chatResp.EvalCount
+        if timedOut != nil {
+            tokens = timedOut.chunks
+            entry.Outcome = "timeout"
+            logSlowPrompt(cfg, chatReq.Model, req.Prompt, time.Since(genStart))
+        } else if !shared {
+            lat.observe(chatReq.Model, time.Since(genStart))
+            logSlowPrompt(cfg, chatReq.Model, req.Prompt, time.Since(genStart))
+            health.success(chatReq.Model)
+        }
+        budget.add(charge, tokens)
+        tags.add(plan.Tag, tokens)
+
+        if chatReq.Logprobs && len(chatResp.Logprobs) == 0 && cfg.LogprobsStrict {
+            http.Error(w, "logprobs requested but not returned by Ollama (requires Ollama 0.12.11 or newer)", http.StatusNotImplemented)
+            return
+        }
+
+        var thinking thinkingJoiner
+        text := thinking.join(chatResp.Thinking, chatResp.Response) + thinking.close()
+        if plan.HideReasoning {
+            text = strings.TrimLeft(stripReasoning(text), "\r\n")
+        }
+        text, repetition := collapseRepeats(text, plan.RepeatMaxLines)
+        if repetition != nil {
+            log.Printf("Removed %d repeated lines from the reply", repetition.Removed)
+        }
+        transforms := cfg.Transforms
+        if plan.Trim {
+            transforms = transforms.then(trimReply)
+        }
+        text = transforms.apply(text)
+        var translated *translation
+        if plan.Translate {
+            var reason string
+            if text, translated, reason = translateReply(cfg, text, plan.Timeout); reason != "" {
+                log.Printf("Returning reply untranslated: %s", reason)
+            }
+        }
+        // Last, so a translation is covered too; what it drops may leave
+        // whitespace at the ends to trim again.
+        if plan.ASCII != asciiOff {
+            text = asciiTransform(plan.ASCII)(text)
+            if plan.Trim {
+                text = trimReply(text)
+            }
+        }
+        entry.ResponseLength = len(text)
+        reply := map[string]interface{}{"response": text, "format": plan.Format, "created_at": time.Now().UTC()}
+        if translated != nil {
+            reply["translation"] = translated
+        }
+        if plan.Format == formatHTML {
+            reply["html"] = renderMarkdown(text)
+        }
+        if len(chatResp.Logprobs) > 0 {
+            reply["logprobs"] = chatResp.Logprobs
+        }
+        // Ollama reports "length" when generation stopped at num_predict
+        // rather than at a natural end.
+        if chatResp.DoneReason == "length" {
+            reply["truncated"] = true
+        }
+        if plan.PromptTruncated != nil {
+            reply["prompt_truncated"] = plan.PromptTruncated
+        }
+        if plan.Warnings != nil {
+            reply["warnings"] = plan.Warnings
+        }
+        if plan.Fallback != nil {
+            reply["fallback"] = plan.Fallback
+        }
+        if continued != nil && (continued.Count > 0 || continued.Stopped != "") {
+            reply["continued"] = continued
+        }
+        if repetition != nil {
+            reply["repetition"] = repetition
+        }
+        if plan.ShowOptions {
+            reply["resolved_options"] = resolvedOptions(plan)
+        }
+        reply["stats"] = statsFrom(&chatResp)
+        if timedOut != nil {
+            reply["partial"] = true
+            reply["timed_out"] = true
+            reply["stats"] = partialStats(timedOut.chunks, genStart, timedOut.firstToken)
+        }
+        if plan.Metadata != nil {
+            reply["metadata"] = plan.Metadata
+        }
+
+        result.done(w, tokens)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(reply)
+        events.publish(&publishedReply{
+            ID: newReplyID(), Session: session, Model: chatReq.Model, Prompt: req.Prompt, Response: text,
+            DoneReason: chatResp.DoneReason, Partial: timedOut != nil, Tokens: tokens, Metadata: plan.Metadata, CreatedAt: time.Now().UTC(),
+        })
+    }
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// fakeOllama answers the Ollama API paths it has handlers for and records
+// every request body. /api/version, /api/tags and /api/ps have harmless
+// defaults.
+type fakeOllama struct {
+    *httptest.Server
+    mu     sync.Mutex
+    bodies map[string][]map[string]interface{}
+}
+
+func newFakeOllama(t *testing.T, handlers map[string]http.HandlerFunc) *fakeOllama {
+    t.Helper()
+    f := &fakeOllama{bodies: make(map[string][]map[string]interface{})}
+    defaults := map[string]string{
+        "/api/version": `{"version": "0.6.0"}`,
+        "/api/tags":    `{"models": []}`,
+        "/api/ps":      `{"models": []}`,
+    }
+    f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        raw, _ := io.ReadAll(r.Body)
+        var body map[string]interface{}
+        json.Unmarshal(raw, &body)
+        f.mu.Lock()
+        f.bodies[r.URL.Path] = append(f.bodies[r.URL.Path], body)
+        f.mu.Unlock()
+        r.Body = io.NopCloser(strings.NewReader(string(raw)))
+
+        if h, ok := handlers[r.URL.Path]; ok {
+            h(w, r)
+        } else if reply, ok := defaults[r.URL.Path]; ok {
+            w.Write([]byte(reply))
+        } else {
+            http.NotFound(w, r)
+        }
+    }))
+    t.Cleanup(f.Close)
+    return f
+}
+
+// requests returns the bodies sent to path so far.
+func (f *fakeOllama) requests(path string) []map[string]interface{} {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return append([]map[string]interface{}(nil), f.bodies[path]...)
+}
+
+// reply answers with resp as a single JSON object, for non-streamed calls.
+func reply(resp ChatResponse) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(resp)
+    }
+}
+
+// testChat is a /chat handler with the state main would give it, kept so
+// tests can look at it.
+type testChat struct {
+    handler  http.HandlerFunc
+    adm      *admission
+    sessions *sessionLimiter
+    limits   *rateLimitCounters
+    flights  *flightGroup
+    health   *modelHealth
+    budget   *tokenBudget
+    tags     *tagUsage
+    registry *streamRegistry
+}
+
+func newTestChat(t *testing.T, cfg *config) *testChat {
+    t.Helper()
+    c := &testChat{
+        adm:      newAdmission(cfg.MaxConcurrent, cfg.QueueSmallestFirst),
+        sessions: newSessionLimiter(cfg.MaxConcurrentPerSession),
+        limits:   &rateLimitCounters{},
+        flights:  newFlightGroup(),
+        health:   newModelHealth(cfg),
+        budget:   newTokenBudget(cfg),
+        tags:     newTagUsage(),
+        registry: newStreamRegistry(),
+    }
+    spools, err := newSpoolStore(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    streams := &streamSlots{limit: int64(cfg.MaxSSEConnections)}
+    c.handler = chatHandler(cfg, c.adm, c.sessions, streams, c.registry, c.limits, c.flights, newDebouncer(cfg.DebounceWindow),
+        c.health, c.budget, nil, nil, newLatencyTracker(cfg), nil, spools, newPSCache(cfg), c.tags)
+    return c
+}
+
+// post sends body to the handler as a JSON POST from 192.0.2.1, with
+// headers given as name/value pairs.
+func (c *testChat) post(body string, headers ...string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest("POST", "/chat", strings.NewReader(body))
+    r.RemoteAddr = "192.0.2.1:1234"
+    r.Header.Set("Content-Type", "application/json")
+    for i := 0; i+1 < len(headers); i += 2 {
+        r.Header.Set(headers[i], headers[i+1])
+    }
+    w := httptest.NewRecorder()
+    c.handler(w, r)
+    return w
+}
+
+// decode parses a JSON reply, failing the test if it isn't one.
+func decode(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+    t.Helper()
+    var v map[string]interface{}
+    if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+        t.Fatalf("reply %d %q is not JSON: %v", w.Code, w.Body.String(), err)
+    }
+    return v
+}
+
+// plan runs planChat on in as a plain request from 192.0.2.1.
+func plan(t *testing.T, cfg *config, in chatInput) (*chatPlan, error) {
+    t.Helper()
+    r := httptest.NewRequest("POST", "/chat", nil)
+    r.RemoteAddr = "192.0.2.1:1234"
+    if in.Prompt == "" {
+        in.Prompt = "hi"
+    }
+    return planChat(cfg, r, &in)
+}
+
+// wantRequestError checks that err is a requestError with status and a
+// message containing msg.
+func wantRequestError(t *testing.T, err error, status int, msg string) {
+    t.Helper()
+    if err == nil {
+        t.Fatalf("got no error, want %d %q", status, msg)
+    }
+    if got := errorStatus(err); got != status || !strings.Contains(err.Error(), msg) {
+        t.Errorf("got %d %q, want %d containing %q", got, err, status, msg)
+    }
+}
+
+func TestPlanChatTimeout(t *testing.T) {
+    cfg := testConfig(t, "UPSTREAM_TIMEOUT", "30s", "MAX_UPSTREAM_TIMEOUT", "2m")
+    tests := []struct {
+        timeout string
+        want    time.Duration
+    }{
+        {"", 30 * time.Second},
+        {"5s", 5 * time.Second},
+        {"90s", 90 * time.Second},
+        {"2m", 2 * time.Minute},
+    }
+    for _, tt := range tests {
+        p, err := plan(t, cfg, chatInput{Timeout: tt.timeout})
+        if err != nil {
+            t.Errorf("timeout %q: %v", tt.timeout, err)
+            continue
+        }
+        if p.Timeout != tt.want {
+            t.Errorf("timeout %q: plan timeout = %s, want %s", tt.timeout, p.Timeout, tt.want)
+        }
+    }
+
+    for _, timeout := range []string{"2m1s", "1h"} {
+        _, err := plan(t, cfg, chatInput{Timeout: timeout})
+        wantRequestError(t, err, http.StatusBadRequest, "timeout may not exceed 2m0s")
+    }
+    for _, timeout := range []string{"0s", "-5s", "90"} {
+        _, err := plan(t, cfg, chatInput{Timeout: timeout})
+        wantRequestError(t, err, http.StatusBadRequest, "timeout must be a positive duration")
+    }
+}
+
+func TestPlanChatModelTimeout(t *testing.T) {
+    file := configFile(t, `{"models": {"big:70b": {"timeout": "10m"}, "small:1b": {}}}`)
+    cfg := testConfig(t, "CONFIG_FILE", file, "UPSTREAM_TIMEOUT", "30s", "MAX_UPSTREAM_TIMEOUT", "15m")
+    tests := []struct {
+        model, timeout string
+        want           time.Duration
+    }{
+        {"big:70b", "", 10 * time.Minute},
+        {"big:70b", "12m", 12 * time.Minute},
+        {"small:1b", "", 30 * time.Second},
+        {"other:7b", "", 30 * time.Second},
+        {"other:7b", "5s", 5 * time.Second},
+    }
+    for _, tt := range tests {
+        p, err := plan(t, cfg, chatInput{Model: tt.model, Timeout: tt.timeout})
+        if err != nil {
+            t.Errorf("%s timeout %q: %v", tt.model, tt.timeout, err)
+            continue
+        }
+        if p.Timeout != tt.want {
+            t.Errorf("%s timeout %q: plan timeout = %s, want %s", tt.model, tt.timeout, p.Timeout, tt.want)
+        }
+    }
+
+    for contents, msg := range map[string]string{
+        `{"models": {"big:70b": {"timeout": "soon"}}}`: "models.big:70b.timeout must be a positive duration",
+        `{"models": {"big:70b": {"timeout": "-1m"}}}`:  "models.big:70b.timeout must be a positive duration",
+        `{"models": {"big:70b": {"timeout": "1h"}}}`:   "models.big:70b.timeout may not exceed MAX_UPSTREAM_TIMEOUT",
+    } {
+        err := configError(t, "CONFIG_FILE", configFile(t, contents), "MAX_UPSTREAM_TIMEOUT", "15m")
+        if err == nil || !strings.Contains(err.Error(), msg) {
+            t.Errorf("%s: error %v, want %q", contents, err, msg)
+        }
+    }
+}
+
+func TestChatMetadata(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, DoneReason: "stop"}),
+    })
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL))
+
+    w := chat.post(`{"prompt": "hi", "metadata": {"ticket": "OPS-42", "ids": [1, 2]}}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body.String())
+    }
+    got, _ := json.Marshal(decode(t, w)["metadata"])
+    if string(got) != `{"ids":[1,2],"ticket":"OPS-42"}` {
+        t.Errorf("metadata echoed = %s", got)
+    }
+    sent := ollama.requests("/api/generate")
+    if len(sent) != 1 {
+        t.Fatalf("%d generate calls, want 1", len(sent))
+    }
+    raw, _ := json.Marshal(sent[0])
+    if _, ok := sent[0]["metadata"]; ok || strings.Contains(string(raw), "OPS-42") {
+        t.Errorf("metadata reached Ollama: %s", raw)
+    }
+}
+
+func TestCheckMetadata(t *testing.T) {
+    if got, err := checkMetadata(json.RawMessage(`{ "a" : 1 }`)); err != nil || string(got) != `{"a":1}` {
+        t.Errorf("checkMetadata = %s, %v; want it compacted", got, err)
+    }
+    for _, raw := range []string{"", "null"} {
+        if got, err := checkMetadata(json.RawMessage(raw)); got != nil || err != nil {
+            t.Errorf("checkMetadata(%q) = %s, %v; want nothing", raw, got, err)
+        }
+    }
+    for _, raw := range []string{`"ticket"`, `[1, 2]`, `42`} {
+        _, err := checkMetadata(json.RawMessage(raw))
+        wantRequestError(t, err, http.StatusBadRequest, "metadata must be a JSON object")
+    }
+    big := `{"note": "` + strings.Repeat("x", maxMetadataBytes) + `"}`
+    _, err := checkMetadata(json.RawMessage(big))
+    wantRequestError(t, err, http.StatusBadRequest, "metadata may not exceed 1024 bytes")
+}
+
+func TestChatTrimResponses(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "\n\nAnswer.\n\n", Done: true, DoneReason: "stop"}),
+    })
+    tests := []struct {
+        env, body string
+        want      string
+    }{
+        {"false", `{"prompt": "hi"}`, "\n\nAnswer.\n\n"},
+        {"true", `{"prompt": "hi"}`, "Answer."},
+        {"true", `{"prompt": "hi", "trim": false}`, "\n\nAnswer.\n\n"},
+        {"false", `{"prompt": "hi", "trim": true}`, "Answer."},
+    }
+    for _, tt := range tests {
+        chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "TRIM_RESPONSES", tt.env))
+        w := chat.post(tt.body)
+        if got := decode(t, w)["response"]; got != tt.want {
+            t.Errorf("TRIM_RESPONSES=%s %s: response = %q, want %q", tt.env, tt.body, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "net/http"
+    "sync"
+    "sync/atomic"
+)
+
+// Identical non-streaming requests that arrive while one is already being
+// generated wait for that generation and share its reply, so a burst of the
+// same prompt (a shared demo link, say) costs the GPU once. Only
+// deterministic requests qualify: with a non-zero temperature each caller
+// is entitled to a different answer.
+
+// bufferedReply is an upstream response read to the end, so it can be
+// handed to any number of waiting requests.
+type bufferedReply struct {
+    status int
+    header http.Header
+    body   []byte
+    // upstream 429 retries it took, reported to every request sharing it
+    retries int
+}
+
+func bufferReply(resp *http.Response) (*bufferedReply, error) {
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    return &bufferedReply{status: resp.StatusCode, header: resp.Header, body: body}, nil
+}
+
+// response gives each caller its own *http.Response over the shared bytes.
+func (b *bufferedReply) response() *http.Response {
+    return &http.Response{StatusCode: b.status, Header: b.header, Body: io.NopCloser(bytes.NewReader(b.body))}
+}
+
+type flight struct {
+    done  chan struct{}
+    reply *bufferedReply
+    err   error
+}
+
+// flightGroup runs one call per key at a time; callers that arrive while
+// it runs wait for its result instead of starting their own.
+type flightGroup struct {
+    mu      sync.Mutex
+    flights map[string]*flight
+
+    coalesced atomic.Int64 // requests answered from another's generation
+}
+
+func newFlightGroup() *flightGroup {
+    return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// do returns fn's reply for key, running fn only if no call for key is in
+// flight. shared reports whether the reply came from another request's
+// call. Waiters give up when ctx ends. If the leading request's client
+// went away, its context error isn't passed on: a waiter that is still
+// connected takes over and runs fn itself.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (*bufferedReply, error)) (reply *bufferedReply, shared bool, err error) {
+    for {
+        g.mu.Lock()
+        if f, ok := g.flights[key]; ok {
+            g.mu.Unlock()
+            select {
+            case <-f.done:
+            case <-ctx.Done():
+                return nil, true, ctx.Err()
+            }
+            if f.err != nil && (errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded)) && ctx.Err() == nil {
+                continue
+            }
+            if f.err == nil {
+                g.coalesced.Add(1)
+            }
+            return f.reply, true, f.err
+        }
+        f := &flight{done: make(chan struct{})}
+        g.flights[key] = f
+        g.mu.Unlock()
+
+        f.reply, f.err = fn()
+        g.mu.Lock()
+        delete(g.flights, key)
+        g.mu.Unlock()
+        close(f.done)
+        return f.reply, false, f.err
+    }
+}
+
+// coalesceKey identifies requests that may share a generation, or is ""
+// when plan must run on its own: streams and passthrough replies are
+// consumed as they arrive, and only an explicit temperature of 0 makes the
+// reply deterministic, since Ollama's default is above it. Collected
+// replies stream from Ollama too.
+func coalesceKey(plan *chatPlan, body []byte) string {
+    if plan.Upstream.Stream || plan.Passthrough {
+        return ""
+    }
+    if t, ok := plan.Upstream.Options["temperature"].(float64); !ok || t != 0 {
+        return ""
+    }
+    sum := sha256.Sum256(append([]byte(plan.GenerateURL+"\n"), body...))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestFlightGroupConcurrentCallers(t *testing.T) {
+    g := newFlightGroup()
+    var calls atomic.Int32
+    release := make(chan struct{})
+    fn := func() (*bufferedReply, error) {
+        calls.Add(1)
+        <-release
+        return &bufferedReply{status: http.StatusOK, body: []byte("shared")}, nil
+    }
+
+    const callers = 10
+    var wg sync.WaitGroup
+    var sharedCount atomic.Int32
+    replies := make([]*bufferedReply, callers)
+    for i := 0; i < callers; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            reply, shared, err := g.do(context.Background(), "k", fn)
+            if err != nil {
+                t.Error(err)
+            }
+            if shared {
+                sharedCount.Add(1)
+            }
+            replies[i] = reply
+        }(i)
+    }
+    time.Sleep(50 * time.Millisecond)
+    close(release)
+    wg.Wait()
+
+    if calls.Load() != 1 {
+        t.Errorf("fn ran %d times for %d concurrent callers, want once", calls.Load(), callers)
+    }
+    if sharedCount.Load() != callers-1 || g.coalesced.Load() != callers-1 {
+        t.Errorf("%d shared and %d coalesced, want %d", sharedCount.Load(), g.coalesced.Load(), callers-1)
+    }
+    for i, r := range replies {
+        if r == nil || string(r.body) != "shared" {
+            t.Errorf("caller %d got %+v", i, r)
+        }
+    }
+
+    // Once the flight has landed, the next call runs on its own.
+    g.do(context.Background(), "k", fn)
+    if calls.Load() != 2 {
+        t.Errorf("a call after the flight ended shared it")
+    }
+}
+
+func TestFlightGroupSeparateKeys(t *testing.T) {
+    g := newFlightGroup()
+    var calls atomic.Int32
+    release := make(chan struct{})
+    var wg sync.WaitGroup
+    for _, key := range []string{"a", "b", "c"} {
+        wg.Add(1)
+        go func(key string) {
+            defer wg.Done()
+            g.do(context.Background(), key, func() (*bufferedReply, error) {
+                calls.Add(1)
+                <-release
+                return &bufferedReply{}, nil
+            })
+        }(key)
+    }
+    time.Sleep(50 * time.Millisecond)
+    close(release)
+    wg.Wait()
+    if calls.Load() != 3 {
+        t.Errorf("%d calls for 3 keys, want 3", calls.Load())
+    }
+}
+
+func TestFlightGroupLeaderGoesAway(t *testing.T) {
+    g := newFlightGroup()
+    leaderCtx, leave := context.WithCancel(context.Background())
+    started := make(chan struct{})
+    leader := make(chan error, 1)
+    go func() {
+        _, _, err := g.do(leaderCtx, "k", func() (*bufferedReply, error) {
+            close(started)
+            <-leaderCtx.Done()
+            return nil, leaderCtx.Err()
+        })
+        leader <- err
+    }()
+    <-started
+
+    waiter := make(chan *bufferedReply, 1)
+    go func() {
+        reply, _, err := g.do(context.Background(), "k", func() (*bufferedReply, error) {
+            return &bufferedReply{body: []byte("mine")}, nil
+        })
+        if err != nil {
+            t.Error(err)
+        }
+        waiter <- reply
+    }()
+    time.Sleep(20 * time.Millisecond)
+    leave()
+
+    if err := <-leader; err != context.Canceled {
+        t.Errorf("leader got %v, want its own cancellation", err)
+    }
+    select {
+    case reply := <-waiter:
+        if reply == nil || string(reply.body) != "mine" {
+            t.Errorf("waiter got %+v, want to have run the call itself", reply)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("waiter stuck after the leader went away")
+    }
+}
+
+func TestFlightGroupWaiterGivesUp(t *testing.T) {
+    g := newFlightGroup()
+    release := make(chan struct{})
+    defer close(release)
+    started := make(chan struct{})
+    go g.do(context.Background(), "k", func() (*bufferedReply, error) {
+        close(started)
+        <-release
+        return &bufferedReply{}, nil
+    })
+    <-started
+
+    ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+    defer cancel()
+    _, shared, err := g.do(ctx, "k", func() (*bufferedReply, error) { t.Error("waiter ran fn"); return nil, nil })
+    if err != context.DeadlineExceeded || !shared {
+        t.Errorf("waiter = shared %v, %v; want to give up with its deadline", shared, err)
+    }
+}
+
+func TestCoalesceKey(t *testing.T) {
+    deterministic := &chatPlan{Upstream: ChatRequest{Options: map[string]interface{}{"temperature": 0.0}}, GenerateURL: "http://a/api/generate"}
+    tests := []struct {
+        name string
+        plan *chatPlan
+    }{
+        {"stream", &chatPlan{Upstream: ChatRequest{Stream: true, Options: map[string]interface{}{"temperature": 0.0}}}},
+        {"passthrough", &chatPlan{Passthrough: true, Upstream: ChatRequest{Options: map[string]interface{}{"temperature": 0.0}}}},
+        {"default temperature", &chatPlan{}},
+        {"temperature above 0", &chatPlan{Upstream: ChatRequest{Options: map[string]interface{}{"temperature": 0.7}}}},
+    }
+    for _, tt := range tests {
+        if key := coalesceKey(tt.plan, []byte(`{}`)); key != "" {
+            t.Errorf("%s: coalesceKey = %q, want none", tt.name, key)
+        }
+    }
+
+    a := coalesceKey(deterministic, []byte(`{"prompt":"a"}`))
+    if a == "" || a != coalesceKey(deterministic, []byte(`{"prompt":"a"}`)) {
+        t.Errorf("identical deterministic requests got keys %q", a)
+    }
+    if a == coalesceKey(deterministic, []byte(`{"prompt":"b"}`)) {
+        t.Error("different prompts share a key")
+    }
+    other := *deterministic
+    other.GenerateURL = "http://b/api/generate"
+    if a == coalesceKey(&other, []byte(`{"prompt":"a"}`)) {
+        t.Error("the same request for different backends shares a key")
+    }
+}
+
+func TestChatCoalescesIdenticalRequests(t *testing.T) {
+    var calls atomic.Int32
+    release := make(chan struct{})
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": func(w http.ResponseWriter, r *http.Request) {
+            calls.Add(1)
+            <-release
+            w.Write([]byte(`{"response": "same", "done": true, "done_reason": "stop"}`))
+        },
+    })
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "COALESCE_REQUESTS", "true", "MAX_CONCURRENT_PER_SESSION", "0"))
+
+    const requests = 5
+    var wg sync.WaitGroup
+    results := make([]*httptest.ResponseRecorder, requests)
+    for i := 0; i < requests; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            results[i] = chat.post(`{"prompt": "hi", "options": {"temperature": 0}}`)
+        }(i)
+    }
+    time.Sleep(100 * time.Millisecond)
+    close(release)
+    wg.Wait()
+
+    if calls.Load() != 1 {
+        t.Errorf("Ollama generated %d times for %d identical requests, want once", calls.Load(), requests)
+    }
+    coalesced := 0
+    for i, w := range results {
+        if w.Code != http.StatusOK || decode(t, w)["response"] != "same" {
+            t.Errorf("request %d = %d %s", i, w.Code, w.Body.String())
+        }
+        if w.Header().Get("X-Coalesced") == "true" {
+            coalesced++
+        }
+    }
+    if coalesced != requests-1 {
+        t.Errorf("%d replies marked X-Coalesced, want %d", coalesced, requests-1)
+    }
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sync"
+    "time"
+)
+
+// With COLD_CHECK=true, /chat asks Ollama's /api/ps whether the model is in
+// memory before sending to it. One that isn't has to be loaded before its
+// first token, which can take long enough to look like a hang, so the reply
+// says so: X-Model-Cold: true, and for a stream a "cold" event sent at once
+// instead of after the load.
+//
+// Holding a request through the load is sometimes what you want, but it
+// also holds a queue slot and the client's connection for as long as the
+// load takes. COLD_START=reject answers it with 503 and a Retry-After
+// instead, and loads the model in the background, so clients and load
+// balancers can back off and come back once it is in memory.
+const (
+    coldHold   = "hold"
+    coldReject = "reject"
+)
+
+// psEntry is one backend's /api/ps answer and when it came.
+type psEntry struct {
+    loaded  map[string]bool
+    fetched time.Time
+}
+
+// psCache keeps each backend's /api/ps answer for COLD_CHECK_TTL, so a
+// burst of requests costs one call. A nil *psCache reports nothing cold.
+type psCache struct {
+    cfg *config
+    ttl time.Duration
+    // flights runs one /api/ps call per backend at a time, without mu, so
+    // a slow backend holds up only the requests for its own models.
+    flights *flightGroup
+
+    mu      sync.Mutex
+    entries map[string]psEntry
+    // gen changes whenever an answer is dropped, so a call begun before
+    // then doesn't bring the old answer back.
+    gen int
+    // loading has when each model's background load started, and loads
+    // how long its last one took, both keyed by loadKey.
+    loading map[string]time.Time
+    loads   map[string]time.Duration
+
+    stats cacheStats
+}
+
+func newPSCache(cfg *config) *psCache {
+    if !cfg.ColdCheck {
+        return nil
+    }
+    return &psCache{
+        cfg:     cfg,
+        ttl:     cfg.ColdCheckTTL,
+        flights: newFlightGroup(),
+        entries: make(map[string]psEntry),
+        loading: make(map[string]time.Time),
+        loads:   make(map[string]time.Duration),
+    }
+}
+
+// loadKey names a model's loads on the backend whose API is under api.
+func loadKey(api, model string) string {
+    return api + " " + withTag(model)
+}
+
+// cold reports whether model isn't loaded in the Ollama whose API is under
+// api, the backend the request was planned for. The check is only advice,
+// so when /api/ps doesn't answer quickly the model is taken to be warm and
+// the request goes ahead as usual.
+func (c *psCache) cold(ctx context.Context, api, model string) bool {
+    if c == nil {
+        return false
+    }
+    c.mu.Lock()
+    _, loading := c.loading[loadKey(api, model)]
+    c.mu.Unlock()
+    if loading {
+        return true
+    }
+    loaded, err := c.loaded(ctx, api+"/api/ps")
+    if err != nil {
+        log.Printf("Cannot check whether %s is loaded: %v", model, err)
+        return false
+    }
+    for name := range loaded {
+        if withTag(name) == withTag(model) {
+            return false
+        }
+    }
+    return true
+}
+
+func (c *psCache) loaded(ctx context.Context, psURL string) (map[string]bool, error) {
+    c.mu.Lock()
+    e, ok := c.entries[psURL]
+    if ok && time.Since(e.fetched) < c.ttl {
+        c.stats.hits.Add(1)
+        c.mu.Unlock()
+        return e.loaded, nil
+    }
+    c.stats.misses.Add(1)
+    if ok {
+        c.stats.evictions.Add(1)
+        delete(c.entries, psURL)
+    }
+    gen := c.gen
+    c.mu.Unlock()
+
+    reply, _, err := c.flights.do(ctx, psURL, func() (*bufferedReply, error) {
+        ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+        defer cancel()
+        return fetchPS(ctx, psURL)
+    })
+    if err != nil {
+        return nil, err
+    }
+    loaded, err := parsePS(reply)
+    if err != nil {
+        return nil, err
+    }
+    c.mu.Lock()
+    if c.gen == gen {
+        c.entries[psURL] = psEntry{loaded: loaded, fetched: time.Now()}
+    }
+    c.mu.Unlock()
+    return loaded, nil
+}
+
+// load starts loading model on the backend whose API is under api in the
+// background for COLD_START=reject, once however many requests are turned
+// away meanwhile, and says how long until it is worth asking again. When
+// the load ends that backend's /api/ps answer is dropped, so the next
+// request sees the model warm.
+func (c *psCache) load(api, model string) time.Duration {
+    key := loadKey(api, model)
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    started, ok := c.loading[key]
+    if !ok {
+        started = time.Now()
+        c.loading[key] = started
+        go c.run(api, model, key, started)
+    }
+    // The last load of the model is the best guess at how long this one
+    // takes; until there is one, COLD_START_RETRY_AFTER.
+    wait := c.cfg.ColdStartRetryAfter
+    if took, timed := c.loads[key]; timed {
+        wait = took - time.Since(started)
+    }
+    if wait < time.Second {
+        wait = time.Second
+    }
+    return wait
+}
+
+func (c *psCache) run(api, model, key string, started time.Time) {
+    log.Printf("Loading cold model %s on %s in the background", model, api)
+    err := pingModelAt(context.Background(), api+"/api/generate", model)
+    took := time.Since(started)
+    if err != nil {
+        log.Printf("Background load of %s failed after %s: %v", model, took.Round(time.Millisecond), err)
+    } else {
+        log.Printf("Loaded %s in %s", model, took.Round(time.Millisecond))
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    delete(c.loading, key)
+    delete(c.entries, api+"/api/ps")
+    c.gen++
+    if err == nil {
+        c.loads[key] = took
+    }
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// coldOllama is an Ollama whose model is loaded only while warm is set. A
+// /api/generate without a prompt is a load: it counts in loads, waits for
+// release and then sets warm.
+type coldOllama struct {
+    *fakeOllama
+    warm  atomic.Bool
+    loads atomic.Int32
+}
+
+func newColdOllama(t *testing.T, release <-chan struct{}) *coldOllama {
+    t.Helper()
+    o := &coldOllama{}
+    o.fakeOllama = newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/ps": func(w http.ResponseWriter, r *http.Request) {
+            if o.warm.Load() {
+                io.WriteString(w, `{"models": [{"name": "codellama:7b"}]}`)
+            } else {
+                io.WriteString(w, `{"models": []}`)
+            }
+        },
+        "/api/generate": func(w http.ResponseWriter, r *http.Request) {
+            var body map[string]interface{}
+            json.NewDecoder(r.Body).Decode(&body)
+            if _, ok := body["prompt"]; ok {
+                reply(ChatResponse{Response: "Hello", Done: true})(w, r)
+                return
+            }
+            o.loads.Add(1)
+            <-release
+            o.warm.Store(true)
+            io.WriteString(w, `{"done": true}`)
+        },
+    })
+    return o
+}
+
+// waitLoads waits for the nth background load to reach Ollama.
+func (o *coldOllama) waitLoads(t *testing.T, n int32) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for o.loads.Load() < n {
+        if time.Now().After(deadline) {
+            t.Fatalf("%d background loads, want %d", o.loads.Load(), n)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestChatColdStartReject(t *testing.T) {
+    release := make(chan struct{})
+    ollama := newColdOllama(t, release)
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "COLD_CHECK", "true", "COLD_CHECK_TTL", "0s", "COLD_START", "reject"))
+
+    for i := 0; i < 3; i++ {
+        w := chat.post(`{"prompt": "hi"}`)
+        if w.Code != http.StatusServiceUnavailable {
+            t.Fatalf("request %d for a cold model: status %d, want 503", i, w.Code)
+        }
+        if got := w.Header().Get("Retry-After"); got != "10" {
+            t.Errorf("request %d: Retry-After = %q, want COLD_START_RETRY_AFTER's 10", i, got)
+        }
+        if w.Header().Get("X-Model-Cold") != "true" {
+            t.Errorf("request %d: no X-Model-Cold", i)
+        }
+    }
+    ollama.waitLoads(t, 1)
+    if n := len(ollama.requests("/api/generate")); n != 1 {
+        t.Errorf("%d calls to /api/generate while loading, want the one background load", n)
+    }
+
+    close(release)
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        w := chat.post(`{"prompt": "hi"}`)
+        if w.Code == http.StatusOK {
+            if w.Header().Get("X-Model-Cold") != "" {
+                t.Error("a warm model's reply says it was cold")
+            }
+            break
+        }
+        if w.Code != http.StatusServiceUnavailable || time.Now().After(deadline) {
+            t.Fatalf("after the load: status %d, want 200", w.Code)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    // Once a load has been timed, Retry-After is what is left of it, and
+    // at least a second.
+    ollama.warm.Store(false)
+    w := chat.post(`{"prompt": "hi"}`)
+    if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+        t.Errorf("cold again: status %d, Retry-After %q, want 503 and 1", w.Code, w.Header().Get("Retry-After"))
+    }
+    ollama.waitLoads(t, 2)
+}
+
+func TestChatColdStartHold(t *testing.T) {
+    release := make(chan struct{})
+    close(release)
+    ollama := newColdOllama(t, release)
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "COLD_CHECK", "true"))
+    w := chat.post(`{"prompt": "hi"}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d, want the request held and answered", w.Code)
+    }
+    if w.Header().Get("X-Model-Cold") != "true" {
+        t.Error("no X-Model-Cold on a reply from a cold model")
+    }
+    if n := ollama.loads.Load(); n != 0 {
+        t.Errorf("%d background loads with COLD_START=hold", n)
+    }
+}
+
+func TestColdStartConfig(t *testing.T) {
+    if err := configError(t, "COLD_START", "reject", "COLD_CHECK", "false"); err == nil {
+        t.Error("COLD_START=reject was accepted without COLD_CHECK")
+    }
+    if err := configError(t, "COLD_START", "wait", "COLD_CHECK", "true"); err == nil {
+        t.Error("COLD_START=wait was accepted")
+    }
+    if err := configError(t, "COLD_START", "reject", "COLD_CHECK", "true", "COLD_START_RETRY_AFTER", "500ms"); err == nil {
+        t.Error("COLD_START_RETRY_AFTER under a second was accepted")
+    }
+}
+
+func TestColdCheckBackendsDontWaitOnEachOther(t *testing.T) {
+    asked := make(chan struct{}, 10)
+    release := make(chan struct{})
+    slow := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/ps": func(w http.ResponseWriter, r *http.Request) {
+            asked <- struct{}{}
+            <-release
+            io.WriteString(w, `{"models": []}`)
+        },
+    })
+    fast := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/ps": func(w http.ResponseWriter, r *http.Request) {
+            io.WriteString(w, `{"models": [{"name": "b:7b"}]}`)
+        },
+    })
+    file := configFile(t, `{"backends": [
+        {"name": "slow", "url": "`+slow.URL+`", "models": ["a:*"]},
+        {"name": "fast", "url": "`+fast.URL+`", "models": ["b:*"]}
+    ]}`)
+    ps := newPSCache(testConfig(t, "COLD_CHECK", "true", "CONFIG_FILE", file))
+
+    colds := make(chan bool, 2)
+    for i := 0; i < 2; i++ {
+        go func() { colds <- ps.cold(context.Background(), slow.URL, "a:7b") }()
+    }
+    <-asked
+
+    done := make(chan bool, 1)
+    go func() { done <- ps.cold(context.Background(), fast.URL, "b:7b") }()
+    select {
+    case cold := <-done:
+        if cold {
+            t.Error("b:7b, loaded on its backend, reported cold")
+        }
+    case <-time.After(time.Second):
+        t.Fatal("the check for b:7b waited on the other backend's /api/ps")
+    }
+
+    close(release)
+    for i := 0; i < 2; i++ {
+        if !<-colds {
+            t.Error("a:7b, loaded nowhere, reported warm")
+        }
+    }
+    if n := len(slow.requests("/api/ps")); n != 1 {
+        t.Errorf("%d /api/ps calls for two checks at once, want them to share one", n)
+    }
+}
+
+func TestChatUsesOneBackendPerRequest(t *testing.T) {
+    // Backend a has the model loaded and b doesn't. Each names itself in
+    // what it generates.
+    backend := func(name, ps string) *fakeOllama {
+        return newFakeOllama(t, map[string]http.HandlerFunc{
+            "/api/ps":       func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, ps) },
+            "/api/generate": reply(ChatResponse{Response: name, Done: true, DoneReason: "length"}),
+            "/api/chat": func(w http.ResponseWriter, r *http.Request) {
+                json.NewEncoder(w).Encode(map[string]interface{}{
+                    "message":     map[string]string{"role": "assistant", "content": " " + name},
+                    "done":        true,
+                    "done_reason": "stop",
+                })
+            },
+        })
+    }
+    a := backend("a", `{"models": [{"name": "codellama:7b"}]}`)
+    b := backend("b", `{"models": []}`)
+    file := configFile(t, `{"backends": [{"name": "a", "url": "`+a.URL+`"}, {"name": "b", "url": "`+b.URL+`"}]}`)
+    chat := newTestChat(t, testConfig(t, "CONFIG_FILE", file, "COLD_CHECK", "true", "COLD_CHECK_TTL", "0s"))
+
+    seen := map[string]bool{}
+    for i := 0; i < 4; i++ {
+        w := chat.post(`{"prompt": "hi", "auto_continue": 1}`)
+        reply := decode(t, w)
+        got, _ := reply["response"].(string)
+        seen[got] = true
+        cold := w.Header().Get("X-Model-Cold") == "true"
+        switch got {
+        case "a a":
+            if cold {
+                t.Errorf("request %d ran on a, where the model is loaded, and was reported cold", i)
+            }
+        case "b b":
+            if !cold {
+                t.Errorf("request %d ran on b, where the model isn't loaded, and wasn't reported cold", i)
+            }
+        default:
+            t.Errorf("request %d: response %q, want the generation and its continuation from one backend", i, got)
+        }
+    }
+    if !seen["a a"] || !seen["b b"] {
+        t.Errorf("responses %v, want requests spread over both backends", seen)
+    }
+    if len(a.requests("/api/ps")) != 2 || len(b.requests("/api/ps")) != 2 {
+        t.Errorf("/api/ps calls: a %d, b %d, want each backend checked for its own 2 requests", len(a.requests("/api/ps")), len(b.requests("/api/ps")))
+    }
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strings"
+    "time"
+)
+
+// With PARTIAL_ON_TIMEOUT a non-streaming /chat request is still sent to
+// Ollama as a stream, and the chunks are put together here. Without
+// streaming Ollama sends nothing until the very end, so a generation that
+// runs past the timeout is lost entirely; this way whatever it had written
+// by then can be returned, marked partial.
+
+// collected is a stream folded into the single response Ollama would have
+// sent without streaming.
+type collected struct {
+    ChatResponse
+    chunks     int
+    firstToken time.Time
+    // timedOut is set when the upstream timeout ended the stream before
+    // Ollama finished.
+    timedOut bool
+}
+
+// collectStream reads an /api/generate stream to the end, or until the
+// client's timeout cuts it off. Errors from Ollama, and a stream that
+// breaks for any other reason, are returned as errors.
+func collectStream(upstream io.Reader) (*collected, error) {
+    c := &collected{}
+    var response, thinking strings.Builder
+    scanner := bufio.NewScanner(upstream)
+    scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+    for scanner.Scan() {
+        var chunk ChatResponse
+        if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+            return nil, fmt.Errorf("invalid response from Ollama: %v", err)
+        }
+        if chunk.Error != "" {
+            return nil, fmt.Errorf("Ollama error: %s", chunk.Error)
+        }
+        if chunk.Response != "" || chunk.Thinking != "" {
+            if c.chunks == 0 {
+                c.firstToken = time.Now()
+            }
+            c.chunks++
+        }
+        response.WriteString(chunk.Response)
+        thinking.WriteString(chunk.Thinking)
+        if chunk.Done {
+            c.ChatResponse = chunk
+            c.Response, c.Thinking = response.String(), thinking.String()
+            return c, nil
+        }
+    }
+
+    err := scanner.Err()
+    var ne net.Error
+    if !errors.As(err, &ne) || !ne.Timeout() {
+        if err == nil {
+            err = io.ErrUnexpectedEOF
+        }
+        return nil, fmt.Errorf("Ollama stream ended early: %v", err)
+    }
+    c.Response, c.Thinking = response.String(), thinking.String()
+    c.timedOut = true
+    return c, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "testing"
+)
+
+// stalledGenerate streams pieces and then hangs until the client gives up,
+// like a generation still running at the deadline.
+func stalledGenerate(pieces ...string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        for _, p := range pieces {
+            fmt.Fprintf(w, "{\"response\": %q, \"done\": false}\n", p)
+        }
+        w.(http.Flusher).Flush()
+        <-r.Context().Done()
+    }
+}
+
+func TestChatPartialOnTimeout(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": stalledGenerate("The answer", " is"),
+    })
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "PARTIAL_ON_TIMEOUT", "true"))
+
+    w := chat.post(`{"prompt": "hi", "timeout": "200ms"}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body.String())
+    }
+    reply := decode(t, w)
+    if reply["response"] != "The answer is" || reply["partial"] != true || reply["timed_out"] != true {
+        t.Errorf("reply = %v, want the text so far marked partial", reply)
+    }
+    if stats, _ := reply["stats"].(map[string]interface{}); stats["partial"] != true {
+        t.Errorf("stats = %v, want an estimate marked partial", reply["stats"])
+    }
+    if sent := ollama.requests("/api/generate"); len(sent) != 1 || sent[0]["stream"] != true {
+        t.Errorf("generate calls = %v, want one streamed call", sent)
+    }
+}
+
+func TestChatPartialOnTimeoutNothingGenerated(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": stalledGenerate(),
+    })
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "PARTIAL_ON_TIMEOUT", "true"))
+    w := chat.post(`{"prompt": "hi", "timeout": "200ms"}`)
+    if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "generated nothing within 200ms") {
+        t.Errorf("reply = %d %q, want 504", w.Code, w.Body.String())
+    }
+}
+
+func TestCollectStream(t *testing.T) {
+    c, err := collectStream(strings.NewReader(ndjson(
+        ChatResponse{Thinking: "hmm"},
+        ChatResponse{Response: "Hel"},
+        ChatResponse{Response: "lo"},
+        ChatResponse{Done: true, DoneReason: "stop", EvalCount: 3},
+    )))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.Response != "Hello" || c.Thinking != "hmm" || c.DoneReason != "stop" || c.EvalCount != 3 || c.chunks != 3 || c.timedOut {
+        t.Errorf("collected = %+v", c)
+    }
+
+    for upstream, msg := range map[string]string{
+        ndjson(ChatResponse{Response: "Hel"}):                              "Ollama stream ended early",
+        ndjson(ChatResponse{Response: "Hel"}, ChatResponse{Error: "boom"}): "Ollama error: boom",
+        "not json\n": "invalid response from Ollama",
+    } {
+        if _, err := collectStream(strings.NewReader(upstream)); err == nil || !strings.Contains(err.Error(), msg) {
+            t.Errorf("%q: error %v, want %q", upstream, err, msg)
+        }
+    }
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Ollama's API has grown over its releases. Two differences matter here:
+// /api/chat, which /v1/chat/completions is built on, only exists from
+// 0.1.14, and older releases end a generation without a done_reason.
+// OLLAMA_COMPAT picks how /v1 talks to Ollama: auto asks each server for
+// its version at startup, chat and generate skip the check.
+const (
+    compatAuto     = "auto"
+    compatChat     = "chat"
+    compatGenerate = "generate"
+)
+
+// ollamaVersion is a release number, major.minor.patch.
+type ollamaVersion [3]int
+
+// firstChatVersion is the first Ollama release with /api/chat.
+var firstChatVersion = ollamaVersion{0, 1, 14}
+
+// parseOllamaVersion reads versions such as "0.1.32" or "v0.5.7-rc1". Dev
+// builds report 0.0.0, which says nothing about what they support, so it is
+// not accepted.
+func parseOllamaVersion(s string) (ollamaVersion, bool) {
+    var v ollamaVersion
+    s = strings.TrimPrefix(s, "v")
+    if i := strings.IndexAny(s, "-+ "); i >= 0 {
+        s = s[:i]
+    }
+    parts := strings.Split(s, ".")
+    if len(parts) > 3 {
+        return v, false
+    }
+    for i, p := range parts {
+        n, err := strconv.Atoi(p)
+        if err != nil || n < 0 {
+            return v, false
+        }
+        v[i] = n
+    }
+    return v, v != ollamaVersion{}
+}
+
+func (v ollamaVersion) before(o ollamaVersion) bool {
+    for i := range v {
+        if v[i] != o[i] {
+            return v[i] < o[i]
+        }
+    }
+    return false
+}
+
+func (v ollamaVersion) String() string { return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2]) }
+
+// detectOllamaCompat, with OLLAMA_COMPAT=auto, reads the version of
+// OLLAMA_URL or of every configured backend and falls back to
+// /api/generate for /v1 if any of them predates /api/chat. A server whose
+// version can't be read is taken to be current.
+func detectOllamaCompat(ctx context.Context, cfg *config) {
+    if cfg.OllamaCompat != compatAuto {
+        log.Printf("Ollama compatibility mode: %s, from OLLAMA_COMPAT", cfg.OllamaCompat)
+        return
+    }
+    servers := map[string]string{cfg.OllamaURL: cfg.ollamaAPI("/api/version")}
+    if cfg.Backends != nil && len(cfg.Backends.list) > 0 {
+        servers = make(map[string]string)
+        for _, b := range cfg.Backends.list {
+            servers[b.Name] = b.URL + cfg.OllamaAPIPrefix + "/api/version"
+        }
+    }
+    missing := false
+    for name, url := range servers {
+        v, err := fetchOllamaVersion(ctx, url)
+        if err != nil {
+            log.Printf("Cannot read the Ollama version of %s, assuming a current release: %v", name, err)
+            continue
+        }
+        log.Printf("Ollama at %s is version %s", name, v)
+        if v.before(firstChatVersion) {
+            log.Printf("Ollama at %s predates /api/chat (added in %s)", name, firstChatVersion)
+            missing = true
+        }
+    }
+    cfg.chatMissing.Store(missing)
+    mode := compatChat
+    if missing {
+        mode = compatGenerate
+    }
+    log.Printf("Ollama compatibility mode: %s", mode)
+}
+
+func fetchOllamaVersion(ctx context.Context, url string) (ollamaVersion, error) {
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+    if err != nil {
+        return ollamaVersion{}, err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return ollamaVersion{}, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return ollamaVersion{}, fmt.Errorf("Ollama responded with status %d", resp.StatusCode)
+    }
+    var out struct {
+        Version string `json:"version"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+        return ollamaVersion{}, fmt.Errorf("invalid response from Ollama: %v", err)
+    }
+    v, ok := parseOllamaVersion(out.Version)
+    if !ok {
+        return ollamaVersion{}, fmt.Errorf("unrecognised version %q", out.Version)
+    }
+    return v, nil
+}
+
+// doneReason is reason, or for an Ollama too old to send one, "length"
+// when the generation used all maxTokens and "stop" otherwise.
+func doneReason(reason string, tokens, maxTokens int) string {
+    switch {
+    case reason != "":
+        return reason
+    case maxTokens > 0 && tokens >= maxTokens:
+        return "length"
+    }
+    return "stop"
+}
+
+// generateRequest is the /api/generate request standing in for an
+// /api/chat one. System messages become the system prompt. A lone user
+// message is sent as the prompt as it is; a longer conversation is written
+// out as a transcript for the model to continue.
+func generateRequest(model string, messages []openAIMessage, stream bool, opts map[string]interface{}) ChatRequest {
+    var system []string
+    var turns []openAIMessage
+    for _, m := range messages {
+        if m.Role == "system" {
+            system = append(system, m.Content)
+        } else {
+            turns = append(turns, m)
+        }
+    }
+    req := ChatRequest{Model: model, System: strings.Join(system, "\n\n"), Stream: stream, Options: opts}
+    if len(turns) == 1 && turns[0].Role == "user" {
+        req.Prompt = turns[0].Content
+        return req
+    }
+    var b strings.Builder
+    for _, m := range turns {
+        role := "User"
+        if m.Role == "assistant" {
+            role = "Assistant"
+        }
+        fmt.Fprintf(&b, "%s: %s\n\n", role, m.Content)
+    }
+    if len(turns) == 0 || turns[len(turns)-1].Role != "assistant" {
+        b.WriteString("Assistant:")
+    }
+    req.Prompt = strings.TrimRight(b.String(), "\n")
+    return req
+}
+
+// chatFromGenerate rewrites an /api/generate response, streamed or not,
+// as /api/chat chunks, so the /v1 code reads either. Closing it stops the
+// rewriting.
+func chatFromGenerate(upstream io.Reader, maxTokens int) io.ReadCloser {
+    pr, pw := io.Pipe()
+    go func() {
+        dec := json.NewDecoder(upstream)
+        enc := json.NewEncoder(pw)
+        for {
+            var g ChatResponse
+            if err := dec.Decode(&g); err != nil {
+                if err == io.EOF {
+                    err = nil
+                }
+                pw.CloseWithError(err)
+                return
+            }
+            c := ollamaChatChunk{
+                Message:         openAIMessage{Role: "assistant", Content: g.Response},
+                Done:            g.Done,
+                Error:           g.Error,
+                PromptEvalCount: g.PromptEvalCount,
+                EvalCount:       g.EvalCount,
+            }
+            if g.Done {
+                c.DoneReason = doneReason(g.DoneReason, g.EvalCount, maxTokens)
+            }
+            if err := enc.Encode(c); err != nil {
+                return
+            }
+        }
+    }()
+    return pr
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestParseOllamaVersion(t *testing.T) {
+    tests := []struct {
+        in   string
+        want ollamaVersion
+        ok   bool
+    }{
+        {"0.1.32", ollamaVersion{0, 1, 32}, true},
+        {"v0.5.7-rc1", ollamaVersion{0, 5, 7}, true},
+        {"0.6", ollamaVersion{0, 6, 0}, true},
+        {"1.0.0+build", ollamaVersion{1, 0, 0}, true},
+        {"0.0.0", ollamaVersion{}, false},
+        {"", ollamaVersion{}, false},
+        {"dev", ollamaVersion{}, false},
+        {"0.1.2.3", ollamaVersion{}, false},
+    }
+    for _, tt := range tests {
+        got, ok := parseOllamaVersion(tt.in)
+        if ok != tt.ok || (ok && got != tt.want) {
+            t.Errorf("parseOllamaVersion(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+        }
+    }
+
+    for _, tt := range []struct {
+        v    ollamaVersion
+        want bool
+    }{
+        {ollamaVersion{0, 1, 13}, true},
+        {ollamaVersion{0, 1, 14}, false},
+        {ollamaVersion{0, 2, 0}, false},
+        {ollamaVersion{0, 0, 99}, true},
+    } {
+        if got := tt.v.before(firstChatVersion); got != tt.want {
+            t.Errorf("%s before %s = %v", tt.v, firstChatVersion, got)
+        }
+    }
+}
+
+// versionOllama reports version from /api/version, or fails with status.
+func versionOllama(t *testing.T, version string, status int) *fakeOllama {
+    return newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/version": func(w http.ResponseWriter, r *http.Request) {
+            if status != http.StatusOK {
+                http.Error(w, "no", status)
+                return
+            }
+            json.NewEncoder(w).Encode(map[string]string{"version": version})
+        },
+    })
+}
+
+func TestDetectOllamaCompat(t *testing.T) {
+    tests := []struct {
+        version string
+        status  int
+        missing bool
+    }{
+        {"0.1.10", http.StatusOK, true},
+        {"0.1.14", http.StatusOK, false},
+        {"0.6.0", http.StatusOK, false},
+        {"0.0.0", http.StatusOK, false},
+        {"", http.StatusNotFound, false},
+    }
+    for _, tt := range tests {
+        ollama := versionOllama(t, tt.version, tt.status)
+        cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "OLLAMA_COMPAT", compatAuto)
+        detectOllamaCompat(context.Background(), cfg)
+        if got := cfg.chatMissing.Load(); got != tt.missing {
+            t.Errorf("version %q (status %d): chat missing = %v, want %v", tt.version, tt.status, got, tt.missing)
+        }
+    }
+
+    // A fixed mode doesn't ask.
+    ollama := versionOllama(t, "0.1.10", http.StatusOK)
+    for mode, missing := range map[string]bool{compatChat: false, compatGenerate: true} {
+        cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "OLLAMA_COMPAT", mode)
+        detectOllamaCompat(context.Background(), cfg)
+        if got := cfg.chatMissing.Load(); got != missing {
+            t.Errorf("OLLAMA_COMPAT=%s: chat missing = %v, want %v", mode, got, missing)
+        }
+    }
+    if n := len(ollama.requests("/api/version")); n != 0 {
+        t.Errorf("version asked %d times with a fixed mode", n)
+    }
+    if err := configError(t, "OLLAMA_COMPAT", "legacy"); err == nil {
+        t.Error("OLLAMA_COMPAT=legacy was accepted")
+    }
+}
+
+func TestDoneReason(t *testing.T) {
+    tests := []struct {
+        reason            string
+        tokens, maxTokens int
+        want              string
+    }{
+        {"stop", 100, 100, "stop"},
+        {"length", 3, 100, "length"},
+        {"", 100, 100, "length"},
+        {"", 99, 100, "stop"},
+        {"", 500, 0, "stop"},
+    }
+    for _, tt := range tests {
+        if got := doneReason(tt.reason, tt.tokens, tt.maxTokens); got != tt.want {
+            t.Errorf("doneReason(%q, %d, %d) = %q, want %q", tt.reason, tt.tokens, tt.maxTokens, got, tt.want)
+        }
+    }
+}
+
+func TestGenerateRequest(t *testing.T) {
+    req := generateRequest("m", []openAIMessage{{Role: "system", Content: "Be brief."}, {Role: "user", Content: "hi"}}, false, nil)
+    if req.System != "Be brief." || req.Prompt != "hi" {
+        t.Errorf("single turn = %+v", req)
+    }
+
+    req = generateRequest("m", []openAIMessage{
+        {Role: "system", Content: "A"},
+        {Role: "user", Content: "hi"},
+        {Role: "assistant", Content: "hello"},
+        {Role: "system", Content: "B"},
+        {Role: "user", Content: "and?"},
+    }, true, nil)
+    if req.System != "A\n\nB" || req.Prompt != "User: hi\n\nAssistant: hello\n\nUser: and?\n\nAssistant:" || !req.Stream {
+        t.Errorf("conversation = %+v", req)
+    }
+
+    req = generateRequest("m", []openAIMessage{{Role: "user", Content: "Name a color."}, {Role: "assistant", Content: "Blue"}}, false, nil)
+    if req.Prompt != "User: Name a color.\n\nAssistant: Blue" {
+        t.Errorf("prefilled reply = %q, want it left open to continue", req.Prompt)
+    }
+}
+
+func TestChatFromGenerate(t *testing.T) {
+    r := chatFromGenerate(strings.NewReader(ndjson(
+        ChatResponse{Response: "Hel"},
+        ChatResponse{Response: "lo", Done: true, PromptEvalCount: 4, EvalCount: 10},
+    )), 10)
+    defer r.Close()
+    dec := json.NewDecoder(r)
+    var chunks []ollamaChatChunk
+    for {
+        var c ollamaChatChunk
+        if err := dec.Decode(&c); err != nil {
+            break
+        }
+        chunks = append(chunks, c)
+    }
+    if len(chunks) != 2 || chunks[0].Message.Content != "Hel" || chunks[0].Message.Role != "assistant" || chunks[0].Done {
+        t.Fatalf("chunks = %+v", chunks)
+    }
+    if c := chunks[1]; c.Message.Content != "lo" || !c.Done || c.DoneReason != "length" || c.EvalCount != 10 || c.PromptEvalCount != 4 {
+        t.Errorf("last chunk = %+v, want done by length with the counts", c)
+    }
+}
+
+func TestOpenAIOnOldOllama(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/version":  func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"version": "0.1.10"}`)) },
+        "/api/generate": reply(ChatResponse{Response: "old but fine", Done: true}),
+    })
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "OLLAMA_COMPAT", compatAuto)
+    detectOllamaCompat(context.Background(), cfg)
+    chat := newTestChat(t, cfg)
+    h := openAIChatHandler(cfg, chat.adm, chat.sessions, &streamSlots{limit: 1}, chat.limits, chat.budget, nil, chat.tags)
+
+    r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "llama3:8b", "messages": [{"role": "user", "content": "hi"}]}`))
+    r.RemoteAddr = "192.0.2.1:1234"
+    r.Header.Set("Content-Type", "application/json")
+    w := httptest.NewRecorder()
+    h(w, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body.String())
+    }
+    var resp struct {
+        Choices []struct {
+            Message      openAIMessage `json:"message"`
+            FinishReason string        `json:"finish_reason"`
+        } `json:"choices"`
+    }
+    json.Unmarshal(w.Body.Bytes(), &resp)
+    if len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "old but fine" || resp.Choices[0].FinishReason != "stop" {
+        t.Errorf("reply = %s", w.Body.String())
+    }
+    if sent := ollama.requests("/api/generate"); len(sent) != 1 || sent[0]["prompt"] != "hi" {
+        t.Errorf("generate calls = %v, want the message sent as the prompt", sent)
+    }
+    if n := len(ollama.requests("/api/chat")); n != 0 {
+        t.Errorf("%d calls to /api/chat on an Ollama without it", n)
+    }
+}
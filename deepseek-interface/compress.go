@@ -0,0 +1,190 @@
+package main
+
+import (
+    "compress/gzip"
+    "compress/zlib"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// compressibleTypes are the content types worth compressing. Event streams
+// and pull progress are left alone: they are written a line at a time and
+// must reach the client as soon as each line is flushed.
+var compressibleTypes = map[string]bool{
+    "application/json": true,
+    "text/html":        true,
+    "text/plain":       true,
+    openMetricsType:    true,
+}
+
+// encoders are the content codings we can produce, keyed by their
+// Accept-Encoding name. "deflate" in HTTP means the zlib format.
+var encoders = map[string]func(w io.Writer, level int) (encoder, error){
+    "gzip": func(w io.Writer, level int) (encoder, error) { return gzip.NewWriterLevel(w, level) },
+    "deflate": func(w io.Writer, level int) (encoder, error) { return zlib.NewWriterLevel(w, level) },
+}
+
+type encoder interface {
+    io.WriteCloser
+    Flush() error
+}
+
+// negotiateEncoding picks the coding to use from enabled, in server
+// preference order, given an Accept-Encoding header. It returns "" for an
+// uncompressed response. Qualifiers are honoured, so "gzip;q=0" refuses
+// gzip and "*" allows anything not listed separately. The highest-weighted
+// coding wins, ties going to the server's order. Compression is skipped
+// when the client explicitly ranks identity above every coding on offer.
+func negotiateEncoding(header string, enabled []string) string {
+    weights := acceptWeights(header)
+    if q, ok := weights["x-gzip"]; ok {
+        weights["gzip"] = q
+    }
+
+    best, bestQ := "", 0.0
+    for _, coding := range enabled {
+        q, ok := weights[coding]
+        if !ok {
+            if q, ok = weights["*"]; !ok {
+                continue
+            }
+        }
+        if q > bestQ {
+            best, bestQ = coding, q
+        }
+    }
+    // identity is only weighed against the codings when the client ranked
+    // it; an implicit identity is acceptable but not preferred.
+    if identityQ, ok := weights["identity"]; ok && identityQ > bestQ {
+        return ""
+    }
+    return best
+}
+
+// acceptWeights reads an Accept or Accept-Encoding header into the weight
+// of each listed value, lower-cased, 1 unless a q parameter says otherwise.
+// Other parameters, such as a media type's version, are ignored.
+func acceptWeights(header string) map[string]float64 {
+    weights := map[string]float64{}
+    for _, part := range strings.Split(header, ",") {
+        value, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        value = strings.ToLower(strings.TrimSpace(value))
+        if value == "" {
+            continue
+        }
+        q := 1.0
+        for _, p := range strings.Split(params, ";") {
+            k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+            if ok && strings.EqualFold(strings.TrimSpace(k), "q") {
+                if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && f >= 0 && f <= 1 {
+                    q = f
+                } else {
+                    q = 0 // a malformed weight is safest read as "not acceptable"
+                }
+            }
+        }
+        // A value listed twice, as media types are for several versions,
+        // counts at its best weight.
+        if old, ok := weights[value]; !ok || q > old {
+            weights[value] = q
+        }
+    }
+    return weights
+}
+
+// compressResponses compresses JSON, HTML and plain-text responses with
+// the best coding the client accepts out of enabled. The decision to
+// compress is made when the handler writes its headers, because only then
+// is the content type known.
+func compressResponses(next http.Handler, enabled []string, level int) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Add("Vary", "Accept-Encoding")
+        coding := negotiateEncoding(r.Header.Get("Accept-Encoding"), enabled)
+        if coding == "" || r.Method == "HEAD" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        cw := &compressWriter{ResponseWriter: w, coding: coding, level: level}
+        defer cw.close()
+        next.ServeHTTP(cw, r)
+    })
+}
+
+type compressWriter struct {
+    http.ResponseWriter
+    coding      string
+    level       int
+    enc         encoder
+    wroteHeader bool
+}
+
+func (g *compressWriter) WriteHeader(code int) {
+    if g.wroteHeader {
+        return
+    }
+    g.wroteHeader = true
+    h := g.Header()
+    mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+    if compressibleTypes[mediaType] && h.Get("Content-Encoding") == "" &&
+        code != http.StatusNoContent && code != http.StatusNotModified {
+        // The level was checked at startup, so this can't fail.
+        g.enc, _ = encoders[g.coding](g.ResponseWriter, g.level)
+        h.Set("Content-Encoding", g.coding)
+        h.Del("Content-Length")
+    }
+    g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *compressWriter) Write(b []byte) (int, error) {
+    if !g.wroteHeader {
+        if g.Header().Get("Content-Type") == "" {
+            g.Header().Set("Content-Type", http.DetectContentType(b))
+        }
+        g.WriteHeader(http.StatusOK)
+    }
+    if g.enc != nil {
+        return g.enc.Write(b)
+    }
+    return g.ResponseWriter.Write(b)
+}
+
+func (g *compressWriter) Flush() {
+    if g.enc != nil {
+        g.enc.Flush()
+    }
+    if f, ok := g.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (g *compressWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+func (g *compressWriter) close() {
+    if g.enc != nil {
+        g.enc.Close()
+    }
+}
+
+// parseEncodings checks COMPRESS_ALGORITHMS, keeping the order given as the
+// server's preference. br is passed over, as there is no encoder for it,
+// so a client asking for it gets the next coding both sides accept.
+func parseEncodings(list string) ([]string, error) {
+    var codings []string
+    for _, c := range parseList(strings.ToLower(list)) {
+        if c == "br" {
+            continue
+        }
+        if encoders[c] == nil {
+            return nil, fmt.Errorf("unknown encoding %q; use gzip or deflate", c)
+        }
+        codings = append(codings, c)
+    }
+    if len(codings) == 0 {
+        return nil, fmt.Errorf("at least one of gzip or deflate is required")
+    }
+    return codings, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+    both := []string{"gzip", "deflate"}
+    tests := []struct {
+        header  string
+        enabled []string
+        want    string
+    }{
+        {"", both, ""},
+        {"gzip", both, "gzip"},
+        {"gzip, deflate", both, "gzip"},
+        {"gzip, deflate", []string{"deflate", "gzip"}, "deflate"},
+        {"GZIP", both, "gzip"},
+        {"x-gzip", both, "gzip"},
+        {"deflate;q=0.5, gzip;q=0.8", []string{"deflate", "gzip"}, "gzip"},
+
+        // q=0 refuses a coding, however it is written.
+        {"gzip;q=0", both, ""},
+        {"gzip;q=0.0, deflate", both, "deflate"},
+        {"gzip; Q=0", both, ""},
+        {"gzip;q=nope", both, ""},
+        {"gzip;q=2", both, ""},
+
+        // identity alone, or ranked above the codings, means no compression.
+        {"identity", both, ""},
+        {"gzip;q=0.5, identity", both, ""},
+        {"gzip, identity;q=0.5", both, "gzip"},
+        {"gzip, identity;q=0", both, "gzip"},
+
+        // * stands in for any coding not listed by name.
+        {"*", both, "gzip"},
+        {"*;q=0", both, ""},
+        {"gzip;q=0, *", both, "deflate"},
+        {"*, identity", both, "gzip"},
+        {"br", both, ""},
+    }
+    for _, tt := range tests {
+        if got := negotiateEncoding(tt.header, tt.enabled); got != tt.want {
+            t.Errorf("negotiateEncoding(%q, %v) = %q, want %q", tt.header, tt.enabled, got, tt.want)
+        }
+    }
+}
+
+func TestCompressResponses(t *testing.T) {
+    const body = `{"response": "a reply long enough to be worth compressing, and then some more"}`
+    h := compressResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+        io.WriteString(w, body)
+    }), []string{"gzip", "deflate"}, 6)
+    get := func(contentType, accept string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest("GET", "/?type="+contentType, nil)
+        r.Header.Set("Accept-Encoding", accept)
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+        return w
+    }
+
+    w := get("application/json", "gzip")
+    if w.Header().Get("Content-Encoding") != "gzip" {
+        t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+    }
+    zr, err := gzip.NewReader(w.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, _ := io.ReadAll(zr); string(got) != body {
+        t.Errorf("decompressed body = %q", got)
+    }
+    if w.Header().Get("Vary") != "Accept-Encoding" {
+        t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+    }
+
+    for _, tt := range []struct{ contentType, accept string }{
+        {"application/json", "identity"},
+        {"application/json", "gzip;q=0"},
+        {"text/event-stream", "gzip"},
+    } {
+        w := get(tt.contentType, tt.accept)
+        if w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+            t.Errorf("%s with Accept-Encoding %q was compressed", tt.contentType, tt.accept)
+        }
+    }
+}
+
+func TestParseEncodings(t *testing.T) {
+    tests := []struct {
+        list string
+        want string
+    }{
+        {"gzip", "gzip"},
+        {"Deflate, gzip", "deflate,gzip"},
+        {"br,gzip", "gzip"},
+        {"gzip, br, deflate", "gzip,deflate"},
+    }
+    for _, tt := range tests {
+        got, err := parseEncodings(tt.list)
+        if err != nil || strings.Join(got, ",") != tt.want {
+            t.Errorf("parseEncodings(%q) = %v, %v, want %s", tt.list, got, err, tt.want)
+        }
+    }
+    for _, list := range []string{"", "br", "gzip,zstd"} {
+        if _, err := parseEncodings(list); err == nil {
+            t.Errorf("parseEncodings(%q) was accepted", list)
+        }
+    }
+
+    // A client asking for br first gets what the server has instead.
+    if got := negotiateEncoding("br, deflate;q=0.5", []string{"gzip", "deflate"}); got != "deflate" {
+        t.Errorf("br first, then deflate: got %q, want deflate", got)
+    }
+}
+
+// BenchmarkCompress measures each coding at the levels the README compares,
+// on the UI page and a long /chat reply, and reports the compressed size as
+// a percentage of the original.
+func BenchmarkCompress(b *testing.B) {
+    // A reply of words drawn at random, with a fixed seed, from a small
+    // vocabulary compresses about as well as real prose does.
+    words := strings.Fields("the a of to and in is it that for on with as this be by are or from can at an not which model reply token request server stream prompt value each when more than")
+    rnd := rand.New(rand.NewSource(1))
+    var reply strings.Builder
+    for i := 0; reply.Len() < 34<<10; i++ {
+        reply.WriteString(words[rnd.Intn(len(words))])
+        if i%14 == 13 {
+            fmt.Fprintf(&reply, " %d.\n", rnd.Intn(1000))
+        } else {
+            reply.WriteString(" ")
+        }
+    }
+    replyJSON, _ := json.Marshal(map[string]string{"response": reply.String()})
+    bodies := []struct {
+        name string
+        data []byte
+    }{
+        {"page", []byte(htmlTemplate)},
+        {"reply", replyJSON},
+    }
+    for _, coding := range []string{"gzip", "deflate"} {
+        for _, level := range []int{1, 3, 6, 9} {
+            for _, body := range bodies {
+                b.Run(fmt.Sprintf("%s/level=%d/%s", coding, level, body.name), func(b *testing.B) {
+                    var out bytes.Buffer
+                    b.SetBytes(int64(len(body.data)))
+                    for i := 0; i < b.N; i++ {
+                        out.Reset()
+                        enc, err := encoders[coding](&out, level)
+                        if err != nil {
+                            b.Fatal(err)
+                        }
+                        enc.Write(body.data)
+                        enc.Close()
+                    }
+                    b.ReportMetric(100*float64(out.Len())/float64(len(body.data)), "%size")
+                })
+            }
+        }
+    }
+}
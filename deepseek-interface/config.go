@@ -0,0 +1,912 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// config holds everything read from the environment at startup, plus the
+// optional JSON file named by CONFIG_FILE for settings that don't fit
+// comfortably in env vars.
+type config struct {
+    OllamaURL string
+    // Path prefix between OllamaURL and /api/..., for setups that expose
+    // Ollama under e.g. /ollama behind a reverse proxy.
+    OllamaAPIPrefix string
+
+    // Default timeout for a generate call and the most a request may ask
+    // for via its "timeout" field.
+    UpstreamTimeout    time.Duration
+    MaxUpstreamTimeout time.Duration
+
+    // How long GET /models serves the model list before asking Ollama again,
+    // and how much longer a stale list is served while a fresh one is
+    // fetched in the background.
+    ModelsCacheTTL   time.Duration
+    ModelsCacheStale time.Duration
+
+    Port         string
+    DefaultModel string
+    SystemPrompt string
+    // With AutoSelectModel, the model used instead of DefaultModel while
+    // that isn't installed; see modelCache.selectDefault.
+    AutoSelectModel bool
+    autoModel       atomic.Pointer[string]
+
+    // Ollama only returns logprobs from 0.12.11 onwards. By default we just
+    // omit them when the backend doesn't send any; strict mode turns that
+    // into an error so evaluation tooling doesn't silently get nothing.
+    LogprobsStrict bool
+
+    // Setting high priority requires the admin token so regular clients
+    // can't push themselves to the front of the queue.
+    AdminToken string
+
+    MaxConcurrent           int
+    MaxConcurrentPerSession int
+    // SESSION_MISSING: issue a cookie to requests without a valid one, or
+    // serve them statelessly; see sessionID.
+    SessionMissing string
+    // SESSION_SECRET signs session cookies; without it a random key is
+    // used, and cookies last only as long as the process.
+    SessionSecret []byte
+    // Request rates allowed per client IP and per session; see
+    // requestRateLimits. The zero value is no limit.
+    RateLimitIP      rateLimit
+    RateLimitSession rateLimit
+    // Embeddings queue separately from chat, with their own limit.
+    MaxConcurrentEmbeddings int
+    EmbeddingModel          string
+    QueueSmallestFirst      bool
+    AllowPull               bool
+    // Model downloads allowed at once (0 = no limit), and whether more
+    // wait for a turn instead of being turned away.
+    MaxConcurrentPulls int
+    QueuePulls         bool
+    // Where Ollama's model store is mounted in this container, the GPU's
+    // total memory, and the free disk space below which pulls are refused;
+    // see /models/capacity.
+    ModelsDir       string
+    GPUVRAM         int64
+    PullMinFreeDisk int64
+    // Models the UI offers to pull when Ollama has none installed.
+    SuggestedModels []string
+
+    // Exposes POST /echo, which reflects request headers back to the
+    // caller. Meant for local debugging only.
+    DebugEcho bool
+    // Log request and response bodies of the /v1 endpoints, each cut to
+    // DebugBodyMaxBytes.
+    DebugV1Bodies     bool
+    DebugBodyMaxBytes int
+
+    TLSCertFile string
+    TLSKeyFile  string
+
+    // Peers whose X-Forwarded-* headers we believe. Anyone else could
+    // simply claim to be behind a TLS-terminating proxy.
+    TrustedProxies []*net.IPNet
+
+    HSTSEnabled           bool
+    HSTSMaxAge            int
+    HSTSIncludeSubdomains bool
+    // Refuse requests that didn't arrive over HTTPS; see requireTLS.
+    RequireTLS bool
+
+    // With HealthDeepCheck, /healthz also runs a one-token generate against
+    // the default model. Probe results are cached for HealthCacheTTL.
+    HealthDeepCheck bool
+    HealthCacheTTL  time.Duration
+    // Longest a probe may take, the deep check's model load included.
+    HealthProbeTimeout time.Duration
+
+    // How long SIGTERM waits for in-flight chats before forcing the
+    // server closed. Keep it below the pod's terminationGracePeriodSeconds.
+    DrainTimeout time.Duration
+
+    Options *optionPolicy
+
+    // REQUEST_TAGS: the tags requests may carry; empty accepts any.
+    RequestTags map[string]bool
+
+    // Hold readiness at startup until Ollama answers, for up to
+    // WaitForOllamaTimeout; then exit, or carry on unready, per
+    // WaitForOllamaFail.
+    WaitForOllama        bool
+    WaitForOllamaTimeout time.Duration
+    WaitForOllamaFail    bool
+
+    // OLLAMA_COMPAT: auto, chat or generate; see compat.go. chatMissing
+    // is set when /v1/chat/completions has to go through /api/generate,
+    // because it was configured so or the Ollama found predates /api/chat.
+    OllamaCompat string
+    chatMissing  atomic.Bool
+
+    // Models the warmer keeps loaded, pinging each in turn every
+    // WarmInterval with WarmDelay between them.
+    WarmModels   []string
+    WarmInterval time.Duration
+    WarmDelay    time.Duration
+    // Report not-ready until the first warm round has finished.
+    WarmBlockReadiness bool
+    // Unload models, other than WarmModels, unused for this long; 0 never.
+    UnloadIdle time.Duration
+
+    // Most models one /chat request may try: the requested model and its
+    // fallbacks.
+    FallbackMaxAttempts int
+
+    // Default for the "format" field: raw, markdown or html.
+    ResponseFormat string
+    // Default for the "flush" field, and how often the time mode sends.
+    StreamFlush         string
+    StreamFlushInterval time.Duration
+    // How often a stream reports its running token count; 0 never.
+    StreamProgressInterval time.Duration
+    // Default for the "thinking_budget" field; "" sends none.
+    ThinkingBudget string
+
+    // Longest prompt accepted, in characters (0 for no limit), and whether
+    // longer ones are rejected or cut down to keep their start or end.
+    MaxPromptLength int
+    PromptOverflow  string
+    // Whether request bodies with invalid UTF-8 are repaired or rejected.
+    InvalidUTF8 string
+    // Prompt clean-up before the limit is applied: CRLF to LF, and tabs
+    // expanded to this many columns (0 leaves tabs alone).
+    NormalizeNewlines bool
+    ExpandTabs        int
+
+    // Rolling window for the per-model latency percentiles on /stats, and
+    // the p95 above which an alert is logged (and posted to the webhook).
+    LatencyWindow       time.Duration
+    LatencyAlertP95     time.Duration
+    LatencyAlertWebhook string
+
+    // Log /chat prompts whose generation takes longer than this, masked
+    // and cut to SlowPromptMaxBytes; 0 logs none.
+    SlowPromptThreshold time.Duration
+    SlowPromptMaxBytes  int
+
+    // Return Ollama's own /api/generate response from /chat instead of
+    // re-wrapping it; requests can override with "passthrough".
+    Passthrough bool
+
+    // Model for the optional translation pass (empty disables it), the
+    // language code replies are translated into, and whether /chat does so
+    // by default.
+    TranslateModel     string
+    TranslateTarget    string
+    TranslateResponses bool
+
+    // Consecutive failed generations after which /models flags a model as
+    // degraded (0 disables), and how long before it gets another chance.
+    ModelDegradeAfter    int
+    ModelDegradeCooldown time.Duration
+
+    // Tokens each session may generate per day (0 for no budget), and the
+    // local time of day, as an offset from midnight, when budgets reset.
+    DailyTokenBudget int
+    TokenBudgetReset time.Duration
+
+    // Compress JSON/HTML responses for clients that accept it, using the
+    // first of CompressEncodings the client prefers, at CompressLevel.
+    CompressResponses bool
+    CompressEncodings []string
+    CompressLevel     int
+
+    // Let identical deterministic /chat requests in flight at the same
+    // time share one generation.
+    CoalesceRequests bool
+
+    // How long a session's repeated /chat request is answered with the
+    // first one's reply; 0 turns debouncing off.
+    DebounceWindow time.Duration
+
+    // Largest reply a "spool" request may write to SpoolDir, which also
+    // turns spooling on; files go SpoolTTL after their stream ends.
+    SpoolMaxBytes int64
+    SpoolDir      string
+    SpoolTTL      time.Duration
+
+    // Ask /api/ps whether a /chat model is loaded before sending to it, and
+    // how long its answer is reused.
+    ColdCheck    bool
+    ColdCheckTTL time.Duration
+
+    // What /chat does with a request for a cold model: hold it while the
+    // model loads, or reject it with 503 and load the model meanwhile.
+    // ColdStartRetryAfter is the Retry-After until a load has been timed.
+    ColdStart           string
+    ColdStartRetryAfter time.Duration
+
+    // How often to wait out and retry an upstream 429, and the longest
+    // Retry-After worth waiting for; beyond either the 429 goes to the client.
+    Upstream429Retries int
+    Upstream429MaxWait time.Duration
+
+    // Most calls to Ollama one client request may make, counting 429
+    // retries, thinking retries and fallbacks together; 0 for no cap.
+    MaxUpstreamAttempts int
+
+    // Most SSE streams open at once across all clients; 0 for no cap.
+    MaxSSEConnections int
+
+    // Longest SSE data line we write. Some proxies reject very long lines,
+    // so bigger payloads are split; see splitData and splitToken.
+    SSEMaxFrame int
+
+    // Where the /chat audit trail goes: a file path or "syslog". Empty
+    // disables it.
+    AuditLog string
+
+    // Directory of <name>.json theme files served at /ui/<name>.
+    ThemesDir string
+
+    // Trim whitespace around replies, after the configured transforms.
+    TrimResponses bool
+    // Rewrite /chat replies to ASCII: off, transliterate or strip.
+    ResponseASCII string
+    // Report the options each /chat reply was generated with.
+    ResponseOptions bool
+    // Add X-Model, X-Duration-Ms and X-Tokens to chat responses.
+    ResultHeaders bool
+    // Return what a non-streaming /chat generation wrote before the
+    // upstream timeout instead of an error; see collectStream.
+    PartialOnTimeout bool
+
+    // Keep at most this many identical consecutive lines of a /chat reply
+    // (0 keeps them all), and with RepeatAbort stop a stream at the first
+    // line too many.
+    RepeatMaxLines int
+    RepeatAbort    bool
+
+    // Most continuations a request's "auto_continue" may ask for, 0 turning
+    // it off, and how long a reply may grow before they stop.
+    AutoContinueMax      int
+    AutoContinueMaxBytes int
+
+    Models     map[string]modelConfig
+    Transforms pipeline
+    Backends   *backends
+    Snippets   *snippetStore
+    Roles      map[string]roleConfig
+
+    // How deep snippets may include others, and the most bytes a prompt
+    // may grow to once they are expanded.
+    SnippetMaxDepth    int
+    SnippetMaxExpanded int
+
+    // The options a request's "creativity" sets, each with its values at 0
+    // and 100; see applyCreativity.
+    Creativity map[string][]float64
+    // Finds documents to put in front of /chat prompts; noRetriever
+    // unless RETRIEVER_URL is set.
+    Retriever retriever
+
+    // Publish completed /chat replies to NATS_SUBJECT.<session> on this
+    // server; see natsPublisher.
+    NATSURL     string
+    NATSSubject string
+}
+
+// modelConfig is the per-model section of CONFIG_FILE.
+type modelConfig struct {
+    SystemPrompt string   `json:"system_prompt"`
+    Stop         []string `json:"stop"`
+    // Models to try in order when this one fails; see fallbackChain.
+    Fallbacks []string `json:"fallbacks"`
+    // Timeout overrides UPSTREAM_TIMEOUT for this model, e.g. "5m";
+    // checkModelTimeouts parses it into timeout.
+    Timeout string `json:"timeout"`
+    timeout time.Duration
+}
+
+// fileConfig is the layout of CONFIG_FILE.
+type fileConfig struct {
+    Models     map[string]modelConfig `json:"models"`
+    Transforms []transformSpec        `json:"transforms"`
+    Backends   []backendSpec          `json:"backends"`
+    Roles      map[string]roleConfig  `json:"roles"`
+    Creativity map[string][]float64   `json:"creativity"`
+}
+
+func getenv(key, fallback string) string {
+    if v := os.Getenv(key); v != "" {
+        return v
+    }
+    return fallback
+}
+
+func loadConfig() (*config, error) {
+    cfg := &config{
+        OllamaURL:      getenv("OLLAMA_URL", "http://host.docker.internal:11434"),
+        Port:           getenv("PORT", "8080"),
+        DefaultModel:   getenv("DEFAULT_MODEL", "codellama:7b"),
+        SystemPrompt:   os.Getenv("SYSTEM_PROMPT"),
+        LogprobsStrict: os.Getenv("LOGPROBS_STRICT") == "true",
+        AdminToken:     os.Getenv("ADMIN_TOKEN"),
+        AllowPull:      os.Getenv("ALLOW_PULL") == "true",
+        QueuePulls:     os.Getenv("PULL_QUEUE") == "true",
+        ModelsDir:      os.Getenv("MODELS_DIR"),
+        DebugEcho:      os.Getenv("DEBUG_ECHO") == "true",
+        DebugV1Bodies:  os.Getenv("DEBUG_V1_BODIES") == "true",
+        ThemesDir:      os.Getenv("THEMES_DIR"),
+        AuditLog:       os.Getenv("AUDIT_LOG"),
+
+        CompressResponses: os.Getenv("COMPRESS_RESPONSES") == "true",
+        CoalesceRequests:  os.Getenv("COALESCE_REQUESTS") == "true",
+        TrimResponses:     os.Getenv("TRIM_RESPONSES") == "true",
+        ResponseOptions:   os.Getenv("RESPONSE_OPTIONS") == "true",
+        ResultHeaders:     os.Getenv("RESULT_HEADERS") == "true",
+        PartialOnTimeout:  os.Getenv("PARTIAL_ON_TIMEOUT") == "true",
+
+        QueueSmallestFirst: os.Getenv("QUEUE_SMALLEST_FIRST") == "true",
+        AutoSelectModel:    os.Getenv("AUTO_SELECT_MODEL") == "true",
+        ColdCheck:          os.Getenv("COLD_CHECK") == "true",
+
+        Creativity: defaultCreativity,
+    }
+    cfg.MaxConcurrent, _ = strconv.Atoi(getenv("MAX_CONCURRENT", "1"))
+    if cfg.MaxConcurrent < 1 {
+        cfg.MaxConcurrent = 1
+    }
+    cfg.MaxConcurrentPerSession, _ = strconv.Atoi(getenv("MAX_CONCURRENT_PER_SESSION", "2"))
+    switch cfg.SessionMissing = getenv("SESSION_MISSING", sessionIssue); cfg.SessionMissing {
+    case sessionIssue, sessionStateless:
+    default:
+        return nil, fmt.Errorf("SESSION_MISSING must be issue or stateless, got %q", cfg.SessionMissing)
+    }
+    cfg.SessionSecret = []byte(os.Getenv("SESSION_SECRET"))
+    if len(cfg.SessionSecret) == 0 {
+        cfg.SessionSecret = make([]byte, 32)
+        rand.Read(cfg.SessionSecret)
+    } else if len(cfg.SessionSecret) < 16 {
+        return nil, fmt.Errorf("SESSION_SECRET must be at least 16 characters")
+    }
+    cfg.MaxConcurrentEmbeddings, _ = strconv.Atoi(getenv("MAX_CONCURRENT_EMBEDDINGS", "1"))
+    if cfg.MaxConcurrentEmbeddings < 1 {
+        cfg.MaxConcurrentEmbeddings = 1
+    }
+    cfg.EmbeddingModel = getenv("EMBEDDING_MODEL", "nomic-embed-text")
+    cfg.SuggestedModels = parseList(getenv("SUGGESTED_MODELS", cfg.DefaultModel))
+
+    cfg.OllamaURL = strings.TrimRight(cfg.OllamaURL, "/")
+    if prefix := strings.Trim(os.Getenv("OLLAMA_API_PREFIX"), "/"); prefix != "" {
+        cfg.OllamaAPIPrefix = "/" + prefix
+    }
+    if u, err := url.Parse(cfg.ollamaAPI("/api/generate")); err != nil || u.Scheme == "" || u.Host == "" {
+        return nil, fmt.Errorf("OLLAMA_URL %q with OLLAMA_API_PREFIX %q is not a valid URL", cfg.OllamaURL, cfg.OllamaAPIPrefix)
+    }
+
+    var err error
+    cfg.UpstreamTimeout, err = time.ParseDuration(getenv("UPSTREAM_TIMEOUT", "30s"))
+    if err != nil || cfg.UpstreamTimeout <= 0 {
+        return nil, fmt.Errorf("UPSTREAM_TIMEOUT must be a positive duration")
+    }
+    cfg.MaxUpstreamTimeout, err = time.ParseDuration(getenv("MAX_UPSTREAM_TIMEOUT", "5m"))
+    if err != nil || cfg.MaxUpstreamTimeout < cfg.UpstreamTimeout {
+        return nil, fmt.Errorf("MAX_UPSTREAM_TIMEOUT must be a duration no shorter than UPSTREAM_TIMEOUT")
+    }
+
+    cfg.Options, err = parseOptionPolicy(os.Getenv("OPTIONS_ALLOW"), os.Getenv("OPTIONS_DENY"), os.Getenv("OPTIONS_POLICY_MODE"))
+    if err != nil {
+        return nil, err
+    }
+    if cfg.RequestTags, err = parseRequestTags(os.Getenv("REQUEST_TAGS")); err != nil {
+        return nil, err
+    }
+
+    cfg.MaxConcurrentPulls, err = strconv.Atoi(getenv("MAX_CONCURRENT_PULLS", "1"))
+    if err != nil || cfg.MaxConcurrentPulls < 0 {
+        return nil, fmt.Errorf("MAX_CONCURRENT_PULLS must be a number of pulls, or 0 for no limit")
+    }
+    if cfg.GPUVRAM, err = parseByteSize(getenv("GPU_VRAM", "0")); err != nil {
+        return nil, fmt.Errorf("GPU_VRAM: %w", err)
+    }
+    if cfg.PullMinFreeDisk, err = parseByteSize(getenv("PULL_MIN_FREE_DISK", "0")); err != nil {
+        return nil, fmt.Errorf("PULL_MIN_FREE_DISK: %w", err)
+    }
+    if cfg.PullMinFreeDisk > 0 && cfg.ModelsDir == "" {
+        return nil, fmt.Errorf("PULL_MIN_FREE_DISK needs MODELS_DIR")
+    }
+    if cfg.AllowPull && cfg.AdminToken == "" {
+        return nil, fmt.Errorf("ALLOW_PULL needs ADMIN_TOKEN, since only admins may pull models")
+    }
+
+    cfg.DebugBodyMaxBytes, err = strconv.Atoi(getenv("DEBUG_BODY_MAX_BYTES", "4096"))
+    if err != nil || cfg.DebugBodyMaxBytes < 1 {
+        return nil, fmt.Errorf("DEBUG_BODY_MAX_BYTES must be a positive number of bytes")
+    }
+
+    cfg.ModelsCacheTTL, err = time.ParseDuration(getenv("MODELS_CACHE_TTL", "30s"))
+    if err != nil || cfg.ModelsCacheTTL < 0 {
+        return nil, fmt.Errorf("MODELS_CACHE_TTL must be a duration such as 30s, or 0 not to cache")
+    }
+    cfg.ModelsCacheStale, err = time.ParseDuration(getenv("MODELS_CACHE_STALE", "0"))
+    if err != nil || cfg.ModelsCacheStale < 0 {
+        return nil, fmt.Errorf("MODELS_CACHE_STALE must be a duration such as 5m, or 0")
+    }
+
+    cfg.WaitForOllama = os.Getenv("WAIT_FOR_OLLAMA") == "true"
+    cfg.WaitForOllamaTimeout, err = time.ParseDuration(getenv("WAIT_FOR_OLLAMA_TIMEOUT", "2m"))
+    if err != nil || cfg.WaitForOllamaTimeout <= 0 {
+        return nil, fmt.Errorf("WAIT_FOR_OLLAMA_TIMEOUT must be a positive duration")
+    }
+    switch v := getenv("WAIT_FOR_OLLAMA_ON_TIMEOUT", "unready"); v {
+    case "fail":
+        cfg.WaitForOllamaFail = true
+    case "unready":
+    default:
+        return nil, fmt.Errorf("WAIT_FOR_OLLAMA_ON_TIMEOUT must be fail or unready, got %q", v)
+    }
+    switch cfg.OllamaCompat = getenv("OLLAMA_COMPAT", compatAuto); cfg.OllamaCompat {
+    case compatAuto, compatChat:
+    case compatGenerate:
+        cfg.chatMissing.Store(true)
+    default:
+        return nil, fmt.Errorf("OLLAMA_COMPAT must be auto, chat or generate, got %q", cfg.OllamaCompat)
+    }
+
+    cfg.WarmModels = parseList(os.Getenv("WARM_MODELS"))
+    cfg.WarmBlockReadiness = os.Getenv("WARM_BLOCK_READINESS") == "true"
+    cfg.WarmInterval, err = time.ParseDuration(getenv("WARM_INTERVAL", "4m"))
+    if err != nil || cfg.WarmInterval <= 0 {
+        return nil, fmt.Errorf("WARM_INTERVAL must be a positive duration")
+    }
+    cfg.WarmDelay, err = time.ParseDuration(getenv("WARM_DELAY", "5s"))
+    if err != nil || cfg.WarmDelay < 0 {
+        return nil, fmt.Errorf("WARM_DELAY must be a duration such as 5s, or 0")
+    }
+    cfg.FallbackMaxAttempts, err = strconv.Atoi(getenv("FALLBACK_MAX_ATTEMPTS", "3"))
+    if err != nil || cfg.FallbackMaxAttempts < 1 {
+        return nil, fmt.Errorf("FALLBACK_MAX_ATTEMPTS must be at least 1")
+    }
+    cfg.UnloadIdle, err = time.ParseDuration(getenv("UNLOAD_IDLE", "0"))
+    if err != nil || cfg.UnloadIdle < 0 {
+        return nil, fmt.Errorf("UNLOAD_IDLE must be a duration such as \"15m\", or 0 to disable")
+    }
+
+    cfg.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+    cfg.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+    if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+        return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+    }
+
+    proxies, err := parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+    if err != nil {
+        return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+    }
+    cfg.TrustedProxies = proxies
+
+    cfg.HSTSEnabled = os.Getenv("HSTS_ENABLED") == "true"
+    cfg.RequireTLS = os.Getenv("REQUIRE_TLS") == "true"
+    cfg.HSTSMaxAge, err = strconv.Atoi(getenv("HSTS_MAX_AGE", "31536000"))
+    if err != nil || cfg.HSTSMaxAge < 0 {
+        return nil, fmt.Errorf("HSTS_MAX_AGE must be a non-negative number of seconds")
+    }
+    cfg.HSTSIncludeSubdomains = os.Getenv("HSTS_INCLUDE_SUBDOMAINS") == "true"
+
+    cfg.HealthDeepCheck = os.Getenv("HEALTH_DEEP_CHECK") == "true"
+    cfg.HealthCacheTTL, err = time.ParseDuration(getenv("HEALTH_CACHE_TTL", "30s"))
+    if err != nil || cfg.HealthCacheTTL < 0 {
+        return nil, fmt.Errorf("HEALTH_CACHE_TTL must be a duration such as 30s, or 0 to probe every time")
+    }
+    cfg.HealthProbeTimeout, err = time.ParseDuration(getenv("HEALTH_PROBE_TIMEOUT", "2m"))
+    if err != nil || cfg.HealthProbeTimeout <= 0 {
+        return nil, fmt.Errorf("HEALTH_PROBE_TIMEOUT must be a positive duration")
+    }
+
+    cfg.ResponseFormat, err = parseResponseFormat(getenv("RESPONSE_FORMAT", formatRaw))
+    if err != nil {
+        return nil, fmt.Errorf("RESPONSE_FORMAT: %w", err)
+    }
+    cfg.ResponseASCII, err = parseASCIIMode(getenv("RESPONSE_ASCII", asciiOff))
+    if err != nil {
+        return nil, fmt.Errorf("RESPONSE_ASCII: %w", err)
+    }
+    cfg.StreamFlush, err = parseFlushMode(getenv("STREAM_FLUSH", flushToken))
+    if err != nil {
+        return nil, fmt.Errorf("STREAM_FLUSH: %w", err)
+    }
+    cfg.StreamFlushInterval, err = time.ParseDuration(getenv("STREAM_FLUSH_INTERVAL", "100ms"))
+    if err != nil || cfg.StreamFlushInterval <= 0 {
+        return nil, fmt.Errorf("STREAM_FLUSH_INTERVAL must be a positive duration")
+    }
+    cfg.StreamProgressInterval, err = time.ParseDuration(getenv("STREAM_PROGRESS_INTERVAL", "1s"))
+    if err != nil || cfg.StreamProgressInterval < 0 {
+        return nil, fmt.Errorf("STREAM_PROGRESS_INTERVAL must be a duration such as \"1s\", or 0 to disable")
+    }
+    cfg.ThinkingBudget, err = parseThinkingBudget(os.Getenv("THINKING_BUDGET"))
+    if err != nil {
+        return nil, fmt.Errorf("THINKING_BUDGET: %w", err)
+    }
+
+    cfg.MaxPromptLength, err = strconv.Atoi(getenv("MAX_PROMPT_LENGTH", "0"))
+    if err != nil || cfg.MaxPromptLength < 0 {
+        return nil, fmt.Errorf("MAX_PROMPT_LENGTH must be a non-negative number of characters")
+    }
+    cfg.PromptOverflow, err = parseOverflowMode(os.Getenv("PROMPT_OVERFLOW"))
+    if err != nil {
+        return nil, err
+    }
+    cfg.InvalidUTF8, err = parseInvalidUTF8Mode(os.Getenv("PROMPT_INVALID_UTF8"))
+    if err != nil {
+        return nil, err
+    }
+    cfg.NormalizeNewlines = os.Getenv("PROMPT_NORMALIZE_NEWLINES") == "true"
+    cfg.ExpandTabs, err = strconv.Atoi(getenv("PROMPT_EXPAND_TABS", "0"))
+    if err != nil || cfg.ExpandTabs < 0 || cfg.ExpandTabs > 16 {
+        return nil, fmt.Errorf("PROMPT_EXPAND_TABS must be a tab width from 1 to 16, or 0 to leave tabs alone")
+    }
+
+    cfg.RepeatMaxLines, err = strconv.Atoi(getenv("REPEAT_MAX_LINES", "0"))
+    if err != nil || cfg.RepeatMaxLines < 0 {
+        return nil, fmt.Errorf("REPEAT_MAX_LINES must be a number of lines, or 0 to keep repeats")
+    }
+    cfg.RepeatAbort = os.Getenv("REPEAT_ABORT") == "true"
+    if cfg.RepeatAbort && cfg.RepeatMaxLines == 0 {
+        return nil, fmt.Errorf("REPEAT_ABORT needs REPEAT_MAX_LINES")
+    }
+    cfg.AutoContinueMax, err = strconv.Atoi(getenv("AUTO_CONTINUE_MAX", "3"))
+    if err != nil || cfg.AutoContinueMax < 0 {
+        return nil, fmt.Errorf("AUTO_CONTINUE_MAX must be a number of continuations, or 0 to disable")
+    }
+    cfg.AutoContinueMaxBytes, err = strconv.Atoi(getenv("AUTO_CONTINUE_MAX_BYTES", "65536"))
+    if err != nil || cfg.AutoContinueMaxBytes < 1 {
+        return nil, fmt.Errorf("AUTO_CONTINUE_MAX_BYTES must be a positive number of bytes")
+    }
+
+    cfg.LatencyWindow, err = time.ParseDuration(getenv("LATENCY_WINDOW", "10m"))
+    if err != nil || cfg.LatencyWindow < 10*time.Second {
+        return nil, fmt.Errorf("LATENCY_WINDOW must be a duration of at least 10s")
+    }
+    if v := os.Getenv("LATENCY_ALERT_P95"); v != "" {
+        cfg.LatencyAlertP95, err = time.ParseDuration(v)
+        if err != nil || cfg.LatencyAlertP95 <= 0 {
+            return nil, fmt.Errorf("LATENCY_ALERT_P95 must be a positive duration")
+        }
+    }
+    cfg.LatencyAlertWebhook = os.Getenv("LATENCY_ALERT_WEBHOOK")
+    if v := os.Getenv("SLOW_PROMPT_THRESHOLD"); v != "" {
+        cfg.SlowPromptThreshold, err = time.ParseDuration(v)
+        if err != nil || cfg.SlowPromptThreshold <= 0 {
+            return nil, fmt.Errorf("SLOW_PROMPT_THRESHOLD must be a positive duration")
+        }
+    }
+    cfg.SlowPromptMaxBytes, err = strconv.Atoi(getenv("SLOW_PROMPT_MAX_BYTES", "500"))
+    if err != nil || cfg.SlowPromptMaxBytes < 1 {
+        return nil, fmt.Errorf("SLOW_PROMPT_MAX_BYTES must be a positive number of bytes")
+    }
+
+    cfg.Upstream429Retries, err = strconv.Atoi(getenv("UPSTREAM_429_RETRIES", "2"))
+    if err != nil || cfg.Upstream429Retries < 0 {
+        return nil, fmt.Errorf("UPSTREAM_429_RETRIES must be a non-negative number")
+    }
+    cfg.Upstream429MaxWait, err = time.ParseDuration(getenv("UPSTREAM_429_MAX_WAIT", "10s"))
+    if err != nil || cfg.Upstream429MaxWait < 0 {
+        return nil, fmt.Errorf("UPSTREAM_429_MAX_WAIT must be a duration such as \"10s\"")
+    }
+    cfg.MaxUpstreamAttempts, err = strconv.Atoi(getenv("MAX_UPSTREAM_ATTEMPTS", "0"))
+    if err != nil || cfg.MaxUpstreamAttempts < 0 {
+        return nil, fmt.Errorf("MAX_UPSTREAM_ATTEMPTS must be a non-negative number")
+    }
+    if cfg.RateLimitIP, err = parseRateLimit(os.Getenv("RATE_LIMIT_IP")); err != nil {
+        return nil, fmt.Errorf("RATE_LIMIT_IP %v", err)
+    }
+    if cfg.RateLimitSession, err = parseRateLimit(os.Getenv("RATE_LIMIT_SESSION")); err != nil {
+        return nil, fmt.Errorf("RATE_LIMIT_SESSION %v", err)
+    }
+    cfg.DebounceWindow, err = time.ParseDuration(getenv("DEBOUNCE_WINDOW", "0"))
+    if err != nil || cfg.DebounceWindow < 0 {
+        return nil, fmt.Errorf("DEBOUNCE_WINDOW must be a duration such as \"2s\", or 0 to disable")
+    }
+    cfg.SpoolMaxBytes, err = strconv.ParseInt(getenv("SPOOL_MAX_BYTES", "0"), 10, 64)
+    if err != nil || cfg.SpoolMaxBytes < 0 {
+        return nil, fmt.Errorf("SPOOL_MAX_BYTES must be a non-negative number of bytes, or 0 to disable")
+    }
+    cfg.SpoolDir = getenv("SPOOL_DIR", filepath.Join(os.TempDir(), "deepseek-spool"))
+    cfg.SpoolTTL, err = time.ParseDuration(getenv("SPOOL_TTL", "1h"))
+    if err != nil || cfg.SpoolTTL <= 0 {
+        return nil, fmt.Errorf("SPOOL_TTL must be a positive duration")
+    }
+    cfg.ColdCheckTTL, err = time.ParseDuration(getenv("COLD_CHECK_TTL", "5s"))
+    if err != nil || cfg.ColdCheckTTL < 0 {
+        return nil, fmt.Errorf("COLD_CHECK_TTL must be a duration such as 5s")
+    }
+    switch cfg.ColdStart = getenv("COLD_START", coldHold); cfg.ColdStart {
+    case coldHold:
+    case coldReject:
+        if !cfg.ColdCheck {
+            return nil, fmt.Errorf("COLD_START=reject needs COLD_CHECK=true to tell when a model is cold")
+        }
+    default:
+        return nil, fmt.Errorf("COLD_START must be hold or reject, got %q", cfg.ColdStart)
+    }
+    cfg.ColdStartRetryAfter, err = time.ParseDuration(getenv("COLD_START_RETRY_AFTER", "10s"))
+    if err != nil || cfg.ColdStartRetryAfter < time.Second {
+        return nil, fmt.Errorf("COLD_START_RETRY_AFTER must be a duration of at least 1s")
+    }
+    if cfg.CompressEncodings, err = parseEncodings(getenv("COMPRESS_ALGORITHMS", "gzip")); err != nil {
+        return nil, fmt.Errorf("COMPRESS_ALGORITHMS: %w", err)
+    }
+    cfg.CompressLevel, err = strconv.Atoi(getenv("COMPRESS_LEVEL", "6"))
+    if err != nil || cfg.CompressLevel < 1 || cfg.CompressLevel > 9 {
+        return nil, fmt.Errorf("COMPRESS_LEVEL must be between 1 (fastest) and 9 (smallest)")
+    }
+
+    cfg.Passthrough = os.Getenv("PASSTHROUGH") == "true"
+
+    cfg.DailyTokenBudget, err = strconv.Atoi(getenv("DAILY_TOKEN_BUDGET", "0"))
+    if err != nil || cfg.DailyTokenBudget < 0 {
+        return nil, fmt.Errorf("DAILY_TOKEN_BUDGET must be a non-negative number")
+    }
+    cfg.TokenBudgetReset, err = parseResetTime(getenv("TOKEN_BUDGET_RESET", "00:00"))
+    if err != nil {
+        return nil, fmt.Errorf("TOKEN_BUDGET_RESET: %w", err)
+    }
+
+    cfg.ModelDegradeAfter, err = strconv.Atoi(getenv("MODEL_DEGRADE_AFTER", "3"))
+    if err != nil || cfg.ModelDegradeAfter < 0 {
+        return nil, fmt.Errorf("MODEL_DEGRADE_AFTER must be a non-negative number")
+    }
+    cfg.ModelDegradeCooldown, err = time.ParseDuration(getenv("MODEL_DEGRADE_COOLDOWN", "10m"))
+    if err != nil || cfg.ModelDegradeCooldown <= 0 {
+        return nil, fmt.Errorf("MODEL_DEGRADE_COOLDOWN must be a positive duration")
+    }
+
+    cfg.TranslateModel = os.Getenv("TRANSLATE_MODEL")
+    cfg.TranslateTarget = getenv("TRANSLATE_TARGET", "en")
+    if _, ok := languageNames[cfg.TranslateTarget]; !ok {
+        return nil, fmt.Errorf("TRANSLATE_TARGET %q is not a supported language code", cfg.TranslateTarget)
+    }
+    cfg.TranslateResponses = os.Getenv("TRANSLATE_RESPONSES") == "true"
+    if cfg.TranslateResponses && cfg.TranslateModel == "" {
+        return nil, fmt.Errorf("TRANSLATE_RESPONSES requires TRANSLATE_MODEL")
+    }
+
+    cfg.Retriever = noRetriever{}
+    if url := os.Getenv("RETRIEVER_URL"); url != "" {
+        limit, err := strconv.Atoi(getenv("RETRIEVER_LIMIT", "3"))
+        if err != nil || limit < 1 {
+            return nil, fmt.Errorf("RETRIEVER_LIMIT must be a positive number of documents")
+        }
+        timeout, err := time.ParseDuration(getenv("RETRIEVER_TIMEOUT", "5s"))
+        if err != nil || timeout <= 0 {
+            return nil, fmt.Errorf("RETRIEVER_TIMEOUT must be a positive duration")
+        }
+        cfg.Retriever = newHTTPRetriever(url, limit, timeout)
+    }
+
+    cfg.NATSURL = os.Getenv("NATS_URL")
+    cfg.NATSSubject = getenv("NATS_SUBJECT", "deepseek.replies")
+    if !natsSubject.MatchString(cfg.NATSSubject) {
+        return nil, fmt.Errorf("NATS_SUBJECT must be dot-separated letters, digits, '-' or '_', got %q", cfg.NATSSubject)
+    }
+
+    cfg.MaxSSEConnections, err = strconv.Atoi(getenv("MAX_SSE_CONNECTIONS", "0"))
+    if err != nil || cfg.MaxSSEConnections < 0 {
+        return nil, fmt.Errorf("MAX_SSE_CONNECTIONS must be a non-negative number")
+    }
+
+    cfg.SSEMaxFrame, err = strconv.Atoi(getenv("SSE_MAX_FRAME_BYTES", "16384"))
+    if err != nil || cfg.SSEMaxFrame < 64 {
+        return nil, fmt.Errorf("SSE_MAX_FRAME_BYTES must be at least 64")
+    }
+
+    cfg.DrainTimeout, err = time.ParseDuration(getenv("DRAIN_TIMEOUT", "60s"))
+    if err != nil || cfg.DrainTimeout <= 0 {
+        return nil, fmt.Errorf("DRAIN_TIMEOUT must be a positive duration such as 60s")
+    }
+
+    cfg.Snippets, err = openSnippetStore(os.Getenv("SNIPPETS_FILE"))
+    if err != nil {
+        return nil, fmt.Errorf("SNIPPETS_FILE: %w", err)
+    }
+    cfg.SnippetMaxDepth, err = strconv.Atoi(getenv("SNIPPET_MAX_DEPTH", "3"))
+    if err != nil || cfg.SnippetMaxDepth < 1 || cfg.SnippetMaxDepth > 10 {
+        return nil, fmt.Errorf("SNIPPET_MAX_DEPTH must be from 1 to 10")
+    }
+    maxExpanded, err := parseByteSize(getenv("SNIPPET_MAX_EXPANDED", "256KiB"))
+    if err != nil || maxExpanded < 1 || maxExpanded > 16<<20 {
+        return nil, fmt.Errorf("SNIPPET_MAX_EXPANDED must be a size from 1 byte to 16MiB, such as \"256KiB\"")
+    }
+    cfg.SnippetMaxExpanded = int(maxExpanded)
+
+    if path := os.Getenv("CONFIG_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("reading config file: %w", err)
+        }
+        var fc fileConfig
+        if err := json.Unmarshal(data, &fc); err != nil {
+            return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+        }
+        cfg.Models = fc.Models
+        if err := checkFallbacks(fc.Models); err != nil {
+            return nil, fmt.Errorf("config file %s: %w", path, err)
+        }
+        if err := checkModelTimeouts(fc.Models, cfg.MaxUpstreamTimeout); err != nil {
+            return nil, fmt.Errorf("config file %s: %w", path, err)
+        }
+        cfg.Transforms, err = buildPipeline(fc.Transforms)
+        if err != nil {
+            return nil, fmt.Errorf("config file %s: %w", path, err)
+        }
+        cfg.Backends, err = buildBackends(fc.Backends)
+        if err != nil {
+            return nil, fmt.Errorf("config file %s: %w", path, err)
+        }
+        if err := checkRoles(fc.Roles); err != nil {
+            return nil, fmt.Errorf("config file %s: %w", path, err)
+        }
+        cfg.Roles = fc.Roles
+        if fc.Creativity != nil {
+            if err := checkCreativity(fc.Creativity); err != nil {
+                return nil, fmt.Errorf("config file %s: %w", path, err)
+            }
+            cfg.Creativity = fc.Creativity
+        }
+    }
+    return cfg, nil
+}
+
+// ollamaAPI returns the full upstream URL for an Ollama API path such as
+// "/api/generate".
+func (c *config) ollamaAPI(path string) string {
+    return c.OllamaURL + c.OllamaAPIPrefix + path
+}
+
+// checkModelTimeouts parses each model's timeout, which like a request's may
+// not exceed MAX_UPSTREAM_TIMEOUT.
+func checkModelTimeouts(models map[string]modelConfig, max time.Duration) error {
+    for name, mc := range models {
+        if mc.Timeout == "" {
+            continue
+        }
+        d, err := time.ParseDuration(mc.Timeout)
+        if err != nil || d <= 0 {
+            return fmt.Errorf("models.%s.timeout must be a positive duration such as \"5m\"", name)
+        }
+        if d > max {
+            return fmt.Errorf("models.%s.timeout may not exceed MAX_UPSTREAM_TIMEOUT (%s)", name, max)
+        }
+        mc.timeout = d
+        models[name] = mc
+    }
+    return nil
+}
+
+// defaultModel is the model for requests that don't name one.
+func (c *config) defaultModel() string {
+    if m := c.autoModel.Load(); m != nil {
+        return *m
+    }
+    return c.DefaultModel
+}
+
+// modelTimeout is the upstream timeout for model when the request doesn't
+// set one: its own from the config file, else UPSTREAM_TIMEOUT.
+func (c *config) modelTimeout(model string) time.Duration {
+    if d := c.Models[model].timeout; d > 0 {
+        return d
+    }
+    return c.UpstreamTimeout
+}
+
+// systemPrompt resolves the system prompt for a request: an explicit
+// per-request prompt wins, then the model's configured prompt, then the
+// global SYSTEM_PROMPT.
+func (c *config) systemPrompt(model, requested string) string {
+    if requested != "" {
+        return requested
+    }
+    if mc, ok := c.Models[model]; ok && mc.SystemPrompt != "" {
+        return mc.SystemPrompt
+    }
+    return c.SystemPrompt
+}
+
+// parseList splits a comma-separated env value, dropping blanks and
+// duplicates but keeping the order given.
+func parseList(list string) []string {
+    var out []string
+    seen := make(map[string]bool)
+    for _, item := range strings.Split(list, ",") {
+        item = strings.TrimSpace(item)
+        if item == "" || seen[item] {
+            continue
+        }
+        seen[item] = true
+        out = append(out, item)
+    }
+    return out
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs or bare IPs.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, entry := range strings.Split(list, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+                entry += "/32"
+            } else {
+                entry += "/128"
+            }
+        }
+        _, n, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, err
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+// fromTrustedProxy reports whether r arrived directly from one of
+// TrustedProxies.
+func (c *config) fromTrustedProxy(r *http.Request) bool {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return false
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && c.trustedIP(ip)
+}
+
+func (c *config) trustedIP(ip net.IP) bool {
+    for _, n := range c.TrustedProxies {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientIP returns the address of the client behind r. X-Forwarded-For is
+// only consulted for requests from TrustedProxies, and then the rightmost
+// hop that isn't itself a trusted proxy is used, since anything left of it
+// could have been made up by the client.
+func (c *config) clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    if !c.fromTrustedProxy(r) {
+        return host
+    }
+    hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        ip := net.ParseIP(strings.TrimSpace(hops[i]))
+        if ip == nil {
+            break
+        }
+        if !c.trustedIP(ip) {
+            return ip.String()
+        }
+    }
+    return host
+}
+
+// isHTTPS reports whether the client connection is encrypted, either
+// because we terminated TLS ourselves or a trusted proxy says it did.
+func (c *config) isHTTPS(r *http.Request) bool {
+    if r.TLS != nil {
+        return true
+    }
+    return c.fromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// testConfig loads the config as main does, with env given as key/value
+// pairs set for the duration of the test.
+func testConfig(t *testing.T, env ...string) *config {
+    t.Helper()
+    for i := 0; i+1 < len(env); i += 2 {
+        t.Setenv(env[i], env[i+1])
+    }
+    cfg, err := loadConfig()
+    if err != nil {
+        t.Fatalf("loadConfig: %v", err)
+    }
+    return cfg
+}
+
+// configFile writes contents to a CONFIG_FILE for the test and returns its
+// path.
+func configFile(t *testing.T, contents string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+// configError is the error loadConfig returns under env.
+func configError(t *testing.T, env ...string) error {
+    t.Helper()
+    for i := 0; i+1 < len(env); i += 2 {
+        t.Setenv(env[i], env[i+1])
+    }
+    _, err := loadConfig()
+    return err
+}
+
+func TestLoadConfigUpstreamTimeouts(t *testing.T) {
+    cfg := testConfig(t)
+    if cfg.UpstreamTimeout != 30*time.Second || cfg.MaxUpstreamTimeout != 5*time.Minute {
+        t.Errorf("defaults = %s, %s; want 30s, 5m", cfg.UpstreamTimeout, cfg.MaxUpstreamTimeout)
+    }
+
+    tests := []struct {
+        timeout, max string
+        want         string
+    }{
+        {"0", "5m", "UPSTREAM_TIMEOUT"},
+        {"-1s", "5m", "UPSTREAM_TIMEOUT"},
+        {"soon", "5m", "UPSTREAM_TIMEOUT"},
+        {"2m", "1m", "MAX_UPSTREAM_TIMEOUT"},
+    }
+    for _, tt := range tests {
+        err := configError(t, "UPSTREAM_TIMEOUT", tt.timeout, "MAX_UPSTREAM_TIMEOUT", tt.max)
+        if err == nil || !strings.Contains(err.Error(), tt.want) {
+            t.Errorf("UPSTREAM_TIMEOUT=%s MAX_UPSTREAM_TIMEOUT=%s: error = %v, want one naming %s", tt.timeout, tt.max, err, tt.want)
+        }
+    }
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+    "fmt"
+    "log"
+)
+
+// conflictRule is one combination of /chat settings that can't be honoured
+// together. check returns "" when the request is fine, otherwise the
+// explanation. Rules look at what the request asked for explicitly, in,
+// against the resolved plan, so a server default never makes an otherwise
+// valid request fail.
+type conflictRule struct {
+    // warn rules are reported alongside the reply instead of rejecting
+    // the request: the combination works but probably isn't what was meant.
+    warn  bool
+    check func(in *chatInput, plan *chatPlan) string
+}
+
+// conflictRules are checked in order; the first error wins. Add new
+// combinations here rather than in planChat.
+var conflictRules = []conflictRule{
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if in.Prefill != "" {
+            return "prefill needs chat mode; send it to /v1/chat/completions, since /chat has no assistant turn to seed"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if in.Translate != nil && *in.Translate && in.Stream {
+            return "translate is only supported without stream"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Passthrough && in.HideReasoning {
+            return "hide_reasoning can't be used with passthrough, which returns Ollama's reply unchanged"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Passthrough && in.Format != "" && in.Format != formatRaw {
+            return fmt.Sprintf("format %q can't be used with passthrough, which returns Ollama's reply unchanged", in.Format)
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Passthrough && in.Translate != nil && *in.Translate {
+            return "translate can't be used with passthrough, which returns Ollama's reply unchanged"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Passthrough && in.Trim != nil && *in.Trim {
+            return "trim can't be used with passthrough, which returns Ollama's reply unchanged"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Passthrough && in.ASCII != "" && in.ASCII != asciiOff {
+            return "ascii can't be used with passthrough, which returns Ollama's reply unchanged"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Passthrough && in.Flush != "" {
+            return "flush can't be used with passthrough, which relays Ollama's stream as it arrives"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Spool != "" && !in.Stream {
+            return "spool only applies to streamed replies; set stream to true"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Spool != "" && plan.Passthrough {
+            return "spool can't be used with passthrough, which relays Ollama's stream as it arrives"
+        }
+        return ""
+    }},
+    {check: func(in *chatInput, plan *chatPlan) string {
+        if plan.Spool == spoolFile && plan.Format == formatHTML {
+            return "format html renders the whole reply into the done event, which spool file is meant to avoid"
+        }
+        return ""
+    }},
+    {warn: true, check: func(in *chatInput, plan *chatPlan) string {
+        if in.Flush != "" && !in.Stream {
+            return "flush only changes how a stream is sent, and this request doesn't stream"
+        }
+        return ""
+    }},
+    {warn: true, check: func(in *chatInput, plan *chatPlan) string {
+        if m, _ := plan.Upstream.Options["mirostat"].(float64); m == 0 {
+            return ""
+        }
+        for _, k := range []string{"top_k", "top_p"} {
+            if _, ok := plan.Upstream.Options[k]; ok {
+                return "mirostat replaces top_k and top_p sampling, so they are ignored while it is on"
+            }
+        }
+        return ""
+    }},
+    {warn: true, check: func(in *chatInput, plan *chatPlan) string {
+        t, _ := plan.Upstream.Options["temperature"].(float64)
+        if _, ok := plan.Upstream.Options["seed"]; ok && t > 1 {
+            return fmt.Sprintf("seed makes replies repeatable, but at temperature %g they will still be very random", t)
+        }
+        return ""
+    }},
+}
+
+// checkConflicts runs conflictRules over a planned request. It returns a
+// 400 for the first conflict, or the warnings to pass back to the client.
+func checkConflicts(in *chatInput, plan *chatPlan) ([]string, error) {
+    var warnings []string
+    for _, rule := range conflictRules {
+        msg := rule.check(in, plan)
+        switch {
+        case msg == "":
+        case rule.warn:
+            warnings = append(warnings, msg)
+        default:
+            return nil, badRequest("%s", msg)
+        }
+    }
+    if len(warnings) > 0 {
+        log.Printf("Request warnings: %v", warnings)
+    }
+    return warnings, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+)
+
+func TestPlanChatConflicts(t *testing.T) {
+    cfg := testConfig(t, "SPOOL_MAX_BYTES", "1048576", "SPOOL_DIR", t.TempDir(), "TRANSLATE_MODEL", "qwen2:7b")
+    on, off := true, false
+    tests := []struct {
+        name string
+        in   chatInput
+        msg  string
+    }{
+        {"prefill", chatInput{Prefill: "Sure:"}, "prefill needs chat mode"},
+        {"translate and stream", chatInput{Translate: &on, Stream: true}, "translate is only supported without stream"},
+        {"passthrough and hide_reasoning", chatInput{Passthrough: &on, HideReasoning: true}, "hide_reasoning can't be used with passthrough"},
+        {"passthrough and format", chatInput{Passthrough: &on, Format: formatHTML}, `format "html" can't be used with passthrough`},
+        {"passthrough and translate", chatInput{Passthrough: &on, Translate: &on}, "translate can't be used with passthrough"},
+        {"passthrough and trim", chatInput{Passthrough: &on, Trim: &on}, "trim can't be used with passthrough"},
+        {"passthrough and ascii", chatInput{Passthrough: &on, ASCII: asciiStrip}, "ascii can't be used with passthrough"},
+        {"passthrough and flush", chatInput{Passthrough: &on, Stream: true, Flush: flushNewline}, "flush can't be used with passthrough"},
+        {"spool without stream", chatInput{Spool: spoolFile}, "spool only applies to streamed replies"},
+        {"spool and passthrough", chatInput{Spool: spoolFile, Stream: true, Passthrough: &on}, "spool can't be used with passthrough"},
+        {"spool file and html", chatInput{Spool: spoolFile, Stream: true, Format: formatHTML}, "format html renders the whole reply"},
+    }
+    for _, tt := range tests {
+        _, err := plan(t, cfg, tt.in)
+        if err == nil {
+            t.Errorf("%s: accepted", tt.name)
+            continue
+        }
+        if errorStatus(err) != http.StatusBadRequest || !strings.Contains(err.Error(), tt.msg) {
+            t.Errorf("%s: %d %q, want 400 containing %q", tt.name, errorStatus(err), err, tt.msg)
+        }
+    }
+
+    // The same settings on their own, or passthrough explicitly off, are
+    // fine.
+    for _, in := range []chatInput{
+        {Translate: &on},
+        {Passthrough: &on},
+        {Passthrough: &off, HideReasoning: true, Trim: &on, Format: formatHTML},
+        {Spool: spoolFile, Stream: true},
+    } {
+        if _, err := plan(t, cfg, in); err != nil {
+            t.Errorf("%+v: %v", in, err)
+        }
+    }
+}
+
+func TestPlanChatWarnings(t *testing.T) {
+    cfg := testConfig(t)
+    tests := []struct {
+        name string
+        in   chatInput
+        warn string
+    }{
+        {"flush without stream", chatInput{Flush: flushNewline}, "flush only changes how a stream is sent"},
+        {"mirostat and top_p", chatInput{Options: map[string]interface{}{"mirostat": 2.0, "top_p": 0.9}}, "mirostat replaces top_k and top_p"},
+        {"seed at a high temperature", chatInput{Options: map[string]interface{}{"seed": 42.0, "temperature": 1.5}}, "at temperature 1.5 they will still be very random"},
+    }
+    for _, tt := range tests {
+        p, err := plan(t, cfg, tt.in)
+        if err != nil {
+            t.Errorf("%s: %v", tt.name, err)
+            continue
+        }
+        if len(p.Warnings) != 1 || !strings.Contains(p.Warnings[0], tt.warn) {
+            t.Errorf("%s: warnings = %q, want one containing %q", tt.name, p.Warnings, tt.warn)
+        }
+    }
+
+    for _, in := range []chatInput{
+        {Flush: flushNewline, Stream: true},
+        {Options: map[string]interface{}{"mirostat": 0.0, "top_p": 0.9}},
+        {Options: map[string]interface{}{"seed": 42.0, "temperature": 0.7}},
+    } {
+        if p, err := plan(t, cfg, in); err != nil || len(p.Warnings) != 0 {
+            t.Errorf("%+v: warnings %q, %v; want none", in, p.Warnings, err)
+        }
+    }
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "fmt"
+    "math"
+)
+
+// A request's "creativity", from 0 to 100, is one dial for people who would
+// rather not tune sampling options by hand. It sets each option in the
+// "creativity" map of CONFIG_FILE to a point between that option's values
+// at 0 and at 100. Options the request sets itself win over it.
+
+// defaultCreativity is the mapping when CONFIG_FILE has none: from close to
+// deterministic at 0 to loose at 100.
+var defaultCreativity = map[string][]float64{
+    "temperature": {0.1, 1.2},
+    "top_p":       {0.5, 1.0},
+}
+
+func checkCreativity(mapping map[string][]float64) error {
+    for key, ends := range mapping {
+        if len(ends) != 2 {
+            return fmt.Errorf("creativity: %s needs its values at 0 and 100, such as [0.1, 1.2]", key)
+        }
+        if key == "stop" || key == "keep_alive" {
+            return fmt.Errorf("creativity: %s is not a number to scale", key)
+        }
+    }
+    return nil
+}
+
+// applyCreativity adds the options mapping gives for level to options,
+// leaving alone those already set and those the options policy keeps from
+// clients.
+func applyCreativity(mapping map[string][]float64, policy *optionPolicy, level float64, options map[string]interface{}) map[string]interface{} {
+    merged := make(map[string]interface{}, len(options)+len(mapping))
+    for k, v := range options {
+        merged[k] = v
+    }
+    for key, ends := range mapping {
+        if _, set := options[key]; set || !policy.allowed(key) {
+            continue
+        }
+        v := ends[0] + (ends[1]-ends[0])*level/100
+        merged[key] = math.Round(v*100) / 100
+    }
+    return merged
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "net/http"
+    "reflect"
+    "testing"
+)
+
+func TestApplyCreativity(t *testing.T) {
+    open := &optionPolicy{}
+    tests := []struct {
+        name    string
+        policy  *optionPolicy
+        level   float64
+        options map[string]interface{}
+        want    map[string]interface{}
+    }{
+        {"lowest", open, 0, nil, map[string]interface{}{"temperature": 0.1, "top_p": 0.5}},
+        {"middle", open, 50, nil, map[string]interface{}{"temperature": 0.65, "top_p": 0.75}},
+        {"highest", open, 100, nil, map[string]interface{}{"temperature": 1.2, "top_p": 1.0}},
+        {"rounded", open, 33, nil, map[string]interface{}{"temperature": 0.46, "top_p": 0.67}},
+        {"raw option wins", open, 100, map[string]interface{}{"temperature": 0.3, "seed": 7},
+            map[string]interface{}{"temperature": 0.3, "top_p": 1.0, "seed": 7}},
+        {"denied option left out", &optionPolicy{deny: map[string]bool{"top_p": true}}, 0, nil,
+            map[string]interface{}{"temperature": 0.1}},
+    }
+    for _, tt := range tests {
+        got := applyCreativity(defaultCreativity, tt.policy, tt.level, tt.options)
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: options = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+
+    options := map[string]interface{}{"seed": 7}
+    applyCreativity(defaultCreativity, open, 50, options)
+    if len(options) != 1 {
+        t.Errorf("the request's options were changed: %v", options)
+    }
+}
+
+func TestPlanChatCreativity(t *testing.T) {
+    cfg := testConfig(t)
+    level := 100.0
+    p, err := plan(t, cfg, chatInput{Creativity: &level, Options: map[string]interface{}{"top_p": 0.9}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := map[string]interface{}{"temperature": 1.2, "top_p": 0.9}; !reflect.DeepEqual(p.Upstream.Options, want) {
+        t.Errorf("options = %v, want %v", p.Upstream.Options, want)
+    }
+
+    p, err = plan(t, cfg, chatInput{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(p.Upstream.Options) != 0 {
+        t.Errorf("options without creativity = %v, want none", p.Upstream.Options)
+    }
+
+    for _, bad := range []float64{-1, 101} {
+        level := bad
+        _, err := plan(t, cfg, chatInput{Creativity: &level})
+        wantRequestError(t, err, http.StatusBadRequest, "creativity must be between 0 and 100")
+    }
+
+    cfg = testConfig(t, "CONFIG_FILE", configFile(t, `{"creativity": {"repeat_penalty": [1.3, 1.0]}}`))
+    level = 50
+    p, err = plan(t, cfg, chatInput{Creativity: &level})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := map[string]interface{}{"repeat_penalty": 1.15}; !reflect.DeepEqual(p.Upstream.Options, want) {
+        t.Errorf("custom mapping options = %v, want %v", p.Upstream.Options, want)
+    }
+}
+
+func TestCreativityConfig(t *testing.T) {
+    for _, contents := range []string{
+        `{"creativity": {"temperature": [0.5]}}`,
+        `{"creativity": {"stop": [0, 1]}}`,
+    } {
+        if err := configError(t, "CONFIG_FILE", configFile(t, contents)); err == nil {
+            t.Errorf("creativity mapping %s was accepted", contents)
+        }
+    }
+}
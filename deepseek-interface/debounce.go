@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "sync"
+    "time"
+)
+
+// With DEBOUNCE_WINDOW set, a session that sends the same /chat request
+// again while the first is still running, or within the window after it
+// finished, gets the first one's reply instead of a second generation: a
+// double-clicked Send, or a client retrying too eagerly. Unlike coalescing
+// this applies whatever the temperature, since it is the same caller
+// asking twice, but only within one session.
+
+type debounced struct {
+    done  chan struct{}
+    reply *bufferedReply
+    err   error
+}
+
+type debouncer struct {
+    window time.Duration
+
+    mu     sync.Mutex
+    recent map[string]*debounced
+    // streams in progress; a stream can't be shared, so a duplicate is
+    // refused instead
+    streaming map[string]bool
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+    if window <= 0 {
+        return nil
+    }
+    return &debouncer{window: window, recent: make(map[string]*debounced), streaming: make(map[string]bool)}
+}
+
+// key identifies a session's request, or is "" when debouncing is
+// off. Passthrough replies are relayed as they arrive, so they are left out.
+func (d *debouncer) key(session string, plan *chatPlan, body []byte) string {
+    if d == nil || plan.Passthrough || session == "" {
+        return ""
+    }
+    sum := sha256.Sum256(append([]byte(session+"\n"+plan.GenerateURL+"\n"), body...))
+    return hex.EncodeToString(sum[:])
+}
+
+// do returns fn's reply for key, running fn unless the same key ran within
+// the window or is running now; dup reports a reply from the earlier call.
+// A failed call isn't kept, so trying again after an error is never
+// debounced.
+func (d *debouncer) do(ctx context.Context, key string, fn func() (*bufferedReply, error)) (reply *bufferedReply, dup bool, err error) {
+    d.mu.Lock()
+    if e, ok := d.recent[key]; ok {
+        d.mu.Unlock()
+        select {
+        case <-e.done:
+        case <-ctx.Done():
+            return nil, true, ctx.Err()
+        }
+        if e.err == nil {
+            return e.reply, true, nil
+        }
+        return d.do(ctx, key, fn)
+    }
+    e := &debounced{done: make(chan struct{})}
+    d.recent[key] = e
+    d.mu.Unlock()
+
+    e.reply, e.err = fn()
+    close(e.done)
+    if e.err != nil {
+        d.forget(key, e)
+    } else {
+        time.AfterFunc(d.window, func() { d.forget(key, e) })
+    }
+    return e.reply, false, e.err
+}
+
+func (d *debouncer) forget(key string, e *debounced) {
+    d.mu.Lock()
+    if d.recent[key] == e {
+        delete(d.recent, key)
+    }
+    d.mu.Unlock()
+}
+
+// startStream marks a stream for key as running, or reports false if one
+// already is. done marks it finished.
+func (d *debouncer) startStream(key string) (done func(), ok bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.streaming[key] {
+        return nil, false
+    }
+    d.streaming[key] = true
+    return func() {
+        d.mu.Lock()
+        delete(d.streaming, key)
+        d.mu.Unlock()
+    }, true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestDebouncerWindow(t *testing.T) {
+    d := newDebouncer(50 * time.Millisecond)
+    calls := 0
+    fn := func() (*bufferedReply, error) {
+        calls++
+        return &bufferedReply{status: calls}, nil
+    }
+
+    first, dup, err := d.do(context.Background(), "k", fn)
+    if err != nil || dup {
+        t.Fatalf("first call: dup %v, %v", dup, err)
+    }
+    again, dup, err := d.do(context.Background(), "k", fn)
+    if err != nil || !dup || again != first || calls != 1 {
+        t.Errorf("repeat within the window: dup %v, %d calls, %v; want the first reply", dup, calls, err)
+    }
+    if _, dup, _ := d.do(context.Background(), "other", fn); dup || calls != 2 {
+        t.Errorf("another key was debounced")
+    }
+
+    time.Sleep(100 * time.Millisecond)
+    if _, dup, _ := d.do(context.Background(), "k", fn); dup || calls != 3 {
+        t.Errorf("repeat after the window: dup %v, %d calls; want a new call", dup, calls)
+    }
+}
+
+func TestDebouncerForgetsFailures(t *testing.T) {
+    d := newDebouncer(time.Minute)
+    calls := 0
+    failing := func() (*bufferedReply, error) {
+        calls++
+        return nil, errors.New("boom")
+    }
+    d.do(context.Background(), "k", failing)
+    if _, dup, err := d.do(context.Background(), "k", failing); dup || err == nil || calls != 2 {
+        t.Errorf("retry after a failure: dup %v, %d calls, %v; want it run again", dup, calls, err)
+    }
+}
+
+func TestDebouncerOff(t *testing.T) {
+    d := newDebouncer(0)
+    if d != nil {
+        t.Fatal("DEBOUNCE_WINDOW=0 made a debouncer")
+    }
+    if key := d.key("session", &chatPlan{}, []byte("{}")); key != "" {
+        t.Errorf("key with debouncing off = %q", key)
+    }
+}
+
+func TestChatDebouncesRapidDuplicates(t *testing.T) {
+    var calls atomic.Int32
+    release := make(chan struct{})
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": func(w http.ResponseWriter, r *http.Request) {
+            calls.Add(1)
+            <-release
+            w.Write([]byte(`{"response": "once", "done": true, "done_reason": "stop"}`))
+        },
+    })
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "DEBOUNCE_WINDOW", "2s", "MAX_CONCURRENT", "4", "MAX_CONCURRENT_PER_SESSION", "0")
+    chat := newTestChat(t, cfg)
+    cookie := func(name string) string {
+        return sessionCookie + "=" + signSession(cfg, sessionFor(name))
+    }
+
+    // A double-clicked Send, and the same prompt from someone else.
+    var wg sync.WaitGroup
+    results := make([]*httptest.ResponseRecorder, 3)
+    for i, name := range []string{"a11ce", "a11ce", "b0b"} {
+        wg.Add(1)
+        go func(i int, name string) {
+            defer wg.Done()
+            results[i] = chat.post(`{"prompt": "hi", "options": {"temperature": 0.9}}`, "Cookie", cookie(name))
+        }(i, name)
+    }
+    time.Sleep(100 * time.Millisecond)
+    close(release)
+    wg.Wait()
+
+    if n := calls.Load(); n != 2 {
+        t.Errorf("Ollama generated %d times, want once per session", n)
+    }
+    debounced := 0
+    for i, w := range results {
+        if w.Code != http.StatusOK || decode(t, w)["response"] != "once" {
+            t.Errorf("request %d = %d %s", i, w.Code, w.Body.String())
+        }
+        if w.Header().Get("X-Debounced") == "true" {
+            debounced++
+        }
+    }
+    if debounced != 1 {
+        t.Errorf("%d replies marked X-Debounced, want 1", debounced)
+    }
+
+    // Still within the window after it finished.
+    w := chat.post(`{"prompt": "hi", "options": {"temperature": 0.9}}`, "Cookie", cookie("a11ce"))
+    if w.Header().Get("X-Debounced") != "true" || calls.Load() != 2 {
+        t.Errorf("repeat after the reply: X-Debounced %q, %d calls", w.Header().Get("X-Debounced"), calls.Load())
+    }
+}
+
+func TestChatDebounceRefusesDuplicateStream(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{"/api/generate": stalledStream})
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "DEBOUNCE_WINDOW", "2s", "MAX_CONCURRENT", "4", "MAX_CONCURRENT_PER_SESSION", "0")
+    chat := newTestChat(t, cfg)
+    cookie := sessionCookie + "=" + signSession(cfg, sessionFor("a11ce"))
+    token := "debounce-0123456789abcdef"
+
+    done := make(chan struct{})
+    go func() {
+        chat.post(`{"prompt": "hi", "stream": true}`, "Cookie", cookie, abortTokenHeader, token)
+        close(done)
+    }()
+    deadline := time.Now().Add(2 * time.Second)
+    for len(ollama.requests("/api/generate")) == 0 {
+        if time.Now().After(deadline) {
+            t.Fatal("stream never reached Ollama")
+        }
+        time.Sleep(time.Millisecond)
+    }
+
+    if w := chat.post(`{"prompt": "hi", "stream": true}`, "Cookie", cookie); w.Code != http.StatusConflict {
+        t.Errorf("duplicate stream = %d, want 409", w.Code)
+    }
+    postAbort(cfg, chat.registry, token)
+    <-done
+}
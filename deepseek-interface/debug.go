@@ -0,0 +1,168 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+)
+
+// redactedHeaders are never echoed back, even to a debugging client, nor
+// written to the debug log.
+var redactedHeaders = []string{"Authorization", "Cookie"}
+
+// redactHeaders returns a copy of h with redactedHeaders masked.
+func redactHeaders(h http.Header) http.Header {
+    headers := h.Clone()
+    for _, name := range redactedHeaders {
+        if headers.Get(name) != "" {
+            headers.Set(name, "[redacted]")
+        }
+    }
+    return headers
+}
+
+// echoHandler returns what the server made of a /chat request body without
+// calling Ollama: the decoded body, the headers it saw and the model,
+// options and limits the request resolved to. Only registered when
+// DEBUG_ECHO is set.
+func echoHandler(cfg *config) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+
+        result := map[string]interface{}{
+            "headers": redactHeaders(r.Header),
+            "limits": map[string]interface{}{
+                "max_upstream_timeout":       cfg.MaxUpstreamTimeout.String(),
+                "max_concurrent":             cfg.MaxConcurrent,
+                "max_concurrent_per_session": cfg.MaxConcurrentPerSession,
+                "max_concurrent_embeddings":  cfg.MaxConcurrentEmbeddings,
+                "max_sse_connections":        cfg.MaxSSEConnections,
+                "max_prompt_length":          cfg.MaxPromptLength,
+            },
+        }
+
+        var in chatInput
+        if err := checkUTF8(r, cfg.InvalidUTF8); err != nil {
+            result["error"] = err.Error()
+        } else if err := decodeBody(r, &in, "a prompt field"); err != nil {
+            result["error"] = err.Error()
+        } else if plan, err := planChat(cfg, r, &in); err != nil {
+            result["parsed"] = in
+            result["error"] = err.Error()
+            result["error_status"] = errorStatus(err)
+        } else {
+            result["parsed"] = in
+            result["resolved"] = map[string]interface{}{
+                "model":    plan.Upstream.Model,
+                "system":   plan.Upstream.System,
+                "options":  plan.Upstream.Options,
+                "logprobs": plan.Upstream.Logprobs,
+                "priority": plan.Priority.String(),
+                "timeout":  plan.Timeout.String(),
+                "format":   plan.Format,
+                "flush":    plan.Flush,
+                "think":    plan.Upstream.Think,
+                "upstream": plan.GenerateURL,
+                "metadata": plan.Metadata,
+
+                "keep_alive":       plan.Upstream.KeepAlive,
+                "passthrough":      plan.Passthrough,
+                "translate":        plan.Translate,
+                "trim":             plan.Trim,
+                "repeat_max_lines": plan.RepeatMaxLines,
+                "role":             plan.Role,
+                "prompt_truncated": plan.PromptTruncated,
+                "warnings":         plan.Warnings,
+            }
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+    }
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+    max     int
+    buf     bytes.Buffer
+    dropped int
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+    keep := c.max - c.buf.Len()
+    if keep > len(p) {
+        keep = len(p)
+    }
+    if keep > 0 {
+        c.buf.Write(p[:keep])
+    }
+    c.dropped += len(p) - keep
+    return len(p), nil
+}
+
+func (c *cappedBuffer) String() string {
+    if c.dropped == 0 {
+        return strconv.Quote(c.buf.String())
+    }
+    return strconv.Quote(c.buf.String()) + " (" + strconv.Itoa(c.dropped) + " more bytes)"
+}
+
+// bodyLogWriter copies what a handler writes into a cappedBuffer.
+type bodyLogWriter struct {
+    *statusWriter
+    body *cappedBuffer
+}
+
+func (b *bodyLogWriter) Write(p []byte) (int, error) {
+    b.body.Write(p)
+    return b.statusWriter.Write(p)
+}
+
+// redactSlack is how far past DEBUG_BODY_MAX_BYTES a body is kept until it
+// has been redacted, so a secret that straddles the cut is still whole
+// enough for promptSecrets to find.
+const redactSlack = 256
+
+// redacted masks what promptSecrets finds in the captured text, as for a
+// slow prompt, and cuts the result to max.
+func (c *cappedBuffer) redacted(max int) *cappedBuffer {
+    out := &cappedBuffer{max: max}
+    out.Write([]byte(redactPrompt(c.buf.String())))
+    out.dropped += c.dropped
+    return out
+}
+
+// logBodies logs each request's headers and the request and response
+// bodies, each cut to DEBUG_BODY_MAX_BYTES, once next is done. Headers are
+// redacted as on /echo and bodies with the slow-prompt rules, so keys and
+// addresses in prompts and replies stay out of the log. It wraps only the
+// OpenAI-compatible endpoints, to compare what clients send and get
+// against the OpenAI spec, and returns next untouched unless
+// DEBUG_V1_BODIES is set. A stream is logged whole when it ends, as far as
+// the limit goes.
+func logBodies(cfg *config, next http.HandlerFunc) http.HandlerFunc {
+    if !cfg.DebugV1Bodies {
+        return next
+    }
+    return func(w http.ResponseWriter, r *http.Request) {
+        req := &cappedBuffer{max: cfg.DebugBodyMaxBytes + redactSlack}
+        r.Body = struct {
+            io.Reader
+            io.Closer
+        }{io.TeeReader(r.Body, req), r.Body}
+        resp := &bodyLogWriter{&statusWriter{ResponseWriter: w, status: http.StatusOK}, &cappedBuffer{max: cfg.DebugBodyMaxBytes + redactSlack}}
+        next(resp, r)
+        headers, _ := json.Marshal(redactHeaders(r.Header))
+        log.Printf("%s %s headers=%s body=%s -> %d body=%s", r.Method, r.URL.Path, headers,
+            req.redacted(cfg.DebugBodyMaxBytes), resp.status, resp.body.redacted(cfg.DebugBodyMaxBytes))
+    }
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestLogBodiesRedacts(t *testing.T) {
+    key := "sk_" + strings.Repeat("a1B2", 10)
+    prompt := `{"messages": [{"role": "user", "content": "I am ann@example.com, password: hunter2, key ` + key + `"}]}`
+    echo := func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        w.Write(body)
+    }
+
+    for _, max := range []string{"4096", "100"} {
+        logged := captureLog(t)
+        cfg := testConfig(t, "DEBUG_V1_BODIES", "true", "DEBUG_BODY_MAX_BYTES", max)
+        r := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(prompt))
+        r.Header.Set("Authorization", "Bearer "+key)
+        w := httptest.NewRecorder()
+        logBodies(cfg, echo)(w, r)
+
+        if w.Body.String() != prompt {
+            t.Errorf("max %s: the client got %q, want the body unchanged", max, w.Body.String())
+        }
+        line := logged.String()
+        if !strings.Contains(line, "POST /v1/chat/completions") {
+            t.Fatalf("max %s: nothing logged: %q", max, line)
+        }
+        for _, secret := range []string{"ann@example.com", "hunter2", key, key[:10]} {
+            if strings.Contains(line, secret) {
+                t.Errorf("max %s: %q logged in clear: %s", max, secret, line)
+            }
+        }
+        if max == "4096" && strings.Count(line, "[email]") != 2 {
+            t.Errorf("max %s: want the address masked in both bodies: %s", max, line)
+        }
+    }
+}
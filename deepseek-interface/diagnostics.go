@@ -0,0 +1,194 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// diagnosticTimeout bounds each /diagnostics check. The checks run side by
+// side, so it is also roughly how long the whole report can take.
+const diagnosticTimeout = 10 * time.Second
+
+// Check outcomes in the /diagnostics report.
+const (
+    checkPass = "pass"
+    checkFail = "fail"
+    checkSkip = "skip"
+)
+
+type diagnosticCheck struct {
+    Name       string `json:"name"`
+    Status     string `json:"status"`
+    DurationMs int64  `json:"duration_ms"`
+    Detail     string `json:"detail,omitempty"`
+    Error      string `json:"error,omitempty"`
+}
+
+type diagnosticReport struct {
+    Status     string            `json:"status"`
+    Version    string            `json:"version"`
+    DurationMs int64             `json:"duration_ms"`
+    Checks     []diagnosticCheck `json:"checks"`
+}
+
+// errSkipped marks a check that doesn't apply to this configuration; its
+// message is reported as the detail.
+type errSkipped string
+
+func (e errSkipped) Error() string { return string(e) }
+
+// diagnostic is one self-test; run returns a short detail on success.
+type diagnostic struct {
+    name string
+    run  func(ctx context.Context) (string, error)
+}
+
+// diagnostics are the self-tests, in report order.
+func diagnostics(cfg *config) []diagnostic {
+    return []diagnostic{
+        {"ollama", func(ctx context.Context) (string, error) {
+            if err := pingOllama(ctx, cfg); err != nil {
+                return "", err
+            }
+            return "API reachable", nil
+        }},
+        {"models", func(ctx context.Context) (string, error) {
+            // A private cache, so this always asks Ollama and leaves the
+            // shared one and its counters alone.
+            models, err := newModelCache(cfg).list(ctx)
+            if err != nil {
+                return "", err
+            }
+            for _, m := range models {
+                if m.Name == cfg.defaultModel() {
+                    return fmt.Sprintf("%d models installed", len(models)), nil
+                }
+            }
+            return "", fmt.Errorf("default model %s is not among the %d installed models", cfg.defaultModel(), len(models))
+        }},
+        {"generate", func(ctx context.Context) (string, error) {
+            if err := generateOneToken(ctx, cfg, cfg.defaultModel()); err != nil {
+                if errors.Is(err, context.DeadlineExceeded) {
+                    return "", fmt.Errorf("no token within %s; the model may still be loading", diagnosticTimeout)
+                }
+                return "", err
+            }
+            return cfg.defaultModel(), nil
+        }},
+        {"config", func(ctx context.Context) (string, error) {
+            // Reloading catches a CONFIG_FILE that has been edited into
+            // something the next restart would refuse.
+            if _, err := loadConfig(); err != nil {
+                return "", err
+            }
+            return "environment and CONFIG_FILE are valid", nil
+        }},
+        {"storage", func(ctx context.Context) (string, error) {
+            var dirs []string
+            if path := os.Getenv("SNIPPETS_FILE"); path != "" {
+                dirs = append(dirs, filepath.Dir(path))
+            }
+            if cfg.AuditLog != "" && cfg.AuditLog != "syslog" {
+                dirs = append(dirs, filepath.Dir(cfg.AuditLog))
+            }
+            if len(dirs) == 0 {
+                return "", errSkipped("nothing is persisted to disk")
+            }
+            for _, dir := range dirs {
+                if err := probeWritable(dir); err != nil {
+                    return "", err
+                }
+            }
+            return strings.Join(dirs, ", ") + " writable", nil
+        }},
+    }
+}
+
+// probeWritable creates and removes a file in dir.
+func probeWritable(dir string) error {
+    f, err := os.CreateTemp(dir, ".diagnostics-*")
+    if err != nil {
+        return err
+    }
+    f.Close()
+    return os.Remove(f.Name())
+}
+
+// runDiagnostics runs every check concurrently, each under its own
+// diagnosticTimeout. A check that ignores its context still has its result
+// dropped when the time is up, so the report is never held back.
+func runDiagnostics(ctx context.Context, cfg *config) diagnosticReport {
+    start := time.Now()
+    checks := diagnostics(cfg)
+    report := diagnosticReport{Status: checkPass, Version: version, Checks: make([]diagnosticCheck, len(checks))}
+    var wg sync.WaitGroup
+    for i, c := range checks {
+        wg.Add(1)
+        go func(i int, c diagnostic) {
+            defer wg.Done()
+            ctx, cancel := context.WithTimeout(ctx, diagnosticTimeout)
+            defer cancel()
+            began := time.Now()
+            type result struct {
+                detail string
+                err    error
+            }
+            done := make(chan result, 1)
+            go func() {
+                detail, err := c.run(ctx)
+                done <- result{detail, err}
+            }()
+            var res result
+            select {
+            case res = <-done:
+            case <-ctx.Done():
+                res.err = fmt.Errorf("timed out after %s", diagnosticTimeout)
+            }
+
+            check := diagnosticCheck{Name: c.name, Status: checkPass, Detail: res.detail, DurationMs: time.Since(began).Milliseconds()}
+            var skipped errSkipped
+            switch {
+            case errors.As(res.err, &skipped):
+                check.Status, check.Detail = checkSkip, string(skipped)
+            case res.err != nil:
+                check.Status, check.Error = checkFail, res.err.Error()
+            }
+            report.Checks[i] = check
+        }(i, c)
+    }
+    wg.Wait()
+
+    for _, c := range report.Checks {
+        if c.Status == checkFail {
+            report.Status = checkFail
+        }
+    }
+    report.DurationMs = time.Since(start).Milliseconds()
+    return report
+}
+
+// diagnosticsHandler serves the admin-only self-test report. It is always
+// 200 when the checks ran; the overall status is in the body.
+func diagnosticsHandler(cfg *config) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !isAdmin(r, cfg.AdminToken) {
+            jsonError(w, "diagnostics require a valid admin token", http.StatusForbidden)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Cache-Control", "no-store")
+        json.NewEncoder(w).Encode(runDiagnostics(r.Context(), cfg))
+    }
+}
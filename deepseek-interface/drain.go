@@ -0,0 +1,67 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// drainRetryAfter is what we tell clients turned away during a drain; by
+// then the replacement pod should be taking traffic.
+const drainRetryAfter = 5 * time.Second
+
+// drainer tracks in-flight requests so a shutdown can wait for them, and
+// flips readiness off once the pod has been asked to stop.
+type drainer struct {
+    draining atomic.Bool
+    active   atomic.Int64
+}
+
+// track counts requests while they run and turns new ones away with 503
+// once draining has started. Health probes are always let through so the
+// kubelet sees the not-ready state.
+func (d *drainer) track(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/healthz" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        if d.draining.Load() {
+            w.Header().Set("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+            jsonError(w, "server is shutting down", http.StatusServiceUnavailable)
+            return
+        }
+        d.active.Add(1)
+        defer d.active.Add(-1)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// drain stops new work, waits up to timeout for active requests to finish
+// and then shuts srv down.
+func (d *drainer) drain(srv *http.Server, timeout time.Duration) {
+    d.draining.Store(true)
+    log.Printf("Draining: %d active request(s)", d.active.Load())
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    ticker := time.NewTicker(250 * time.Millisecond)
+    defer ticker.Stop()
+    for d.active.Load() > 0 {
+        select {
+        case <-ctx.Done():
+            log.Printf("Drain timeout reached with %d active request(s)", d.active.Load())
+            srv.Close()
+            return
+        case <-ticker.C:
+        }
+    }
+
+    if err := srv.Shutdown(ctx); err != nil {
+        log.Printf("Shutdown: %v", err)
+    }
+}
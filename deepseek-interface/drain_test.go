@@ -0,0 +1,117 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// drainServer serves /slow, which holds each request until release is
+// closed, and the readiness probe, all behind d.track.
+func drainServer(d *drainer, started chan<- struct{}, release <-chan struct{}) *httptest.Server {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+        started <- struct{}{}
+        <-release
+        w.Write([]byte("done"))
+    })
+    mux.HandleFunc("/healthz", healthHandler(d, nil, nil, &atomic.Bool{}))
+    return httptest.NewServer(d.track(mux))
+}
+
+func TestDrainWaitsForInFlightRequests(t *testing.T) {
+    d := &drainer{}
+    started, release := make(chan struct{}), make(chan struct{})
+    ts := drainServer(d, started, release)
+    defer ts.Close()
+
+    inFlight := make(chan int, 1)
+    go func() {
+        resp, err := http.Get(ts.URL + "/slow")
+        if err != nil {
+            inFlight <- 0
+            return
+        }
+        resp.Body.Close()
+        inFlight <- resp.StatusCode
+    }()
+    <-started
+    if n := d.active.Load(); n != 1 {
+        t.Fatalf("active = %d before the drain, want 1", n)
+    }
+
+    drained := make(chan struct{})
+    go func() {
+        d.drain(ts.Config, 10*time.Second)
+        close(drained)
+    }()
+    for !d.draining.Load() {
+        time.Sleep(time.Millisecond)
+    }
+
+    resp, err := http.Get(ts.URL + "/healthz")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+        t.Errorf("readiness while draining = %d, Retry-After %q; want 503, 5", resp.StatusCode, resp.Header.Get("Retry-After"))
+    }
+
+    resp, err = http.Get(ts.URL + "/slow")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+        t.Errorf("new request while draining = %d, Retry-After %q; want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+    }
+
+    select {
+    case <-drained:
+        t.Fatal("drain returned while a request was still in flight")
+    case <-time.After(300 * time.Millisecond):
+    }
+
+    close(release)
+    if code := <-inFlight; code != http.StatusOK {
+        t.Errorf("in-flight request finished with %d, want 200", code)
+    }
+    // Shutdown waits up to 5s on a connection the client dialed and never
+    // used, so don't leave it one.
+    http.DefaultClient.CloseIdleConnections()
+    select {
+    case <-drained:
+    case <-time.After(5 * time.Second):
+        t.Fatal("drain didn't return once the in-flight request finished")
+    }
+}
+
+func TestDrainGivesUpAfterTimeout(t *testing.T) {
+    d := &drainer{}
+    started, release := make(chan struct{}), make(chan struct{})
+    ts := drainServer(d, started, release)
+    defer ts.Close()
+    defer close(release)
+
+    inFlight := make(chan error, 1)
+    go func() {
+        resp, err := http.Get(ts.URL + "/slow")
+        if err == nil {
+            resp.Body.Close()
+        }
+        inFlight <- err
+    }()
+    <-started
+
+    start := time.Now()
+    d.drain(ts.Config, 300*time.Millisecond)
+    if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 5*time.Second {
+        t.Errorf("drain took %v with a stuck request, want about the 300ms timeout", elapsed)
+    }
+    if err := <-inFlight; err == nil {
+        t.Error("stuck request wasn't cut off when the drain timed out")
+    }
+}
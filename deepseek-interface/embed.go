@@ -0,0 +1,68 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "log"
+    "net/http"
+)
+
+// embedInput is the body accepted by /embeddings. Input is a string or a
+// list of strings, passed to Ollama's /api/embed unchanged.
+type embedInput struct {
+    Model string          `json:"model"`
+    Input json.RawMessage `json:"input"`
+}
+
+// embedHandler proxies embedding requests to Ollama. Embeddings have their
+// own admission queue, separate from chat, so a batch indexing job and
+// interactive chats each keep their share of the GPU.
+func embedHandler(cfg *config, adm *admission) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+
+        var in embedInput
+        if err := decodeBody(r, &in, "an input field"); err != nil {
+            jsonError(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if len(in.Input) == 0 {
+            jsonError(w, "input is required", http.StatusBadRequest)
+            return
+        }
+        if in.Model == "" {
+            in.Model = cfg.EmbeddingModel
+        }
+        embedURL, err := cfg.modelAPI(in.Model, "/api/embed")
+        if err != nil {
+            jsonError(w, err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+
+        if err := adm.acquire(r.Context(), priorityNormal, len(in.Input)); err != nil {
+            log.Printf("Client gave up while queued for embeddings: %v", err)
+            return
+        }
+        defer adm.release()
+
+        body, _ := json.Marshal(in)
+        client := &http.Client{Timeout: cfg.UpstreamTimeout}
+        resp, err := client.Post(embedURL, "application/json", bytes.NewReader(body))
+        if err != nil {
+            jsonError(w, "cannot connect to Ollama: "+err.Error(), http.StatusBadGateway)
+            return
+        }
+        defer resp.Body.Close()
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(resp.StatusCode)
+        io.Copy(w, resp.Body)
+    }
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "unicode"
+)
+
+// estimateTokens guesses how many tokens s is without the model's
+// tokenizer, which Ollama doesn't expose. Words are counted at about four
+// characters a token, punctuation and symbols at one each, and letters
+// from scripts written without spaces, such as Chinese, at one each. For
+// English prose and code it tends to land within a fifth of the real count.
+func estimateTokens(s string) int {
+    tokens, word := 0, 0
+    endWord := func() {
+        tokens += (word + 3) / 4
+        word = 0
+    }
+    for _, r := range s {
+        switch {
+        case unicode.IsSpace(r):
+            endWord()
+        case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Thai):
+            endWord()
+            tokens++
+        case unicode.IsLetter(r) || unicode.IsDigit(r):
+            word++
+        default:
+            endWord()
+            tokens++
+        }
+    }
+    endWord()
+    return tokens
+}
+
+// promptEstimate is the reply from /estimate.
+type promptEstimate struct {
+    Model string `json:"model"`
+    // Tokens is the estimate for the system prompt and prompt together;
+    // MaxTokens is num_predict, the room kept for the reply.
+    Tokens    int `json:"tokens"`
+    MaxTokens int `json:"max_tokens,omitempty"`
+    // ContextLength is the window the request gets: options.num_ctx when
+    // set, otherwise the model's own context length. Fits and Remaining are
+    // left out when neither is known.
+    ContextLength   int               `json:"context_length,omitempty"`
+    Fits            *bool             `json:"fits,omitempty"`
+    Remaining       *int              `json:"remaining,omitempty"`
+    PromptTruncated *promptTruncation `json:"prompt_truncated,omitempty"`
+    Warnings        []string          `json:"warnings,omitempty"`
+}
+
+// estimateHandler takes a /chat body and says how many tokens the request
+// /chat would send comes to, and whether it fits the model's context. The
+// request is assembled just as /chat would, with the system prompt,
+// snippets, retrieved documents and the prompt length limit applied, and
+// rejected for the same reasons, but nothing is generated.
+func estimateHandler(cfg *config, cache *modelCache) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+        if err := checkUTF8(r, cfg.InvalidUTF8); err != nil {
+            jsonError(w, err.Error(), errorStatus(err))
+            return
+        }
+        var in chatInput
+        if err := decodeBody(r, &in, "a prompt field"); err != nil {
+            jsonError(w, err.Error(), errorStatus(err))
+            return
+        }
+        retrieveFor(cfg, r, &in)
+        plan, err := planChat(cfg, r, &in)
+        if err != nil {
+            jsonError(w, err.Error(), errorStatus(err))
+            return
+        }
+
+        up := plan.Upstream
+        est := promptEstimate{
+            Model:           up.Model,
+            Tokens:          estimateTokens(up.System) + estimateTokens(up.Prompt),
+            MaxTokens:       intOption(up.Options, "num_predict"),
+            ContextLength:   intOption(up.Options, "num_ctx"),
+            PromptTruncated: plan.PromptTruncated,
+            Warnings:        plan.Warnings,
+        }
+        if est.ContextLength == 0 {
+            est.ContextLength = modelContextLength(r, cache, up.Model)
+        }
+        if est.ContextLength > 0 {
+            remaining := est.ContextLength - est.Tokens - est.MaxTokens
+            fits := remaining >= 0
+            est.Fits, est.Remaining = &fits, &remaining
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(est)
+    }
+}
+
+// modelContextLength is model's context length from the model list, or 0
+// when it isn't installed or Ollama can't be asked.
+func modelContextLength(r *http.Request, cache *modelCache, model string) int {
+    models, err := cache.list(r.Context())
+    if err != nil {
+        log.Printf("Cannot look up the context length of %s: %v", model, err)
+        return 0
+    }
+    for _, m := range models {
+        if withTag(m.Name) == withTag(model) {
+            return m.ContextLength
+        }
+    }
+    return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+    tests := []struct {
+        in   string
+        want int
+    }{
+        {"", 0},
+        {"hi", 1},
+        {"hello world", 4},
+        {"internationalization", 5},
+        {"x := f(a, b)", 9},
+        {"日本語", 3},
+        {"Go 日本", 3},
+        {"  \n\t ", 0},
+    }
+    for _, tt := range tests {
+        if got := estimateTokens(tt.in); got != tt.want {
+            t.Errorf("estimateTokens(%q) = %d, want %d", tt.in, got, tt.want)
+        }
+    }
+}
+
+// estimateOllama has llama3:8b installed with a 100 token context.
+func estimateOllama(t *testing.T) *fakeOllama {
+    return newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/tags": func(w http.ResponseWriter, r *http.Request) {
+            w.Write([]byte(`{"models": [{"name": "llama3:8b"}]}`))
+        },
+        "/api/show": func(w http.ResponseWriter, r *http.Request) {
+            w.Write([]byte(`{"model_info": {"general.architecture": "llama", "llama.context_length": 100}}`))
+        },
+    })
+}
+
+func TestEstimateHandler(t *testing.T) {
+    ollama := estimateOllama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "SYSTEM_PROMPT", "Be brief.")
+    estimate := func(body string) (*httptest.ResponseRecorder, promptEstimate) {
+        r := httptest.NewRequest("POST", "/estimate", strings.NewReader(body))
+        r.RemoteAddr = "192.0.2.1:1234"
+        r.Header.Set("Content-Type", "application/json")
+        w := httptest.NewRecorder()
+        estimateHandler(cfg, newModelCache(cfg))(w, r)
+        var est promptEstimate
+        json.Unmarshal(w.Body.Bytes(), &est)
+        return w, est
+    }
+
+    // "Be brief." is 4 tokens and the prompt 4.
+    w, est := estimate(`{"model": "llama3:8b", "prompt": "hello world", "options": {"num_predict": 50}}`)
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body.String())
+    }
+    if est.Model != "llama3:8b" || est.Tokens != 8 || est.MaxTokens != 50 || est.ContextLength != 100 {
+        t.Errorf("estimate = %+v", est)
+    }
+    if est.Fits == nil || !*est.Fits || *est.Remaining != 42 {
+        t.Errorf("fits = %v, remaining = %v; want it to fit with 42 left", est.Fits, est.Remaining)
+    }
+
+    _, est = estimate(`{"model": "llama3:8b", "prompt": "` + strings.Repeat("word ", 60) + `", "options": {"num_predict": 50}}`)
+    if est.Fits == nil || *est.Fits || *est.Remaining != -14 {
+        t.Errorf("long prompt: fits = %v, remaining = %v; want 14 over", est.Fits, est.Remaining)
+    }
+
+    // num_ctx is the window the request would get.
+    _, est = estimate(`{"model": "llama3:8b", "prompt": "hello world", "options": {"num_ctx": 7}}`)
+    if est.ContextLength != 7 || est.Fits == nil || *est.Fits {
+        t.Errorf("with num_ctx 7: %+v", est)
+    }
+
+    // A model that isn't installed has no known context.
+    _, est = estimate(`{"model": "other:7b", "prompt": "hello world"}`)
+    if est.ContextLength != 0 || est.Fits != nil || est.Remaining != nil {
+        t.Errorf("unknown model: %+v, want no fit given", est)
+    }
+
+    // Rejected just as /chat would reject it, and nothing is generated.
+    if w, _ := estimate(`{"prompt": "hi", "creativity": 101}`); w.Code != http.StatusBadRequest {
+        t.Errorf("invalid request = %d, want 400", w.Code)
+    }
+    if n := len(ollama.requests("/api/generate")); n != 0 {
+        t.Errorf("%d generate calls, want none", n)
+    }
+}
+
+func TestEstimateHandlerPromptLimit(t *testing.T) {
+    ollama := estimateOllama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "MAX_PROMPT_LENGTH", "8", "PROMPT_OVERFLOW", overflowKeepEnd)
+    r := httptest.NewRequest("POST", "/estimate", strings.NewReader(`{"model": "llama3:8b", "prompt": "lots of context, then the question"}`))
+    r.Header.Set("Content-Type", "application/json")
+    w := httptest.NewRecorder()
+    estimateHandler(cfg, newModelCache(cfg))(w, r)
+    var est promptEstimate
+    json.Unmarshal(w.Body.Bytes(), &est)
+    if est.Tokens != estimateTokens("question") || est.PromptTruncated == nil || est.PromptTruncated.Kept != "end" {
+        t.Errorf("estimate = %+v, want the truncated prompt counted", est)
+    }
+}
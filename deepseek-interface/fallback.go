@@ -0,0 +1,137 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+)
+
+// A model can name fallbacks in CONFIG_FILE. When it is unreachable,
+// overloaded or failing, /chat tries them in order before giving up, and
+// the reply says which model answered.
+
+// fallbackFailure is one model in the chain that didn't answer.
+type fallbackFailure struct {
+    Model string `json:"model"`
+    Error string `json:"error"`
+}
+
+// fallbackNote is reported on the reply when a fallback answered.
+type fallbackNote struct {
+    Requested string            `json:"requested"`
+    Model     string            `json:"model"`
+    Failed    []fallbackFailure `json:"failed"`
+}
+
+// fallbackChain is model followed by its configured fallbacks, at most
+// FallbackMaxAttempts long.
+func (c *config) fallbackChain(model string) []string {
+    chain := append([]string{model}, c.Models[model].Fallbacks...)
+    if len(chain) > c.FallbackMaxAttempts {
+        chain = chain[:c.FallbackMaxAttempts]
+    }
+    return chain
+}
+
+// checkFallbacks rejects chains that name the model itself or repeat an
+// entry.
+func checkFallbacks(models map[string]modelConfig) error {
+    for name, mc := range models {
+        seen := map[string]bool{name: true}
+        for _, fb := range mc.Fallbacks {
+            if seen[fb] {
+                return fmt.Errorf("models.%s.fallbacks: %s is listed twice or is the model itself", name, fb)
+            }
+            seen[fb] = true
+        }
+    }
+    return nil
+}
+
+// retryableFailure describes why an attempt is worth retrying on the next
+// model, or returns "" when the result should go to the client as it is.
+// Rate limits, server errors and a missing model may well be fixed by
+// another model; a 400 would fail the same way on every one.
+func retryableFailure(resp *http.Response, err error) string {
+    switch {
+    case err != nil:
+        return err.Error()
+    case resp.StatusCode == http.StatusTooManyRequests:
+        return "rate limited"
+    case resp.StatusCode == http.StatusNotFound:
+        return "model not found"
+    case resp.StatusCode >= 500:
+        return fmt.Sprintf("status %d", resp.StatusCode)
+    }
+    return ""
+}
+
+// fetchFunc sends one planned request upstream; shared is as for
+// flightGroup.do.
+type fetchFunc func(plan *chatPlan, body []byte) (resp *http.Response, shared bool, err error)
+
+// runFallbackChain sends plan and, while attempts fail in a retryable way,
+// the same request planned against each fallback in turn. Fallbacks the
+// caller may not use (its role's model list) are left out, and a model
+// already flagged as degraded is skipped without a call unless it is the
+// last one left. It returns the plan that produced the final result, with
+// Fallback set when a model other than the requested one answered. The
+// final result is returned as is, failure or not, for the handler to
+// report; only earlier failures are recorded against model health here.
+func runFallbackChain(cfg *config, r *http.Request, in *chatInput, plan *chatPlan, health *modelHealth, fetch fetchFunc) (*chatPlan, *http.Response, bool, error) {
+    plans := []*chatPlan{plan}
+    for _, model := range cfg.fallbackChain(plan.Upstream.Model)[1:] {
+        alt := *in
+        alt.Model = model
+        p, err := planChat(cfg, r, &alt)
+        if err != nil {
+            log.Printf("Leaving fallback %s out for this request: %v", model, err)
+            continue
+        }
+        plans = append(plans, p)
+    }
+
+    var failed []fallbackFailure
+    answered := func(i int, p *chatPlan) *chatPlan {
+        if i > 0 {
+            p.Fallback = &fallbackNote{Requested: plan.Upstream.Model, Model: p.Upstream.Model, Failed: failed}
+            log.Printf("Fallback %s answered for %s", p.Upstream.Model, plan.Upstream.Model)
+        }
+        return p
+    }
+    for i, p := range plans[:len(plans)-1] {
+        model := p.Upstream.Model
+        if health.degraded(model) != nil {
+            failed = append(failed, fallbackFailure{Model: model, Error: "degraded"})
+            continue
+        }
+        body, _ := json.Marshal(p.Upstream)
+        resp, shared, err := fetch(p, body)
+        if errors.Is(err, errUpstreamAttempts) {
+            // The model didn't fail; we gave up before asking it.
+            return p, resp, shared, err
+        }
+        reason := retryableFailure(resp, err)
+        if reason == "" || r.Context().Err() != nil {
+            return answered(i, p), resp, shared, err
+        }
+        if !shared {
+            health.failure(model, reason)
+        }
+        if resp != nil {
+            resp.Body.Close()
+        }
+        failed = append(failed, fallbackFailure{Model: model, Error: reason})
+        log.Printf("Model %s failed (%s), trying fallback %s", model, reason, plans[i+1].Upstream.Model)
+    }
+    i := len(plans) - 1
+    body, _ := json.Marshal(plans[i].Upstream)
+    resp, shared, err := fetch(plans[i], body)
+    if i > 0 && retryableFailure(resp, err) != "" {
+        log.Printf("Every model in the fallback chain for %s failed", plan.Upstream.Model)
+        return plans[i], resp, shared, err
+    }
+    return answered(i, plans[i]), resp, shared, err
+}
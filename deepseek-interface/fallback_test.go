@@ -0,0 +1,94 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "testing"
+)
+
+// failingModels answers /api/generate with status for the models it names
+// and with a reply from the model for the rest.
+func failingModels(status map[string]int) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var req ChatRequest
+        json.NewDecoder(r.Body).Decode(&req)
+        if code, ok := status[req.Model]; ok {
+            http.Error(w, `{"error": "failed"}`, code)
+            return
+        }
+        json.NewEncoder(w).Encode(ChatResponse{Response: "from " + req.Model, Done: true, DoneReason: "stop"})
+    }
+}
+
+func TestChatFallbackChain(t *testing.T) {
+    file := configFile(t, `{"models": {"a:7b": {"fallbacks": ["b:7b", "c:7b"]}}}`)
+    tests := []struct {
+        name     string
+        status   map[string]int
+        attempts string
+        code     int
+        calls    []string
+        answered string
+    }{
+        {"first answers", nil, "3", 200, []string{"a:7b"}, ""},
+        {"second answers", map[string]int{"a:7b": 500}, "3", 200, []string{"a:7b", "b:7b"}, "b:7b"},
+        {"last answers", map[string]int{"a:7b": 500, "b:7b": 404}, "3", 200, []string{"a:7b", "b:7b", "c:7b"}, "c:7b"},
+        {"all fail", map[string]int{"a:7b": 500, "b:7b": 500, "c:7b": 503}, "3", 500, []string{"a:7b", "b:7b", "c:7b"}, ""},
+        {"chain cut short", map[string]int{"a:7b": 500, "b:7b": 500}, "2", 500, []string{"a:7b", "b:7b"}, ""},
+        {"not retryable", map[string]int{"a:7b": 400}, "3", 500, []string{"a:7b"}, ""},
+    }
+    for _, tt := range tests {
+        ollama := newFakeOllama(t, map[string]http.HandlerFunc{"/api/generate": failingModels(tt.status)})
+        chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "CONFIG_FILE", file,
+            "FALLBACK_MAX_ATTEMPTS", tt.attempts, "UPSTREAM_429_RETRIES", "0"))
+        w := chat.post(`{"prompt": "hi", "model": "a:7b"}`)
+        if w.Code != tt.code {
+            t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.code, w.Body.String())
+        }
+
+        var calls []string
+        for _, req := range ollama.requests("/api/generate") {
+            calls = append(calls, req["model"].(string))
+        }
+        if len(calls) != len(tt.calls) {
+            t.Errorf("%s: models asked = %q, want %q", tt.name, calls, tt.calls)
+        } else {
+            for i := range calls {
+                if calls[i] != tt.calls[i] {
+                    t.Errorf("%s: models asked = %q, want %q", tt.name, calls, tt.calls)
+                    break
+                }
+            }
+        }
+
+        if got := w.Header().Get("X-Fallback-Model"); got != tt.answered {
+            t.Errorf("%s: X-Fallback-Model = %q, want %q", tt.name, got, tt.answered)
+        }
+        if tt.answered == "" {
+            continue
+        }
+        var body struct {
+            Response string
+            Fallback *fallbackNote
+        }
+        json.Unmarshal(w.Body.Bytes(), &body)
+        if body.Response != "from "+tt.answered {
+            t.Errorf("%s: response = %q", tt.name, body.Response)
+        }
+        if fb := body.Fallback; fb == nil || fb.Requested != "a:7b" || fb.Model != tt.answered || len(fb.Failed) != len(tt.calls)-1 {
+            t.Errorf("%s: fallback = %+v, want %s answering after %d failures", tt.name, fb, tt.answered, len(tt.calls)-1)
+        }
+    }
+}
+
+func TestCheckFallbacks(t *testing.T) {
+    for _, chain := range [][]string{{"a:7b"}, {"b:7b", "b:7b"}} {
+        err := checkFallbacks(map[string]modelConfig{"a:7b": {Fallbacks: chain}})
+        if err == nil {
+            t.Errorf("fallbacks %q were accepted", chain)
+        }
+    }
+    if err := checkFallbacks(map[string]modelConfig{"a:7b": {Fallbacks: []string{"b:7b", "c:7b"}}}); err != nil {
+        t.Error(err)
+    }
+}
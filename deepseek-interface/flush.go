@@ -0,0 +1,72 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "time"
+)
+
+// Flush modes for STREAM_FLUSH and the per-request "flush" field: when a
+// /chat stream sends the text it has. token sends each chunk from Ollama
+// as it arrives; newline holds text until a line is complete, for
+// line-buffered readers such as CLIs; time sends what has built up at most
+// once per STREAM_FLUSH_INTERVAL.
+const (
+    flushToken   = "token"
+    flushNewline = "newline"
+    flushTime    = "time"
+)
+
+func parseFlushMode(s string) (string, error) {
+    switch s {
+    case flushToken, flushNewline, flushTime:
+        return s, nil
+    }
+    return "", fmt.Errorf("flush must be token, newline or time, got %q", s)
+}
+
+// tokenBatcher groups streamed text according to a flush mode. The time
+// mode is checked as text arrives, so while the model is silent nothing is
+// sent; the rest is sent by flush when the stream ends.
+type tokenBatcher struct {
+    mode  string
+    every time.Duration
+
+    buf  strings.Builder
+    last time.Time
+}
+
+func newTokenBatcher(mode string, every time.Duration) *tokenBatcher {
+    return &tokenBatcher{mode: mode, every: every, last: time.Now()}
+}
+
+// add takes the next piece of text and returns what should be sent now.
+func (b *tokenBatcher) add(token string) string {
+    switch b.mode {
+    case flushNewline:
+        b.buf.WriteString(token)
+        held := b.buf.String()
+        end := strings.LastIndexByte(held, '\n')
+        if end < 0 {
+            return ""
+        }
+        b.buf.Reset()
+        b.buf.WriteString(held[end+1:])
+        return held[:end+1]
+    case flushTime:
+        b.buf.WriteString(token)
+        if time.Since(b.last) < b.every {
+            return ""
+        }
+        return b.flush()
+    }
+    return token
+}
+
+// flush returns everything held, including a final partial line.
+func (b *tokenBatcher) flush() string {
+    out := b.buf.String()
+    b.buf.Reset()
+    b.last = time.Now()
+    return out
+}
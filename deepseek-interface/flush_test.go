@@ -0,0 +1,90 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTokenBatcherNewline(t *testing.T) {
+    b := newTokenBatcher(flushNewline, 0)
+    steps := []struct{ in, want string }{
+        {"Hel", ""},
+        {"lo\nwor", "Hello\n"},
+        {"ld", ""},
+        {"\n\nne", "world\n\n"},
+        {"xt\nand\nmore", "next\nand\n"},
+    }
+    for _, s := range steps {
+        if got := b.add(s.in); got != s.want {
+            t.Errorf("add(%q) = %q, want %q", s.in, got, s.want)
+        }
+    }
+    if got := b.flush(); got != "more" {
+        t.Errorf("flush = %q, want the final partial line", got)
+    }
+    if got := b.flush(); got != "" {
+        t.Errorf("second flush = %q, want nothing", got)
+    }
+}
+
+func TestTokenBatcherModes(t *testing.T) {
+    b := newTokenBatcher(flushToken, 0)
+    for _, tok := range []string{"a", "b\n", "c"} {
+        if got := b.add(tok); got != tok {
+            t.Errorf("token mode add(%q) = %q", tok, got)
+        }
+    }
+
+    b = newTokenBatcher(flushTime, time.Hour)
+    for _, tok := range []string{"a", "b\n", "c"} {
+        if got := b.add(tok); got != "" {
+            t.Errorf("time mode add(%q) = %q before the interval", tok, got)
+        }
+    }
+    if got := b.flush(); got != "ab\nc" {
+        t.Errorf("time mode flush = %q", got)
+    }
+    b.last = time.Now().Add(-2 * time.Hour)
+    if got := b.add("d"); got != "d" {
+        t.Errorf("time mode add after the interval = %q, want d", got)
+    }
+}
+
+func TestStreamResponseFlushNewline(t *testing.T) {
+    p := streamPlan()
+    p.Flush = flushNewline
+    events, outcome := runStream(t, p, tokens("def f():", "\n    ret", "urn 1\n", "print(f", "())"), 0)
+    if outcome != "ok" {
+        t.Errorf("outcome = %q, want ok", outcome)
+    }
+    var sent []string
+    for i, ev := range events {
+        if ev.event == "" {
+            sent = append(sent, text(t, events[i:i+1]))
+        }
+    }
+    want := []string{"def f():\n", "    return 1\n", "print(f())"}
+    if strings.Join(sent, "|") != strings.Join(want, "|") {
+        t.Errorf("token events = %q, want %q", sent, want)
+    }
+}
+
+func TestPlanChatFlush(t *testing.T) {
+    cfg := testConfig(t, "STREAM_FLUSH", flushNewline)
+    for in, want := range map[string]string{"": flushNewline, flushToken: flushToken, flushTime: flushTime} {
+        p, err := plan(t, cfg, chatInput{Stream: true, Flush: in})
+        if err != nil {
+            t.Errorf("flush %q: %v", in, err)
+        } else if p.Flush != want {
+            t.Errorf("flush %q: plan flush = %q, want %q", in, p.Flush, want)
+        }
+    }
+    _, err := plan(t, cfg, chatInput{Stream: true, Flush: "line"})
+    wantRequestError(t, err, http.StatusBadRequest, "flush must be token, newline or time")
+
+    if err := configError(t, "STREAM_FLUSH", "sometimes"); err == nil {
+        t.Error("STREAM_FLUSH=sometimes was accepted")
+    }
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Health statuses reported by /healthz.
+const (
+    healthOK                = "ok"
+    healthDraining          = "draining"
+    healthOllamaUnreachable = "ollama_unreachable"
+    healthModelFailing      = "model_failing"
+    healthWarming           = "warming"
+    healthWaiting           = "waiting_for_ollama"
+)
+
+// version is stamped at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var startedAt = time.Now()
+
+type healthResult struct {
+    Status string `json:"status"`
+    Error  string `json:"error,omitempty"`
+
+    Version       string        `json:"version"`
+    UptimeSeconds int64         `json:"uptime_seconds"`
+    Ollama        *ollamaStatus `json:"ollama,omitempty"`
+}
+
+// ollamaStatus is the backend summary in /healthz. It comes from the same
+// cached probe as the status, so it costs nothing extra per request.
+type ollamaStatus struct {
+    Version      string   `json:"version,omitempty"`
+    LoadedModels []string `json:"loaded_models"`
+}
+
+// healthChecker probes Ollama for the readiness endpoint. The API check is
+// cheap; the deep check runs a one-token generation against the default
+// model, so results are cached for ttl to keep probes from loading the GPU.
+//
+// A probe runs in the background, one at a time, and callers are answered
+// with the last result meanwhile, so a deep check that waits for the model
+// to load doesn't hold kubelet probes past their timeout. Only the very
+// first probe is waited for, for as long as the caller is willing to.
+type healthChecker struct {
+    cfg     *config
+    deep    bool
+    ttl     time.Duration
+    timeout time.Duration
+
+    mu      sync.Mutex
+    last    healthResult
+    checked time.Time
+    // probing is closed when the probe in flight ends; nil when there is
+    // none.
+    probing chan struct{}
+
+    stats cacheStats
+}
+
+func newHealthChecker(cfg *config) *healthChecker {
+    return &healthChecker{cfg: cfg, deep: cfg.HealthDeepCheck, ttl: cfg.HealthCacheTTL, timeout: cfg.HealthProbeTimeout}
+}
+
+func (h *healthChecker) check(ctx context.Context) healthResult {
+    h.mu.Lock()
+    if !h.checked.IsZero() && time.Since(h.checked) < h.ttl {
+        h.stats.hits.Add(1)
+        defer h.mu.Unlock()
+        return h.last
+    }
+    h.stats.misses.Add(1)
+    if h.probing == nil {
+        if !h.checked.IsZero() {
+            h.stats.evictions.Add(1)
+        }
+        h.probing = make(chan struct{})
+        go h.run(h.probing)
+    }
+    probing, last, checked := h.probing, h.last, h.checked
+    h.mu.Unlock()
+    if !checked.IsZero() {
+        return last
+    }
+
+    select {
+    case <-probing:
+    case <-ctx.Done():
+        return healthResult{Status: healthOllamaUnreachable, Error: "the first health probe is still running"}
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.last
+}
+
+// run makes one probe, bounded by HEALTH_PROBE_TIMEOUT rather than by the
+// caller that started it, whose result it is for everyone.
+func (h *healthChecker) run(done chan struct{}) {
+    ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+    defer cancel()
+    result := h.probe(ctx)
+    h.mu.Lock()
+    h.last, h.checked, h.probing = result, time.Now(), nil
+    h.mu.Unlock()
+    close(done)
+}
+
+// probe checks the backend that serves the default model.
+func (h *healthChecker) probe(ctx context.Context) healthResult {
+    model := h.cfg.defaultModel()
+    versionURL, err := h.cfg.modelAPI(model, "/api/version")
+    if err != nil {
+        return healthResult{Status: healthOllamaUnreachable, Error: err.Error()}
+    }
+    apiCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(apiCtx, "GET", versionURL, nil)
+    if err != nil {
+        return healthResult{Status: healthOllamaUnreachable, Error: err.Error()}
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return healthResult{Status: healthOllamaUnreachable, Error: err.Error()}
+    }
+    var v struct {
+        Version string `json:"version"`
+    }
+    json.NewDecoder(resp.Body).Decode(&v)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return healthResult{Status: healthOllamaUnreachable, Error: fmt.Sprintf("Ollama responded with status %d", resp.StatusCode)}
+    }
+
+    backend := &ollamaStatus{Version: v.Version, LoadedModels: []string{}}
+    psURL, _ := h.cfg.modelAPI(model, "/api/ps")
+    if loaded, err := loadedModelsAt(apiCtx, psURL); err == nil {
+        for name := range loaded {
+            backend.LoadedModels = append(backend.LoadedModels, name)
+        }
+        sort.Strings(backend.LoadedModels)
+    }
+
+    if !h.deep {
+        return healthResult{Status: healthOK, Ollama: backend}
+    }
+    // The whole probe timeout, since loading the model can take a while.
+    if err := generateOneToken(ctx, h.cfg, model); err != nil {
+        return healthResult{Status: healthModelFailing, Error: err.Error(), Ollama: backend}
+    }
+    return healthResult{Status: healthOK, Ollama: backend}
+}
+
+// generateOneToken runs the smallest possible generation against model to
+// prove it can actually produce output, not just that the API is up.
+func generateOneToken(ctx context.Context, cfg *config, model string) error {
+    body, _ := json.Marshal(ChatRequest{
+        Model:   model,
+        Prompt:  "ping",
+        Options: map[string]interface{}{"num_predict": 1},
+    })
+    // Generous enough to cover loading the model from disk.
+    client := &http.Client{Timeout: 2 * time.Minute}
+    generateURL, err := cfg.modelAPI(model, "/api/generate")
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, "POST", generateURL, bytes.NewBuffer(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    var out ChatResponse
+    if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+        return fmt.Errorf("invalid response from Ollama: %w", err)
+    }
+    if resp.StatusCode != http.StatusOK || out.Error != "" {
+        return fmt.Errorf("model %s failed to generate: status %d %s", model, resp.StatusCode, out.Error)
+    }
+    return nil
+}
+
+// healthHandler is the readiness probe: 200 only when not draining and
+// Ollama (and, with the deep check, the default model) is usable. A non-nil
+// preload holds readiness back until the warmer's startup round is done, and
+// waiting while the WAIT_FOR_OLLAMA startup phase is still running.
+func healthHandler(drain *drainer, checker *healthChecker, preload *warmer, waiting *atomic.Bool) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        var result healthResult
+        switch {
+        case drain.draining.Load():
+            result = healthResult{Status: healthDraining}
+            w.Header().Set("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+        case waiting.Load():
+            result = healthResult{Status: healthWaiting}
+        case preload != nil && !preload.preloaded.Load():
+            result = healthResult{Status: healthWarming}
+        default:
+            result = checker.check(r.Context())
+        }
+        result.Version = version
+        result.UptimeSeconds = int64(time.Since(startedAt).Seconds())
+
+        w.Header().Set("Content-Type", "application/json")
+        if result.Status != healthOK {
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+        json.NewEncoder(w).Encode(result)
+    }
+}
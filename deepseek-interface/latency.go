@@ -0,0 +1,249 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the generation
+// latency histogram. A last, unbounded bucket catches the rest.
+var latencyBuckets = []float64{0.25, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300}
+
+// latencySlots is how many pieces the rolling window is cut into. Each
+// slot is one histogram, so memory per model is fixed no matter the load.
+const latencySlots = 10
+
+// latencyAlertMinSamples keeps a couple of slow requests right after a quiet
+// period from tripping the alert.
+const latencyAlertMinSamples = 10
+
+type latencySlot struct {
+    start  time.Time
+    counts []int64
+}
+
+// modelLatency is the histogram state for one model: a ring of recent slots
+// for the rolling percentiles and cumulative counts for /metrics.
+type modelLatency struct {
+    slots    [latencySlots]latencySlot
+    total    []int64
+    sum      float64
+    alerting bool
+}
+
+// latencyTracker records how long successful generations take, per model.
+type latencyTracker struct {
+    window    time.Duration
+    threshold time.Duration // p95 above this fires an alert; 0 disables
+    webhook   string
+
+    mu     sync.Mutex
+    models map[string]*modelLatency
+}
+
+func newLatencyTracker(cfg *config) *latencyTracker {
+    return &latencyTracker{
+        window:    cfg.LatencyWindow,
+        threshold: cfg.LatencyAlertP95,
+        webhook:   cfg.LatencyAlertWebhook,
+        models:    make(map[string]*modelLatency),
+    }
+}
+
+func bucketIndex(seconds float64) int {
+    return sort.SearchFloat64s(latencyBuckets, seconds)
+}
+
+// observe records one generation of model that took d.
+func (t *latencyTracker) observe(model string, d time.Duration) {
+    now := time.Now()
+    t.mu.Lock()
+    m := t.models[model]
+    if m == nil {
+        m = &modelLatency{total: make([]int64, len(latencyBuckets)+1)}
+        t.models[model] = m
+    }
+    b := bucketIndex(d.Seconds())
+    m.total[b]++
+    m.sum += d.Seconds()
+
+    slotLen := t.window / latencySlots
+    start := now.Truncate(slotLen)
+    slot := &m.slots[(start.UnixNano()/int64(slotLen))%latencySlots]
+    if !slot.start.Equal(start) {
+        slot.start = start
+        slot.counts = make([]int64, len(latencyBuckets)+1)
+    }
+    slot.counts[b]++
+
+    var alert, recovered bool
+    var p95 float64
+    if t.threshold > 0 {
+        counts := t.recentLocked(m, now)
+        if n := countAll(counts); n >= latencyAlertMinSamples {
+            p95 = quantile(counts, 0.95)
+            over := p95 > t.threshold.Seconds()
+            alert = over && !m.alerting
+            recovered = !over && m.alerting
+            m.alerting = over
+        }
+    }
+    t.mu.Unlock()
+
+    if alert {
+        log.Printf("Latency alert: %s p95 is %.1fs over the last %s (threshold %s)", model, p95, t.window, t.threshold)
+        t.notify(model, p95)
+    } else if recovered {
+        log.Printf("Latency recovered: %s p95 is %.1fs", model, p95)
+    }
+}
+
+// recentLocked sums the slots of m that fall inside the window.
+func (t *latencyTracker) recentLocked(m *modelLatency, now time.Time) []int64 {
+    counts := make([]int64, len(latencyBuckets)+1)
+    for _, s := range m.slots {
+        if s.counts == nil || now.Sub(s.start) >= t.window {
+            continue
+        }
+        for i, n := range s.counts {
+            counts[i] += n
+        }
+    }
+    return counts
+}
+
+func countAll(counts []int64) int64 {
+    var n int64
+    for _, c := range counts {
+        n += c
+    }
+    return n
+}
+
+// quantile estimates the q-th quantile from bucket counts by interpolating
+// linearly inside the bucket it falls in. Anything in the unbounded bucket
+// is reported as the largest bound.
+func quantile(counts []int64, q float64) float64 {
+    n := countAll(counts)
+    if n == 0 {
+        return 0
+    }
+    rank := q * float64(n)
+    var seen float64
+    for i, c := range counts {
+        if c == 0 || seen+float64(c) < rank {
+            seen += float64(c)
+            continue
+        }
+        if i == len(latencyBuckets) {
+            return latencyBuckets[i-1]
+        }
+        lower := 0.0
+        if i > 0 {
+            lower = latencyBuckets[i-1]
+        }
+        return lower + (latencyBuckets[i]-lower)*(rank-seen)/float64(c)
+    }
+    return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// notify posts the alert to the webhook, if one is configured, without
+// holding up the request that tripped it.
+func (t *latencyTracker) notify(model string, p95 float64) {
+    if t.webhook == "" {
+        return
+    }
+    body, _ := json.Marshal(map[string]interface{}{
+        "alert":             "latency_p95",
+        "model":             model,
+        "p95_seconds":       p95,
+        "threshold_seconds": t.threshold.Seconds(),
+        "window":            t.window.String(),
+    })
+    go func() {
+        client := &http.Client{Timeout: 10 * time.Second}
+        resp, err := client.Post(t.webhook, "application/json", bytes.NewReader(body))
+        if err != nil {
+            log.Printf("Latency alert webhook failed: %v", err)
+            return
+        }
+        resp.Body.Close()
+        if resp.StatusCode >= 300 {
+            log.Printf("Latency alert webhook responded with status %d", resp.StatusCode)
+        }
+    }()
+}
+
+// modelStats is the per-model entry of /stats.
+type modelStats struct {
+    Count      int64   `json:"count"`
+    P50Seconds float64 `json:"p50_seconds"`
+    P95Seconds float64 `json:"p95_seconds"`
+    Alerting   bool    `json:"alerting"`
+}
+
+// snapshot returns rolling-window percentiles for every model seen.
+func (t *latencyTracker) snapshot() map[string]modelStats {
+    now := time.Now()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    out := make(map[string]modelStats, len(t.models))
+    for name, m := range t.models {
+        counts := t.recentLocked(m, now)
+        out[name] = modelStats{
+            Count:      countAll(counts),
+            P50Seconds: quantile(counts, 0.5),
+            P95Seconds: quantile(counts, 0.95),
+            Alerting:   m.alerting,
+        }
+    }
+    return out
+}
+
+// histogram is the cumulative, since-start view used for /metrics.
+type histogram struct {
+    Buckets []int64 // cumulative, one per latencyBuckets entry plus +Inf
+    Sum     float64
+}
+
+func (t *latencyTracker) histograms() map[string]histogram {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    out := make(map[string]histogram, len(t.models))
+    for name, m := range t.models {
+        h := histogram{Buckets: make([]int64, len(m.total)), Sum: m.sum}
+        var running int64
+        for i, c := range m.total {
+            running += c
+            h.Buckets[i] = running
+        }
+        out[name] = h
+    }
+    return out
+}
+
+// statsHandler serves per-model latency over the rolling window as JSON,
+// along with the number of open streams, cache counters and usage per tag.
+func statsHandler(t *latencyTracker, streams *streamSlots, pulls *pulls, caches []namedCache, tags *tagUsage) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        cacheStats := make(map[string]cacheCounts, len(caches))
+        for _, c := range caches {
+            cacheStats[c.name] = c.stats.counts()
+        }
+        tagCounts, _ := tags.snapshot()
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "window":          t.window.String(),
+            "models":          t.snapshot(),
+            "sse_connections": streams.active.Load(),
+            "caches":          cacheStats,
+            "pulls":           pulls.counts(),
+            "tags":            tagCounts,
+        })
+    }
+}
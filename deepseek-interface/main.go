@@ -1,52 +1,517 @@
 package main
 
 import (
-    "bytes"
-    "encoding/json"
-    "fmt"
-    "html/template"
-    "io"
+    "context"
+    "errors"
     "log"
     "net/http"
     "os"
-    "time"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
 )
 
-type ChatRequest struct {
-    Model  string `json:"model"`
-    Prompt string `json:"prompt"`
-    Stream bool   `json:"stream"`
-}
-
-type ChatResponse struct {
-    Response string `json:"response"`
-}
-
 const htmlTemplate = `
 <!DOCTYPE html>
 <html>
 <head>
-    <title>DeepSeek Local Interface</title>
+    <title>{{.Title}}</title>
     <style>
         body { font-family: Arial, sans-serif; max-width: 800px; margin: 0 auto; padding: 20px; }
         .chat-container { border: 1px solid #ddd; height: 400px; overflow-y: auto; padding: 10px; margin-bottom: 10px; }
         .input-container { display: flex; gap: 10px; }
         input[type="text"] { flex: 1; padding: 10px; }
         button { padding: 10px 20px; }
-        .message { margin: 10px 0; padding: 10px; border-radius: 5px; }
-        .user { background: #e3f2fd; }
-        .assistant { background: #f1f8e9; }
+        .message { margin: 10px 0; padding: 10px; border-radius: 5px; white-space: pre-wrap; }
+        .user { background: {{.UserColor}}; }
+        .assistant { background: {{.AssistantColor}}; }
+        .incomplete { border-left: 3px solid #e0a800; }
+        .thinking { font-style: italic; opacity: 0.7; }
+        .rendered { white-space: normal; }
+        .rendered pre { background: rgba(0, 0, 0, 0.06); padding: 8px; overflow-x: auto; }
+        .message pre, .message code { direction: ltr; unicode-bidi: isolate; text-align: left; }
+        .note { margin: -5px 0 10px; font-size: 0.85em; color: #8a6d3b; }
+        .timestamp { margin: -5px 0 10px; font-size: 0.75em; color: #999; }
+        .settings { margin-bottom: 10px; }
+        .settings label { display: block; margin: 5px 0; }
+        .hint { font-size: 0.85em; color: #666; }
+        .warning { font-size: 0.85em; color: #b45309; }
+        .onboarding { border: 1px solid #e0a800; background: #fff8e1; padding: 10px; margin-bottom: 10px; }
+        .onboarding button, .onboarding input { margin-right: 5px; }
     </style>
 </head>
 <body>
-    <h1>🧠 DeepSeek Local Interface</h1>
+    <h1>{{.Heading}}</h1>
+    <details class="settings">
+        <summary>Settings</summary>
+        <label>Model <select id="model-select"></select></label>
+        <label>Max tokens <input type="number" id="max-tokens" min="1" placeholder="model default"></label>
+        <label>Context length <input type="number" id="num-ctx" min="1" placeholder="model default">
+            <span id="num-ctx-limit" class="hint"></span>
+        </label>
+        <label>Creativity <input type="range" id="creativity" min="0" max="100" step="5">
+            <span id="creativity-state" class="hint"></span>
+            <button type="button" id="creativity-reset">Model default</button>
+        </label>
+        <label><input type="checkbox" id="stream-toggle"> Stream responses</label>
+        <label><input type="checkbox" id="hide-reasoning"> Hide reasoning</label>
+        <label>Keep model loaded
+            <select id="keep-alive">
+                <option value="">Server default</option>
+                <option value="-1">Until unloaded</option>
+                <option value="30m">30 minutes</option>
+                <option value="5m">5 minutes</option>
+                <option value="1m">1 minute</option>
+                <option value="0">Release after each reply</option>
+            </select>
+            <span id="keep-alive-state" class="hint"></span>
+        </label>
+        <label>Timestamps
+            <select id="timestamps">
+                <option value="relative">Relative (2m ago)</option>
+                <option value="absolute">Date and time</option>
+                <option value="off">Hidden</option>
+            </select>
+        </label>
+        <label id="spool-setting" hidden>Long replies
+            <select id="spool">
+                <option value="">Show in the chat</option>
+                <option value="copy">Show and offer a download</option>
+                <option value="file">Only offer a download</option>
+            </select>
+        </label>
+        <label>Text direction
+            <select id="text-direction">
+                <option value="auto">Detect from each message</option>
+                <option value="ltr">Left to right</option>
+                <option value="rtl">Right to left</option>
+            </select>
+        </label>
+    </details>
+    <div id="onboarding" class="onboarding" hidden></div>
     <div id="chat-container" class="chat-container"></div>
     <div class="input-container">
-        <input type="text" id="prompt-input" placeholder="Ask DeepSeek something...">
+        <input type="text" id="prompt-input" placeholder="{{.Placeholder}}">
         <button onclick="sendMessage()">Send</button>
+        <button id="stop-button" onclick="stopStream()" hidden>Stop</button>
     </div>
     
     <script>
+        const assistantName = {{.AssistantName}};
+        const themeDefaultModel = {{.DefaultModel}};
+        const prefs = JSON.parse(localStorage.getItem('deepseek-prefs') || '{}');
+
+        function savePrefs() {
+            localStorage.setItem('deepseek-prefs', JSON.stringify(prefs));
+        }
+
+        const maxTokensInput = document.getElementById('max-tokens');
+        if (prefs.maxTokens) maxTokensInput.value = prefs.maxTokens;
+        maxTokensInput.addEventListener('change', function() {
+            const n = parseInt(maxTokensInput.value, 10);
+            prefs.maxTokens = n > 0 ? n : undefined;
+            if (!prefs.maxTokens) maxTokensInput.value = '';
+            savePrefs();
+        });
+
+        // num_ctx is capped at the selected model's context length when
+        // /models knows it, so a value saved for a large model still works
+        // after switching to a smaller one.
+        const numCtxInput = document.getElementById('num-ctx');
+        const numCtxLimit = document.getElementById('num-ctx-limit');
+        if (prefs.numCtx) numCtxInput.value = prefs.numCtx;
+        numCtxInput.addEventListener('change', function() {
+            const n = parseInt(numCtxInput.value, 10);
+            prefs.numCtx = n > 0 ? n : undefined;
+            if (!prefs.numCtx) numCtxInput.value = '';
+            savePrefs();
+            showContextLimit();
+        });
+        function selectedContextLength() {
+            const m = knownModels.find(function(m) { return m.name === modelSelect.value; });
+            return m && m.context_length || 0;
+        }
+        function showContextLimit() {
+            const max = selectedContextLength();
+            numCtxInput.max = max || '';
+            numCtxLimit.textContent = !max ? '' :
+                prefs.numCtx > max ? 'This model supports up to ' + max + ' tokens; ' + max + ' will be used.' :
+                'Up to ' + max + ' tokens.';
+        }
+
+        // One dial instead of temperature and top_p; the server decides what
+        // each setting means. Until it is moved the model's own defaults
+        // apply.
+        const creativityInput = document.getElementById('creativity');
+        const creativityState = document.getElementById('creativity-state');
+        function showCreativity() {
+            const v = prefs.creativity;
+            creativityState.textContent = v === undefined ? 'model default' :
+                v <= 20 ? v + ' (focused)' : v >= 80 ? v + ' (adventurous)' : String(v);
+        }
+        creativityInput.value = prefs.creativity === undefined ? 50 : prefs.creativity;
+        showCreativity();
+        creativityInput.addEventListener('input', function() {
+            prefs.creativity = parseInt(creativityInput.value, 10);
+            savePrefs();
+            showCreativity();
+        });
+        document.getElementById('creativity-reset').addEventListener('click', function() {
+            prefs.creativity = undefined;
+            creativityInput.value = 50;
+            savePrefs();
+            showCreativity();
+        });
+
+        const streamToggle = document.getElementById('stream-toggle');
+        streamToggle.checked = prefs.stream !== false;
+        streamToggle.addEventListener('change', function() {
+            prefs.stream = streamToggle.checked;
+            savePrefs();
+        });
+
+        const hideReasoning = document.getElementById('hide-reasoning');
+        hideReasoning.checked = prefs.hideReasoning === true;
+        hideReasoning.addEventListener('change', function() {
+            prefs.hideReasoning = hideReasoning.checked;
+            savePrefs();
+        });
+
+        // keep_alive goes to Ollama with each request; it decides how long
+        // the model stays in GPU memory after the reply.
+        const keepAliveSelect = document.getElementById('keep-alive');
+        const keepAliveState = document.getElementById('keep-alive-state');
+        function showKeepAlive() {
+            const v = keepAliveSelect.value;
+            keepAliveState.textContent = v === '' ? '' :
+                v === '-1' ? 'The model stays loaded until another takes its place or Ollama restarts.' :
+                v === '0' ? 'The model is unloaded as soon as each reply finishes, freeing the GPU.' :
+                'The model is unloaded after ' + keepAliveSelect.options[keepAliveSelect.selectedIndex].text + ' without requests.';
+        }
+        keepAliveSelect.value = prefs.keepAlive || '';
+        showKeepAlive();
+        keepAliveSelect.addEventListener('change', function() {
+            prefs.keepAlive = keepAliveSelect.value || undefined;
+            savePrefs();
+            showKeepAlive();
+        });
+
+        // Streamed replies can also be written to a file on the server, to
+        // download once they finish; the setting only appears when the
+        // server allows it.
+        const spoolSetting = document.getElementById('spool-setting');
+        const spoolSelect = document.getElementById('spool');
+        spoolSelect.value = prefs.spool || '';
+        spoolSelect.addEventListener('change', function() {
+            prefs.spool = spoolSelect.value || undefined;
+            savePrefs();
+        });
+
+        // Each message gets a timestamp line under it. Relative times are
+        // redrawn every half minute so "just now" doesn't go stale.
+        const timestampsSelect = document.getElementById('timestamps');
+        timestampsSelect.value = prefs.timestamps || 'relative';
+        timestampsSelect.addEventListener('change', function() {
+            prefs.timestamps = timestampsSelect.value;
+            savePrefs();
+            renderTimestamps();
+        });
+        function formatTimestamp(ms) {
+            if (timestampsSelect.value === 'absolute') return new Date(ms).toLocaleString();
+            const seconds = Math.round((Date.now() - ms) / 1000);
+            if (seconds < 45) return 'just now';
+            if (seconds < 3600) return Math.round(seconds / 60) + 'm ago';
+            if (seconds < 86400) return Math.round(seconds / 3600) + 'h ago';
+            return Math.round(seconds / 86400) + 'd ago';
+        }
+        function renderTimestamps() {
+            document.querySelectorAll('.timestamp').forEach(function(el) {
+                el.hidden = timestampsSelect.value === 'off';
+                el.textContent = formatTimestamp(Number(el.dataset.time));
+                el.title = new Date(Number(el.dataset.time)).toLocaleString();
+            });
+        }
+        function setTimestamp(div, when) {
+            const ts = div.nextElementSibling;
+            if (!ts || !ts.classList.contains('timestamp') || !when) return;
+            ts.dataset.time = Date.parse(when) || ts.dataset.time;
+            renderTimestamps();
+        }
+        setInterval(renderTimestamps, 30000);
+
+        // Messages in Arabic, Hebrew and other right-to-left scripts are
+        // shown right to left. Detection goes by the first letter that has a
+        // direction, as browsers do for dir="auto", skipping reasoning and
+        // code so an English preamble doesn't decide it. Code blocks stay
+        // left to right either way.
+        const directionSelect = document.getElementById('text-direction');
+        directionSelect.value = prefs.textDirection || 'auto';
+        directionSelect.addEventListener('change', function() {
+            prefs.textDirection = directionSelect.value;
+            savePrefs();
+            document.querySelectorAll('.message').forEach(function(div) {
+                setDirection(div, div.dataset.text || '');
+            });
+        });
+        const rtlLetter = /[\u0590-\u08FF\uFB1D-\uFDFF\uFE70-\uFEFC]/;
+        const strongLetter = /[A-Za-z\u00C0-\u02AF\u0370-\u052F\u0590-\u08FF\u0900-\u0DFF\u3040-\u9FFF\uAC00-\uD7AF\uFB1D-\uFDFF\uFE70-\uFEFC]/;
+        function textDirection(text) {
+            if (directionSelect.value !== 'auto') return directionSelect.value;
+            const prose = text
+                .replace(/<think>[\s\S]*?(<\/think>|$)/g, '')
+                .replace(/\x60\x60\x60[\s\S]*?(\x60\x60\x60|$)/g, '')
+                .replace(/\x60[^\x60\n]*\x60/g, '');
+            const first = prose.match(strongLetter);
+            return first && rtlLetter.test(first[0]) ? 'rtl' : 'ltr';
+        }
+        function setDirection(div, text) {
+            div.dataset.text = text;
+            div.dir = textDirection(text);
+        }
+
+        // Most recently used models, newest first, shown above the full list.
+        const maxRecentModels = 5;
+        const modelSelect = document.getElementById('model-select');
+        modelSelect.addEventListener('change', function() {
+            prefs.model = modelSelect.value;
+            savePrefs();
+            showContextLimit();
+        });
+
+        function addOption(parent, name) {
+            const option = document.createElement('option');
+            option.value = name;
+            option.textContent = name;
+            parent.appendChild(option);
+        }
+
+        let knownModels = [];
+        let defaultModel = '';
+
+        function renderModels() {
+            const names = knownModels.map(function(m) { return m.name; });
+            const recent = (prefs.recentModels || []).filter(function(n) { return names.includes(n); });
+            modelSelect.innerHTML = '';
+            if (recent.length) {
+                const group = document.createElement('optgroup');
+                group.label = 'Recent';
+                recent.forEach(function(n) { addOption(group, n); });
+                modelSelect.appendChild(group);
+            }
+            const all = document.createElement('optgroup');
+            all.label = 'All models';
+            names.forEach(function(n) { addOption(all, n); });
+            modelSelect.appendChild(all);
+
+            const wanted = prefs.model || defaultModel;
+            modelSelect.value = names.includes(wanted) ? wanted : (names.includes(defaultModel) ? defaultModel : names[0] || '');
+            showContextLimit();
+        }
+
+        async function loadModels() {
+            try {
+                const response = await fetch('/models');
+                if (!response.ok) return;
+                const data = await response.json();
+                // Models failing repeatedly are left out until they recover.
+                knownModels = data.models.filter(function(m) { return !m.degraded; });
+                defaultModel = themeDefaultModel || data.default;
+                renderModels();
+                showOnboarding(data);
+                spoolSetting.hidden = !data.spool_enabled;
+            } catch (e) {
+                // Leave the list empty; the server falls back to its default model.
+            }
+        }
+
+        // A fresh Ollama install has no models at all. Say so instead of
+        // leaving an empty dropdown, and offer to pull one when the server
+        // allows it.
+        const onboarding = document.getElementById('onboarding');
+
+        function showOnboarding(data) {
+            onboarding.hidden = !data.empty;
+            onboarding.innerHTML = '';
+            if (!data.empty) return;
+            const intro = document.createElement('p');
+            intro.textContent = 'No models are installed in Ollama yet, so there is nothing to chat with.';
+            onboarding.appendChild(intro);
+            const suggested = data.suggested || [];
+            if (!data.pull_enabled) {
+                const how = document.createElement('p');
+                how.textContent = 'Install one on the Ollama host to get started' +
+                    (suggested.length ? ', for example: ollama pull ' + suggested[0] : '.');
+                onboarding.appendChild(how);
+                return;
+            }
+            const status = document.createElement('p');
+            status.className = 'hint';
+            const warning = document.createElement('p');
+            warning.className = 'warning';
+            warning.hidden = true;
+            // Pulling takes the admin token; it is only kept in this page.
+            const token = document.createElement('input');
+            token.type = 'password';
+            token.placeholder = 'Admin token';
+            onboarding.appendChild(token);
+            suggested.forEach(function(name) {
+                const button = document.createElement('button');
+                button.textContent = 'Pull ' + name;
+                button.addEventListener('click', function() { pullModel(name, token.value, status, warning); });
+                onboarding.appendChild(button);
+            });
+            onboarding.appendChild(status);
+            onboarding.appendChild(warning);
+            showFreeSpace(status, warning);
+        }
+
+        // pullDisk is the disk half of /models/capacity, once known, for the
+        // warnings in the pull flow.
+        let pullDisk = null;
+
+        function gigabytes(bytes) {
+            return (bytes / 1e9).toFixed(1) + ' GB';
+        }
+
+        function diskBelowMinimum() {
+            return pullDisk && pullDisk.min_free_bytes && pullDisk.free_bytes < pullDisk.min_free_bytes;
+        }
+
+        function showWarning(warning, text) {
+            warning.textContent = text;
+            warning.hidden = false;
+        }
+
+        async function showFreeSpace(status, warning) {
+            try {
+                const response = await fetch('/models/capacity');
+                const data = await response.json();
+                if (!data.disk.available) return;
+                pullDisk = data.disk;
+                status.textContent = gigabytes(pullDisk.free_bytes) + ' free for models.';
+                if (diskBelowMinimum()) {
+                    showWarning(warning, 'Only ' + gigabytes(pullDisk.free_bytes) + ' is free, less than the ' +
+                        gigabytes(pullDisk.min_free_bytes) + ' this server keeps free, so a pull may fill the disk.');
+                }
+            } catch (e) {
+                // Free space is only a hint.
+            }
+        }
+
+        function pullProgress(name, p) {
+            if (p.error) return 'Pull failed: ' + p.error;
+            if (p.status === 'queued') return name + ' is waiting for another pull to finish\u2026';
+            if (p.total) return 'Pulling ' + name + ': ' + Math.floor(100 * (p.completed || 0) / p.total) + '%';
+            return 'Pulling ' + name + ': ' + p.status;
+        }
+
+        // pullModel runs a pull from the onboarding panel, showing its
+        // progress, and reloads the model list once it succeeds.
+        // Below PULL_MIN_FREE_DISK the server refuses a pull unless it is
+        // forced, so the user is asked first.
+        async function pullModel(name, token, status, warning) {
+            const force = diskBelowMinimum();
+            if (force && !confirm('Only ' + gigabytes(pullDisk.free_bytes) + ' is free for models. Pull ' + name + ' anyway?')) {
+                return;
+            }
+            const buttons = onboarding.querySelectorAll('button');
+            buttons.forEach(function(b) { b.disabled = true; });
+            status.textContent = 'Pulling ' + name + '\u2026';
+            let sizeChecked = false;
+            try {
+                const response = await fetch('/models/pull', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+                    body: JSON.stringify({ name: name, force: force })
+                });
+                if (!response.ok) {
+                    status.textContent = 'Pull failed: ' + await errorMessage(response);
+                    return;
+                }
+                const reader = response.body.getReader();
+                const decoder = new TextDecoder();
+                let buffer = '';
+                let last = {};
+                while (true) {
+                    const { value, done } = await reader.read();
+                    if (done) break;
+                    buffer += decoder.decode(value, { stream: true });
+                    let end;
+                    while ((end = buffer.indexOf('\n')) >= 0) {
+                        const line = buffer.slice(0, end);
+                        buffer = buffer.slice(end + 1);
+                        if (!line) continue;
+                        last = JSON.parse(line);
+                        status.textContent = pullProgress(name, last);
+                        // The first sized download is the model's weights,
+                        // the one part big enough to matter.
+                        if (!sizeChecked && last.total && pullDisk) {
+                            sizeChecked = true;
+                            if (last.total > pullDisk.free_bytes) {
+                                showWarning(warning, name + ' needs ' + gigabytes(last.total) + ' but only ' +
+                                    gigabytes(pullDisk.free_bytes) + ' is free, so the pull will probably fail.');
+                            }
+                        }
+                    }
+                }
+                if (last.status === 'success') {
+                    loadModels();
+                } else if (!last.error) {
+                    status.textContent = 'Pull of ' + name + ' stopped before it finished.';
+                }
+            } catch (e) {
+                status.textContent = 'Pull failed: ' + e.message;
+            } finally {
+                buttons.forEach(function(b) { b.disabled = false; });
+            }
+        }
+
+        function rememberModel(name) {
+            if (!name) return;
+            const recent = (prefs.recentModels || []).filter(function(n) { return n !== name; });
+            recent.unshift(name);
+            prefs.recentModels = recent.slice(0, maxRecentModels);
+            prefs.model = name;
+            savePrefs();
+            renderModels();
+        }
+
+        loadModels();
+
+        async function errorMessage(response) {
+            const text = await response.text();
+            try {
+                return JSON.parse(text).error || text;
+            } catch (e) {
+                return text;
+            }
+        }
+
+        // readEvents parses a text/event-stream body and calls onEvent with
+        // each event name and its decoded JSON data.
+        async function readEvents(response, onEvent) {
+            const reader = response.body.getReader();
+            const decoder = new TextDecoder();
+            let buffer = '';
+            while (true) {
+                const { value, done } = await reader.read();
+                if (done) return;
+                buffer += decoder.decode(value, { stream: true });
+                let end;
+                while ((end = buffer.indexOf('\n\n')) >= 0) {
+                    const frame = buffer.slice(0, end);
+                    buffer = buffer.slice(end + 2);
+                    let event = 'message';
+                    const data = [];
+                    for (const line of frame.split('\n')) {
+                        if (line.startsWith('event: ')) event = line.slice(7);
+                        else if (line.startsWith('data:')) data.push(line.slice(line.startsWith('data: ') ? 6 : 5));
+                    }
+                    if (data.length) onEvent(event, JSON.parse(data.join('\n')));
+                }
+            }
+        }
+
         async function sendMessage() {
             const input = document.getElementById('prompt-input');
             const prompt = input.value.trim();
@@ -55,27 +520,206 @@ const htmlTemplate = `
             appendMessage('user', prompt);
             input.value = '';
             
+            const body = { prompt: prompt, stream: prefs.stream !== false };
+            if (modelSelect.value) body.model = modelSelect.value;
+            const options = {};
+            if (prefs.maxTokens) options.num_predict = prefs.maxTokens;
+            if (prefs.numCtx) options.num_ctx = Math.min(prefs.numCtx, selectedContextLength() || Infinity);
+            if (prefs.keepAlive) options.keep_alive = prefs.keepAlive === '-1' ? -1 : prefs.keepAlive;
+            if (Object.keys(options).length) body.options = options;
+            if (prefs.hideReasoning) body.hide_reasoning = true;
+            if (prefs.creativity !== undefined) body.creativity = prefs.creativity;
+            if (body.stream && prefs.spool && !spoolSetting.hidden && !sessionLost) body.spool = prefs.spool;
+
             try {
                 const response = await fetch('/chat', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ prompt: prompt })
+                    body: JSON.stringify(body)
+                });
+                checkSession(response);
+                if (!response.ok) {
+                    appendMessage('assistant', 'Error: ' + await errorMessage(response));
+                    return;
+                }
+
+                if (!body.stream) {
+                    const data = await response.json();
+                    const div = appendMessage('assistant', data.response);
+                    setTimestamp(div, data.created_at);
+                    if (data.html) showHTML(div, data.html);
+                    if (data.stats) appendNote(statsNote(data.stats));
+                    if (data.truncated) appendNote('Response cut off at the max tokens limit.');
+                    if (data.prompt_truncated) appendNote(promptNote(data.prompt_truncated));
+                    if (data.repetition) appendNote(repetitionNote(data.repetition));
+                    rememberModel(body.model);
+                    return;
+                }
+
+                const div = appendMessage('assistant', body.spool === 'file' ? 'writing the reply to a file\u2026' : '');
+                let text = '';
+                // The live token counter, replaced by the stats footer.
+                let progress = null;
+                const endProgress = function() {
+                    if (progress) progress.remove();
+                    progress = null;
+                };
+                currentStream = response.headers.get('X-Stream-ID');
+                stopButton.hidden = !currentStream;
+                await readEvents(response, function(event, data) {
+                    if (event === 'message') {
+                        text += data.token;
+                        div.classList.remove('thinking');
+                        div.textContent = assistantName + ': ' + text;
+                        setDirection(div, text);
+                    } else if (event === 'thinking') {
+                        div.classList.add('thinking');
+                        div.textContent = assistantName + ': thinking\u2026';
+                    } else if (event === 'cold') {
+                        appendNote(data.model + ' is not loaded yet; the reply starts once it is.');
+                    } else if (event === 'progress') {
+                        if (!progress) progress = appendNote('');
+                        progress.textContent = progressNote(data);
+                    } else if (event === 'stats') {
+                        endProgress();
+                        appendNote(statsNote(data));
+                    } else if (event === 'done') {
+                        endProgress();
+                        setTimestamp(div, data.created_at);
+                        if (data.html) showHTML(div, data.html);
+                        if (data.truncated) appendNote('Response cut off at the max tokens limit.');
+                        if (data.prompt_truncated) appendNote(promptNote(data.prompt_truncated));
+                        if (data.repetition) {
+                            if (data.repetition.aborted) div.classList.add('incomplete');
+                            appendNote(repetitionNote(data.repetition));
+                        }
+                        if (data.spool) appendDownload(data.spool);
+                        rememberModel(body.model);
+                    } else if (event === 'cancelled') {
+                        endProgress();
+                        div.classList.add('incomplete');
+                        appendNote('Stopped.');
+                        if (data.spool) appendDownload(data.spool);
+                    } else if (event === 'error') {
+                        endProgress();
+                        if (data.partial) {
+                            div.classList.add('incomplete');
+                            appendNote('Error: ' + data.error + ' (response is incomplete)');
+                        } else {
+                            appendNote('Error: ' + data.error);
+                        }
+                        if (data.spool && data.spool.bytes) appendDownload(data.spool);
+                    }
+                    const container = document.getElementById('chat-container');
+                    container.scrollTop = container.scrollHeight;
                 });
-                
-                const data = await response.json();
-                appendMessage('assistant', data.response);
             } catch (error) {
                 appendMessage('assistant', 'Error: ' + error.message);
+            } finally {
+                currentStream = null;
+                stopButton.hidden = true;
             }
         }
+
+        // X-Session says how the server handled a request without a valid
+        // session cookie: "none" when it served it statelessly, "new" when it
+        // issued one. "new" twice running means the cookie didn't stick.
+        // Either way the features tied to a session can't work, so say so
+        // once rather than let them fail one by one.
+        let sessionLost = false;
+        let sessionIssued = false;
+        function checkSession(response) {
+            const s = response.headers.get('X-Session');
+            const lost = s === 'none' || (s === 'new' && sessionIssued);
+            sessionIssued = s === 'new';
+            if (!lost || sessionLost) return;
+            sessionLost = true;
+            appendNote('This browser is not keeping the session cookie, so the server can\'t tell your ' +
+                'requests apart. Stop, snippets and reply downloads won\'t work until cookies are allowed for this site.');
+        }
+
+        // stopStream asks the server to end the current stream, which then
+        // finishes with a "cancelled" event rather than just dropping.
+        const stopButton = document.getElementById('stop-button');
+        let currentStream = null;
+        function stopStream() {
+            if (!currentStream) return;
+            fetch('/chat/abort', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ id: currentStream })
+            });
+        }
         
         function appendMessage(type, content) {
             const container = document.getElementById('chat-container');
             const div = document.createElement('div');
             div.className = 'message ' + type;
-            div.textContent = (type === 'user' ? 'You: ' : 'DeepSeek: ') + content;
+            div.textContent = (type === 'user' ? 'You: ' : assistantName + ': ') + content;
+            setDirection(div, content);
+            container.appendChild(div);
+            const ts = document.createElement('div');
+            ts.className = 'timestamp';
+            ts.dataset.time = Date.now();
+            container.appendChild(ts);
+            renderTimestamps();
+            container.scrollTop = container.scrollHeight;
+            return div;
+        }
+
+        // showHTML swaps a reply's text for the server-rendered version. The
+        // server escapes everything the model wrote before adding markup.
+        function showHTML(div, html) {
+            div.textContent = assistantName + ':';
+            const body = document.createElement('div');
+            body.className = 'rendered';
+            body.innerHTML = html;
+            div.appendChild(body);
+        }
+
+        function appendNote(text) {
+            const container = document.getElementById('chat-container');
+            const div = document.createElement('div');
+            div.className = 'note';
+            div.textContent = text;
             container.appendChild(div);
             container.scrollTop = container.scrollHeight;
+            return div;
+        }
+
+        // appendDownload links to a spooled reply. The server deletes it
+        // once downloaded, or when it expires.
+        function appendDownload(spool) {
+            const note = appendNote('');
+            const link = document.createElement('a');
+            link.href = spool.url;
+            link.download = '';
+            link.textContent = 'Download the reply';
+            note.appendChild(link);
+            const size = spool.bytes < 1024 ? spool.bytes + ' bytes' : (spool.bytes / 1024).toFixed(1) + ' KB';
+            note.appendChild(document.createTextNode(' (' + size +
+                (spool.truncated ? ', cut off at the size limit' : '') +
+                '; available until ' + new Date(spool.expires_at).toLocaleTimeString() + ')'));
+        }
+
+        function progressNote(p) {
+            return p.tokens + (p.max_tokens ? ' of ' + p.max_tokens : '') + ' tokens\u2026';
+        }
+
+        function statsNote(st) {
+            const parts = [st.tokens + ' tokens', (st.total_ms / 1000).toFixed(1) + 's'];
+            if (st.tokens_per_second) parts.push(st.tokens_per_second.toFixed(1) + ' tok/s');
+            return parts.join(' \u00b7 ') + (st.partial ? ' (partial)' : '');
+        }
+
+        function promptNote(cut) {
+            return 'Prompt was ' + cut.original_length + ' characters; only the ' + cut.kept +
+                ' (' + cut.kept_length + ' characters) was sent.';
+        }
+
+        function repetitionNote(rep) {
+            const note = 'The model kept repeating "' + rep.line + '"; ' + rep.removed + ' repeated lines were removed.';
+            return rep.aborted ? note + ' Generation was stopped.' : note;
         }
         
         document.getElementById('prompt-input').addEventListener('keypress', function(e) {
@@ -87,78 +731,164 @@ const htmlTemplate = `
 `
 
 func main() {
-    ollamaURL := os.Getenv("OLLAMA_URL")
-    if ollamaURL == "" {
-        ollamaURL = "http://host.docker.internal:11434"
+    cfg, err := loadConfig()
+    if err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
+    if os.Getenv("SESSION_SECRET") == "" {
+        log.Printf("SESSION_SECRET is not set; session cookies will not survive a restart or work across replicas")
+    }
+
+    adm := newAdmission(cfg.MaxConcurrent, cfg.QueueSmallestFirst)
+    drain := &drainer{}
+
+    themes, err := loadThemes(cfg.ThemesDir)
+    if err != nil {
+        log.Fatalf("Invalid themes: %v", err)
+    }
+    http.HandleFunc("/", indexHandler(themes))
+    http.HandleFunc("/ui/", indexHandler(themes))
+
+    audit, err := openAuditLog(cfg.AuditLog)
+    if err != nil {
+        log.Fatalf("Cannot open audit log: %v", err)
     }
+    lat := newLatencyTracker(cfg)
+    sessions := newSessionLimiter(cfg.MaxConcurrentPerSession)
+    streams := &streamSlots{limit: int64(cfg.MaxSSEConnections)}
+    limits := &rateLimitCounters{}
+    rates := newRequestRateLimits(cfg, limits)
+    registry := newStreamRegistry()
+    modelHealth := newModelHealth(cfg)
+    budget := newTokenBudget(cfg)
+    flights := newFlightGroup()
+    events, err := newNATSPublisher(cfg.NATSURL, cfg.NATSSubject)
+    if err != nil {
+        log.Fatalf("Invalid configuration: NATS_URL %v", err)
+    }
+    if events != nil {
+        go events.run()
+    }
+    spools, err := newSpoolStore(cfg)
+    if err != nil {
+        log.Fatalf("Cannot prepare SPOOL_DIR: %v", err)
+    }
+    debounces := newDebouncer(cfg.DebounceWindow)
+    var unload *unloader
+    if cfg.UnloadIdle > 0 {
+        unload = newUnloader(cfg)
+    }
+    ps := newPSCache(cfg)
+    tags := newTagUsage()
+    http.HandleFunc("/chat", rates.wrap(chatHandler(cfg, adm, sessions, streams, registry, limits, flights, debounces, modelHealth, budget, unload, audit, lat, events, spools, ps, tags), http.Error))
+    http.HandleFunc("/chat/abort", abortHandler(cfg, registry))
+    http.HandleFunc("/chat/spool/", spoolHandler(cfg, spools))
+    http.HandleFunc("/v1/chat/completions", rates.wrap(logBodies(cfg, openAIChatHandler(cfg, adm, sessions, streams, limits, budget, unload, tags)), openAIError))
+    http.HandleFunc("/snippets", snippetsHandler(cfg, cfg.Snippets))
 
-    http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        tmpl := template.Must(template.New("index").Parse(htmlTemplate))
-        tmpl.Execute(w, nil)
-    })
+    embedAdm := newAdmission(cfg.MaxConcurrentEmbeddings, false)
+    http.HandleFunc("/embeddings", rates.wrap(embedHandler(cfg, embedAdm), jsonError))
 
-    http.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
-        if r.Method != "POST" {
-            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-            return
+    models := newModelCache(cfg)
+    http.HandleFunc("/models", modelsHandler(cfg, models, modelHealth))
+    http.HandleFunc("/models/refresh", modelsRefreshHandler(cfg, models, modelHealth))
+    http.HandleFunc("/estimate", rates.wrap(estimateHandler(cfg, models), jsonError))
+    http.HandleFunc("/models/enable", modelsEnableHandler(cfg, modelHealth))
+    http.HandleFunc("/diagnostics", diagnosticsHandler(cfg))
+    http.HandleFunc("/models/capacity", capacityHandler(cfg))
+    var warm, preload *warmer
+    if len(cfg.WarmModels) > 0 {
+        warm = newWarmer(cfg)
+        if cfg.WarmBlockReadiness {
+            preload = warm
         }
+    }
+    health := newHealthChecker(cfg)
+    waiting := &atomic.Bool{}
+    waiting.Store(cfg.WaitForOllama)
+    http.HandleFunc("/healthz", healthHandler(drain, health, preload, waiting))
+    caches := []namedCache{{"models", &models.stats}, {"health", &health.stats}}
+    if ps != nil {
+        caches = append(caches, namedCache{"ps", &ps.stats})
+    }
+    activePulls := newPulls(cfg)
+    http.HandleFunc("/metrics", metricsHandler(adm, embedAdm, lat, streams, limits, flights, caches, tags))
+    http.HandleFunc("/stats", statsHandler(lat, streams, activePulls, caches, tags))
+
+    if cfg.AllowPull {
+        http.HandleFunc("/models/pull", pullHandler(cfg, activePulls, models))
+        http.HandleFunc("/models/pull/cancel", pullCancelHandler(cfg, activePulls))
+    }
 
-        var req struct {
-            Prompt string `json:"prompt"`
+    if cfg.DebugEcho {
+        log.Printf("DEBUG_ECHO is enabled; /echo reflects request details back to clients")
+        http.HandleFunc("/echo", echoHandler(cfg))
+    }
+    if cfg.DebugV1Bodies {
+        log.Printf("DEBUG_V1_BODIES is enabled; /v1 request and response bodies, prompts included, are logged")
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+    defer stop()
+
+    // Warming waits for Ollama too, so its first round isn't wasted on a
+    // backend that isn't up yet.
+    go func() {
+        if cfg.WaitForOllama {
+            if err := waitForOllama(ctx, cfg); err != nil && ctx.Err() == nil {
+                if cfg.WaitForOllamaFail {
+                    log.Fatalf("Giving up: %v", err)
+                }
+                log.Printf("%v; carrying on, readiness will follow Ollama", err)
+            }
+            waiting.Store(false)
         }
-        
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-            http.Error(w, err.Error(), http.StatusBadRequest)
-            return
+        detectOllamaCompat(ctx, cfg)
+        if cfg.AutoSelectModel {
+            if _, err := models.list(ctx); err != nil {
+                log.Printf("Cannot check that %s is installed: %v", cfg.DefaultModel, err)
+            }
         }
-
-        chatReq := ChatRequest{
-            Model:  "codellama:7b", // Updated to use available model
-            Prompt: req.Prompt,
-            Stream: false,
+        if unload != nil {
+            go unload.run(ctx)
         }
-
-        reqBody, _ := json.Marshal(chatReq)
-        
-        // Add timeout and better error handling
-        client := &http.Client{Timeout: 30 * time.Second}
-        resp, err := client.Post(ollamaURL+"/api/generate", "application/json", bytes.NewBuffer(reqBody))
-        if err != nil {
-            log.Printf("Error connecting to Ollama: %v", err)
-            http.Error(w, fmt.Sprintf("Cannot connect to Ollama: %v", err), http.StatusInternalServerError)
-            return
+        if warm != nil {
+            warm.run(ctx)
         }
-        defer resp.Body.Close()
+    }()
+    if audit != nil {
+        go audit.run(ctx)
+    }
+    if spools != nil {
+        go spools.run(ctx)
+    }
 
-        if resp.StatusCode != http.StatusOK {
-            body, _ := io.ReadAll(resp.Body)
-            log.Printf("Ollama responded with status %d: %s", resp.StatusCode, string(body))
-            http.Error(w, fmt.Sprintf("Ollama error: %s", string(body)), http.StatusInternalServerError)
-            return
-        }
+    var handler http.Handler = http.DefaultServeMux
+    if cfg.CompressResponses {
+        handler = compressResponses(handler, cfg.CompressEncodings, cfg.CompressLevel)
+    }
+    srv := &http.Server{
+        Addr:    ":" + cfg.Port,
+        Handler: drain.track(securityHeaders(cfg, requireTLS(cfg, handler))),
+    }
 
-        body, err := io.ReadAll(resp.Body)
-        if err != nil {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
+    go func() {
+        log.Printf("DeepSeek interface starting on port %s", cfg.Port)
+        var err error
+        if cfg.TLSCertFile != "" {
+            err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+        } else {
+            err = srv.ListenAndServe()
         }
-
-        var chatResp ChatResponse
-        if err := json.Unmarshal(body, &chatResp); err != nil {
-            log.Printf("Failed to parse Ollama response: %s", string(body))
-            http.Error(w, fmt.Sprintf("Invalid response from Ollama: %v", err), http.StatusInternalServerError)
-            return
+        if !errors.Is(err, http.ErrServerClosed) {
+            log.Fatal(err)
         }
+    }()
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(map[string]string{"response": chatResp.Response})
-    })
-
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "8080"
-    }
+    <-ctx.Done()
 
-    log.Printf("DeepSeek interface starting on port %s", port)
-    log.Fatal(http.ListenAndServe(":"+port, nil))
+    drain.drain(srv, cfg.DrainTimeout)
+    audit.close()
+    events.close()
+    log.Printf("Shutdown complete")
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+    "fmt"
+    "html"
+    "regexp"
+    "strings"
+)
+
+// Response formats for RESPONSE_FORMAT and the per-request "format" field.
+// raw and markdown both return the model's text untouched and only tell the
+// client how to treat it; html also returns it rendered by renderMarkdown.
+const (
+    formatRaw      = "raw"
+    formatMarkdown = "markdown"
+    formatHTML     = "html"
+)
+
+func parseResponseFormat(s string) (string, error) {
+    switch s {
+    case formatRaw, formatMarkdown, formatHTML:
+        return s, nil
+    }
+    return "", fmt.Errorf("format must be raw, markdown or html, got %q", s)
+}
+
+var (
+    mdHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+    mdBullet   = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+    mdOrdered  = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+    mdLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+    mdBold     = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+    mdItalic   = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+    mdLanguage = regexp.MustCompile(`^[A-Za-z0-9_+-]+$`)
+)
+
+// renderMarkdown converts the Markdown models usually produce (headings,
+// lists, fenced code, emphasis, inline code and links) to HTML. All text is
+// escaped before any markup is added, so the only tags in the output are the
+// ones generated here and raw HTML from the model is shown, never run. Links
+// are only kept for http, https and mailto URLs.
+func renderMarkdown(src string) string {
+    var out strings.Builder
+    var para []string
+    list := "" // "ul" or "ol" while inside a list
+
+    flushPara := func() {
+        if len(para) > 0 {
+            out.WriteString("<p>" + renderInline(strings.Join(para, "\n")) + "</p>\n")
+            para = nil
+        }
+    }
+    closeList := func() {
+        if list != "" {
+            out.WriteString("</" + list + ">\n")
+            list = ""
+        }
+    }
+    openList := func(kind string) {
+        if list != kind {
+            closeList()
+            out.WriteString("<" + kind + ">\n")
+            list = kind
+        }
+    }
+
+    lines := strings.Split(normalizeNewlines(src), "\n")
+    for i := 0; i < len(lines); i++ {
+        line := lines[i]
+        trimmed := strings.TrimSpace(line)
+
+        if strings.HasPrefix(trimmed, "```") {
+            flushPara()
+            closeList()
+            lang := strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+            var code []string
+            for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+                code = append(code, lines[i])
+            }
+            out.WriteString("<pre><code")
+            if mdLanguage.MatchString(lang) {
+                out.WriteString(` class="language-` + lang + `"`)
+            }
+            out.WriteString(">" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+            continue
+        }
+
+        if trimmed == "" {
+            flushPara()
+            closeList()
+            continue
+        }
+        if m := mdHeading.FindStringSubmatch(trimmed); m != nil {
+            flushPara()
+            closeList()
+            n := len(m[1])
+            fmt.Fprintf(&out, "<h%d>%s</h%d>\n", n, renderInline(m[2]), n)
+            continue
+        }
+        if m := mdBullet.FindStringSubmatch(line); m != nil {
+            flushPara()
+            openList("ul")
+            out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+            continue
+        }
+        if m := mdOrdered.FindStringSubmatch(line); m != nil {
+            flushPara()
+            openList("ol")
+            out.WriteString("<li>" + renderInline(m[1]) + "</li>\n")
+            continue
+        }
+        closeList()
+        para = append(para, trimmed)
+    }
+    flushPara()
+    closeList()
+    return out.String()
+}
+
+// renderInline handles code spans, links and emphasis within one block.
+// Code spans are split out first so nothing inside them is interpreted.
+func renderInline(s string) string {
+    parts := strings.Split(s, "`")
+    var out strings.Builder
+    for i, part := range parts {
+        // An unmatched trailing backtick is text, not an open code span.
+        if i%2 == 1 && i < len(parts)-1 {
+            out.WriteString("<code>" + html.EscapeString(part) + "</code>")
+            continue
+        }
+        if i%2 == 1 {
+            out.WriteString("`")
+        }
+        out.WriteString(renderEmphasis(html.EscapeString(part)))
+    }
+    return out.String()
+}
+
+// renderEmphasis works on already escaped text.
+func renderEmphasis(s string) string {
+    s = mdLink.ReplaceAllStringFunc(s, func(m string) string {
+        sub := mdLink.FindStringSubmatch(m)
+        url := sub[2]
+        lower := strings.ToLower(url)
+        if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "mailto:") {
+            return m
+        }
+        return `<a href="` + url + `" rel="nofollow noopener">` + sub[1] + `</a>`
+    })
+    s = mdBold.ReplaceAllString(s, "<strong>$1</strong>")
+    s = mdItalic.ReplaceAllString(s, "<em>$1</em>")
+    return s
+}
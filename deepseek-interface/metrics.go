@@ -0,0 +1,172 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+const openMetricsType = "application/openmetrics-text"
+
+// wantsOpenMetrics reports whether the Accept header prefers OpenMetrics
+// to the classic text format, as newer Prometheus servers ask for.
+func wantsOpenMetrics(accept string) bool {
+    weights := acceptWeights(accept)
+    om := weights[openMetricsType]
+    return om > 0 && om >= weights["text/plain"]
+}
+
+// toOpenMetrics rewrites the classic exposition format as OpenMetrics 1.0.
+// The only differences in what we emit are that a counter's family is
+// named without the _total its samples carry, and the closing # EOF.
+func toOpenMetrics(classic []byte) []byte {
+    var out bytes.Buffer
+    var pending []string // a family's HELP line, until its TYPE says what it is
+    scanner := bufio.NewScanner(bytes.NewReader(classic))
+    for scanner.Scan() {
+        line := scanner.Text()
+        switch {
+        case strings.HasPrefix(line, "# HELP "):
+            pending = append(pending, line)
+            continue
+        case strings.HasPrefix(line, "# TYPE ") && strings.HasSuffix(line, " counter"):
+            name := strings.Fields(line)[2]
+            family := strings.TrimSuffix(name, "_total")
+            for _, help := range pending {
+                fmt.Fprintln(&out, strings.Replace(help, name, family, 1))
+            }
+            pending = nil
+            line = strings.Replace(line, name, family, 1)
+        }
+        for _, help := range pending {
+            fmt.Fprintln(&out, help)
+        }
+        pending = nil
+        fmt.Fprintln(&out, line)
+    }
+    out.WriteString("# EOF\n")
+    return out.Bytes()
+}
+
+// metricsHandler serves a small set of gauges in the Prometheus text
+// exposition format, or in OpenMetrics when the scraper asks for it.
+func metricsHandler(adm, embedAdm *admission, lat *latencyTracker, streams *streamSlots, limits *rateLimitCounters, flights *flightGroup, caches []namedCache, tags *tagUsage) http.HandlerFunc {
+    return func(rw http.ResponseWriter, r *http.Request) {
+        queued, active := adm.depths()
+
+        // Written in the classic format, then converted if need be.
+        w := &bytes.Buffer{}
+        fmt.Fprintln(w, "# HELP deepseek_queue_depth Requests waiting for a generation slot.")
+        fmt.Fprintln(w, "# TYPE deepseek_queue_depth gauge")
+        for p, n := range queued {
+            fmt.Fprintf(w, "deepseek_queue_depth{priority=%q} %d\n", priority(p), n)
+        }
+        fmt.Fprintln(w, "# HELP deepseek_active_generations Generations currently running against Ollama.")
+        fmt.Fprintln(w, "# TYPE deepseek_active_generations gauge")
+        fmt.Fprintf(w, "deepseek_active_generations %d\n", active)
+        fmt.Fprintln(w, "# HELP deepseek_queue_abandoned_total Queued requests dropped because the client went away before a slot came free.")
+        fmt.Fprintln(w, "# TYPE deepseek_queue_abandoned_total counter")
+        fmt.Fprintf(w, "deepseek_queue_abandoned_total %d\n", adm.abandonedCount())
+
+        fmt.Fprintln(w, "# HELP deepseek_sse_connections Streaming responses currently open.")
+        fmt.Fprintln(w, "# TYPE deepseek_sse_connections gauge")
+        fmt.Fprintf(w, "deepseek_sse_connections %d\n", streams.active.Load())
+
+        fmt.Fprintln(w, "# HELP deepseek_rate_limited_total Rate-limit rejections: ours (local) or received from Ollama (upstream).")
+        fmt.Fprintln(w, "# TYPE deepseek_rate_limited_total counter")
+        fmt.Fprintf(w, "deepseek_rate_limited_total{source=\"local\"} %d\n", limits.local.Load())
+        fmt.Fprintf(w, "deepseek_rate_limited_total{source=\"upstream\"} %d\n", limits.upstream.Load())
+        fmt.Fprintln(w, "# HELP deepseek_upstream_429_retries_total Upstream 429s waited out and retried.")
+        fmt.Fprintln(w, "# TYPE deepseek_upstream_429_retries_total counter")
+        fmt.Fprintf(w, "deepseek_upstream_429_retries_total %d\n", limits.retried.Load())
+
+        fmt.Fprintln(w, "# HELP deepseek_coalesced_requests_total /chat requests answered by another identical request's generation.")
+        fmt.Fprintln(w, "# TYPE deepseek_coalesced_requests_total counter")
+        fmt.Fprintf(w, "deepseek_coalesced_requests_total %d\n", flights.coalesced.Load())
+
+        cacheCounter := func(name, help string, value func(cacheCounts) int64) {
+            fmt.Fprintf(w, "# HELP deepseek_cache_%s_total %s\n", name, help)
+            fmt.Fprintf(w, "# TYPE deepseek_cache_%s_total counter\n", name)
+            for _, c := range caches {
+                fmt.Fprintf(w, "deepseek_cache_%s_total{cache=%q} %d\n", name, c.name, value(c.stats.counts()))
+            }
+        }
+        cacheCounter("hits", "Lookups answered from the cache.", func(c cacheCounts) int64 { return c.Hits })
+        cacheCounter("misses", "Lookups that had to go to Ollama.", func(c cacheCounts) int64 { return c.Misses })
+        cacheCounter("evictions", "Cached values dropped on expiry or invalidation.", func(c cacheCounts) int64 { return c.Evictions })
+
+        tagCounts, tagNames := tags.snapshot()
+        fmt.Fprintln(w, "# HELP deepseek_tag_requests_total Finished requests by their tag.")
+        fmt.Fprintln(w, "# TYPE deepseek_tag_requests_total counter")
+        for _, tag := range tagNames {
+            fmt.Fprintf(w, "deepseek_tag_requests_total{tag=%q} %d\n", tag, tagCounts[tag].Requests)
+        }
+        fmt.Fprintln(w, "# HELP deepseek_tag_tokens_total Tokens generated for requests by their tag.")
+        fmt.Fprintln(w, "# TYPE deepseek_tag_tokens_total counter")
+        for _, tag := range tagNames {
+            fmt.Fprintf(w, "deepseek_tag_tokens_total{tag=%q} %d\n", tag, tagCounts[tag].Tokens)
+        }
+
+        embedQueued, embedActive := embedAdm.depths()
+        fmt.Fprintln(w, "# HELP deepseek_embeddings_queue_depth Embedding requests waiting for a slot.")
+        fmt.Fprintln(w, "# TYPE deepseek_embeddings_queue_depth gauge")
+        fmt.Fprintf(w, "deepseek_embeddings_queue_depth %d\n", embedQueued[priorityNormal])
+        fmt.Fprintln(w, "# HELP deepseek_active_embeddings Embedding requests currently running against Ollama.")
+        fmt.Fprintln(w, "# TYPE deepseek_active_embeddings gauge")
+        fmt.Fprintf(w, "deepseek_active_embeddings %d\n", embedActive)
+
+        fmt.Fprintln(w, "# HELP deepseek_queue_wait_seconds Time requests spent waiting for a slot, by prompt size.")
+        fmt.Fprintln(w, "# TYPE deepseek_queue_wait_seconds summary")
+        for i, ws := range adm.waitTimes() {
+            fmt.Fprintf(w, "deepseek_queue_wait_seconds_sum{size=%q} %g\n", sizeBuckets[i].name, ws.Seconds)
+            fmt.Fprintf(w, "deepseek_queue_wait_seconds_count{size=%q} %d\n", sizeBuckets[i].name, ws.Count)
+        }
+
+        hists := lat.histograms()
+        models := make([]string, 0, len(hists))
+        for name := range hists {
+            models = append(models, name)
+        }
+        sort.Strings(models)
+
+        fmt.Fprintln(w, "# HELP deepseek_generation_seconds Time from sending a generation to Ollama until it finished, by model.")
+        fmt.Fprintln(w, "# TYPE deepseek_generation_seconds histogram")
+        for _, name := range models {
+            h := hists[name]
+            for i, n := range h.Buckets {
+                le := "+Inf"
+                if i < len(latencyBuckets) {
+                    le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+                }
+                fmt.Fprintf(w, "deepseek_generation_seconds_bucket{model=%q,le=%q} %d\n", name, le, n)
+            }
+            fmt.Fprintf(w, "deepseek_generation_seconds_sum{model=%q} %g\n", name, h.Sum)
+            fmt.Fprintf(w, "deepseek_generation_seconds_count{model=%q} %d\n", name, h.Buckets[len(h.Buckets)-1])
+        }
+
+        stats := lat.snapshot()
+        fmt.Fprintln(w, "# HELP deepseek_generation_p95_seconds Estimated p95 generation latency over the rolling window.")
+        fmt.Fprintln(w, "# TYPE deepseek_generation_p95_seconds gauge")
+        for _, name := range models {
+            fmt.Fprintf(w, "deepseek_generation_p95_seconds{model=%q} %g\n", name, stats[name].P95Seconds)
+        }
+        fmt.Fprintln(w, "# HELP deepseek_generation_p50_seconds Estimated median generation latency over the rolling window.")
+        fmt.Fprintln(w, "# TYPE deepseek_generation_p50_seconds gauge")
+        for _, name := range models {
+            fmt.Fprintf(w, "deepseek_generation_p50_seconds{model=%q} %g\n", name, stats[name].P50Seconds)
+        }
+
+        rw.Header().Add("Vary", "Accept")
+        if wantsOpenMetrics(r.Header.Get("Accept")) {
+            rw.Header().Set("Content-Type", openMetricsType+"; version=1.0.0; charset=utf-8")
+            rw.Write(toOpenMetrics(w.Bytes()))
+            return
+        }
+        rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        rw.Write(w.Bytes())
+    }
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+)
+
+// securityHeaders sets Strict-Transport-Security on responses served over
+// HTTPS. It is never sent over plain HTTP, where browsers ignore it anyway
+// and it would only confuse staging setups without TLS.
+func securityHeaders(cfg *config, next http.Handler) http.Handler {
+    hsts := fmt.Sprintf("max-age=%d", cfg.HSTSMaxAge)
+    if cfg.HSTSIncludeSubdomains {
+        hsts += "; includeSubDomains"
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if cfg.HSTSEnabled && cfg.isHTTPS(r) {
+            w.Header().Set("Strict-Transport-Security", hsts)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// tlsExempt are reachable over plain HTTP even with REQUIRE_TLS, since
+// probes and metrics scrapes come straight to the pod rather than through
+// the TLS-terminating proxy.
+var tlsExempt = map[string]bool{"/healthz": true, "/metrics": true}
+
+// requireTLS answers requests that didn't arrive over HTTPS with 426
+// Upgrade Required when REQUIRE_TLS is set. Whether they did is decided by
+// isHTTPS, so X-Forwarded-Proto is only believed from TRUSTED_PROXIES and
+// a client can't get past this by claiming https itself.
+func requireTLS(cfg *config, next http.Handler) http.Handler {
+    if !cfg.RequireTLS {
+        return next
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !cfg.isHTTPS(r) && !tlsExempt[r.URL.Path] {
+            w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+            w.Header().Set("Connection", "Upgrade")
+            jsonError(w, "this server only accepts HTTPS requests", http.StatusUpgradeRequired)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "crypto/tls"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestRequireTLS(t *testing.T) {
+    cfg := testConfig(t, "REQUIRE_TLS", "true", "TRUSTED_PROXIES", "10.0.0.0/8")
+    h := requireTLS(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    tests := []struct {
+        name, peer, proto, path string
+        tls                     bool
+        want                    int
+    }{
+        {"trusted proxy, https", "10.1.2.3:5000", "https", "/chat", false, http.StatusOK},
+        {"trusted proxy, HTTPS", "10.1.2.3:5000", "HTTPS", "/chat", false, http.StatusOK},
+        {"trusted proxy, http", "10.1.2.3:5000", "http", "/chat", false, http.StatusUpgradeRequired},
+        {"trusted proxy, no header", "10.1.2.3:5000", "", "/chat", false, http.StatusUpgradeRequired},
+        {"untrusted peer claiming https", "203.0.113.9:5000", "https", "/chat", false, http.StatusUpgradeRequired},
+        {"untrusted peer, plain", "203.0.113.9:5000", "", "/", false, http.StatusUpgradeRequired},
+        {"direct TLS", "203.0.113.9:5000", "", "/chat", true, http.StatusOK},
+        {"health probe", "10.244.0.1:5000", "", "/healthz", false, http.StatusOK},
+        {"metrics scrape", "203.0.113.9:5000", "http", "/metrics", false, http.StatusOK},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest("POST", tt.path, nil)
+        r.RemoteAddr = tt.peer
+        if tt.proto != "" {
+            r.Header.Set("X-Forwarded-Proto", tt.proto)
+        }
+        if tt.tls {
+            r.TLS = &tls.ConnectionState{}
+        }
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, r)
+        if w.Code != tt.want {
+            t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+        }
+        if tt.want == http.StatusUpgradeRequired && w.Header().Get("Upgrade") == "" {
+            t.Errorf("%s: 426 without an Upgrade header", tt.name)
+        }
+    }
+}
+
+func TestRequireTLSOff(t *testing.T) {
+    cfg := testConfig(t, "REQUIRE_TLS", "false")
+    h := requireTLS(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    r := httptest.NewRequest("POST", "/chat", nil)
+    r.Header.Set("X-Forwarded-Proto", "http")
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, r)
+    if w.Code != http.StatusOK {
+        t.Errorf("plain HTTP with REQUIRE_TLS off = %d", w.Code)
+    }
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// modelHealth marks a model degraded after it fails a number of
+// generations in a row, so /models can flag it and the UI stops offering
+// it. A degraded model gets another chance once the cooldown passes: the
+// next failure degrades it again straight away, a success clears it.
+type modelHealth struct {
+    threshold int // consecutive failures; 0 disables tracking
+    cooldown  time.Duration
+
+    mu     sync.Mutex
+    models map[string]*modelFailures
+}
+
+type modelFailures struct {
+    consecutive int
+    lastError   string
+    degradedAt  time.Time
+}
+
+// degradation is how a degraded model is flagged in /models.
+type degradation struct {
+    Reason   string    `json:"reason"`
+    Since    time.Time `json:"since"`
+    Failures int       `json:"failures"`
+}
+
+func newModelHealth(cfg *config) *modelHealth {
+    return &modelHealth{
+        threshold: cfg.ModelDegradeAfter,
+        cooldown:  cfg.ModelDegradeCooldown,
+        models:    make(map[string]*modelFailures),
+    }
+}
+
+func (h *modelHealth) success(model string) {
+    if h.threshold == 0 {
+        return
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if f := h.models[model]; f != nil && !f.degradedAt.IsZero() {
+        log.Printf("Model %s recovered", model)
+    }
+    delete(h.models, model)
+}
+
+func (h *modelHealth) failure(model, reason string) {
+    if h.threshold == 0 {
+        return
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    f := h.models[model]
+    if f == nil {
+        f = &modelFailures{}
+        h.models[model] = f
+    }
+    f.consecutive++
+    f.lastError = reason
+    if f.consecutive >= h.threshold && f.degradedAt.IsZero() {
+        f.degradedAt = time.Now()
+        log.Printf("Model %s degraded after %d failures in a row: %s", model, f.consecutive, reason)
+    }
+}
+
+// degraded returns why model is degraded, or nil if it isn't.
+func (h *modelHealth) degraded(model string) *degradation {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    f := h.models[model]
+    if f == nil || f.degradedAt.IsZero() {
+        return nil
+    }
+    if time.Since(f.degradedAt) >= h.cooldown {
+        // On probation: one more failure degrades it again.
+        f.degradedAt = time.Time{}
+        f.consecutive = h.threshold - 1
+        return nil
+    }
+    return &degradation{Reason: f.lastError, Since: f.degradedAt, Failures: f.consecutive}
+}
+
+// enable clears model's failure history and reports whether it was degraded.
+func (h *modelHealth) enable(model string) bool {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    f := h.models[model]
+    delete(h.models, model)
+    return f != nil && !f.degradedAt.IsZero()
+}
+
+// modelsEnableHandler serves POST /models/enable {"model": "..."}, letting
+// an admin put a degraded model back in the list without waiting out the
+// cooldown.
+func modelsEnableHandler(cfg *config, health *modelHealth) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !isAdmin(r, cfg.AdminToken) {
+            jsonError(w, "re-enabling a model requires a valid admin token", http.StatusForbidden)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+        var in struct {
+            Model string `json:"model"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Model == "" {
+            jsonError(w, "model is required", http.StatusBadRequest)
+            return
+        }
+        wasDegraded := health.enable(in.Model)
+        if wasDegraded {
+            log.Printf("Model %s re-enabled by an admin", in.Model)
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{"model": in.Model, "was_degraded": wasDegraded})
+    }
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestModelHealthTransitions(t *testing.T) {
+    h := &modelHealth{threshold: 3, cooldown: time.Minute, models: make(map[string]*modelFailures)}
+
+    h.failure("m", "timeout")
+    h.failure("m", "timeout")
+    if h.degraded("m") != nil {
+        t.Fatal("degraded after 2 failures with a threshold of 3")
+    }
+    h.success("m")
+    h.failure("m", "timeout")
+    h.failure("m", "timeout")
+    if h.degraded("m") != nil {
+        t.Fatal("a success didn't reset the count of failures in a row")
+    }
+
+    h.failure("m", "out of memory")
+    d := h.degraded("m")
+    if d == nil || d.Reason != "out of memory" || d.Failures != 3 {
+        t.Fatalf("after 3 failures in a row = %+v, want degraded for out of memory", d)
+    }
+    if h.degraded("other") != nil {
+        t.Error("a model that never failed is degraded")
+    }
+
+    // Past the cooldown it is on probation: listed again, but the next
+    // failure degrades it at once.
+    h.models["m"].degradedAt = time.Now().Add(-2 * time.Minute)
+    if h.degraded("m") != nil {
+        t.Fatal("still degraded after the cooldown")
+    }
+    h.failure("m", "timeout")
+    if h.degraded("m") == nil {
+        t.Fatal("a failure on probation didn't degrade the model again")
+    }
+
+    h.models["m"].degradedAt = time.Now().Add(-2 * time.Minute)
+    h.degraded("m")
+    h.success("m")
+    h.failure("m", "timeout")
+    if h.degraded("m") != nil {
+        t.Error("a success on probation didn't clear the model")
+    }
+}
+
+func TestModelHealthDisabled(t *testing.T) {
+    h := &modelHealth{threshold: 0, models: make(map[string]*modelFailures)}
+    for i := 0; i < 10; i++ {
+        h.failure("m", "timeout")
+    }
+    if h.degraded("m") != nil {
+        t.Error("a model was degraded with MODEL_DEGRADE_AFTER=0")
+    }
+}
+
+func TestModelsFlagsAndEnablesDegraded(t *testing.T) {
+    store := &modelStore{}
+    store.set("good:7b", "bad:7b")
+    ollama := store.ollama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "ADMIN_TOKEN", "secret", "MODEL_DEGRADE_AFTER", "2")
+    health := newModelHealth(cfg)
+    health.failure("bad:7b", "model runner crashed")
+    health.failure("bad:7b", "model runner crashed")
+
+    list := func() map[string]*degradation {
+        w := httptest.NewRecorder()
+        modelsHandler(cfg, newModelCache(cfg), health)(w, httptest.NewRequest("GET", "/models", nil))
+        var reply struct {
+            Models []struct {
+                Name     string
+                Degraded *degradation
+            }
+        }
+        json.Unmarshal(w.Body.Bytes(), &reply)
+        out := make(map[string]*degradation)
+        for _, m := range reply.Models {
+            out[m.Name] = m.Degraded
+        }
+        return out
+    }
+    models := list()
+    if models["good:7b"] != nil || models["bad:7b"] == nil || models["bad:7b"].Reason != "model runner crashed" {
+        t.Fatalf("/models = %+v, want only bad:7b flagged", models)
+    }
+
+    enable := func(token string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest("POST", "/models/enable", strings.NewReader(`{"model": "bad:7b"}`))
+        r.Header.Set("Content-Type", "application/json")
+        r.Header.Set("Authorization", "Bearer "+token)
+        w := httptest.NewRecorder()
+        modelsEnableHandler(cfg, health)(w, r)
+        return w
+    }
+    if w := enable("wrong"); w.Code != http.StatusForbidden {
+        t.Errorf("enable with the wrong token = %d, want 403", w.Code)
+    }
+    w := enable("secret")
+    if reply := decode(t, w); reply["was_degraded"] != true {
+        t.Errorf("enable = %v, want was_degraded true", reply)
+    }
+    if models := list(); models["bad:7b"] != nil {
+        t.Errorf("bad:7b still flagged after being re-enabled: %+v", models["bad:7b"])
+    }
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// modelInfo is the subset of Ollama's /api/tags entry we pass on.
+type modelInfo struct {
+    Name       string    `json:"name"`
+    Size       int64     `json:"size"`
+    ModifiedAt time.Time `json:"modified_at"`
+    // ContextLength is the most tokens of context the model supports, from
+    // /api/show; 0 when Ollama doesn't say.
+    ContextLength int `json:"context_length,omitempty"`
+}
+
+// contextLength is a model's context length as of the version of the model
+// it was read from.
+type contextLength struct {
+    modifiedAt time.Time
+    tokens     int
+}
+
+// modelCache keeps the installed model list for a short while so every
+// page load doesn't hit Ollama. With MODELS_CACHE_STALE, a list past its
+// TTL is still served for that long while a fresh one is fetched in the
+// background, so no request waits on Ollama around the expiry.
+type modelCache struct {
+    cfg   *config
+    ttl   time.Duration
+    stale time.Duration
+
+    mu      sync.Mutex
+    models  []modelInfo
+    fetched time.Time
+    // gen changes whenever the list is invalidated, so a background
+    // refresh begun before then doesn't bring the old list back.
+    gen        int
+    refreshing bool
+
+    // fetching lets one fetch from Ollama run at a time, and guards
+    // contexts. It is taken before mu, never while holding it.
+    fetching sync.Mutex
+    // Kept across refreshes: a model's context length only changes when
+    // the model does.
+    contexts map[string]contextLength
+
+    stats cacheStats
+}
+
+func newModelCache(cfg *config) *modelCache {
+    return &modelCache{cfg: cfg, ttl: cfg.ModelsCacheTTL, stale: cfg.ModelsCacheStale, contexts: make(map[string]contextLength)}
+}
+
+func (c *modelCache) list(ctx context.Context) ([]modelInfo, error) {
+    c.mu.Lock()
+    age := time.Since(c.fetched)
+    if c.models != nil && age < c.ttl {
+        c.stats.hits.Add(1)
+        defer c.mu.Unlock()
+        return c.models, nil
+    }
+    if c.models != nil && age < c.ttl+c.stale {
+        c.stats.hits.Add(1)
+        c.revalidate()
+        defer c.mu.Unlock()
+        return c.models, nil
+    }
+    c.mu.Unlock()
+
+    c.fetching.Lock()
+    defer c.fetching.Unlock()
+    // Another request may have fetched the list while this one waited.
+    c.mu.Lock()
+    if c.models != nil && time.Since(c.fetched) < c.ttl {
+        c.stats.hits.Add(1)
+        defer c.mu.Unlock()
+        return c.models, nil
+    }
+    c.stats.misses.Add(1)
+    if c.models != nil {
+        c.stats.evictions.Add(1)
+        c.models = nil
+    }
+    gen := c.gen
+    c.mu.Unlock()
+
+    models, err := c.fetch(ctx)
+    if err != nil {
+        return nil, err
+    }
+    c.mu.Lock()
+    if c.gen == gen {
+        c.models, c.fetched = models, time.Now()
+    }
+    c.mu.Unlock()
+    return models, nil
+}
+
+// revalidate fetches the list in the background while the stale one is
+// served, one fetch at a time. c.mu must be held.
+func (c *modelCache) revalidate() {
+    if c.refreshing {
+        return
+    }
+    c.refreshing = true
+    gen := c.gen
+    go func() {
+        c.fetching.Lock()
+        defer c.fetching.Unlock()
+        c.mu.Lock()
+        fresh := c.models != nil && time.Since(c.fetched) < c.ttl
+        c.mu.Unlock()
+        var models []modelInfo
+        var err error
+        if !fresh {
+            if models, err = c.fetch(context.Background()); err != nil {
+                log.Printf("Cannot refresh the model list, serving the cached one: %v", err)
+            }
+        }
+        c.mu.Lock()
+        defer c.mu.Unlock()
+        c.refreshing = false
+        if models != nil && c.gen == gen {
+            c.stats.evictions.Add(1)
+            c.models, c.fetched = models, time.Now()
+        }
+    }()
+}
+
+// fetch asks Ollama for the installed models. c.fetching must be held.
+func (c *modelCache) fetch(ctx context.Context) ([]modelInfo, error) {
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, "GET", c.cfg.ollamaAPI("/api/tags"), nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("cannot connect to Ollama: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Ollama responded with status %d", resp.StatusCode)
+    }
+
+    var tags struct {
+        Models []modelInfo `json:"models"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+        return nil, fmt.Errorf("invalid response from Ollama: %w", err)
+    }
+    if tags.Models == nil {
+        tags.Models = []modelInfo{}
+    }
+    for i := range tags.Models {
+        tags.Models[i].ContextLength = c.contextLength(ctx, tags.Models[i])
+    }
+    c.selectDefault(tags.Models)
+    return tags.Models, nil
+}
+
+// selectDefault, with AUTO_SELECT_MODEL, picks the first installed model,
+// the most recently changed as Ollama orders them, as the default while
+// DEFAULT_MODEL isn't installed, and drops it once DEFAULT_MODEL is back.
+// With nothing installed DEFAULT_MODEL stays, and requests fail as usual.
+func (c *modelCache) selectDefault(models []modelInfo) {
+    if !c.cfg.AutoSelectModel || len(models) == 0 {
+        return
+    }
+    want := c.cfg.DefaultModel
+    for _, m := range models {
+        if m.Name == want || m.Name == want+":latest" {
+            if c.cfg.autoModel.Swap(nil) != nil {
+                log.Printf("Default model %s is installed again", want)
+            }
+            return
+        }
+    }
+    name := models[0].Name
+    if prev := c.cfg.autoModel.Load(); prev == nil || *prev != name {
+        log.Printf("Default model %s is not installed; using %s", want, name)
+        c.cfg.autoModel.Store(&name)
+    }
+}
+
+// contextLength looks m's context length up with /api/show, unless it is
+// known for this version of the model. Failures leave it at 0 and are
+// retried on the next refresh.
+func (c *modelCache) contextLength(ctx context.Context, m modelInfo) int {
+    if known, ok := c.contexts[m.Name]; ok && known.modifiedAt.Equal(m.ModifiedAt) {
+        return known.tokens
+    }
+    body, _ := json.Marshal(map[string]string{"model": m.Name})
+    req, err := http.NewRequestWithContext(ctx, "POST", c.cfg.ollamaAPI("/api/show"), bytes.NewReader(body))
+    if err != nil {
+        return 0
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        log.Printf("Cannot read the context length of %s: %v", m.Name, err)
+        return 0
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        log.Printf("Cannot read the context length of %s: Ollama responded with status %d", m.Name, resp.StatusCode)
+        return 0
+    }
+    var show struct {
+        ModelInfo map[string]interface{} `json:"model_info"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&show); err != nil {
+        log.Printf("Cannot read the context length of %s: %v", m.Name, err)
+        return 0
+    }
+    // The key is prefixed with the architecture, e.g. llama.context_length.
+    arch, _ := show.ModelInfo["general.architecture"].(string)
+    n, _ := show.ModelInfo[arch+".context_length"].(float64)
+    c.contexts[m.Name] = contextLength{modifiedAt: m.ModifiedAt, tokens: int(n)}
+    return int(n)
+}
+
+// invalidate drops the cached list so the next call asks Ollama again.
+func (c *modelCache) invalidate() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.models != nil {
+        c.stats.evictions.Add(1)
+    }
+    c.models = nil
+    c.gen++
+}
+
+// modelsHandler lists the models installed in Ollama along with the
+// server's default. "empty" marks a fresh Ollama install with nothing to
+// chat with; the UI then offers the SUGGESTED_MODELS, through /models/pull
+// when "pull_enabled" says it is there.
+func modelsHandler(cfg *config, cache *modelCache, health *modelHealth) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        cached, err := cache.list(r.Context())
+        if err != nil {
+            jsonError(w, err.Error(), http.StatusBadGateway)
+            return
+        }
+        type listedModel struct {
+            modelInfo
+            Degraded *degradation `json:"degraded,omitempty"`
+        }
+        models := make([]listedModel, len(cached))
+        for i, m := range cached {
+            models[i] = listedModel{m, health.degraded(m.Name)}
+        }
+        reply := map[string]interface{}{
+            "models":        models,
+            "default":       cfg.defaultModel(),
+            "empty":         len(models) == 0,
+            "pull_enabled":  cfg.AllowPull,
+            "spool_enabled": cfg.SpoolMaxBytes > 0,
+        }
+        if len(models) == 0 {
+            reply["suggested"] = cfg.SuggestedModels
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(reply)
+    }
+}
+
+// modelsRefreshHandler drops the cached model list and returns a fresh one,
+// for admins who just installed a model and don't want to wait out the TTL.
+func modelsRefreshHandler(cfg *config, cache *modelCache, health *modelHealth) http.HandlerFunc {
+    list := modelsHandler(cfg, cache, health)
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !isAdmin(r, cfg.AdminToken) {
+            jsonError(w, "refreshing the model list requires a valid admin token", http.StatusForbidden)
+            return
+        }
+        cache.invalidate()
+        list(w, r)
+    }
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// modelStore is an Ollama whose installed models the test can change. A
+// pull installs the named model. While gate is set, /api/tags waits for it
+// to close.
+type modelStore struct {
+    mu        sync.Mutex
+    installed []string
+    tagCalls  int
+    gate      chan struct{}
+}
+
+func (s *modelStore) set(names ...string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.installed = names
+}
+
+func (s *modelStore) calls() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.tagCalls
+}
+
+func (s *modelStore) ollama(t *testing.T) *fakeOllama {
+    return newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/tags": func(w http.ResponseWriter, r *http.Request) {
+            s.mu.Lock()
+            gate := s.gate
+            s.mu.Unlock()
+            if gate != nil {
+                <-gate
+            }
+            s.mu.Lock()
+            defer s.mu.Unlock()
+            s.tagCalls++
+            var models []modelInfo
+            for _, name := range s.installed {
+                models = append(models, modelInfo{Name: name})
+            }
+            json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
+        },
+        "/api/show": func(w http.ResponseWriter, r *http.Request) {
+            w.Write([]byte(`{"model_info": {}}`))
+        },
+        "/api/pull": func(w http.ResponseWriter, r *http.Request) {
+            var req struct{ Model string }
+            json.NewDecoder(r.Body).Decode(&req)
+            s.mu.Lock()
+            s.installed = append(s.installed, req.Model)
+            s.mu.Unlock()
+            fmt.Fprintln(w, `{"status": "pulling manifest"}`)
+            fmt.Fprintln(w, `{"status": "success"}`)
+        },
+    })
+}
+
+// names lists the models /models returned.
+func names(t *testing.T, w *httptest.ResponseRecorder) string {
+    t.Helper()
+    var reply struct {
+        Models []modelInfo `json:"models"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+        t.Fatalf("/models reply %d %q: %v", w.Code, w.Body.String(), err)
+    }
+    var list []string
+    for _, m := range reply.Models {
+        list = append(list, m.Name)
+    }
+    return strings.Join(list, ",")
+}
+
+func TestModelsRefresh(t *testing.T) {
+    store := &modelStore{}
+    store.set("llama3:8b")
+    ollama := store.ollama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "ADMIN_TOKEN", "secret", "MODELS_CACHE_TTL", "1h")
+    cache := newModelCache(cfg)
+    health := newModelHealth(cfg)
+    models := modelsHandler(cfg, cache, health)
+    refresh := modelsRefreshHandler(cfg, cache, health)
+    get := func() *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        models(w, httptest.NewRequest("GET", "/models", nil))
+        return w
+    }
+
+    if got := names(t, get()); got != "llama3:8b" {
+        t.Fatalf("/models = %q", got)
+    }
+    store.set("llama3:8b", "qwen2:7b")
+    if got := names(t, get()); got != "llama3:8b" || store.calls() != 1 {
+        t.Fatalf("/models within the TTL = %q after %d calls to Ollama, want the cached list after 1", got, store.calls())
+    }
+
+    w := httptest.NewRecorder()
+    refresh(w, httptest.NewRequest("POST", "/models/refresh", nil))
+    if w.Code != http.StatusForbidden {
+        t.Errorf("refresh without the admin token = %d, want 403", w.Code)
+    }
+
+    r := httptest.NewRequest("POST", "/models/refresh", nil)
+    r.Header.Set("Authorization", "Bearer secret")
+    w = httptest.NewRecorder()
+    refresh(w, r)
+    if got := names(t, w); got != "llama3:8b,qwen2:7b" {
+        t.Errorf("refresh = %q, want the new list", got)
+    }
+    if got := names(t, get()); got != "llama3:8b,qwen2:7b" || store.calls() != 2 {
+        t.Errorf("/models after a refresh = %q after %d calls to Ollama, want the new list cached after 2", got, store.calls())
+    }
+}
+
+func TestModelsStaleWhileRevalidate(t *testing.T) {
+    store := &modelStore{}
+    store.set("llama3:8b")
+    ollama := store.ollama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "MODELS_CACHE_TTL", "1m", "MODELS_CACHE_STALE", "1h")
+    cache := newModelCache(cfg)
+    list := func() string {
+        t.Helper()
+        models, err := cache.list(context.Background())
+        if err != nil {
+            t.Fatal(err)
+        }
+        var list []string
+        for _, m := range models {
+            list = append(list, m.Name)
+        }
+        return strings.Join(list, ",")
+    }
+    expire := func(by time.Duration) {
+        cache.mu.Lock()
+        cache.fetched = time.Now().Add(-by)
+        cache.mu.Unlock()
+    }
+
+    if got := list(); got != "llama3:8b" {
+        t.Fatalf("first list = %q", got)
+    }
+    store.set("llama3:8b", "qwen2:7b")
+    gate := make(chan struct{})
+    store.mu.Lock()
+    store.gate = gate
+    store.mu.Unlock()
+
+    // Past the TTL but within the stale window, the old list comes back at
+    // once while Ollama, held up by the gate, is asked for a new one.
+    expire(2 * time.Minute)
+    for i := 0; i < 3; i++ {
+        if got := list(); got != "llama3:8b" {
+            t.Errorf("stale list %d = %q, want the cached one", i, got)
+        }
+    }
+    close(gate)
+    deadline := time.Now().Add(5 * time.Second)
+    for list() != "llama3:8b,qwen2:7b" {
+        if time.Now().After(deadline) {
+            t.Fatal("the background refresh never replaced the stale list")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    if n := store.calls(); n != 2 {
+        t.Errorf("%d calls to /api/tags, want one background refresh after the first", n)
+    }
+
+    // Past both windows the request waits for a fresh list.
+    store.set("qwen2:7b")
+    expire(2 * time.Hour)
+    if got := list(); got != "qwen2:7b" || store.calls() != 3 {
+        t.Errorf("expired list = %q after %d calls, want a fresh fetch", got, store.calls())
+    }
+
+    for _, env := range [][]string{{"MODELS_CACHE_TTL", "-1s"}, {"MODELS_CACHE_TTL", "30s", "MODELS_CACHE_STALE", "-1s"}} {
+        if err := configError(t, env...); err == nil {
+            t.Errorf("%s=%s was accepted", env[len(env)-2], env[len(env)-1])
+        }
+    }
+}
+
+func TestPullInvalidatesModelList(t *testing.T) {
+    store := &modelStore{}
+    store.set("llama3:8b")
+    ollama := store.ollama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "ADMIN_TOKEN", "secret", "MODELS_CACHE_TTL", "1h")
+    cache := newModelCache(cfg)
+    if _, err := cache.list(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+
+    r := httptest.NewRequest("POST", "/models/pull", strings.NewReader(`{"name": "qwen2:7b"}`))
+    r.Header.Set("Content-Type", "application/json")
+    r.Header.Set("Authorization", "Bearer secret")
+    w := httptest.NewRecorder()
+    pullHandler(cfg, newPulls(cfg), cache)(w, r)
+    if !strings.Contains(w.Body.String(), `"success"`) {
+        t.Fatalf("pull = %d %q", w.Code, w.Body.String())
+    }
+
+    models, err := cache.list(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(models) != 2 || models[1].Name != "qwen2:7b" {
+        t.Errorf("model list after the pull = %+v, want qwen2:7b in it", models)
+    }
+}
+
+func TestAutoSelectModel(t *testing.T) {
+    store := &modelStore{}
+    store.set("qwen2:7b", "llama3:8b")
+    ollama := store.ollama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "DEFAULT_MODEL", "codellama:7b",
+        "AUTO_SELECT_MODEL", "true", "MODELS_CACHE_TTL", "0")
+    cache := newModelCache(cfg)
+    refresh := func() {
+        t.Helper()
+        if _, err := cache.list(context.Background()); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    refresh()
+    if got := cfg.defaultModel(); got != "qwen2:7b" {
+        t.Errorf("default with codellama:7b missing = %q, want the first installed model", got)
+    }
+    p, err := plan(t, cfg, chatInput{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p.Upstream.Model != "qwen2:7b" {
+        t.Errorf("/chat without a model uses %q, want qwen2:7b", p.Upstream.Model)
+    }
+    if p, _ := plan(t, cfg, chatInput{Model: "llama3:8b"}); p == nil || p.Upstream.Model != "llama3:8b" {
+        t.Error("a requested model was replaced by the auto-selected default")
+    }
+
+    store.set("llama3:8b", "codellama:7b")
+    refresh()
+    if got := cfg.defaultModel(); got != "codellama:7b" {
+        t.Errorf("default once codellama:7b is installed = %q", got)
+    }
+
+    // Nothing installed leaves DEFAULT_MODEL to fail as usual.
+    store.set()
+    refresh()
+    if got := cfg.defaultModel(); got != "codellama:7b" {
+        t.Errorf("default with nothing installed = %q", got)
+    }
+}
+
+func TestAutoSelectModelMatchesLatest(t *testing.T) {
+    store := &modelStore{}
+    store.set("qwen2:7b", "llama3:latest")
+    ollama := store.ollama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "DEFAULT_MODEL", "llama3", "AUTO_SELECT_MODEL", "true")
+    if _, err := newModelCache(cfg).list(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if got := cfg.defaultModel(); got != "llama3" {
+        t.Errorf("default = %q, want llama3 kept since llama3:latest is installed", got)
+    }
+
+    off := testConfig(t, "OLLAMA_URL", ollama.URL, "DEFAULT_MODEL", "codellama:7b", "AUTO_SELECT_MODEL", "false")
+    if _, err := newModelCache(off).list(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+    if got := off.defaultModel(); got != "codellama:7b" {
+        t.Errorf("default without AUTO_SELECT_MODEL = %q", got)
+    }
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "net/url"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+)
+
+// With NATS_URL set, every completed /chat reply is published to NATS for
+// consumers that process results on their own time. Publishing never holds
+// up the client: replies go into a queue that one goroutine writes out,
+// reconnecting with backoff while the broker is down. A queue that fills up
+// meanwhile drops the newest replies rather than blocking or growing
+// without bound. Delivery is at most once.
+
+const (
+    natsQueueSize     = 1000
+    natsClosePatience = 5 * time.Second
+    natsMaxBackoff    = 30 * time.Second
+)
+
+// publishedReply is the message body published for one reply. ID is the
+// stream's X-Stream-ID for a streamed reply, otherwise made up here.
+type publishedReply struct {
+    ID         string          `json:"id"`
+    Session    string          `json:"session"`
+    Model      string          `json:"model"`
+    Prompt     string          `json:"prompt"`
+    Response   string          `json:"response"`
+    DoneReason string          `json:"done_reason,omitempty"`
+    Partial    bool            `json:"partial,omitempty"`
+    Tokens     int             `json:"tokens"`
+    Metadata   json.RawMessage `json:"metadata,omitempty"`
+    CreatedAt  time.Time       `json:"created_at"`
+}
+
+func newReplyID() string {
+    b := make([]byte, 8)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// natsSubject is a subject we can publish under: no wildcards or spaces.
+var natsSubject = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+type natsMessage struct {
+    subject string
+    body    []byte
+}
+
+// natsPublisher speaks just enough of the NATS client protocol to publish:
+// CONNECT, PUB, and PONG in answer to the server's PING. A nil
+// *natsPublisher publishes nothing.
+type natsPublisher struct {
+    addr    string
+    connect []byte
+    subject string
+
+    mu     sync.Mutex
+    closed bool
+    queue  chan natsMessage
+    done   chan struct{}
+    // dropping is set from the first dropped reply until one is queued
+    // again, so an outage is logged once rather than per reply.
+    dropping bool
+}
+
+// newNATSPublisher parses a nats://[user:pass@|token@]host[:port] URL, or
+// returns nil when it is empty.
+func newNATSPublisher(rawURL, subject string) (*natsPublisher, error) {
+    if rawURL == "" {
+        return nil, nil
+    }
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Scheme != "nats" || u.Hostname() == "" {
+        return nil, fmt.Errorf("must look like nats://host:4222, got %q", rawURL)
+    }
+    addr := u.Host
+    if u.Port() == "" {
+        addr = net.JoinHostPort(u.Hostname(), "4222")
+    }
+    opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "deepseek-interface", "lang": "go"}
+    if u.User != nil {
+        if pass, ok := u.User.Password(); ok {
+            opts["user"], opts["pass"] = u.User.Username(), pass
+        } else {
+            opts["auth_token"] = u.User.Username()
+        }
+    }
+    connect, _ := json.Marshal(opts)
+    return &natsPublisher{
+        addr:    addr,
+        connect: []byte("CONNECT " + string(connect) + "\r\n"),
+        subject: subject,
+        queue:   make(chan natsMessage, natsQueueSize),
+        done:    make(chan struct{}),
+    }, nil
+}
+
+// publish queues reply for the subject NATS_SUBJECT.<session>, so
+// consumers can take every reply or one session's. Stateless requests go
+// to NATS_SUBJECT.none.
+func (p *natsPublisher) publish(reply *publishedReply) {
+    if p == nil {
+        return
+    }
+    body, _ := json.Marshal(reply)
+    session := reply.Session
+    if session == "" {
+        session = "none"
+    }
+    msg := natsMessage{subject: p.subject + "." + session, body: body}
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.closed {
+        return
+    }
+    select {
+    case p.queue <- msg:
+        p.dropping = false
+    default:
+        if !p.dropping {
+            log.Printf("NATS queue is full; dropping replies until %s catches up", p.addr)
+            p.dropping = true
+        }
+    }
+}
+
+// run writes queued replies out until close, reconnecting whenever the
+// connection is lost. A reply that was being written when it broke is
+// lost.
+func (p *natsPublisher) run() {
+    defer close(p.done)
+    backoff := time.Second
+    for {
+        conn, err := p.dial()
+        if err != nil {
+            log.Printf("Cannot connect to NATS at %s, retrying in %s: %v", p.addr, backoff, err)
+            if !p.wait(backoff) {
+                return
+            }
+            if backoff *= 2; backoff > natsMaxBackoff {
+                backoff = natsMaxBackoff
+            }
+            continue
+        }
+        log.Printf("Connected to NATS at %s", p.addr)
+        backoff = time.Second
+        finished := p.pump(conn)
+        conn.Close()
+        if finished {
+            return
+        }
+    }
+}
+
+// dial connects and introduces us, reading the server's INFO first.
+func (p *natsPublisher) dial() (*natsConn, error) {
+    raw, err := net.DialTimeout("tcp", p.addr, 5*time.Second)
+    if err != nil {
+        return nil, err
+    }
+    c := &natsConn{conn: raw, broken: make(chan struct{})}
+    r := bufio.NewReader(raw)
+    raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+    info, err := r.ReadString('\n')
+    if err != nil || !strings.HasPrefix(info, "INFO ") {
+        raw.Close()
+        return nil, fmt.Errorf("no INFO from server: %v", err)
+    }
+    raw.SetReadDeadline(time.Time{})
+    if err := c.write(p.connect); err != nil {
+        raw.Close()
+        return nil, err
+    }
+    go c.read(r)
+    return c, nil
+}
+
+// pump writes replies to c until it breaks, returning false, or the queue
+// is closed and empty, returning true.
+func (p *natsPublisher) pump(c *natsConn) bool {
+    for {
+        select {
+        case msg, ok := <-p.queue:
+            if !ok {
+                return true
+            }
+            frame := fmt.Sprintf("PUB %s %d\r\n", msg.subject, len(msg.body))
+            if err := c.write(append(append([]byte(frame), msg.body...), '\r', '\n')); err != nil {
+                log.Printf("Lost the NATS connection, reconnecting: %v", err)
+                return false
+            }
+        case <-c.broken:
+            log.Printf("Lost the NATS connection, reconnecting: %v", c.err)
+            return false
+        }
+    }
+}
+
+// wait sleeps for d before the next attempt, or returns false at once when
+// shutting down.
+func (p *natsPublisher) wait(d time.Duration) bool {
+    p.mu.Lock()
+    closed := p.closed
+    p.mu.Unlock()
+    if closed {
+        // Shutting down with the broker unreachable: what is queued is lost.
+        return false
+    }
+    time.Sleep(d)
+    return true
+}
+
+// close stops taking replies and gives run a little while to send what is
+// queued. Call it once the server has drained.
+func (p *natsPublisher) close() {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    p.closed = true
+    close(p.queue)
+    p.mu.Unlock()
+    select {
+    case <-p.done:
+    case <-time.After(natsClosePatience):
+        log.Printf("Gave up sending %d queued replies to NATS", len(p.queue))
+    }
+}
+
+// natsConn is one connection. Writes from pump and PONGs from read share
+// it, so they are serialised.
+type natsConn struct {
+    conn   net.Conn
+    wmu    sync.Mutex
+    broken chan struct{}
+    err    error
+}
+
+func (c *natsConn) write(b []byte) error {
+    c.wmu.Lock()
+    defer c.wmu.Unlock()
+    c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+    _, err := c.conn.Write(b)
+    return err
+}
+
+// read answers PINGs and reports errors from the server, closing broken
+// when the connection ends.
+func (c *natsConn) read(r *bufio.Reader) {
+    defer close(c.broken)
+    for {
+        line, err := r.ReadString('\n')
+        if err != nil {
+            c.err = err
+            return
+        }
+        switch {
+        case strings.HasPrefix(line, "PING"):
+            if err := c.write([]byte("PONG\r\n")); err != nil {
+                c.err = err
+                return
+            }
+        case strings.HasPrefix(line, "-ERR"):
+            log.Printf("NATS error: %s", strings.TrimSpace(line))
+        }
+    }
+}
+
+func (c *natsConn) Close() error { return c.conn.Close() }
@@ -0,0 +1,387 @@
+package main
+
+import (
+    "bufio"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// OpenAI-compatible /v1/chat/completions, translated onto Ollama's
+// /api/chat so clients written against the OpenAI API can use this server.
+// Only the commonly used request fields are mapped.
+
+type openAIMessage struct {
+    Role    string `json:"role"`
+    Content string `json:"content"`
+}
+
+type openAIRequest struct {
+    Model       string          `json:"model"`
+    Messages    []openAIMessage `json:"messages"`
+    Stream      bool            `json:"stream"`
+    MaxTokens   *int            `json:"max_tokens"`
+    Temperature *float64        `json:"temperature"`
+    TopP        *float64        `json:"top_p"`
+    Stop        interface{}     `json:"stop"`
+
+    // Prefill is not part of the OpenAI API: it starts the assistant's
+    // reply, which the model then continues, to steer it into a format.
+    Prefill string `json:"prefill"`
+    // Tag is not part of the OpenAI API either; see tagUsage.
+    Tag string `json:"tag"`
+
+    StreamOptions *struct {
+        IncludeUsage bool `json:"include_usage"`
+    } `json:"stream_options"`
+}
+
+type openAIUsage struct {
+    PromptTokens     int `json:"prompt_tokens"`
+    CompletionTokens int `json:"completion_tokens"`
+    TotalTokens      int `json:"total_tokens"`
+}
+
+// ollamaChatRequest and ollamaChatChunk are the parts of Ollama's /api/chat
+// we use.
+type ollamaChatRequest struct {
+    Model    string                 `json:"model"`
+    Messages []openAIMessage        `json:"messages"`
+    Stream   bool                   `json:"stream"`
+    Options  map[string]interface{} `json:"options,omitempty"`
+}
+
+type ollamaChatChunk struct {
+    Message         openAIMessage `json:"message"`
+    Done            bool          `json:"done"`
+    DoneReason      string        `json:"done_reason"`
+    Error           string        `json:"error"`
+    PromptEvalCount int           `json:"prompt_eval_count"`
+    EvalCount       int           `json:"eval_count"`
+}
+
+func (c *ollamaChatChunk) usage() *openAIUsage {
+    return &openAIUsage{
+        PromptTokens:     c.PromptEvalCount,
+        CompletionTokens: c.EvalCount,
+        TotalTokens:      c.PromptEvalCount + c.EvalCount,
+    }
+}
+
+func finishReason(doneReason string) string {
+    if doneReason == "length" {
+        return "length"
+    }
+    return "stop"
+}
+
+// openAIError writes an error in the shape OpenAI clients expect.
+func openAIError(w http.ResponseWriter, msg string, status int) {
+    kind := "invalid_request_error"
+    if status >= 500 {
+        kind = "server_error"
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "error": map[string]string{"message": msg, "type": kind},
+    })
+}
+
+func completionID() string {
+    b := make([]byte, 12)
+    rand.Read(b)
+    return "chatcmpl-" + hex.EncodeToString(b)
+}
+
+// openAIOptions maps OpenAI sampling fields onto Ollama options, subject to
+// the same option policy and role defaults as /chat.
+func openAIOptions(cfg *config, r *http.Request, in *openAIRequest) (map[string]interface{}, error) {
+    opts := map[string]interface{}{}
+    if in.MaxTokens != nil {
+        opts["num_predict"] = *in.MaxTokens
+    }
+    if in.Temperature != nil {
+        opts["temperature"] = *in.Temperature
+    }
+    if in.TopP != nil {
+        opts["top_p"] = *in.TopP
+    }
+    if in.Stop != nil {
+        stops, err := mergeStops(in.Stop, nil)
+        if err != nil {
+            return nil, badRequest("%v", err)
+        }
+        opts["stop"] = stops
+    }
+    opts, dropped := cfg.Options.filter(opts)
+    if len(dropped) > 0 {
+        if cfg.Options.reject {
+            return nil, badRequest("options not allowed on this server: %s", strings.Join(dropped, ", "))
+        }
+        log.Printf("Stripped disallowed options: %s", strings.Join(dropped, ", "))
+    }
+    role, rc := cfg.roleFor(r)
+    return rc.applyRole(role, in.Model, opts)
+}
+
+func openAIChatHandler(cfg *config, adm *admission, sessions *sessionLimiter, streams *streamSlots, limits *rateLimitCounters, budget *tokenBudget, unload *unloader, tags *tagUsage) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        if r.Method != "POST" {
+            openAIError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+
+        if err := checkUTF8(r, cfg.InvalidUTF8); err != nil {
+            openAIError(w, err.Error(), errorStatus(err))
+            return
+        }
+        var in openAIRequest
+        if err := decodeBody(r, &in, "a messages field"); err != nil {
+            openAIError(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if len(in.Messages) == 0 {
+            openAIError(w, "messages must not be empty", http.StatusBadRequest)
+            return
+        }
+        if err := checkTag(cfg, in.Tag); err != nil {
+            openAIError(w, err.Error(), errorStatus(err))
+            return
+        }
+        for i := range in.Messages {
+            in.Messages[i].Content = normalizePrompt(in.Messages[i].Content, cfg.NormalizeNewlines, cfg.ExpandTabs)
+        }
+        if in.Prefill != "" && in.Messages[len(in.Messages)-1].Role == "assistant" {
+            openAIError(w, "prefill can't be used when the last message is already from the assistant", http.StatusBadRequest)
+            return
+        }
+        if in.Model == "" {
+            in.Model = cfg.defaultModel()
+        }
+        result := newResultHeaders(cfg, start)
+        result.model(w, in.Model, in.Stream)
+        opts, err := openAIOptions(cfg, r, &in)
+        if err != nil {
+            openAIError(w, err.Error(), errorStatus(err))
+            return
+        }
+        // An Ollama without /api/chat gets the conversation flattened into
+        // one /api/generate prompt, and its replies are rewritten to match.
+        legacy := cfg.chatMissing.Load()
+        if legacy && in.Prefill != "" {
+            openAIError(w, "prefill needs Ollama's /api/chat, which this Ollama predates", http.StatusBadRequest)
+            return
+        }
+        api := "/api/chat"
+        if legacy {
+            api = "/api/generate"
+        }
+        chatURL, err := cfg.modelAPI(in.Model, api)
+        if err != nil {
+            openAIError(w, err.Error(), http.StatusServiceUnavailable)
+            return
+        }
+
+        if in.Stream {
+            if !streams.acquire(w) {
+                return
+            }
+            defer streams.release()
+        }
+
+        // Issued as on /chat, so the client's next request has a session
+        // to count against.
+        sessionID(cfg, w, r)
+        limited := limitKey(cfg, r)
+        role, rc := cfg.roleFor(r)
+        charge := budgetKey(role, limited)
+        if !budget.admit(w, charge, cfg.budgetLimit(rc), func(msg string) { openAIError(w, msg, http.StatusTooManyRequests) }) {
+            limits.local.Add(1)
+            return
+        }
+        if !sessions.acquire(limited) {
+            limits.local.Add(1)
+            openAIError(w, "too many concurrent generations for this session", http.StatusTooManyRequests)
+            return
+        }
+        defer sessions.release(limited)
+
+        size := 0
+        for _, m := range in.Messages {
+            size += len(m.Content)
+        }
+        if err := adm.acquire(r.Context(), priorityNormal, size); err != nil {
+            log.Printf("Client gave up while queued: %v", err)
+            return
+        }
+        defer adm.release()
+
+        defer unload.use(in.Model)()
+        // Ollama continues a final assistant message rather than starting a
+        // new one, and sends back only what it added.
+        messages := in.Messages
+        if in.Prefill != "" {
+            messages = append(messages, openAIMessage{Role: "assistant", Content: in.Prefill})
+        }
+        body, _ := json.Marshal(ollamaChatRequest{Model: in.Model, Messages: messages, Stream: in.Stream, Options: opts})
+        if legacy {
+            body, _ = json.Marshal(generateRequest(in.Model, messages, in.Stream, opts))
+        }
+        client := &http.Client{Timeout: cfg.modelTimeout(in.Model)}
+        ctx := withAttemptCap(r.Context(), cfg.MaxUpstreamAttempts)
+        resp, retries, err := postUpstream(ctx, cfg, client, chatURL, body, limits)
+        reportUpstreamRetries(w, r, retries)
+        if err != nil {
+            if errors.Is(err, errUpstreamAttempts) {
+                openAIError(w, err.Error(), http.StatusServiceUnavailable)
+                return
+            }
+            if r.Context().Err() == nil {
+                openAIError(w, "cannot connect to Ollama: "+err.Error(), http.StatusBadGateway)
+            }
+            return
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode == http.StatusTooManyRequests {
+            w.Header().Set("Retry-After", upstreamRetryAfter(resp))
+            openAIError(w, "Ollama is rate limiting requests, try again shortly", http.StatusTooManyRequests)
+            return
+        }
+        if resp.StatusCode != http.StatusOK {
+            msg, _ := io.ReadAll(resp.Body)
+            openAIError(w, "Ollama error: "+string(msg), http.StatusBadGateway)
+            return
+        }
+
+        maxTokens := intOption(opts, "num_predict")
+        var upstream io.Reader = resp.Body
+        if legacy {
+            chunks := chatFromGenerate(resp.Body, maxTokens)
+            defer chunks.Close()
+            upstream = chunks
+        }
+
+        id, created := completionID(), time.Now().Unix()
+        if in.Stream {
+            includeUsage := in.StreamOptions != nil && in.StreamOptions.IncludeUsage
+            tokens := streamOpenAI(w, upstream, id, created, in.Model, in.Prefill, includeUsage, maxTokens, cfg.SSEMaxFrame)
+            result.done(w, tokens)
+            budget.add(charge, tokens)
+            tags.add(in.Tag, tokens)
+            return
+        }
+
+        var out ollamaChatChunk
+        if err := json.NewDecoder(upstream).Decode(&out); err != nil {
+            openAIError(w, "invalid response from Ollama: "+err.Error(), http.StatusBadGateway)
+            return
+        }
+        if out.Error != "" {
+            openAIError(w, "Ollama error: "+out.Error, http.StatusBadGateway)
+            return
+        }
+        budget.add(charge, out.EvalCount)
+        tags.add(in.Tag, out.EvalCount)
+        result.done(w, out.EvalCount)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "id":      id,
+            "object":  "chat.completion",
+            "created": created,
+            "model":   in.Model,
+            "choices": []map[string]interface{}{{
+                "index":         0,
+                "message":       openAIMessage{Role: "assistant", Content: in.Prefill + out.Message.Content},
+                "finish_reason": finishReason(doneReason(out.DoneReason, out.EvalCount, maxTokens)),
+            }},
+            "usage": out.usage(),
+        })
+    }
+}
+
+// streamOpenAI relays Ollama's /api/chat stream as OpenAI
+// chat.completion.chunk events, ending with "data: [DONE]". With
+// includeUsage, as with OpenAI's stream_options.include_usage, every chunk
+// carries "usage": null and one extra chunk with empty choices and the
+// token counts is sent just before [DONE]. A prefill is sent in the first
+// chunk, ahead of what the model continued it with. It returns the tokens
+// generated, counted as for streamResponse. maxTokens is num_predict, to
+// tell a reply cut off at it for an Ollama that doesn't say.
+func streamOpenAI(w http.ResponseWriter, upstream io.Reader, id string, created int64, model, prefill string, includeUsage bool, maxTokens, maxFrame int) int {
+    sse := newSSEWriter(w, maxFrame)
+    chunk := func(choices []map[string]interface{}, usage *openAIUsage) error {
+        c := map[string]interface{}{
+            "id":      id,
+            "object":  "chat.completion.chunk",
+            "created": created,
+            "model":   model,
+            "choices": choices,
+        }
+        if includeUsage {
+            c["usage"] = usage // null until the final chunk
+        }
+        return sse.send("", c)
+    }
+    delta := func(d map[string]string, finish interface{}) []map[string]interface{} {
+        return []map[string]interface{}{{"index": 0, "delta": d, "finish_reason": finish}}
+    }
+
+    roleSent := false
+    chunks := 0
+    scanner := bufio.NewScanner(upstream)
+    scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+    for scanner.Scan() {
+        var c ollamaChatChunk
+        if err := json.Unmarshal(scanner.Bytes(), &c); err != nil || c.Error != "" {
+            msg := c.Error
+            if err != nil {
+                msg = err.Error()
+            }
+            log.Printf("OpenAI stream failed: %s", msg)
+            sse.send("", map[string]interface{}{"error": map[string]string{"message": msg, "type": "server_error"}})
+            return chunks
+        }
+
+        if c.Message.Content != "" {
+            chunks++
+        }
+        if c.Message.Content != "" || !roleSent {
+            d := map[string]string{"content": c.Message.Content}
+            if !roleSent {
+                d["role"] = "assistant"
+                d["content"] = prefill + c.Message.Content
+                roleSent = true
+            }
+            if err := chunk(delta(d, nil), nil); err != nil {
+                log.Printf("Client went away mid-stream: %v", err)
+                return chunks
+            }
+        }
+
+        if c.Done {
+            chunk(delta(map[string]string{}, finishReason(doneReason(c.DoneReason, c.EvalCount, maxTokens))), nil)
+            if includeUsage {
+                chunk([]map[string]interface{}{}, c.usage())
+            }
+            fmt.Fprint(w, "data: [DONE]\n\n")
+            if sse.flusher != nil {
+                sse.flusher.Flush()
+            }
+            return c.EvalCount
+        }
+    }
+    log.Printf("OpenAI stream ended early: %v", scanner.Err())
+    return chunks
+}
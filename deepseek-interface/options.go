@@ -0,0 +1,155 @@
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+)
+
+// optionPolicy restricts which Ollama options clients may set, e.g. to keep
+// num_gpu or num_thread out of reach on a shared box. With an allow-list
+// only those keys pass; the deny-list is applied on top.
+type optionPolicy struct {
+    allow  map[string]bool
+    deny   map[string]bool
+    reject bool
+}
+
+func parseOptionPolicy(allow, deny, mode string) (*optionPolicy, error) {
+    p := &optionPolicy{allow: parseKeySet(allow), deny: parseKeySet(deny)}
+    switch mode {
+    case "", "strip":
+    case "reject":
+        p.reject = true
+    default:
+        return nil, fmt.Errorf("OPTIONS_POLICY_MODE must be strip or reject, got %q", mode)
+    }
+    return p, nil
+}
+
+func parseKeySet(list string) map[string]bool {
+    set := make(map[string]bool)
+    for _, k := range strings.Split(list, ",") {
+        if k = strings.TrimSpace(k); k != "" {
+            set[k] = true
+        }
+    }
+    return set
+}
+
+func (p *optionPolicy) allowed(key string) bool {
+    if len(p.allow) > 0 && !p.allow[key] {
+        return false
+    }
+    return !p.deny[key]
+}
+
+// filter returns the permitted subset of opts and the sorted keys that
+// were dropped.
+func (p *optionPolicy) filter(opts map[string]interface{}) (map[string]interface{}, []string) {
+    var dropped []string
+    for k := range opts {
+        if !p.allowed(k) {
+            dropped = append(dropped, k)
+        }
+    }
+    if len(dropped) == 0 {
+        return opts, nil
+    }
+    sort.Strings(dropped)
+    kept := make(map[string]interface{}, len(opts)-len(dropped))
+    for k, v := range opts {
+        if p.allowed(k) {
+            kept[k] = v
+        }
+    }
+    return kept, dropped
+}
+
+// maxStopSequences caps the merged stop list sent to Ollama.
+const maxStopSequences = 16
+
+// mergeStops combines the request's options.stop with a model's configured
+// stop sequences. Request stops come first and duplicates are dropped; if
+// the total exceeds maxStopSequences the model defaults are cut, but a
+// request that alone asks for too many is an error.
+func mergeStops(requested interface{}, defaults []string) ([]string, error) {
+    var stops []string
+    switch v := requested.(type) {
+    case nil:
+    case string:
+        stops = []string{v}
+    case []interface{}:
+        for _, s := range v {
+            str, ok := s.(string)
+            if !ok {
+                return nil, fmt.Errorf("options.stop must be a string or an array of strings")
+            }
+            stops = append(stops, str)
+        }
+    default:
+        return nil, fmt.Errorf("options.stop must be a string or an array of strings")
+    }
+    if len(stops) > maxStopSequences {
+        return nil, fmt.Errorf("at most %d stop sequences are allowed", maxStopSequences)
+    }
+
+    seen := make(map[string]bool)
+    var merged []string
+    for _, s := range append(stops, defaults...) {
+        if s == "" || seen[s] {
+            continue
+        }
+        if len(merged) == maxStopSequences {
+            break
+        }
+        seen[s] = true
+        merged = append(merged, s)
+    }
+    return merged, nil
+}
+
+// resolvedOptions is what plan sends Ollama to generate with, after server
+// defaults, role and model settings and the request's own options were all
+// applied, for RESPONSE_OPTIONS. keep_alive and think, which go to Ollama
+// beside the options, are included when set. Ollama has no secret options,
+// but anything named like a credential that a role or client slipped in is
+// masked all the same.
+func resolvedOptions(plan *chatPlan) map[string]interface{} {
+    out := make(map[string]interface{}, len(plan.Upstream.Options)+2)
+    for k, v := range plan.Upstream.Options {
+        if sensitiveOption(k) {
+            v = "[redacted]"
+        }
+        out[k] = v
+    }
+    if plan.Upstream.KeepAlive != nil {
+        out["keep_alive"] = plan.Upstream.KeepAlive
+    }
+    if plan.Upstream.Think != nil {
+        out["think"] = plan.Upstream.Think
+    }
+    return out
+}
+
+// intOption reads a whole-number option such as num_predict, which comes
+// in as a float64 from JSON or an int when set here; 0 when it isn't set.
+func intOption(opts map[string]interface{}, key string) int {
+    switch n := opts[key].(type) {
+    case float64:
+        return int(n)
+    case int:
+        return n
+    }
+    return 0
+}
+
+func sensitiveOption(key string) bool {
+    key = strings.ToLower(key)
+    for _, s := range []string{"key", "token", "secret", "password"} {
+        if key == s || strings.HasSuffix(key, "_"+s) {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "testing"
+)
+
+func TestOptionPolicyFilter(t *testing.T) {
+    opts := map[string]interface{}{"temperature": 0.2, "num_gpu": 99, "num_thread": 8, "top_p": 0.9}
+    tests := []struct {
+        allow, deny string
+        kept        []string
+        dropped     []string
+    }{
+        {"", "", []string{"num_gpu", "num_thread", "temperature", "top_p"}, nil},
+        {"", "num_gpu, num_thread", []string{"temperature", "top_p"}, []string{"num_gpu", "num_thread"}},
+        {"temperature,top_p", "", []string{"temperature", "top_p"}, []string{"num_gpu", "num_thread"}},
+        {"temperature,top_p", "top_p", []string{"temperature"}, []string{"num_gpu", "num_thread", "top_p"}},
+    }
+    for _, tt := range tests {
+        p, err := parseOptionPolicy(tt.allow, tt.deny, "strip")
+        if err != nil {
+            t.Fatal(err)
+        }
+        kept, dropped := p.filter(opts)
+        var keys []string
+        for _, k := range []string{"num_gpu", "num_thread", "temperature", "top_p"} {
+            if _, ok := kept[k]; ok {
+                keys = append(keys, k)
+            }
+        }
+        if !reflect.DeepEqual(keys, tt.kept) || !reflect.DeepEqual(dropped, tt.dropped) {
+            t.Errorf("allow %q deny %q: kept %v dropped %v, want %v and %v", tt.allow, tt.deny, keys, dropped, tt.kept, tt.dropped)
+        }
+    }
+    if len(opts) != 4 {
+        t.Errorf("filter changed the request's options: %v", opts)
+    }
+}
+
+func TestParseOptionPolicyMode(t *testing.T) {
+    for mode, reject := range map[string]bool{"": false, "strip": false, "reject": true} {
+        p, err := parseOptionPolicy("", "num_gpu", mode)
+        if err != nil || p.reject != reject {
+            t.Errorf("mode %q: reject = %v, err %v; want %v", mode, p != nil && p.reject, err, reject)
+        }
+    }
+    if _, err := parseOptionPolicy("", "", "drop"); err == nil {
+        t.Error("mode drop was accepted")
+    }
+}
+
+func TestPlanChatOptionPolicy(t *testing.T) {
+    in := chatInput{Options: map[string]interface{}{"temperature": 0.2, "num_gpu": 99}}
+
+    cfg := testConfig(t, "OPTIONS_DENY", "num_gpu", "OPTIONS_POLICY_MODE", "strip")
+    p, err := plan(t, cfg, in)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := map[string]interface{}{"temperature": 0.2}; !reflect.DeepEqual(p.Upstream.Options, want) {
+        t.Errorf("strip mode sent options %v, want %v", p.Upstream.Options, want)
+    }
+
+    cfg = testConfig(t, "OPTIONS_DENY", "num_gpu", "OPTIONS_POLICY_MODE", "reject")
+    _, err = plan(t, cfg, in)
+    wantRequestError(t, err, http.StatusBadRequest, "options not allowed on this server: num_gpu")
+}
+
+func TestMergeStops(t *testing.T) {
+    many := func(n int, prefix string) []interface{} {
+        var s []interface{}
+        for i := 0; i < n; i++ {
+            s = append(s, prefix+string(rune('a'+i)))
+        }
+        return s
+    }
+    tests := []struct {
+        name      string
+        requested interface{}
+        defaults  []string
+        want      []string
+    }{
+        {"defaults only", nil, []string{"</s>", "User:"}, []string{"</s>", "User:"}},
+        {"string", "END", []string{"</s>"}, []string{"END", "</s>"}},
+        {"request first", []interface{}{"B", "A"}, []string{"A", "C"}, []string{"B", "A", "C"}},
+        {"duplicates and empties", []interface{}{"A", "A", ""}, []string{"", "A"}, []string{"A"}},
+        {"defaults cut at the cap", many(15, "r"), []string{"d1", "d2"}, append(toStrings(many(15, "r")), "d1")},
+    }
+    for _, tt := range tests {
+        got, err := mergeStops(tt.requested, tt.defaults)
+        if err != nil {
+            t.Errorf("%s: %v", tt.name, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: mergeStops = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+
+    for _, requested := range []interface{}{many(maxStopSequences+1, "r"), 42.0, []interface{}{"A", 1.0}} {
+        if _, err := mergeStops(requested, nil); err == nil {
+            t.Errorf("mergeStops(%v) was accepted", requested)
+        }
+    }
+}
+
+func toStrings(v []interface{}) []string {
+    s := make([]string, len(v))
+    for i := range v {
+        s[i] = v[i].(string)
+    }
+    return s
+}
+
+func TestPlanChatModelStops(t *testing.T) {
+    cfg := testConfig(t, "CONFIG_FILE", configFile(t, `{"models": {"base:7b": {"stop": ["</s>", "User:"]}}}`))
+
+    p, err := plan(t, cfg, chatInput{Model: "base:7b", Options: map[string]interface{}{"stop": []interface{}{"User:", "###"}}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if want := []string{"User:", "###", "</s>"}; !reflect.DeepEqual(p.Upstream.Options["stop"], want) {
+        t.Errorf("stop = %q, want %q", p.Upstream.Options["stop"], want)
+    }
+
+    p, err = plan(t, cfg, chatInput{Model: "other:7b"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if stop, ok := p.Upstream.Options["stop"]; ok {
+        t.Errorf("a model without stops got stop = %v", stop)
+    }
+}
+
+func TestChatResolvedOptions(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, DoneReason: "stop"}),
+    })
+    file := configFile(t, `{
+        "models": {"codellama:7b": {"stop": ["</s>"]}},
+        "roles": {"ci": {"tokens": ["ci-token"], "max_tokens": 256,
+            "options": {"temperature": 0.2, "top_k": 20, "api_key": "from-the-role"}}}
+    }`)
+    body := `{"prompt": "hi", "options": {"temperature": 0.8, "stop": ["User:"], "keep_alive": "10m"}}`
+
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "CONFIG_FILE", file, "RESPONSE_OPTIONS", "true"))
+    reply := decode(t, chat.post(body, "Authorization", "Bearer ci-token"))
+    got, _ := json.Marshal(reply["resolved_options"])
+    want := `{"api_key":"[redacted]","keep_alive":"10m","num_predict":256,"stop":["User:","\u003c/s\u003e"],"temperature":0.8,"top_k":20}`
+    if string(got) != want {
+        t.Errorf("resolved_options = %s, want %s", got, want)
+    }
+
+    // They are what Ollama was sent, less the masking.
+    sent := ollama.requests("/api/generate")
+    options := sent[len(sent)-1]["options"].(map[string]interface{})
+    if options["api_key"] != "from-the-role" {
+        t.Errorf("Ollama got api_key %v", options["api_key"])
+    }
+    options["api_key"] = "[redacted]"
+    options["keep_alive"] = sent[len(sent)-1]["keep_alive"]
+    if sentJSON, _ := json.Marshal(options); string(sentJSON) != want {
+        t.Errorf("Ollama was sent %s, reported %s", sentJSON, want)
+    }
+
+    chat = newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "CONFIG_FILE", file, "RESPONSE_OPTIONS", "false"))
+    if reply := decode(t, chat.post(body, "Authorization", "Bearer ci-token")); reply["resolved_options"] != nil {
+        t.Errorf("resolved_options reported with RESPONSE_OPTIONS off: %v", reply["resolved_options"])
+    }
+}
+
+func TestSensitiveOption(t *testing.T) {
+    for key, want := range map[string]bool{
+        "key": true, "api_key": true, "Auth_Token": true, "password": true, "client_secret": true,
+        "top_k": false, "keepalive": false, "tokens": false, "num_predict": false,
+    } {
+        if got := sensitiveOption(key); got != want {
+            t.Errorf("sensitiveOption(%q) = %v, want %v", key, got, want)
+        }
+    }
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "io"
+    "log"
+    "net/http"
+)
+
+// relayRaw copies Ollama's response to the client unchanged: status, content
+// type and body, flushing as each read arrives so a stream of NDJSON stays a
+// stream. It returns the bytes sent and an audit outcome.
+func relayRaw(w http.ResponseWriter, resp *http.Response) (int, string) {
+    for _, h := range []string{"Content-Type", "Retry-After"} {
+        if v := resp.Header.Get(h); v != "" {
+            w.Header().Set(h, v)
+        }
+    }
+    w.WriteHeader(resp.StatusCode)
+    flusher, _ := w.(http.Flusher)
+
+    sent := 0
+    buf := make([]byte, 32*1024)
+    for {
+        n, err := resp.Body.Read(buf)
+        if n > 0 {
+            if _, werr := w.Write(buf[:n]); werr != nil {
+                log.Printf("Client went away mid-passthrough: %v", werr)
+                return sent, "client_gone"
+            }
+            sent += n
+            if flusher != nil {
+                flusher.Flush()
+            }
+        }
+        if err == io.EOF {
+            if resp.StatusCode != http.StatusOK {
+                return sent, "upstream_error"
+            }
+            return sent, "ok"
+        }
+        if err != nil {
+            log.Printf("Passthrough read from Ollama failed: %v", err)
+            return sent, "upstream_error"
+        }
+    }
+}
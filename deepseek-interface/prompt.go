@@ -0,0 +1,129 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strings"
+    "unicode/utf8"
+)
+
+// What to do with a prompt longer than MAX_PROMPT_LENGTH.
+const (
+    overflowReject    = "reject"
+    overflowKeepStart = "keep_start"
+    overflowKeepEnd   = "keep_end"
+)
+
+func parseOverflowMode(s string) (string, error) {
+    switch s {
+    case "":
+        return overflowReject, nil
+    case overflowReject, overflowKeepStart, overflowKeepEnd:
+        return s, nil
+    }
+    return "", fmt.Errorf("PROMPT_OVERFLOW must be reject, keep_start or keep_end, got %q", s)
+}
+
+// promptTruncation describes what was cut from a prompt, for the notice
+// returned to the client.
+type promptTruncation struct {
+    OriginalLength int    `json:"original_length"`
+    KeptLength     int    `json:"kept_length"`
+    Kept           string `json:"kept"`
+}
+
+// limitPrompt applies the prompt length limit. Lengths are counted in
+// characters, not bytes, so a cut never splits a UTF-8 sequence. Keeping
+// the end suits pasted logs, where the question usually comes last.
+func limitPrompt(prompt string, max int, mode string) (string, *promptTruncation, error) {
+    n := utf8.RuneCountInString(prompt)
+    if max <= 0 || n <= max {
+        return prompt, nil, nil
+    }
+    if mode == overflowReject {
+        return "", nil, &requestError{http.StatusRequestEntityTooLarge,
+            fmt.Sprintf("prompt is %d characters, the limit is %d", n, max)}
+    }
+
+    runes := []rune(prompt)
+    kept := "start"
+    if mode == overflowKeepStart {
+        runes = runes[:max]
+    } else {
+        runes = runes[n-max:]
+        kept = "end"
+    }
+    return string(runes), &promptTruncation{OriginalLength: n, KeptLength: max, Kept: kept}, nil
+}
+
+// What to do with a request body that isn't valid UTF-8. encoding/json
+// would quietly turn each bad byte into U+FFFD; replace does the same but
+// says so in the log, and reject refuses the request.
+const (
+    invalidUTF8Replace = "replace"
+    invalidUTF8Reject  = "reject"
+)
+
+func parseInvalidUTF8Mode(s string) (string, error) {
+    switch s {
+    case "":
+        return invalidUTF8Replace, nil
+    case invalidUTF8Replace, invalidUTF8Reject:
+        return s, nil
+    }
+    return "", fmt.Errorf("PROMPT_INVALID_UTF8 must be replace or reject, got %q", s)
+}
+
+// checkUTF8 reads r's body and puts it back, valid UTF-8, for decoding.
+// The check is on the raw bytes: a \ud800 escape is valid JSON and still
+// decodes to U+FFFD.
+func checkUTF8(r *http.Request, mode string) error {
+    raw, err := io.ReadAll(r.Body)
+    if err != nil {
+        return badRequest("reading request body: %v", err)
+    }
+    if !utf8.Valid(raw) {
+        if mode == invalidUTF8Reject {
+            return badRequest("request body is not valid UTF-8")
+        }
+        log.Printf("Replacing invalid UTF-8 in a %s request body", r.URL.Path)
+        raw = bytes.ToValidUTF8(raw, []byte("\uFFFD"))
+    }
+    r.Body = io.NopCloser(bytes.NewReader(raw))
+    return nil
+}
+
+// normalizePrompt tidies whitespace in pasted code before it reaches the
+// model: with newlines set, CRLF and lone CR line endings become LF, and
+// with tabWidth above 0, tabs are expanded to spaces up to the next tab
+// stop, so indentation keeps its shape.
+func normalizePrompt(s string, newlines bool, tabWidth int) string {
+    if newlines {
+        s = strings.ReplaceAll(s, "\r\n", "\n")
+        s = strings.ReplaceAll(s, "\r", "\n")
+    }
+    if tabWidth <= 0 || !strings.Contains(s, "\t") {
+        return s
+    }
+    var b strings.Builder
+    b.Grow(len(s))
+    col := 0
+    for _, r := range s {
+        switch r {
+        case '\t':
+            n := tabWidth - col%tabWidth
+            b.WriteString(strings.Repeat(" ", n))
+            col += n
+        case '\n':
+            b.WriteRune(r)
+            col = 0
+        default:
+            b.WriteRune(r)
+            col++
+        }
+    }
+    return b.String()
+}
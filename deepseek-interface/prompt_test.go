@@ -0,0 +1,170 @@
+package main
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestLimitPrompt(t *testing.T) {
+    tests := []struct {
+        name   string
+        prompt string
+        max    int
+        mode   string
+        want   string
+        kept   string
+    }{
+        {"under the limit", "short", 10, overflowKeepEnd, "short", ""},
+        {"at the limit", "exactly10!", 10, overflowKeepStart, "exactly10!", ""},
+        {"no limit", "anything at all", 0, overflowReject, "anything at all", ""},
+        {"keep start", "first part, second part", 10, overflowKeepStart, "first part", "start"},
+        {"keep end", "long log...\nwhat failed?", 12, overflowKeepEnd, "what failed?", "end"},
+        {"keep start, characters not bytes", "héllo wörld", 7, overflowKeepStart, "héllo w", "start"},
+        {"keep end, characters not bytes", "日本語のテキスト", 4, overflowKeepEnd, "テキスト", "end"},
+    }
+    for _, tt := range tests {
+        got, note, err := limitPrompt(tt.prompt, tt.max, tt.mode)
+        if err != nil {
+            t.Errorf("%s: %v", tt.name, err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("%s: prompt = %q, want %q", tt.name, got, tt.want)
+        }
+        switch {
+        case tt.kept == "" && note != nil:
+            t.Errorf("%s: got a truncation notice %+v for an uncut prompt", tt.name, note)
+        case tt.kept != "" && (note == nil || note.Kept != tt.kept || note.KeptLength != tt.max):
+            t.Errorf("%s: notice = %+v, want kept %s with %d characters", tt.name, note, tt.kept, tt.max)
+        }
+    }
+}
+
+func TestLimitPromptReject(t *testing.T) {
+    _, _, err := limitPrompt("far too long", 5, overflowReject)
+    wantRequestError(t, err, http.StatusRequestEntityTooLarge, "prompt is 12 characters, the limit is 5")
+}
+
+func TestPlanChatPromptTruncation(t *testing.T) {
+    cfg := testConfig(t, "MAX_PROMPT_LENGTH", "8", "PROMPT_OVERFLOW", overflowKeepEnd)
+    p, err := plan(t, cfg, chatInput{Prompt: "lots of context, then the question"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p.Upstream.Prompt != "question" {
+        t.Errorf("prompt sent = %q, want %q", p.Upstream.Prompt, "question")
+    }
+    if n := p.PromptTruncated; n == nil || n.OriginalLength != 34 || n.KeptLength != 8 || n.Kept != "end" {
+        t.Errorf("notice = %+v, want 34 characters cut to the last 8", n)
+    }
+
+    if _, err := parseOverflowMode("keep_middle"); err == nil {
+        t.Error("PROMPT_OVERFLOW=keep_middle was accepted")
+    }
+}
+
+func TestNormalizePrompt(t *testing.T) {
+    tests := []struct {
+        in       string
+        newlines bool
+        tabWidth int
+        want     string
+    }{
+        {"a\r\nb\rc\n", false, 0, "a\r\nb\rc\n"},
+        {"a\r\nb\rc\n", true, 0, "a\nb\nc\n"},
+        {"\tx", false, 4, "    x"},
+        {"ab\tc", false, 4, "ab  c"},
+        {"abcd\te", false, 4, "abcd    e"},
+        {"if x {\n\treturn\n}", false, 2, "if x {\n  return\n}"},
+        {"é\tx", false, 4, "é   x"},
+        {"\tx\r\n\ty", true, 4, "    x\n    y"},
+        {"\tx", true, 0, "\tx"},
+    }
+    for _, tt := range tests {
+        if got := normalizePrompt(tt.in, tt.newlines, tt.tabWidth); got != tt.want {
+            t.Errorf("normalizePrompt(%q, %v, %d) = %q, want %q", tt.in, tt.newlines, tt.tabWidth, got, tt.want)
+        }
+    }
+}
+
+func TestPlanChatNormalizesPrompt(t *testing.T) {
+    p, err := plan(t, testConfig(t), chatInput{Prompt: "a\r\n\tb"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p.Upstream.Prompt != "a\r\n\tb" {
+        t.Errorf("prompt sent = %q, want it untouched by default", p.Upstream.Prompt)
+    }
+
+    cfg := testConfig(t, "PROMPT_NORMALIZE_NEWLINES", "true", "PROMPT_EXPAND_TABS", "4")
+    if p, err = plan(t, cfg, chatInput{Prompt: "a\r\n\tb"}); err != nil {
+        t.Fatal(err)
+    }
+    if p.Upstream.Prompt != "a\n    b" {
+        t.Errorf("prompt sent = %q, want %q", p.Upstream.Prompt, "a\n    b")
+    }
+
+    if err := configError(t, "PROMPT_EXPAND_TABS", "17"); err == nil {
+        t.Error("PROMPT_EXPAND_TABS=17 was accepted")
+    }
+}
+
+func TestCheckUTF8(t *testing.T) {
+    tests := []struct {
+        body, mode string
+        want       string
+        ok         bool
+    }{
+        {`{"prompt": "héllo"}`, invalidUTF8Reject, `{"prompt": "héllo"}`, true},
+        {"{\"prompt\": \"a\xffb\"}", invalidUTF8Replace, "{\"prompt\": \"a\uFFFDb\"}", true},
+        {"{\"prompt\": \"a\xc3\"}", invalidUTF8Replace, "{\"prompt\": \"a\uFFFD\"}", true},
+        {"{\"prompt\": \"\xed\xa0\x80\"}", invalidUTF8Replace, "{\"prompt\": \"\uFFFD\"}", true},
+        {"{\"prompt\": \"a\xffb\"}", invalidUTF8Reject, "", false},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest("POST", "/chat", strings.NewReader(tt.body))
+        err := checkUTF8(r, tt.mode)
+        if !tt.ok {
+            wantRequestError(t, err, http.StatusBadRequest, "request body is not valid UTF-8")
+            continue
+        }
+        if err != nil {
+            t.Errorf("%q (%s): %v", tt.body, tt.mode, err)
+            continue
+        }
+        if got, _ := io.ReadAll(r.Body); string(got) != tt.want {
+            t.Errorf("%q (%s): body = %q, want %q", tt.body, tt.mode, got, tt.want)
+        }
+    }
+}
+
+func TestChatInvalidUTF8(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, DoneReason: "stop"}),
+    })
+    body := "{\"prompt\": \"caf\xe9\"}"
+
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL))
+    if w := chat.post(body); w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body.String())
+    }
+    if sent := ollama.requests("/api/generate"); len(sent) != 1 || sent[0]["prompt"] != "caf\uFFFD" {
+        t.Errorf("generate calls = %v, want the bad byte replaced", sent)
+    }
+
+    chat = newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "PROMPT_INVALID_UTF8", invalidUTF8Reject))
+    w := chat.post(body)
+    if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not valid UTF-8") {
+        t.Errorf("reply = %d %q, want 400", w.Code, w.Body.String())
+    }
+    if n := len(ollama.requests("/api/generate")); n != 1 {
+        t.Errorf("%d generate calls, want the rejected prompt kept from Ollama", n)
+    }
+
+    if err := configError(t, "PROMPT_INVALID_UTF8", "ignore"); err == nil {
+        t.Error("PROMPT_INVALID_UTF8=ignore was accepted")
+    }
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sync"
+    "sync/atomic"
+)
+
+// pulls tracks in-progress model downloads so they can be cancelled by name,
+// and limits how many download at once: several large models pulling
+// together saturate the node's bandwidth and disk.
+type pulls struct {
+    mu      sync.Mutex
+    cancels map[string]context.CancelFunc
+
+    // slots holds a token per running download; nil means no limit.
+    slots   chan struct{}
+    queue   bool
+    running atomic.Int64
+    waiting atomic.Int64
+}
+
+func newPulls(cfg *config) *pulls {
+    p := &pulls{cancels: make(map[string]context.CancelFunc), queue: cfg.QueuePulls}
+    if cfg.MaxConcurrentPulls > 0 {
+        p.slots = make(chan struct{}, cfg.MaxConcurrentPulls)
+    }
+    return p
+}
+
+// errPullsBusy is returned by acquire when every slot is taken and pulls
+// don't queue.
+var errPullsBusy = errors.New("too many model pulls in progress")
+
+// acquire takes a download slot. When none is free it fails with
+// errPullsBusy, or with PULL_QUEUE calls queued with its place in line and
+// waits until one is free or ctx is done.
+func (p *pulls) acquire(ctx context.Context, queued func(position int64)) error {
+    if p.slots != nil {
+        select {
+        case p.slots <- struct{}{}:
+        default:
+            if !p.queue {
+                return errPullsBusy
+            }
+            queued(p.waiting.Add(1))
+            defer p.waiting.Add(-1)
+            select {
+            case p.slots <- struct{}{}:
+            case <-ctx.Done():
+                return ctx.Err()
+            }
+        }
+    }
+    p.running.Add(1)
+    return nil
+}
+
+func (p *pulls) release() {
+    p.running.Add(-1)
+    if p.slots != nil {
+        <-p.slots
+    }
+}
+
+// pullCounts is the pulls part of /stats.
+type pullCounts struct {
+    Active int64 `json:"active"`
+    Queued int64 `json:"queued"`
+    Limit  int   `json:"limit"`
+}
+
+func (p *pulls) counts() pullCounts {
+    return pullCounts{Active: p.running.Load(), Queued: p.waiting.Load(), Limit: cap(p.slots)}
+}
+
+// start registers a pull for model and returns a context that is cancelled
+// either when parent is done or when cancel(model) is called. It fails if a
+// pull for the same model is already running.
+func (p *pulls) start(parent context.Context, model string) (context.Context, func(), error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if _, ok := p.cancels[model]; ok {
+        return nil, nil, fmt.Errorf("a pull for %s is already in progress", model)
+    }
+    ctx, cancel := context.WithCancel(parent)
+    p.cancels[model] = cancel
+    done := func() {
+        p.mu.Lock()
+        delete(p.cancels, model)
+        p.mu.Unlock()
+        cancel()
+    }
+    return ctx, done, nil
+}
+
+func (p *pulls) cancel(model string) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    cancel, ok := p.cancels[model]
+    if ok {
+        cancel()
+    }
+    return ok
+}
+
+// pullHandler proxies Ollama's /api/pull progress stream as NDJSON. The
+// upstream request is bound to the client's context, so closing the
+// connection aborts the download. A successful pull invalidates the model
+// list cache so the new model shows up straight away.
+//
+// A pull that has to wait for a slot starts the stream with a "queued"
+// status line, after which errors are reported in the stream as Ollama
+// does, as {"error": "..."} lines. A pull can fill the disk, so it takes
+// the admin token, like a refresh of the model list.
+func pullHandler(cfg *config, active *pulls, cache *modelCache) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !isAdmin(r, cfg.AdminToken) {
+            jsonError(w, "pulling models requires a valid admin token", http.StatusForbidden)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+
+        var req struct {
+            Name string `json:"name"`
+            // Force skips the PULL_MIN_FREE_DISK check.
+            Force bool `json:"force"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+            jsonError(w, "request must include a model name", http.StatusBadRequest)
+            return
+        }
+
+        if cfg.PullMinFreeDisk > 0 && !req.Force {
+            disk := diskSpace(cfg)
+            if !disk.Available {
+                log.Printf("Pulling %s without a disk space check: %s", req.Name, disk.Reason)
+            } else if disk.FreeBytes < uint64(cfg.PullMinFreeDisk) {
+                jsonError(w, fmt.Sprintf("only %s free in %s, less than the %s this server keeps free; send \"force\": true to pull anyway", formatBytes(disk.FreeBytes), disk.Path, formatBytes(uint64(cfg.PullMinFreeDisk))), http.StatusInsufficientStorage)
+                return
+            }
+        }
+
+        ctx, done, err := active.start(r.Context(), req.Name)
+        if err != nil {
+            jsonError(w, err.Error(), http.StatusConflict)
+            return
+        }
+        defer done()
+
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        flusher, _ := w.(http.Flusher)
+        streaming := false
+        fail := func(msg string, status int) {
+            if !streaming {
+                jsonError(w, msg, status)
+                return
+            }
+            line, _ := json.Marshal(map[string]string{"error": msg})
+            w.Write(append(line, '\n'))
+        }
+        err = active.acquire(ctx, func(position int64) {
+            log.Printf("Pull of %s queued behind %d running", req.Name, active.running.Load())
+            line, _ := json.Marshal(map[string]interface{}{"status": "queued", "position": position})
+            w.Write(append(line, '\n'))
+            if flusher != nil {
+                flusher.Flush()
+            }
+            streaming = true
+        })
+        if err == errPullsBusy {
+            jsonError(w, fmt.Sprintf("model pull limit reached (%d at a time); try again when a running pull finishes", cap(active.slots)), http.StatusTooManyRequests)
+            return
+        }
+        if err != nil {
+            log.Printf("Pull of %s cancelled while queued", req.Name)
+            if r.Context().Err() == nil {
+                w.Write([]byte(`{"status":"cancelled"}` + "\n"))
+            }
+            return
+        }
+        defer active.release()
+
+        reqBody, _ := json.Marshal(map[string]interface{}{"model": req.Name, "stream": true})
+        upstream, err := http.NewRequestWithContext(ctx, "POST", cfg.ollamaAPI("/api/pull"), bytes.NewBuffer(reqBody))
+        if err != nil {
+            fail(err.Error(), http.StatusInternalServerError)
+            return
+        }
+        upstream.Header.Set("Content-Type", "application/json")
+
+        // No client timeout here: large models can take a long time to
+        // download and cancellation is driven by ctx instead.
+        resp, err := http.DefaultClient.Do(upstream)
+        if err != nil {
+            log.Printf("Error connecting to Ollama: %v", err)
+            fail(fmt.Sprintf("Cannot connect to Ollama: %v", err), http.StatusBadGateway)
+            return
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode != http.StatusOK {
+            body, _ := io.ReadAll(resp.Body)
+            fail(fmt.Sprintf("Ollama error: %s", string(body)), http.StatusBadGateway)
+            return
+        }
+
+        scanner := bufio.NewScanner(resp.Body)
+        lastStatus := ""
+        for scanner.Scan() {
+            var line struct {
+                Status string `json:"status"`
+            }
+            json.Unmarshal(scanner.Bytes(), &line)
+            lastStatus = line.Status
+            if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+                break
+            }
+            if flusher != nil {
+                flusher.Flush()
+            }
+        }
+        if lastStatus == "success" {
+            cache.invalidate()
+        }
+        if ctx.Err() != nil {
+            log.Printf("Pull of %s cancelled", req.Name)
+        }
+    }
+}
+
+// pullCancelHandler aborts an in-progress pull started by another client.
+func pullCancelHandler(cfg *config, active *pulls) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" {
+            http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        if !isAdmin(r, cfg.AdminToken) {
+            jsonError(w, "cancelling a pull requires a valid admin token", http.StatusForbidden)
+            return
+        }
+        if !requireJSON(w, r) {
+            return
+        }
+
+        var req struct {
+            Name string `json:"name"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+            jsonError(w, "request must include a model name", http.StatusBadRequest)
+            return
+        }
+
+        if !active.cancel(req.Name) {
+            jsonError(w, "no pull in progress for "+req.Name, http.StatusNotFound)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]string{"status": "cancelled"})
+    }
+}
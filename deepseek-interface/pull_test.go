@@ -0,0 +1,119 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestPullsLimit(t *testing.T) {
+    p := newPulls(testConfig(t, "MAX_CONCURRENT_PULLS", "2"))
+    for i := 0; i < 2; i++ {
+        if err := p.acquire(context.Background(), nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := p.acquire(context.Background(), nil); err != errPullsBusy {
+        t.Errorf("third pull = %v, want errPullsBusy", err)
+    }
+    if c := p.counts(); c != (pullCounts{Active: 2, Queued: 0, Limit: 2}) {
+        t.Errorf("counts = %+v", c)
+    }
+    p.release()
+    if err := p.acquire(context.Background(), nil); err != nil {
+        t.Errorf("pull after a release = %v", err)
+    }
+
+    unlimited := newPulls(testConfig(t, "MAX_CONCURRENT_PULLS", "0"))
+    for i := 0; i < 5; i++ {
+        if err := unlimited.acquire(context.Background(), nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if c := unlimited.counts(); c.Active != 5 || c.Limit != 0 {
+        t.Errorf("counts with no limit = %+v", c)
+    }
+}
+
+func TestPullsQueue(t *testing.T) {
+    p := newPulls(testConfig(t, "MAX_CONCURRENT_PULLS", "1", "PULL_QUEUE", "true"))
+    if err := p.acquire(context.Background(), nil); err != nil {
+        t.Fatal(err)
+    }
+
+    positions := make(chan int64, 2)
+    queued := func(position int64) { positions <- position }
+    admitted := make(chan error)
+    go func() { admitted <- p.acquire(context.Background(), queued) }()
+    if pos := <-positions; pos != 1 {
+        t.Errorf("first queued pull is at %d, want 1", pos)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancelled := make(chan error)
+    go func() { cancelled <- p.acquire(ctx, queued) }()
+    if pos := <-positions; pos != 2 {
+        t.Errorf("second queued pull is at %d, want 2", pos)
+    }
+    if c := p.counts(); c.Active != 1 || c.Queued != 2 {
+        t.Errorf("counts = %+v, want 1 active and 2 queued", c)
+    }
+
+    cancel()
+    if err := <-cancelled; err != context.Canceled {
+        t.Errorf("cancelled pull = %v, want context.Canceled", err)
+    }
+    p.release()
+    select {
+    case err := <-admitted:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("queued pull not started after a release")
+    }
+    if c := p.counts(); c != (pullCounts{Active: 1, Queued: 0, Limit: 1}) {
+        t.Errorf("counts = %+v, want the queued pull running", c)
+    }
+}
+
+func TestPullHandlerLimit(t *testing.T) {
+    store := &modelStore{}
+    ollama := store.ollama(t)
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "ADMIN_TOKEN", "secret", "MAX_CONCURRENT_PULLS", "1")
+    active := newPulls(cfg)
+    pull := func(token string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest("POST", "/models/pull", strings.NewReader(`{"name": "qwen2:7b"}`))
+        r.Header.Set("Content-Type", "application/json")
+        r.Header.Set("Authorization", "Bearer "+token)
+        w := httptest.NewRecorder()
+        pullHandler(cfg, active, newModelCache(cfg))(w, r)
+        return w
+    }
+
+    if w := pull("wrong"); w.Code != http.StatusForbidden {
+        t.Errorf("pull with the wrong token = %d, want 403", w.Code)
+    }
+
+    // Another download holds the only slot.
+    if err := active.acquire(context.Background(), nil); err != nil {
+        t.Fatal(err)
+    }
+    w := pull("secret")
+    if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "model pull limit reached (1 at a time)") {
+        t.Errorf("pull over the limit = %d %q, want 429", w.Code, w.Body.String())
+    }
+    if len(store.installed) != 0 {
+        t.Errorf("installed %q while over the limit", store.installed)
+    }
+
+    active.release()
+    if w := pull("secret"); !strings.Contains(w.Body.String(), `"success"`) {
+        t.Errorf("pull with a free slot = %d %q", w.Code, w.Body.String())
+    }
+    if c := active.counts(); c.Active != 0 {
+        t.Errorf("%d pulls still counted as active", c.Active)
+    }
+}
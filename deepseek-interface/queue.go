@@ -0,0 +1,201 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+)
+
+type priority int
+
+const (
+    priorityHigh priority = iota
+    priorityNormal
+    priorityLow
+    numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+func (p priority) String() string {
+    return priorityNames[p]
+}
+
+func parsePriority(s string) (priority, error) {
+    if s == "" {
+        return priorityNormal, nil
+    }
+    for i, name := range priorityNames {
+        if s == name {
+            return priority(i), nil
+        }
+    }
+    return 0, fmt.Errorf("invalid priority %q (want high, normal or low)", s)
+}
+
+// Prompt size buckets for queue wait metrics, by prompt length in bytes.
+var sizeBuckets = []struct {
+    name string
+    max  int
+}{
+    {"small", 1 << 10},
+    {"medium", 8 << 10},
+    {"large", -1},
+}
+
+func sizeBucket(size int) int {
+    for i, b := range sizeBuckets {
+        if b.max < 0 || size < b.max {
+            return i
+        }
+    }
+    return len(sizeBuckets) - 1
+}
+
+// waitStats accumulates time spent queued, for one size bucket.
+type waitStats struct {
+    Count   int64
+    Seconds float64
+}
+
+type waiter struct {
+    ch   chan struct{}
+    size int
+}
+
+// admission limits how many generations run against Ollama at once. Requests
+// over the limit wait in per-priority queues and a freed slot always goes to
+// the highest non-empty priority. Within a priority waiters are served FIFO,
+// or smallest prompt first when smallestFirst is set.
+type admission struct {
+    mu            sync.Mutex
+    limit         int
+    smallestFirst bool
+    active        int
+    waiting       [numPriorities][]*waiter
+    waits         []waitStats
+    // requests whose client went away while they were queued
+    abandoned int64
+}
+
+func newAdmission(limit int, smallestFirst bool) *admission {
+    if limit < 1 {
+        limit = 1
+    }
+    return &admission{limit: limit, smallestFirst: smallestFirst, waits: make([]waitStats, len(sizeBuckets))}
+}
+
+// acquire blocks until a slot is free or ctx is done. size is the prompt
+// length used for ordering and metrics. Callers must call release once they
+// are finished with a successfully acquired slot.
+func (a *admission) acquire(ctx context.Context, p priority, size int) error {
+    start := time.Now()
+    a.mu.Lock()
+    if a.active < a.limit && a.queuedLocked() == 0 {
+        a.active++
+        a.recordWaitLocked(size, 0)
+        a.mu.Unlock()
+        return nil
+    }
+    wt := &waiter{ch: make(chan struct{}), size: size}
+    a.waiting[p] = append(a.waiting[p], wt)
+    a.mu.Unlock()
+
+    select {
+    case <-wt.ch:
+        a.mu.Lock()
+        defer a.mu.Unlock()
+        // When the slot arrives just as the client leaves, select may pick
+        // either case; don't start a generation nobody will read.
+        if ctx.Err() != nil {
+            a.abandoned++
+            a.releaseLocked()
+            return ctx.Err()
+        }
+        a.recordWaitLocked(size, time.Since(start))
+        return nil
+    case <-ctx.Done():
+        a.mu.Lock()
+        defer a.mu.Unlock()
+        a.abandoned++
+        for i, w := range a.waiting[p] {
+            if w == wt {
+                a.waiting[p] = append(a.waiting[p][:i], a.waiting[p][i+1:]...)
+                return ctx.Err()
+            }
+        }
+        // The slot was handed to us while we were giving up; pass it on.
+        a.releaseLocked()
+        return ctx.Err()
+    }
+}
+
+func (a *admission) release() {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.releaseLocked()
+}
+
+func (a *admission) releaseLocked() {
+    for p := range a.waiting {
+        q := a.waiting[p]
+        if len(q) == 0 {
+            continue
+        }
+        next := 0
+        if a.smallestFirst {
+            for i, w := range q {
+                if w.size < q[next].size {
+                    next = i
+                }
+            }
+        }
+        wt := q[next]
+        a.waiting[p] = append(q[:next], q[next+1:]...)
+        close(wt.ch) // slot moves straight to the waiter, active is unchanged
+        return
+    }
+    a.active--
+}
+
+func (a *admission) recordWaitLocked(size int, d time.Duration) {
+    b := &a.waits[sizeBucket(size)]
+    b.Count++
+    b.Seconds += d.Seconds()
+}
+
+func (a *admission) queuedLocked() int {
+    n := 0
+    for _, q := range a.waiting {
+        n += len(q)
+    }
+    return n
+}
+
+// depths returns the number of queued requests per priority and the number
+// of generations currently running.
+func (a *admission) depths() (queued [numPriorities]int, active int) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    for p, q := range a.waiting {
+        queued[p] = len(q)
+    }
+    return queued, a.active
+}
+
+// abandonedCount is how many queued requests were dropped because their
+// client went away before a slot came free.
+func (a *admission) abandonedCount() int64 {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    return a.abandoned
+}
+
+// waitTimes returns cumulative queue wait per prompt size bucket, in
+// sizeBuckets order.
+func (a *admission) waitTimes() []waitStats {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    return append([]waitStats(nil), a.waits...)
+}
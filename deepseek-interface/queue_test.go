@@ -0,0 +1,135 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// waitQueued waits until n requests are queued on a.
+func waitQueued(t *testing.T, a *admission, n int) {
+    t.Helper()
+    deadline := time.Now().Add(2 * time.Second)
+    for {
+        queued, _ := a.depths()
+        total := 0
+        for _, q := range queued {
+            total += q
+        }
+        if total == n {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d requests queued, want %d", total, n)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestAdmissionPriorityOrder(t *testing.T) {
+    a := newAdmission(1, true)
+    if err := a.acquire(context.Background(), priorityNormal, 0); err != nil {
+        t.Fatal(err)
+    }
+    order := make(chan string, 3)
+    queue := func(name string, p priority, size int) {
+        go func() {
+            if err := a.acquire(context.Background(), p, size); err != nil {
+                t.Error(err)
+                return
+            }
+            order <- name
+            a.release()
+        }()
+    }
+    queue("low", priorityLow, 1)
+    waitQueued(t, a, 1)
+    queue("normal, large", priorityNormal, 9000)
+    waitQueued(t, a, 2)
+    queue("normal, small", priorityNormal, 10)
+    waitQueued(t, a, 3)
+
+    a.release()
+    for _, want := range []string{"normal, small", "normal, large", "low"} {
+        if got := <-order; got != want {
+            t.Errorf("admitted %q, want %q", got, want)
+        }
+    }
+    if _, active := a.depths(); active != 0 {
+        t.Errorf("%d slots still held", active)
+    }
+}
+
+func TestAdmissionCancelWhileQueued(t *testing.T) {
+    a := newAdmission(1, false)
+    if err := a.acquire(context.Background(), priorityNormal, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    gone := make(chan error)
+    go func() { gone <- a.acquire(ctx, priorityNormal, 0) }()
+    waitQueued(t, a, 1)
+    next := make(chan error)
+    go func() { next <- a.acquire(context.Background(), priorityNormal, 0) }()
+    waitQueued(t, a, 2)
+
+    // The cancelled request leaves the queue at once, without waiting for
+    // the slot to come free.
+    cancel()
+    if err := <-gone; err != context.Canceled {
+        t.Fatalf("cancelled acquire = %v, want context.Canceled", err)
+    }
+    waitQueued(t, a, 1)
+    if n := a.abandonedCount(); n != 1 {
+        t.Errorf("abandoned = %d, want 1", n)
+    }
+
+    // The slot goes to the request behind it, not to the one that left.
+    a.release()
+    if err := <-next; err != nil {
+        t.Fatal(err)
+    }
+    a.release()
+    if queued, active := a.depths(); active != 0 || queued != [numPriorities]int{} {
+        t.Errorf("after release: queued %v, active %d", queued, active)
+    }
+}
+
+func TestChatClientGoneWhileQueued(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, DoneReason: "stop"}),
+    })
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "MAX_CONCURRENT", "1"))
+    if err := chat.adm.acquire(context.Background(), priorityNormal, 0); err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    r := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"prompt": "hi"}`)).WithContext(ctx)
+    r.RemoteAddr = "192.0.2.1:1234"
+    r.Header.Set("Content-Type", "application/json")
+    done := make(chan struct{})
+    go func() {
+        chat.handler(httptest.NewRecorder(), r)
+        close(done)
+    }()
+    waitQueued(t, chat.adm, 1)
+    cancel()
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatal("handler still waiting after its client went away")
+    }
+
+    chat.adm.release()
+    if n := len(ollama.requests("/api/generate")); n != 0 {
+        t.Errorf("%d generate calls for an abandoned request, want 0", n)
+    }
+    if queued, active := chat.adm.depths(); active != 0 || queued != [numPriorities]int{} {
+        t.Errorf("after release: queued %v, active %d", queued, active)
+    }
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// rateLimit is RATE_LIMIT_IP or RATE_LIMIT_SESSION: n requests per per,
+// allowed in a burst of up to n.
+type rateLimit struct {
+    n   int
+    per time.Duration
+}
+
+// parseRateLimit reads "30/m" style limits: a count per s, m or h. "" is no
+// limit.
+func parseRateLimit(s string) (rateLimit, error) {
+    if s == "" {
+        return rateLimit{}, nil
+    }
+    count, unit, ok := strings.Cut(s, "/")
+    n, err := strconv.Atoi(count)
+    if !ok || err != nil || n < 1 {
+        return rateLimit{}, fmt.Errorf("must be a count per s, m or h, such as \"30/m\", got %q", s)
+    }
+    per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+    if per == 0 {
+        return rateLimit{}, fmt.Errorf("must be a count per s, m or h, such as \"30/m\", got %q", s)
+    }
+    return rateLimit{n: n, per: per}, nil
+}
+
+type rateBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// rateLimiter is a token bucket per key. A nil *rateLimiter allows
+// everything.
+type rateLimiter struct {
+    limit rateLimit
+
+    mu      sync.Mutex
+    buckets map[string]*rateBucket
+    swept   time.Time
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+    if limit.n == 0 {
+        return nil
+    }
+    return &rateLimiter{limit: limit, buckets: make(map[string]*rateBucket)}
+}
+
+// allow takes a request from key's bucket, or says how long until there is
+// one to take.
+func (l *rateLimiter) allow(key string) (ok bool, retry time.Duration) {
+    if l == nil || key == "" {
+        return true, 0
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    now := time.Now()
+    every := l.limit.per / time.Duration(l.limit.n)
+    // A bucket that has refilled is no different from a missing one, so
+    // those are dropped now and then to keep the map from growing.
+    if now.Sub(l.swept) > l.limit.per {
+        for k, b := range l.buckets {
+            if now.Sub(b.last) >= l.limit.per {
+                delete(l.buckets, k)
+            }
+        }
+        l.swept = now
+    }
+    b, found := l.buckets[key]
+    if !found {
+        b = &rateBucket{tokens: float64(l.limit.n), last: now}
+        l.buckets[key] = b
+    }
+    b.tokens += float64(now.Sub(b.last)) / float64(every)
+    if max := float64(l.limit.n); b.tokens > max {
+        b.tokens = max
+    }
+    b.last = now
+    if b.tokens < 1 {
+        return false, time.Duration((1 - b.tokens) * float64(every))
+    }
+    b.tokens--
+    return true, 0
+}
+
+// requestRateLimits holds the per-session and per-IP limits. They are
+// independent: an IP limit high enough for everyone behind one NAT can sit
+// beside a lower session limit that stops one heavy user.
+type requestRateLimits struct {
+    cfg     *config
+    ip      *rateLimiter
+    session *rateLimiter
+    counts  *rateLimitCounters
+}
+
+func newRequestRateLimits(cfg *config, counts *rateLimitCounters) *requestRateLimits {
+    return &requestRateLimits{cfg: cfg, ip: newRateLimiter(cfg.RateLimitIP), session: newRateLimiter(cfg.RateLimitSession), counts: counts}
+}
+
+// wrap answers requests over either limit with 429, Retry-After and
+// X-Rate-Limit saying which one it was, written with fail in the endpoint's
+// own error format. The session is checked first, so a session over its
+// limit doesn't use up what its IP is allowed. Requests without a session
+// cookie are only limited by IP.
+func (l *requestRateLimits) wrap(next http.HandlerFunc, fail func(http.ResponseWriter, string, int)) http.HandlerFunc {
+    if l.ip == nil && l.session == nil {
+        return next
+    }
+    return func(w http.ResponseWriter, r *http.Request) {
+        if ok, retry := l.session.allow(existingSession(l.cfg, r)); !ok {
+            l.reject(w, "session", retry, fail)
+            return
+        }
+        if ok, retry := l.ip.allow(l.cfg.clientIP(r)); !ok {
+            l.reject(w, "ip", retry, fail)
+            return
+        }
+        next(w, r)
+    }
+}
+
+func (l *requestRateLimits) reject(w http.ResponseWriter, scope string, retry time.Duration, fail func(http.ResponseWriter, string, int)) {
+    l.counts.local.Add(1)
+    w.Header().Set("X-Rate-Limit", scope)
+    w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+    who := "this session"
+    if scope == "ip" {
+        who = "this IP address"
+    }
+    fail(w, "rate limit for "+who+" exceeded, try again shortly", http.StatusTooManyRequests)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+    tests := []struct {
+        in   string
+        want rateLimit
+        ok   bool
+    }{
+        {"", rateLimit{}, true},
+        {"30/m", rateLimit{30, time.Minute}, true},
+        {"5/s", rateLimit{5, time.Second}, true},
+        {"1000/h", rateLimit{1000, time.Hour}, true},
+        {"30", rateLimit{}, false},
+        {"0/m", rateLimit{}, false},
+        {"30/d", rateLimit{}, false},
+        {"many/m", rateLimit{}, false},
+    }
+    for _, tt := range tests {
+        got, err := parseRateLimit(tt.in)
+        if (err == nil) != tt.ok || got != tt.want {
+            t.Errorf("parseRateLimit(%q) = %+v, %v", tt.in, got, err)
+        }
+    }
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+    l := newRateLimiter(rateLimit{n: 3, per: time.Minute})
+    for i := 0; i < 3; i++ {
+        if ok, _ := l.allow("k"); !ok {
+            t.Fatalf("request %d refused within the burst", i+1)
+        }
+    }
+    ok, retry := l.allow("k")
+    if ok || retry <= 0 || retry > 20*time.Second {
+        t.Errorf("fourth request: ok %v, retry %s; want refused for up to 20s", ok, retry)
+    }
+    if ok, _ := l.allow("other"); !ok {
+        t.Error("another key shared the bucket")
+    }
+
+    // A third of the minute later one request's worth has refilled.
+    l.buckets["k"].last = l.buckets["k"].last.Add(-20 * time.Second)
+    if ok, _ := l.allow("k"); !ok {
+        t.Error("request refused after the bucket refilled")
+    }
+
+    var none *rateLimiter
+    if ok, _ := none.allow("k"); !ok {
+        t.Error("a nil limiter refused a request")
+    }
+}
+
+func TestRequestRateLimits(t *testing.T) {
+    cfg := testConfig(t, "RATE_LIMIT_IP", "5/m", "RATE_LIMIT_SESSION", "2/m")
+    counts := &rateLimitCounters{}
+    served := 0
+    h := newRequestRateLimits(cfg, counts).wrap(func(w http.ResponseWriter, r *http.Request) { served++ }, http.Error)
+    send := func(session string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest("POST", "/chat", nil)
+        r.RemoteAddr = "192.0.2.1:1234"
+        if session != "" {
+            withSession(cfg, r, sessionFor(session))
+        }
+        w := httptest.NewRecorder()
+        h(w, r)
+        return w
+    }
+
+    // Two sessions behind one IP each get their own two requests.
+    for _, s := range []string{"a", "a", "b", "b"} {
+        if w := send(s); w.Code != http.StatusOK {
+            t.Fatalf("session %s refused within its limit: %d", s, w.Code)
+        }
+    }
+    w := send("a")
+    if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Rate-Limit") != "session" || w.Header().Get("Retry-After") == "" {
+        t.Errorf("third request from a = %d, X-Rate-Limit %q", w.Code, w.Header().Get("X-Rate-Limit"))
+    }
+
+    // The session refusal didn't use up the IP's allowance: one request is
+    // left for a new session, then the IP limit applies to everyone.
+    if w := send("c"); w.Code != http.StatusOK {
+        t.Errorf("fifth request from the IP = %d, want it allowed", w.Code)
+    }
+    for _, s := range []string{"d", ""} {
+        w := send(s)
+        if w.Code != http.StatusTooManyRequests || w.Header().Get("X-Rate-Limit") != "ip" {
+            t.Errorf("request over the IP limit from %q = %d, X-Rate-Limit %q", s, w.Code, w.Header().Get("X-Rate-Limit"))
+        }
+    }
+    if served != 5 || counts.local.Load() != 3 {
+        t.Errorf("served %d and refused %d, want 5 and 3", served, counts.local.Load())
+    }
+}
+
+func TestRequestRateLimitsOff(t *testing.T) {
+    cfg := testConfig(t, "RATE_LIMIT_IP", "", "RATE_LIMIT_SESSION", "")
+    served := 0
+    h := newRequestRateLimits(cfg, &rateLimitCounters{}).wrap(func(w http.ResponseWriter, r *http.Request) { served++ }, http.Error)
+    for i := 0; i < 100; i++ {
+        h(httptest.NewRecorder(), httptest.NewRequest("POST", "/chat", nil))
+    }
+    if served != 100 {
+        t.Errorf("served %d of 100 requests with no limits", served)
+    }
+    if err := configError(t, "RATE_LIMIT_SESSION", "10"); err == nil {
+        t.Error("RATE_LIMIT_SESSION=10 was accepted")
+    }
+}
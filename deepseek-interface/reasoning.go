@@ -0,0 +1,79 @@
+package main
+
+import "strings"
+
+const (
+    thinkOpen  = "<think>"
+    thinkClose = "</think>"
+)
+
+type reasoningState int
+
+const (
+    reasoningUndecided reasoningState = iota // still looking for a leading <think>
+    reasoningInside
+    reasoningAnswer
+)
+
+// reasoningFilter withholds a leading <think>...</think> block from a token
+// stream and passes through only the answer after it. Tags can arrive split
+// across chunks, so a few bytes are held back until it's clear whether they
+// are part of one. Only the tail of the reasoning is kept, never all of it.
+type reasoningFilter struct {
+    state reasoningState
+    buf   string
+    // set once the answer has started, so leading blank lines after
+    // </think> are dropped but later whitespace is left alone
+    answering bool
+}
+
+// feed takes the next chunk and returns the text to send on, plus whether
+// this chunk is the one that opened the reasoning block.
+func (f *reasoningFilter) feed(chunk string) (out string, started bool) {
+    f.buf += chunk
+    if f.state == reasoningUndecided {
+        head := strings.TrimLeft(f.buf, " \t\r\n")
+        switch {
+        case strings.HasPrefix(head, thinkOpen):
+            f.state = reasoningInside
+            f.buf = head[len(thinkOpen):]
+            started = true
+        case strings.HasPrefix(thinkOpen, head):
+            return "", false // could still become <think>
+        default:
+            f.state = reasoningAnswer
+            f.answering = true
+        }
+    }
+    if f.state == reasoningInside {
+        i := strings.Index(f.buf, thinkClose)
+        if i < 0 {
+            if keep := len(thinkClose) - 1; len(f.buf) > keep {
+                f.buf = f.buf[len(f.buf)-keep:]
+            }
+            return "", started
+        }
+        f.state = reasoningAnswer
+        f.buf = f.buf[i+len(thinkClose):]
+    }
+    if !f.answering {
+        f.buf = strings.TrimLeft(f.buf, "\r\n")
+        if f.buf == "" {
+            return "", started
+        }
+        f.answering = true
+    }
+    out, f.buf = f.buf, ""
+    return out, started
+}
+
+// flush returns whatever is still held back once the stream has ended. A
+// reasoning block that never closed yields nothing.
+func (f *reasoningFilter) flush() string {
+    if f.state == reasoningInside {
+        return ""
+    }
+    out := f.buf
+    f.buf = ""
+    return out
+}
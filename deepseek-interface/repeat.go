@@ -0,0 +1,135 @@
+package main
+
+import "strings"
+
+// Smaller models sometimes get stuck and print the same line over and
+// over. With REPEAT_MAX_LINES set, a run of identical consecutive lines is
+// cut down to that many; blank lines between the repeats neither count nor
+// end the run, and are dropped along with the repeats.
+
+// repetitionNote is reported on the reply when lines were removed.
+type repetitionNote struct {
+    Line    string `json:"line"`
+    Removed int    `json:"removed"`
+    // Aborted is set when REPEAT_ABORT stopped the generation.
+    Aborted bool `json:"aborted,omitempty"`
+}
+
+// repeatFilter collapses repeated lines in text fed to it in pieces. Text
+// is passed on as it arrives, except the start of a line that could still
+// turn out to be one repeat too many, and blank lines that could sit between
+// repeats; those are held until it is clear.
+type repeatFilter struct {
+    max int
+
+    last   string // the last non-blank line passed on
+    count  int    // times in a row it has been seen
+    blanks string // blank lines held back since then
+    held   string // start of the current line, held back
+    sent   string // start of the current line, already passed on
+
+    note *repetitionNote
+}
+
+func newRepeatFilter(max int) *repeatFilter {
+    if max <= 0 {
+        return nil
+    }
+    return &repeatFilter{max: max}
+}
+
+// collapseRepeats runs a whole reply through a repeatFilter.
+func collapseRepeats(s string, max int) (string, *repetitionNote) {
+    f := newRepeatFilter(max)
+    if f == nil {
+        return s, nil
+    }
+    s = f.feed(s) + f.flush()
+    return s, f.note
+}
+
+func trimLine(s string) string {
+    return strings.TrimRight(s, " \t\r")
+}
+
+// feed returns the part of token that can be sent now.
+func (f *repeatFilter) feed(token string) string {
+    var out strings.Builder
+    for {
+        piece, rest, ended := strings.Cut(token, "\n")
+        f.held += piece
+        if !ended {
+            out.WriteString(f.release())
+            return out.String()
+        }
+        out.WriteString(f.endLine())
+        token = rest
+    }
+}
+
+// release passes on the held start of the current line once it can no
+// longer be a blank line or a repeat too many.
+func (f *repeatFilter) release() string {
+    if f.held == "" {
+        return ""
+    }
+    if f.sent == "" {
+        if strings.TrimSpace(f.held) == "" {
+            return ""
+        }
+        if f.count >= f.max && strings.HasPrefix(f.last, trimLine(f.held)) {
+            return ""
+        }
+    }
+    out := f.blanks + f.held
+    f.sent += f.held
+    f.blanks, f.held = "", ""
+    return out
+}
+
+// endLine finishes the current line at a newline.
+func (f *repeatFilter) endLine() string {
+    line := f.sent + f.held
+    var out string
+    switch {
+    case f.sent == "" && strings.TrimSpace(line) == "":
+        f.blanks += line + "\n"
+    case f.sent == "" && f.over(line):
+        f.drop()
+    default:
+        out = f.blanks + f.held + "\n"
+        f.blanks = ""
+        if line = trimLine(line); line == f.last {
+            f.count++
+        } else {
+            f.last, f.count = line, 1
+        }
+    }
+    f.held, f.sent = "", ""
+    return out
+}
+
+// over reports whether line would be one more repeat than allowed.
+func (f *repeatFilter) over(line string) bool {
+    return f.count >= f.max && trimLine(line) == f.last
+}
+
+// drop discards a repeat too many, and the blank lines before it.
+func (f *repeatFilter) drop() {
+    f.blanks = ""
+    if f.note == nil {
+        f.note = &repetitionNote{Line: f.last}
+    }
+    f.note.Removed++
+}
+
+// flush returns what is still held at the end of the reply.
+func (f *repeatFilter) flush() string {
+    out := f.blanks + f.held
+    if f.sent == "" && strings.TrimSpace(f.held) != "" && f.over(f.held) {
+        f.drop()
+        out = ""
+    }
+    f.blanks, f.held, f.sent = "", "", ""
+    return out
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestCollapseRepeats(t *testing.T) {
+    loop := strings.Repeat("I am stuck.\n", 50)
+    tests := []struct {
+        in      string
+        max     int
+        want    string
+        removed int
+    }{
+        {loop, 0, loop, 0},
+        {loop, 2, "I am stuck.\nI am stuck.\n", 48},
+        {"a\na\nb\na\n", 1, "a\nb\na\n", 1},
+        {"a\n\na\n\n\na\nb", 1, "a\nb", 2},
+        {"a\na  \na", 1, "a\n", 2},
+        {"a\nab\nab\n", 1, "a\nab\n", 1},
+        {"x\ny\nx\ny\n", 1, "x\ny\nx\ny\n", 0},
+        {"no newline", 1, "no newline", 0},
+    }
+    for _, tt := range tests {
+        got, note := collapseRepeats(tt.in, tt.max)
+        if got != tt.want {
+            t.Errorf("collapseRepeats(%.30q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+        }
+        removed := 0
+        if note != nil {
+            removed = note.Removed
+        }
+        if removed != tt.removed {
+            t.Errorf("collapseRepeats(%.30q, %d) removed %d lines, want %d", tt.in, tt.max, removed, tt.removed)
+        }
+
+        // Fed a character at a time, as a stream might be, the result is
+        // the same.
+        if f := newRepeatFilter(tt.max); f != nil {
+            var b strings.Builder
+            for _, r := range tt.in {
+                b.WriteString(f.feed(string(r)))
+            }
+            b.WriteString(f.flush())
+            if b.String() != tt.want {
+                t.Errorf("%.30q fed a character at a time = %q, want %q", tt.in, b.String(), tt.want)
+            }
+        }
+    }
+}
+
+func TestStreamResponseRepeats(t *testing.T) {
+    pieces := []string{"Start\n"}
+    for i := 0; i < 20; i++ {
+        pieces = append(pieces, "loop", " again\n")
+    }
+    pieces = append(pieces, "End\n")
+
+    p := streamPlan()
+    p.RepeatMaxLines = 2
+    events, outcome := runStream(t, p, tokens(pieces...), 0)
+    if outcome != "ok" {
+        t.Errorf("outcome = %q, want ok", outcome)
+    }
+    if got, want := text(t, events), "Start\nloop again\nloop again\nEnd\n"; got != want {
+        t.Errorf("text = %q, want %q", got, want)
+    }
+    rep, _ := last(t, events, "done")["repetition"].(map[string]interface{})
+    if rep["line"] != "loop again" || rep["removed"] != 18.0 || rep["aborted"] != nil {
+        t.Errorf("repetition = %v, want 18 lines removed", rep)
+    }
+
+    p.RepeatAbort = true
+    events, outcome = runStream(t, p, tokens(pieces...), 0)
+    if outcome != "repetition" {
+        t.Errorf("outcome = %q, want repetition", outcome)
+    }
+    if got, want := text(t, events), "Start\nloop again\nloop again\n"; got != want {
+        t.Errorf("text = %q, want %q", got, want)
+    }
+    done := last(t, events, "done")
+    if rep, _ := done["repetition"].(map[string]interface{}); done["done_reason"] != "repetition" || rep["aborted"] != true {
+        t.Errorf("done = %v, want the stream stopped for repetition", done)
+    }
+    if events[len(events)-1].event != "stats" {
+        t.Errorf("last event = %q, want stats", events[len(events)-1].event)
+    }
+}
+
+func TestRepeatAbortNeedsMaxLines(t *testing.T) {
+    if err := configError(t, "REPEAT_ABORT", "true"); err == nil {
+        t.Error("REPEAT_ABORT was accepted without REPEAT_MAX_LINES")
+    }
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "mime"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// jsonError writes {"error": msg} with the given status code.
+func jsonError(w http.ResponseWriter, msg string, status int) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// requireJSON rejects requests whose Content-Type isn't application/json
+// with 415 and reports whether the handler should carry on.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+    mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if err != nil || mediaType != "application/json" {
+        jsonError(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+        return false
+    }
+    return true
+}
+
+// decodeBody decodes r's JSON body into v. A missing or whitespace-only
+// body gets a 400 saying a body is needed and what goes in it, since the
+// decoder alone would only say "EOF".
+func decodeBody(r *http.Request, v interface{}, needs string) error {
+    err := json.NewDecoder(r.Body).Decode(v)
+    if err == io.EOF {
+        return badRequest("request body is required with %s", needs)
+    }
+    return err
+}
+
+// resultHeaders adds X-Model, X-Duration-Ms and X-Tokens to chat responses
+// when RESULT_HEADERS is on, so clients can see what happened without
+// reading the body. A nil *resultHeaders adds nothing.
+type resultHeaders struct {
+    start time.Time
+}
+
+func newResultHeaders(cfg *config, start time.Time) *resultHeaders {
+    if !cfg.ResultHeaders {
+        return nil
+    }
+    return &resultHeaders{start: start}
+}
+
+// model sets X-Model. Streams also declare the other two as trailers here,
+// since their totals are only known once the body has been written.
+func (h *resultHeaders) model(w http.ResponseWriter, model string, stream bool) {
+    if h == nil {
+        return
+    }
+    w.Header().Set("X-Model", model)
+    if stream {
+        w.Header().Set("Trailer", "X-Duration-Ms, X-Tokens")
+    }
+}
+
+// done sets the duration and token count: as headers before a buffered
+// body, or as the declared trailers after a stream.
+func (h *resultHeaders) done(w http.ResponseWriter, tokens int) {
+    if h == nil {
+        return
+    }
+    w.Header().Set("X-Duration-Ms", strconv.FormatInt(time.Since(h.start).Milliseconds(), 10))
+    w.Header().Set("X-Tokens", strconv.Itoa(tokens))
+}
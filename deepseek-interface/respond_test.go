@@ -0,0 +1,91 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestRequireJSON(t *testing.T) {
+    tests := []struct {
+        contentType string
+        ok          bool
+    }{
+        {"application/json", true},
+        {"application/json; charset=utf-8", true},
+        {"Application/JSON", true},
+        {"", false},
+        {"text/plain", false},
+        {"application/x-www-form-urlencoded", false},
+        {"multipart/form-data; boundary=x", false},
+        {"application/json; =", false},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"prompt":"hi"}`))
+        if tt.contentType != "" {
+            r.Header.Set("Content-Type", tt.contentType)
+        }
+        w := httptest.NewRecorder()
+        if got := requireJSON(w, r); got != tt.ok {
+            t.Errorf("requireJSON(%q) = %v, want %v", tt.contentType, got, tt.ok)
+            continue
+        }
+        if tt.ok {
+            continue
+        }
+        if w.Code != http.StatusUnsupportedMediaType {
+            t.Errorf("requireJSON(%q) status = %d, want 415", tt.contentType, w.Code)
+        }
+        var body map[string]string
+        if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body["error"] == "" {
+            t.Errorf("requireJSON(%q) body isn't a JSON error: %v", tt.contentType, err)
+        }
+    }
+}
+
+func TestDecodeBody(t *testing.T) {
+    for _, body := range []string{"", "   ", "\n\t \r\n"} {
+        var in chatInput
+        err := decodeBody(httptest.NewRequest("POST", "/chat", strings.NewReader(body)), &in, "a prompt field")
+        wantRequestError(t, err, http.StatusBadRequest, "request body is required with a prompt field")
+    }
+
+    var in chatInput
+    if err := decodeBody(httptest.NewRequest("POST", "/chat", strings.NewReader(` {"prompt": "hi"} `)), &in, "a prompt field"); err != nil || in.Prompt != "hi" {
+        t.Errorf("decodeBody = %+v, %v", in, err)
+    }
+    err := decodeBody(httptest.NewRequest("POST", "/chat", strings.NewReader(`{"prompt": `)), &in, "a prompt field")
+    if err == nil || strings.Contains(err.Error(), "required") {
+        t.Errorf("truncated JSON gave %v, want the decode error", err)
+    }
+}
+
+func TestEmptyBodies(t *testing.T) {
+    cfg := testConfig(t)
+    chat := newTestChat(t, cfg)
+    handlers := []struct {
+        path    string
+        handler http.HandlerFunc
+        needs   string
+    }{
+        {"/chat", chat.handler, "a prompt field"},
+        {"/chat/abort", abortHandler(cfg, newStreamRegistry()), "an id or token field"},
+        {"/v1/chat/completions", openAIChatHandler(cfg, chat.adm, chat.sessions, &streamSlots{limit: 1}, chat.limits, chat.budget, nil, chat.tags), "a messages field"},
+        {"/embed", embedHandler(cfg, newAdmission(1, false)), "an input field"},
+        {"/estimate", estimateHandler(cfg, newModelCache(cfg)), "a prompt field"},
+    }
+    for _, h := range handlers {
+        for _, body := range []string{"", " \n "} {
+            r := httptest.NewRequest("POST", h.path, strings.NewReader(body))
+            r.RemoteAddr = "192.0.2.1:1234"
+            r.Header.Set("Content-Type", "application/json")
+            w := httptest.NewRecorder()
+            h.handler(w, r)
+            if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "request body is required with "+h.needs) {
+                t.Errorf("%s with body %q = %d %q, want 400 asking for %s", h.path, body, w.Code, w.Body.String(), h.needs)
+            }
+        }
+    }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// A retriever finds documents relevant to a /chat prompt, which are then
+// put in front of it as context. RETRIEVER_URL selects httpRetriever; any
+// other store can be plugged in by implementing the interface.
+type retriever interface {
+    Retrieve(ctx context.Context, query string) ([]document, error)
+}
+
+type document struct {
+    Text   string `json:"text"`
+    Title  string `json:"title,omitempty"`
+    Source string `json:"source,omitempty"`
+}
+
+// noRetriever is used when retrieval is off, and finds nothing.
+type noRetriever struct{}
+
+func (noRetriever) Retrieve(ctx context.Context, query string) ([]document, error) {
+    return nil, nil
+}
+
+// httpRetriever asks a search service for documents. It POSTs
+// {"query": ..., "limit": n} and expects {"documents": [{"text": ...,
+// "title": ..., "source": ...}]}, best match first.
+type httpRetriever struct {
+    url    string
+    limit  int
+    client *http.Client
+}
+
+func newHTTPRetriever(url string, limit int, timeout time.Duration) *httpRetriever {
+    return &httpRetriever{url: url, limit: limit, client: &http.Client{Timeout: timeout}}
+}
+
+func (h *httpRetriever) Retrieve(ctx context.Context, query string) ([]document, error) {
+    body, _ := json.Marshal(map[string]interface{}{"query": query, "limit": h.limit})
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := h.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("retriever responded with status %d", resp.StatusCode)
+    }
+    var out struct {
+        Documents []document `json:"documents"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+        return nil, fmt.Errorf("invalid response from retriever: %v", err)
+    }
+    if len(out.Documents) > h.limit {
+        out.Documents = out.Documents[:h.limit]
+    }
+    return out.Documents, nil
+}
+
+// retrieveFor looks up documents for in's prompt, unless it opted out, and
+// sets what planChat puts in front of the prompt. A failed lookup is kept
+// to be reported as a warning; the request goes ahead without context.
+func retrieveFor(cfg *config, r *http.Request, in *chatInput) {
+    if in.Retrieve != nil && !*in.Retrieve {
+        return
+    }
+    docs, err := cfg.Retriever.Retrieve(r.Context(), in.Prompt)
+    if err != nil {
+        log.Printf("Document retrieval failed: %v", err)
+        in.retrievalError = err
+    } else if len(docs) > 0 {
+        log.Printf("Retrieved %d documents for the prompt", len(docs))
+    }
+    in.retrieved = retrievalContext(docs)
+}
+
+// retrievalContext is the text put in front of the prompt for docs, or ""
+// when there are none.
+func retrievalContext(docs []document) string {
+    var b strings.Builder
+    for _, d := range docs {
+        if strings.TrimSpace(d.Text) == "" {
+            continue
+        }
+        if b.Len() == 0 {
+            b.WriteString("Use these documents to answer where they are relevant.\n\n")
+        }
+        fmt.Fprintf(&b, "Document: %s\n", documentLabel(d))
+        b.WriteString(strings.TrimSpace(d.Text))
+        b.WriteString("\n\n")
+    }
+    if b.Len() == 0 {
+        return ""
+    }
+    b.WriteString("Question:\n")
+    return b.String()
+}
+
+func documentLabel(d document) string {
+    switch {
+    case d.Title != "" && d.Source != "":
+        return d.Title + " (" + d.Source + ")"
+    case d.Title != "":
+        return d.Title
+    case d.Source != "":
+        return d.Source
+    }
+    return "untitled"
+}
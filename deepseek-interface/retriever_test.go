@@ -0,0 +1,108 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// fakeRetriever returns docs, or err, and records the queries it gets.
+type fakeRetriever struct {
+    docs    []document
+    err     error
+    queries []string
+}
+
+func (f *fakeRetriever) Retrieve(ctx context.Context, query string) ([]document, error) {
+    f.queries = append(f.queries, query)
+    return f.docs, f.err
+}
+
+func TestChatRetrieval(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, DoneReason: "stop"}),
+    })
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL)
+    fake := &fakeRetriever{docs: []document{
+        {Text: "  Pods restart on OOM.  ", Title: "Runbook", Source: "wiki/oom"},
+        {Text: " "},
+        {Text: "Limits are in values.yaml.", Source: "repo"},
+    }}
+    cfg.Retriever = fake
+    chat := newTestChat(t, cfg)
+
+    prompt := func() string {
+        sent := ollama.requests("/api/generate")
+        return sent[len(sent)-1]["prompt"].(string)
+    }
+    want := "Use these documents to answer where they are relevant.\n\n" +
+        "Document: Runbook (wiki/oom)\nPods restart on OOM.\n\n" +
+        "Document: repo\nLimits are in values.yaml.\n\n" +
+        "Question:\nwhy did it restart?"
+    if w := chat.post(`{"prompt": "why did it restart?"}`); w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body.String())
+    }
+    if got := prompt(); got != want {
+        t.Errorf("prompt sent = %q, want %q", got, want)
+    }
+    if len(fake.queries) != 1 || fake.queries[0] != "why did it restart?" {
+        t.Errorf("queries = %q", fake.queries)
+    }
+
+    chat.post(`{"prompt": "just this", "retrieve": false}`)
+    if got := prompt(); got != "just this" {
+        t.Errorf("prompt sent with retrieve false = %q", got)
+    }
+    if len(fake.queries) != 1 {
+        t.Errorf("retriever asked %d times, want it skipped", len(fake.queries))
+    }
+
+    fake.docs, fake.err = nil, errors.New("search is down")
+    w := chat.post(`{"prompt": "still answer"}`)
+    if got := prompt(); got != "still answer" {
+        t.Errorf("prompt sent after a failed lookup = %q", got)
+    }
+    warnings, _ := decode(t, w)["warnings"].([]interface{})
+    if len(warnings) != 1 || !strings.Contains(warnings[0].(string), "document retrieval failed") {
+        t.Errorf("warnings = %v, want the failed lookup reported", warnings)
+    }
+}
+
+func TestHTTPRetriever(t *testing.T) {
+    var got map[string]interface{}
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        json.NewDecoder(r.Body).Decode(&got)
+        w.Write([]byte(`{"documents": [{"text": "one"}, {"text": "two"}, {"text": "three"}]}`))
+    }))
+    defer ts.Close()
+
+    docs, err := newHTTPRetriever(ts.URL, 2, time.Second).Retrieve(context.Background(), "query")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(docs) != 2 || docs[0].Text != "one" || docs[1].Text != "two" {
+        t.Errorf("documents = %+v, want the first two", docs)
+    }
+    if got["query"] != "query" || got["limit"] != 2.0 {
+        t.Errorf("request = %v", got)
+    }
+
+    failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.Error(w, "no", http.StatusBadGateway)
+    }))
+    defer failing.Close()
+    if _, err := newHTTPRetriever(failing.URL, 2, time.Second).Retrieve(context.Background(), "q"); err == nil || !strings.Contains(err.Error(), "status 502") {
+        t.Errorf("error = %v, want the status", err)
+    }
+}
+
+func TestRetrieverOffByDefault(t *testing.T) {
+    if _, ok := testConfig(t).Retriever.(noRetriever); !ok {
+        t.Error("a retriever is configured without RETRIEVER_URL")
+    }
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "crypto/subtle"
+    "fmt"
+    "net/http"
+    "path"
+    "strings"
+)
+
+// Built-in role names. Requests with the admin token are "admin", requests
+// with one of a custom role's tokens take that role, and everyone else is
+// "user".
+const (
+    roleAdmin = "admin"
+    roleUser  = "user"
+)
+
+// roleConfig is one entry of the "roles" map in CONFIG_FILE.
+type roleConfig struct {
+    // Bearer tokens that select this role. Only for custom roles: admin
+    // is selected by ADMIN_TOKEN and user is the fallback.
+    Tokens []string `json:"tokens"`
+    // Ollama options applied unless the request sets them itself.
+    Options map[string]interface{} `json:"options"`
+    // Models the role may use, as names or globs such as "llama3:*".
+    // Empty allows all.
+    Models []string `json:"models"`
+    // Upper bound on num_predict; it is also the default when a request
+    // sets none. 0 leaves it alone.
+    MaxTokens int `json:"max_tokens"`
+    // Overrides DAILY_TOKEN_BUDGET for this role; 0 means no budget.
+    DailyTokenBudget *int `json:"daily_token_budget"`
+}
+
+func checkRoles(roles map[string]roleConfig) error {
+    seen := make(map[string]string)
+    for name, rc := range roles {
+        if (name == roleAdmin || name == roleUser) && len(rc.Tokens) > 0 {
+            return fmt.Errorf("role %s: tokens can only be set on custom roles", name)
+        }
+        for _, t := range rc.Tokens {
+            if t == "" {
+                return fmt.Errorf("role %s: empty token", name)
+            }
+            if other, dup := seen[t]; dup {
+                return fmt.Errorf("roles %s and %s share a token", other, name)
+            }
+            seen[t] = name
+        }
+        for _, m := range rc.Models {
+            if _, err := path.Match(m, ""); err != nil {
+                return fmt.Errorf("role %s: bad model pattern %q", name, m)
+            }
+        }
+        if rc.MaxTokens < 0 || (rc.DailyTokenBudget != nil && *rc.DailyTokenBudget < 0) {
+            return fmt.Errorf("role %s: limits must not be negative", name)
+        }
+    }
+    return nil
+}
+
+// roleFor resolves the role of r and its settings. A role missing from the
+// config has no extra defaults or limits.
+func (c *config) roleFor(r *http.Request) (string, roleConfig) {
+    name := roleUser
+    if isAdmin(r, c.AdminToken) {
+        name = roleAdmin
+    } else if got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+        for role, rc := range c.Roles {
+            for _, t := range rc.Tokens {
+                if subtle.ConstantTimeCompare([]byte(got), []byte(t)) == 1 {
+                    name = role
+                }
+            }
+        }
+    }
+    return name, c.Roles[name]
+}
+
+func (rc *roleConfig) allowsModel(model string) bool {
+    if len(rc.Models) == 0 {
+        return true
+    }
+    for _, m := range rc.Models {
+        if ok, _ := path.Match(m, model); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// applyRole checks model against the role's allow-list and returns opts
+// with the role's defaults filled in and num_predict capped. Request
+// options win over role defaults; the cap wins over both.
+func (rc *roleConfig) applyRole(role, model string, opts map[string]interface{}) (map[string]interface{}, error) {
+    if !rc.allowsModel(model) {
+        return nil, &requestError{http.StatusForbidden, fmt.Sprintf("model %s is not available to role %s", model, role)}
+    }
+    if len(rc.Options) == 0 && rc.MaxTokens == 0 {
+        return opts, nil
+    }
+    merged := make(map[string]interface{}, len(rc.Options)+len(opts)+1)
+    for k, v := range rc.Options {
+        merged[k] = v
+    }
+    for k, v := range opts {
+        merged[k] = v
+    }
+    if rc.MaxTokens > 0 {
+        n, ok := merged["num_predict"].(float64)
+        if i, isInt := merged["num_predict"].(int); isInt {
+            n, ok = float64(i), true
+        }
+        if !ok || n < 0 || n > float64(rc.MaxTokens) {
+            merged["num_predict"] = rc.MaxTokens
+        }
+    }
+    return merged, nil
+}
+
+// budgetLimit is the daily token budget for role.
+func (c *config) budgetLimit(rc roleConfig) int {
+    if rc.DailyTokenBudget != nil {
+        return *rc.DailyTokenBudget
+    }
+    return c.DailyTokenBudget
+}
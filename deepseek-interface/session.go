@@ -0,0 +1,131 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "strings"
+    "sync"
+)
+
+const sessionCookie = "deepseek_session"
+
+// What SESSION_MISSING does with a request that has no valid session
+// cookie, because cookies are off or it was tampered with.
+const (
+    sessionIssue     = "issue"
+    sessionStateless = "stateless"
+)
+
+// sessionHeader says how a request without a valid cookie was handled:
+// "new" when one was just issued, "none" when it was served statelessly.
+// A client that keeps getting "new" isn't storing the cookie.
+const sessionHeader = "X-Session"
+
+// sessionID returns the caller's session ID. A request that doesn't carry
+// a validly signed one is issued a new cookie, or with
+// SESSION_MISSING=stateless gets "" and goes ahead without a session.
+func sessionID(cfg *config, w http.ResponseWriter, r *http.Request) string {
+    if id := existingSession(cfg, r); id != "" {
+        return id
+    }
+    if cfg.SessionMissing == sessionStateless {
+        w.Header().Set(sessionHeader, "none")
+        return ""
+    }
+    b := make([]byte, 16)
+    rand.Read(b)
+    id := hex.EncodeToString(b)
+    http.SetCookie(w, &http.Cookie{
+        Name:     sessionCookie,
+        Value:    signSession(cfg, id),
+        Path:     "/",
+        HttpOnly: true,
+        Secure:   cfg.isHTTPS(r),
+        SameSite: http.SameSiteLaxMode,
+    })
+    w.Header().Set(sessionHeader, "new")
+    return id
+}
+
+// limitKey is what per-session limits count a request against: the
+// session its cookie names, or its client IP when it came without one. A
+// session issued to this very request counts as none, or a client that
+// drops its cookie each time would get fresh limits on every request.
+func limitKey(cfg *config, r *http.Request) string {
+    if id := existingSession(cfg, r); id != "" {
+        return id
+    }
+    return "ip:" + cfg.clientIP(r)
+}
+
+// existingSession returns the session ID the request's cookie carries, or
+// "" without issuing one, for code that only reads per-session state.
+func existingSession(cfg *config, r *http.Request) string {
+    c, err := r.Cookie(sessionCookie)
+    if err != nil {
+        return ""
+    }
+    id, sig, ok := strings.Cut(c.Value, ".")
+    if !ok || !validSessionID(id) || !hmac.Equal([]byte(sig), []byte(sessionSignature(cfg, id))) {
+        return ""
+    }
+    return id
+}
+
+// The cookie is the session ID and an HMAC of it under SESSION_SECRET, so
+// a client can't make up IDs, or pick another user's, to get a fresh
+// budget or limits.
+func signSession(cfg *config, id string) string {
+    return id + "." + sessionSignature(cfg, id)
+}
+
+func sessionSignature(cfg *config, id string) string {
+    mac := hmac.New(sha256.New, cfg.SessionSecret)
+    mac.Write([]byte(id))
+    return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func validSessionID(id string) bool {
+    if len(id) != 32 {
+        return false
+    }
+    _, err := hex.DecodeString(id)
+    return err == nil
+}
+
+// sessionLimiter caps how many generations a single session may have
+// running at once, so one user with many tabs can't hog every slot.
+type sessionLimiter struct {
+    mu     sync.Mutex
+    limit  int
+    active map[string]int
+}
+
+func newSessionLimiter(limit int) *sessionLimiter {
+    return &sessionLimiter{limit: limit, active: make(map[string]int)}
+}
+
+// acquire reports whether the session may start another generation. A
+// limit of zero or less disables the cap.
+func (l *sessionLimiter) acquire(id string) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.limit > 0 && l.active[id] >= l.limit {
+        return false
+    }
+    l.active[id]++
+    return true
+}
+
+func (l *sessionLimiter) release(id string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.active[id] <= 1 {
+        delete(l.active, id)
+        return
+    }
+    l.active[id]--
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// withSession adds a validly signed cookie for session id to r.
+func withSession(cfg *config, r *http.Request, id string) *http.Request {
+    r.AddCookie(&http.Cookie{Name: sessionCookie, Value: signSession(cfg, id)})
+    return r
+}
+
+// sessionFor makes a session ID from a short name, for readable tests.
+func sessionFor(name string) string {
+    return (name + strings.Repeat("0", 32))[:32]
+}
+
+func TestSessionLimiterCap(t *testing.T) {
+    l := newSessionLimiter(2)
+    if !l.acquire("a") || !l.acquire("a") {
+        t.Fatal("session a refused below its cap")
+    }
+    if l.acquire("a") {
+        t.Error("session a got a third generation with a cap of 2")
+    }
+    if !l.acquire("b") {
+        t.Error("session b refused because of a's generations")
+    }
+
+    l.release("a")
+    if !l.acquire("a") {
+        t.Error("session a refused after releasing one of two")
+    }
+    l.release("a")
+    l.release("a")
+    l.release("b")
+    if len(l.active) != 0 {
+        t.Errorf("active = %v after every generation ended, want empty", l.active)
+    }
+}
+
+func TestSessionLimiterUnlimited(t *testing.T) {
+    l := newSessionLimiter(0)
+    for i := 0; i < 100; i++ {
+        if !l.acquire("a") {
+            t.Fatalf("generation %d refused with the cap off", i+1)
+        }
+    }
+}
+
+func TestSessionLimiterConcurrent(t *testing.T) {
+    const limit = 3
+    l := newSessionLimiter(limit)
+    var (
+        wg      sync.WaitGroup
+        mu      sync.Mutex
+        granted int
+    )
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if l.acquire("a") {
+                mu.Lock()
+                granted++
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    if granted != limit {
+        t.Errorf("%d of 50 concurrent generations were let in, want %d", granted, limit)
+    }
+}
+
+func TestSessionID(t *testing.T) {
+    cfg := testConfig(t, "SESSION_SECRET", "test-secret-0123456789", "SESSION_MISSING", sessionIssue)
+    other := testConfig(t, "SESSION_SECRET", "other-secret-0123456789")
+    id := sessionFor("a")
+    tests := []struct {
+        name, cookie string
+        keep         bool
+    }{
+        {"valid", signSession(cfg, id), true},
+        {"missing", "", false},
+        {"unsigned", id, false},
+        {"bad signature", id + ".0123456789abcdef0123456789abcdef", false},
+        {"signed with another secret", signSession(other, id), false},
+        {"signature of another ID", id + "." + sessionSignature(cfg, sessionFor("b")), false},
+        {"not hex", signSession(cfg, "zz"+id[2:]), false},
+        {"too short", signSession(cfg, id[:16]), false},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest("POST", "/chat", nil)
+        if tt.cookie != "" {
+            r.AddCookie(&http.Cookie{Name: sessionCookie, Value: tt.cookie})
+        }
+        w := httptest.NewRecorder()
+        got := sessionID(cfg, w, r)
+        if tt.keep {
+            if got != id || w.Header().Get(sessionHeader) != "" || w.Header().Get("Set-Cookie") != "" {
+                t.Errorf("%s: session %q, %s %q; want %q kept as it is", tt.name, got, sessionHeader, w.Header().Get(sessionHeader), id)
+            }
+            continue
+        }
+        if got == id || !validSessionID(got) || w.Header().Get(sessionHeader) != "new" {
+            t.Errorf("%s: session %q, %s %q; want a new one", tt.name, got, sessionHeader, w.Header().Get(sessionHeader))
+        }
+        // The cookie issued is valid from then on.
+        next := httptest.NewRequest("POST", "/chat", nil)
+        for _, c := range w.Result().Cookies() {
+            next.AddCookie(c)
+        }
+        if again := existingSession(cfg, next); again != got {
+            t.Errorf("%s: the issued cookie reads back as %q, want %q", tt.name, again, got)
+        }
+    }
+}
+
+func TestSessionIDStateless(t *testing.T) {
+    cfg := testConfig(t, "SESSION_SECRET", "test-secret-0123456789", "SESSION_MISSING", sessionStateless)
+    for _, cookie := range []string{"", sessionFor("a") + ".forged"} {
+        r := httptest.NewRequest("POST", "/chat", nil)
+        if cookie != "" {
+            r.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookie})
+        }
+        w := httptest.NewRecorder()
+        if got := sessionID(cfg, w, r); got != "" || w.Header().Get(sessionHeader) != "none" || w.Header().Get("Set-Cookie") != "" {
+            t.Errorf("cookie %q: session %q, %s %q; want none and no cookie", cookie, got, sessionHeader, w.Header().Get(sessionHeader))
+        }
+    }
+
+    // A valid cookie is still honoured.
+    r := withSession(cfg, httptest.NewRequest("POST", "/chat", nil), sessionFor("a"))
+    w := httptest.NewRecorder()
+    if got := sessionID(cfg, w, r); got != sessionFor("a") || w.Header().Get(sessionHeader) != "" {
+        t.Errorf("valid cookie in stateless mode: session %q, %s %q", got, sessionHeader, w.Header().Get(sessionHeader))
+    }
+
+    if err := configError(t, "SESSION_MISSING", "reject"); err == nil {
+        t.Error("SESSION_MISSING=reject was accepted")
+    }
+}
+
+func TestChatSessionHeader(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, DoneReason: "stop"}),
+    })
+    for mode, want := range map[string]string{sessionIssue: "new", sessionStateless: "none"} {
+        chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "SESSION_MISSING", mode))
+        w := chat.post(`{"prompt": "hi"}`, "Cookie", sessionCookie+"=garbage")
+        if w.Code != http.StatusOK || w.Header().Get(sessionHeader) != want {
+            t.Errorf("SESSION_MISSING=%s: %d, %s %q, want %q", mode, w.Code, sessionHeader, w.Header().Get(sessionHeader), want)
+        }
+    }
+}
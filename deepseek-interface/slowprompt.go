@@ -0,0 +1,40 @@
+package main
+
+import (
+    "log"
+    "regexp"
+    "time"
+)
+
+// promptSecrets are masked before a prompt is logged as slow: email
+// addresses, values given for something named like a credential, and long
+// unbroken strings that look like keys or tokens.
+var promptSecrets = []struct {
+    re   *regexp.Regexp
+    with string
+}{
+    {regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[email]"},
+    {regexp.MustCompile(`(?i)\b(bearer|api[_-]?key|token|password|passwd|secret)(\s*[:=]\s*|\s+)\S+`), "$1$2[redacted]"},
+    {regexp.MustCompile(`\b[A-Za-z0-9_\-+/]{32,}={0,2}`), "[redacted]"},
+}
+
+func redactPrompt(prompt string) string {
+    for _, s := range promptSecrets {
+        prompt = s.re.ReplaceAllString(prompt, s.with)
+    }
+    return prompt
+}
+
+// logSlowPrompt logs a /chat prompt whose generation took longer than
+// SLOW_PROMPT_THRESHOLD, with the model and how long it took, to find the
+// kinds of prompt that make generations slow. The prompt is masked and cut
+// to SLOW_PROMPT_MAX_BYTES. Unlike DEBUG_V1_BODIES it logs nothing for
+// requests that finish in time.
+func logSlowPrompt(cfg *config, model, prompt string, took time.Duration) {
+    if cfg.SlowPromptThreshold == 0 || took <= cfg.SlowPromptThreshold {
+        return
+    }
+    text := &cappedBuffer{max: cfg.SlowPromptMaxBytes}
+    text.Write([]byte(redactPrompt(prompt)))
+    log.Printf("Slow prompt: model=%s duration=%s prompt=%s", model, took.Round(time.Millisecond), text)
+}
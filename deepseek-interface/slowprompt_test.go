@@ -0,0 +1,114 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// syncBuffer is a bytes.Buffer safe to log to from handler goroutines.
+type syncBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+// captureLog sends the log to a buffer for the rest of the test.
+func captureLog(t *testing.T) *syncBuffer {
+    b := &syncBuffer{}
+    prev := log.Writer()
+    log.SetOutput(b)
+    t.Cleanup(func() { log.SetOutput(prev) })
+    return b
+}
+
+// slowLines returns the "Slow prompt" lines logged.
+func slowLines(logged *syncBuffer) []string {
+    var lines []string
+    for _, line := range strings.Split(logged.String(), "\n") {
+        if strings.Contains(line, "Slow prompt:") {
+            lines = append(lines, line)
+        }
+    }
+    return lines
+}
+
+func TestLogSlowPrompt(t *testing.T) {
+    logged := captureLog(t)
+    cfg := testConfig(t, "SLOW_PROMPT_THRESHOLD", "2s", "SLOW_PROMPT_MAX_BYTES", "20")
+
+    logSlowPrompt(cfg, "m:7b", "fast enough", time.Second)
+    logSlowPrompt(cfg, "m:7b", "right at it", 2*time.Second)
+    if lines := slowLines(logged); len(lines) != 0 {
+        t.Fatalf("logged %q for prompts within the threshold", lines)
+    }
+
+    logSlowPrompt(cfg, "m:7b", "explain this very long stack trace please", 2500*time.Millisecond)
+    lines := slowLines(logged)
+    if len(lines) != 1 {
+        t.Fatalf("logged %q, want one slow prompt", lines)
+    }
+    if want := `model=m:7b duration=2.5s prompt="explain this very lo" (21 more bytes)`; !strings.HasSuffix(lines[0], want) {
+        t.Errorf("logged %q, want it to end %q", lines[0], want)
+    }
+
+    off := testConfig(t, "SLOW_PROMPT_THRESHOLD", "")
+    logSlowPrompt(off, "m:7b", "anything", time.Hour)
+    if lines := slowLines(logged); len(lines) != 1 {
+        t.Errorf("logged %q with SLOW_PROMPT_THRESHOLD unset", lines)
+    }
+}
+
+func TestRedactPrompt(t *testing.T) {
+    tests := []struct{ in, want string }{
+        {"mail ops@example.com about it", "mail [email] about it"},
+        {"password: hunter2 then", "password: [redacted] then"},
+        {"API_KEY=abc123", "API_KEY=[redacted]"},
+        {"Authorization: Bearer eyJhbGciOi", "Authorization: Bearer [redacted]"},
+        {"key " + strings.Repeat("a1B2", 10), "key [redacted]"},
+        {"why does my pod restart?", "why does my pod restart?"},
+    }
+    for _, tt := range tests {
+        if got := redactPrompt(tt.in); got != tt.want {
+            t.Errorf("redactPrompt(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestChatLogsSlowPrompts(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": func(w http.ResponseWriter, r *http.Request) {
+            var req ChatRequest
+            json.NewDecoder(r.Body).Decode(&req)
+            if strings.Contains(req.Prompt, "slow") {
+                time.Sleep(150 * time.Millisecond)
+            }
+            w.Write([]byte(`{"response": "ok", "done": true, "done_reason": "stop"}`))
+        },
+    })
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "SLOW_PROMPT_THRESHOLD", "100ms"))
+    logged := captureLog(t)
+
+    chat.post(`{"prompt": "a quick one"}`)
+    chat.post(`{"prompt": "a slow one"}`)
+    lines := slowLines(logged)
+    if len(lines) != 1 || !strings.Contains(lines[0], `prompt="a slow one"`) || !strings.Contains(lines[0], "model=codellama:7b") {
+        t.Errorf("logged %q, want only the slow prompt", lines)
+    }
+}
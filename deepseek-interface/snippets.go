@@ -0,0 +1,245 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Saved snippets are named chunks of text a session can reference from a
+// prompt as @snippet:<name>; the server expands them before the prompt is
+// limited and sent to Ollama.
+
+const (
+    maxSnippetLength    = 8 * 1024
+    maxSnippetsPerOwner = 100
+)
+
+var (
+    snippetRef  = regexp.MustCompile(`@snippet:([A-Za-z0-9_-]+)`)
+    snippetName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// snippetStore holds snippets per owner (the session ID). With a path set,
+// every change is written back to that JSON file so snippets survive a
+// restart; otherwise they live in memory only.
+type snippetStore struct {
+    path string
+
+    mu     sync.Mutex
+    owners map[string]map[string]string
+}
+
+func openSnippetStore(path string) (*snippetStore, error) {
+    s := &snippetStore{path: path, owners: make(map[string]map[string]string)}
+    if path == "" {
+        return s, nil
+    }
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return s, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &s.owners); err != nil {
+        return nil, fmt.Errorf("parsing %s: %w", path, err)
+    }
+    return s, nil
+}
+
+// saveLocked writes the store to a temporary file and renames it over the
+// old one, so a crash mid-write leaves the previous version intact.
+func (s *snippetStore) saveLocked() error {
+    if s.path == "" {
+        return nil
+    }
+    data, _ := json.Marshal(s.owners)
+    tmp, err := os.CreateTemp(filepath.Dir(s.path), ".snippets-*")
+    if err != nil {
+        return err
+    }
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *snippetStore) list(owner string) map[string]string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    out := make(map[string]string, len(s.owners[owner]))
+    for k, v := range s.owners[owner] {
+        out[k] = v
+    }
+    return out
+}
+
+func (s *snippetStore) put(owner, name, text string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    m := s.owners[owner]
+    if m == nil {
+        m = make(map[string]string)
+        s.owners[owner] = m
+    }
+    if _, exists := m[name]; !exists && len(m) >= maxSnippetsPerOwner {
+        return badRequest("at most %d snippets may be saved", maxSnippetsPerOwner)
+    }
+    m[name] = text
+    return s.saveLocked()
+}
+
+// remove reports whether the snippet existed.
+func (s *snippetStore) remove(owner, name string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.owners[owner][name]; !ok {
+        return false, nil
+    }
+    delete(s.owners[owner], name)
+    if len(s.owners[owner]) == 0 {
+        delete(s.owners, owner)
+    }
+    return true, s.saveLocked()
+}
+
+// expandSnippets replaces @snippet:<name> references in prompt with the
+// owner's snippets, following references inside snippets up to maxDepth
+// (SNIPPET_MAX_DEPTH). Unknown names and cycles are errors rather than
+// being left in place, so a typo doesn't silently reach the model.
+//
+// maxSize (SNIPPET_MAX_EXPANDED) bounds the prompt after expansion, before
+// MAX_PROMPT_LENGTH is applied, so a few snippets that reference each
+// other many times can't build an enormous string. It is checked as the
+// text grows, not only at the end.
+func expandSnippets(prompt string, snippets map[string]string, maxDepth, maxSize int) (string, error) {
+    if !strings.Contains(prompt, "@snippet:") {
+        return prompt, nil
+    }
+    var expand func(text string, depth int, stack []string) (string, error)
+    expand = func(text string, depth int, stack []string) (string, error) {
+        var b strings.Builder
+        last := 0
+        for _, m := range snippetRef.FindAllStringSubmatchIndex(text, -1) {
+            name := text[m[2]:m[3]]
+            for i, s := range stack {
+                if s != name {
+                    continue
+                }
+                if i == len(stack)-1 {
+                    return "", badRequest("snippet %s includes itself", name)
+                }
+                cycle := append(append([]string{}, stack[i:]...), name)
+                return "", badRequest("snippets include each other in a cycle: %s", strings.Join(cycle, " -> "))
+            }
+            body, ok := snippets[name]
+            if !ok {
+                return "", badRequest("unknown snippet %s", name)
+            }
+            if depth >= maxDepth {
+                return "", badRequest("snippets may be nested at most %d deep (%s)", maxDepth, strings.Join(append(stack, name), " -> "))
+            }
+            inner, err := expand(body, depth+1, append(stack, name))
+            if err != nil {
+                return "", err
+            }
+            b.WriteString(text[last:m[0]])
+            b.WriteString(inner)
+            last = m[1]
+            if b.Len() > maxSize {
+                return "", &requestError{http.StatusRequestEntityTooLarge, fmt.Sprintf("prompt with snippets expanded exceeds %d bytes", maxSize)}
+            }
+        }
+        b.WriteString(text[last:])
+        return b.String(), nil
+    }
+    out, err := expand(prompt, 0, nil)
+    if err == nil && len(out) > maxSize {
+        return "", &requestError{http.StatusRequestEntityTooLarge, fmt.Sprintf("prompt with snippets expanded exceeds %d bytes", maxSize)}
+    }
+    return out, err
+}
+
+type snippetInput struct {
+    Name string `json:"name"`
+    Text string `json:"text"`
+}
+
+// snippetsHandler lists (GET), saves (POST {"name","text"}) and deletes
+// (DELETE ?name=) the caller's snippets.
+func snippetsHandler(cfg *config, store *snippetStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        owner := sessionID(cfg, w, r)
+        if owner == "" {
+            jsonError(w, "snippets are kept per session, and this request has no session cookie", http.StatusBadRequest)
+            return
+        }
+        switch r.Method {
+        case "GET":
+            snippets := store.list(owner)
+            names := make([]string, 0, len(snippets))
+            for name := range snippets {
+                names = append(names, name)
+            }
+            sort.Strings(names)
+            out := make([]snippetInput, 0, len(names))
+            for _, name := range names {
+                out = append(out, snippetInput{Name: name, Text: snippets[name]})
+            }
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(map[string]interface{}{"snippets": out})
+
+        case "POST":
+            if !requireJSON(w, r) {
+                return
+            }
+            var in snippetInput
+            if err := decodeBody(r, &in, "name and text fields"); err != nil {
+                jsonError(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            if !snippetName.MatchString(in.Name) {
+                jsonError(w, "name must be 1-64 letters, digits, '-' or '_'", http.StatusBadRequest)
+                return
+            }
+            if len(in.Text) > maxSnippetLength {
+                jsonError(w, fmt.Sprintf("text may not exceed %d bytes", maxSnippetLength), http.StatusBadRequest)
+                return
+            }
+            if err := store.put(owner, in.Name, in.Text); err != nil {
+                jsonError(w, err.Error(), errorStatus(err))
+                return
+            }
+            w.Header().Set("Content-Type", "application/json")
+            json.NewEncoder(w).Encode(in)
+
+        case "DELETE":
+            found, err := store.remove(owner, r.URL.Query().Get("name"))
+            if err != nil {
+                jsonError(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+            if !found {
+                jsonError(w, "no such snippet", http.StatusNotFound)
+                return
+            }
+            w.WriteHeader(http.StatusNoContent)
+
+        default:
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+    }
+}
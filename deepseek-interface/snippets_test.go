@@ -0,0 +1,187 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+func TestExpandSnippets(t *testing.T) {
+    snippets := map[string]string{
+        "style": "Use tabs.",
+        "review": "Review this. @snippet:style",
+        "empty": "",
+    }
+    tests := []struct {
+        prompt, want string
+    }{
+        {"no references", "no references"},
+        {"@snippet:style Fix it.", "Use tabs. Fix it."},
+        {"@snippet:review\ncode", "Review this. Use tabs.\ncode"},
+        {"@snippet:style @snippet:style", "Use tabs. Use tabs."},
+        {"[@snippet:empty]", "[]"},
+        {"mail me@snippet.example", "mail me@snippet.example"},
+    }
+    for _, tt := range tests {
+        got, err := expandSnippets(tt.prompt, snippets, 3, 1024)
+        if err != nil {
+            t.Errorf("expandSnippets(%q): %v", tt.prompt, err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("expandSnippets(%q) = %q, want %q", tt.prompt, got, tt.want)
+        }
+    }
+}
+
+func TestExpandSnippetsGuards(t *testing.T) {
+    snippets := map[string]string{
+        "self": "again @snippet:self",
+        "big":  strings.Repeat("x", 600),
+        "two":  "@snippet:big @snippet:big",
+    }
+    tests := []struct {
+        prompt string
+        status int
+        msg    string
+    }{
+        {"@snippet:missing", http.StatusBadRequest, "unknown snippet missing"},
+        {"@snippet:self", http.StatusBadRequest, "snippet self includes itself"},
+        {"@snippet:two", http.StatusRequestEntityTooLarge, "exceeds 1000 bytes"},
+        {"@snippet:big " + strings.Repeat("y", 500), http.StatusRequestEntityTooLarge, "exceeds 1000 bytes"},
+    }
+    for _, tt := range tests {
+        _, err := expandSnippets(tt.prompt, snippets, 3, 1000)
+        wantRequestError(t, err, tt.status, tt.msg)
+    }
+}
+
+func TestExpandSnippetsDepthAndCycles(t *testing.T) {
+    snippets := map[string]string{
+        "a":  "A @snippet:b",
+        "b":  "B @snippet:c",
+        "c":  "C @snippet:a",
+        "d1": "1 @snippet:d2",
+        "d2": "2 @snippet:d3",
+        "d3": "3 @snippet:d4",
+        "d4": "4",
+    }
+    _, err := expandSnippets("@snippet:a", snippets, 10, 1024)
+    wantRequestError(t, err, http.StatusBadRequest, "snippets include each other in a cycle: a -> b -> c -> a")
+    _, err = expandSnippets("@snippet:b", snippets, 10, 1024)
+    wantRequestError(t, err, http.StatusBadRequest, "cycle: b -> c -> a -> b")
+
+    _, err = expandSnippets("@snippet:d1", snippets, 3, 1024)
+    wantRequestError(t, err, http.StatusBadRequest, "snippets may be nested at most 3 deep (d1 -> d2 -> d3 -> d4)")
+    if got, err := expandSnippets("@snippet:d1", snippets, 4, 1024); err != nil || got != "1 2 3 4" {
+        t.Errorf("four deep with a depth of 4 = %q, %v", got, err)
+    }
+    if got, err := expandSnippets("@snippet:d4", snippets, 1, 1024); err != nil || got != "4" {
+        t.Errorf("one deep with a depth of 1 = %q, %v", got, err)
+    }
+
+    // Each level doubles the text; the size check stops it as it grows
+    // rather than after building all of it.
+    bomb := map[string]string{"x0": strings.Repeat("x", 100)}
+    for i := 1; i <= 9; i++ {
+        ref := "@snippet:x" + strconv.Itoa(i-1)
+        bomb["x"+strconv.Itoa(i)] = ref + ref
+    }
+    _, err = expandSnippets("@snippet:x9", bomb, 10, 10000)
+    wantRequestError(t, err, http.StatusRequestEntityTooLarge, "exceeds 10000 bytes")
+
+    for _, env := range [][]string{
+        {"SNIPPET_MAX_DEPTH", "0"},
+        {"SNIPPET_MAX_DEPTH", "11"},
+        {"SNIPPET_MAX_EXPANDED", "0"},
+        {"SNIPPET_MAX_EXPANDED", "17MiB"},
+    } {
+        if err := configError(t, env...); err == nil {
+            t.Errorf("%s=%s was accepted", env[0], env[1])
+        }
+    }
+    cfg := testConfig(t, "SNIPPET_MAX_DEPTH", "5", "SNIPPET_MAX_EXPANDED", "1KiB")
+    if cfg.SnippetMaxDepth != 5 || cfg.SnippetMaxExpanded != 1024 {
+        t.Errorf("limits = %d deep, %d bytes", cfg.SnippetMaxDepth, cfg.SnippetMaxExpanded)
+    }
+}
+
+func TestSnippetsHandler(t *testing.T) {
+    cfg := testConfig(t)
+    store, err := openSnippetStore(filepath.Join(t.TempDir(), "snippets.json"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    h := snippetsHandler(cfg, store)
+    do := func(owner, method, target, body string) *httptest.ResponseRecorder {
+        r := withSession(cfg, httptest.NewRequest(method, target, strings.NewReader(body)), sessionFor(owner))
+        r.Header.Set("Content-Type", "application/json")
+        w := httptest.NewRecorder()
+        h(w, r)
+        return w
+    }
+    list := func(owner string) []snippetInput {
+        var out struct{ Snippets []snippetInput }
+        json.Unmarshal(do(owner, "GET", "/snippets", "").Body.Bytes(), &out)
+        return out.Snippets
+    }
+
+    if w := do("a", "POST", "/snippets", `{"name": "style", "text": "Use tabs."}`); w.Code != http.StatusOK {
+        t.Fatalf("save = %d %s", w.Code, w.Body.String())
+    }
+    if got := list("a"); len(got) != 1 || got[0] != (snippetInput{"style", "Use tabs."}) {
+        t.Errorf("a's snippets = %+v", got)
+    }
+    if got := list("b"); len(got) != 0 {
+        t.Errorf("b sees a's snippets: %+v", got)
+    }
+    if w := do("a", "POST", "/snippets", `{"name": "bad name", "text": "x"}`); w.Code != http.StatusBadRequest {
+        t.Errorf("save with a bad name = %d, want 400", w.Code)
+    }
+    if w := do("a", "POST", "/snippets", `{"name": "huge", "text": "`+strings.Repeat("x", maxSnippetLength+1)+`"}`); w.Code != http.StatusBadRequest {
+        t.Errorf("save of an oversized snippet = %d, want 400", w.Code)
+    }
+
+    reopened, err := openSnippetStore(store.path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := reopened.list(sessionFor("a")); got["style"] != "Use tabs." {
+        t.Errorf("snippets after reopening the file = %v", got)
+    }
+
+    if w := do("b", "DELETE", "/snippets?name=style", ""); w.Code != http.StatusNotFound {
+        t.Errorf("b deleting a's snippet = %d, want 404", w.Code)
+    }
+    if w := do("a", "DELETE", "/snippets?name=style", ""); w.Code != http.StatusNoContent {
+        t.Errorf("delete = %d, want 204", w.Code)
+    }
+    if got := list("a"); len(got) != 0 {
+        t.Errorf("snippets after the delete = %+v", got)
+    }
+}
+
+func TestPlanChatExpandsSnippets(t *testing.T) {
+    cfg := testConfig(t)
+    owner := sessionFor("a")
+    cfg.Snippets.put(owner, "style", "Use tabs.")
+
+    r := withSession(cfg, httptest.NewRequest("POST", "/chat", nil), owner)
+    p, err := planChat(cfg, r, &chatInput{Prompt: "@snippet:style Fix it."})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if p.Upstream.Prompt != "Use tabs. Fix it." {
+        t.Errorf("prompt sent = %q", p.Upstream.Prompt)
+    }
+
+    // Without a session there are no snippets to expand.
+    p, err = plan(t, cfg, chatInput{Prompt: "@snippet:style Fix it."})
+    if err != nil || p.Upstream.Prompt != "@snippet:style Fix it." {
+        t.Errorf("prompt sent without a session = %q, %v", p.Upstream.Prompt, err)
+    }
+}
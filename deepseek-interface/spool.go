@@ -0,0 +1,219 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "unicode/utf8"
+)
+
+// Spooling is for replies too big to keep in a browser tab, such as a
+// generated file. A streamed /chat request with "spool" has its reply
+// written to a temp file as it arrives, and can download it once the
+// stream ends. SPOOL_MAX_BYTES bounds each file and turns the feature on.
+// A file is removed once it has been downloaded, or SPOOL_TTL after the
+// stream ended.
+const (
+    spoolCopy = "copy" // stream as usual and keep a copy in the file
+    spoolFile = "file" // only write the file; the stream carries progress
+)
+
+func parseSpoolMode(s string) (string, error) {
+    switch s {
+    case spoolCopy, spoolFile:
+        return s, nil
+    }
+    return "", fmt.Errorf("spool must be copy or file, got %q", s)
+}
+
+// spoolInfo tells the client where its reply went, on the stream's last
+// event.
+type spoolInfo struct {
+    URL       string    `json:"url"`
+    Bytes     int64     `json:"bytes"`
+    Truncated bool      `json:"truncated,omitempty"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+// spooledReply is one reply's file. Only the stream writing it touches
+// file, size and truncated; done and expires are guarded by the store.
+type spooledReply struct {
+    store     *spoolStore
+    id        string
+    owner     string
+    path      string
+    file      *os.File
+    size      int64
+    truncated bool
+    done      bool
+    expires   time.Time
+}
+
+// spoolStore keeps track of the spooled replies. A nil *spoolStore
+// spools nothing.
+type spoolStore struct {
+    dir string
+    ttl time.Duration
+    max int64
+
+    mu    sync.Mutex
+    files map[string]*spooledReply
+}
+
+// newSpoolStore prepares SPOOL_DIR, or returns nil with spooling off.
+// Files left behind by an earlier run can't be downloaded any more, so they
+// are removed.
+func newSpoolStore(cfg *config) (*spoolStore, error) {
+    if cfg.SpoolMaxBytes == 0 {
+        return nil, nil
+    }
+    if err := os.MkdirAll(cfg.SpoolDir, 0o700); err != nil {
+        return nil, err
+    }
+    old, _ := filepath.Glob(filepath.Join(cfg.SpoolDir, "reply-*.txt"))
+    for _, p := range old {
+        os.Remove(p)
+    }
+    return &spoolStore{dir: cfg.SpoolDir, ttl: cfg.SpoolTTL, max: cfg.SpoolMaxBytes, files: make(map[string]*spooledReply)}, nil
+}
+
+// create starts a file for a reply to owner's session.
+func (s *spoolStore) create(owner string) (*spooledReply, error) {
+    f, err := os.CreateTemp(s.dir, "reply-*.txt")
+    if err != nil {
+        return nil, err
+    }
+    sr := &spooledReply{store: s, id: newReplyID() + newReplyID(), owner: owner, path: f.Name(), file: f}
+    s.mu.Lock()
+    s.files[sr.id] = sr
+    s.mu.Unlock()
+    return sr, nil
+}
+
+func (sr *spooledReply) url() string { return "/chat/spool/" + sr.id }
+
+// write appends text to the file. Once SPOOL_MAX_BYTES is reached the rest
+// is left out and the file is marked truncated; a failed write does the
+// same, so the stream itself is never held up by the disk.
+func (sr *spooledReply) write(text string) {
+    if sr.truncated {
+        return
+    }
+    if room := sr.store.max - sr.size; int64(len(text)) > room {
+        cut := int(room)
+        for cut > 0 && !utf8.RuneStart(text[cut]) {
+            cut--
+        }
+        text = text[:cut]
+        sr.truncated = true
+    }
+    n, err := sr.file.WriteString(text)
+    sr.size += int64(n)
+    if err != nil {
+        log.Printf("Cannot spool reply %s: %v", sr.id, err)
+        sr.truncated = true
+    }
+}
+
+// finish closes the file, which can then be downloaded until it expires.
+// It may be called more than once; later calls only report.
+func (sr *spooledReply) finish() spoolInfo {
+    s := sr.store
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if !sr.done {
+        sr.file.Close()
+        sr.done = true
+        sr.expires = time.Now().Add(s.ttl)
+    }
+    return spoolInfo{URL: sr.url(), Bytes: sr.size, Truncated: sr.truncated, ExpiresAt: sr.expires.UTC()}
+}
+
+// remove forgets sr and deletes its file.
+func (s *spoolStore) remove(sr *spooledReply) {
+    s.mu.Lock()
+    delete(s.files, sr.id)
+    s.mu.Unlock()
+    os.Remove(sr.path)
+}
+
+// run removes expired files until ctx ends.
+func (s *spoolStore) run(ctx context.Context) {
+    every := s.ttl
+    if every > time.Minute {
+        every = time.Minute
+    }
+    tick := time.NewTicker(every)
+    defer tick.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-tick.C:
+            var expired []*spooledReply
+            s.mu.Lock()
+            for _, sr := range s.files {
+                if sr.done && now.After(sr.expires) {
+                    expired = append(expired, sr)
+                }
+            }
+            s.mu.Unlock()
+            for _, sr := range expired {
+                s.remove(sr)
+            }
+        }
+    }
+}
+
+// spoolHandler serves GET /chat/spool/<id> to the session the reply was
+// generated for, and deletes the file once it has all been sent. Anyone
+// else gets 404, as for a file that doesn't exist.
+func spoolHandler(cfg *config, spools *spoolStore) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            jsonError(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        id := strings.TrimPrefix(r.URL.Path, "/chat/spool/")
+        var sr *spooledReply
+        done := false
+        if spools != nil {
+            spools.mu.Lock()
+            sr = spools.files[id]
+            if sr != nil {
+                done = sr.done
+            }
+            spools.mu.Unlock()
+        }
+        if sr == nil || sr.owner != existingSession(cfg, r) {
+            jsonError(w, "no such spooled reply", http.StatusNotFound)
+            return
+        }
+        if !done {
+            jsonError(w, "the reply is still being written", http.StatusConflict)
+            return
+        }
+        f, err := os.Open(sr.path)
+        if err != nil {
+            jsonError(w, "no such spooled reply", http.StatusNotFound)
+            return
+        }
+        defer f.Close()
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Header().Set("Content-Disposition", `attachment; filename="reply-`+sr.id[:8]+`.txt"`)
+        w.Header().Set("Content-Length", strconv.FormatInt(sr.size, 10))
+        if _, err := io.Copy(w, f); err != nil {
+            log.Printf("Download of spooled reply %s failed, keeping it: %v", sr.id, err)
+            return
+        }
+        spools.remove(sr)
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+)
+
+// maxStartupBackoff caps the pause between reachability checks while
+// waiting for Ollama at startup.
+const maxStartupBackoff = 10 * time.Second
+
+// waitForOllama polls /api/version, backing off from half a second up to
+// maxStartupBackoff, until Ollama answers or cfg.WaitForOllamaTimeout
+// passes. ctx is the shutdown signal.
+func waitForOllama(ctx context.Context, cfg *config) error {
+    ctx, cancel := context.WithTimeout(ctx, cfg.WaitForOllamaTimeout)
+    defer cancel()
+    start := time.Now()
+    backoff := 500 * time.Millisecond
+    for attempt := 1; ; attempt++ {
+        err := pingOllama(ctx, cfg)
+        if err == nil {
+            log.Printf("Ollama is reachable after %s (attempt %d)", time.Since(start).Round(time.Millisecond), attempt)
+            return nil
+        }
+        log.Printf("Waiting for Ollama (attempt %d): %v; retrying in %s", attempt, err, backoff)
+        select {
+        case <-ctx.Done():
+            return fmt.Errorf("Ollama not reachable after %s: %v", time.Since(start).Round(time.Second), err)
+        case <-time.After(backoff):
+        }
+        if backoff *= 2; backoff > maxStartupBackoff {
+            backoff = maxStartupBackoff
+        }
+    }
+}
+
+func pingOllama(ctx context.Context, cfg *config) error {
+    ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, "GET", cfg.ollamaAPI("/api/version"), nil)
+    if err != nil {
+        return err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("Ollama responded with status %d", resp.StatusCode)
+    }
+    return nil
+}
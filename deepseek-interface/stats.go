@@ -0,0 +1,48 @@
+package main
+
+import "time"
+
+// generationStats summarises a finished generation for the client.
+type generationStats struct {
+    PromptTokens    int     `json:"prompt_tokens"`
+    Tokens          int     `json:"tokens"`
+    TotalMs         int64   `json:"total_ms"`
+    LoadMs          int64   `json:"load_ms"`
+    PromptMs        int64   `json:"prompt_ms"`
+    EvalMs          int64   `json:"eval_ms"`
+    TokensPerSecond float64 `json:"tokens_per_second"`
+    // Partial is set when the generation stopped before Ollama sent its
+    // final chunk, in which case the numbers are our own estimates.
+    Partial bool `json:"partial,omitempty"`
+}
+
+// statsFrom reads the counters Ollama puts on its final chunk.
+func statsFrom(r *ChatResponse) *generationStats {
+    st := &generationStats{
+        PromptTokens: r.PromptEvalCount,
+        Tokens:       r.EvalCount,
+        TotalMs:      time.Duration(r.TotalDuration).Milliseconds(),
+        LoadMs:       time.Duration(r.LoadDuration).Milliseconds(),
+        PromptMs:     time.Duration(r.PromptEvalDuration).Milliseconds(),
+        EvalMs:       time.Duration(r.EvalDuration).Milliseconds(),
+    }
+    if r.EvalDuration > 0 {
+        st.TokensPerSecond = float64(r.EvalCount) / time.Duration(r.EvalDuration).Seconds()
+    }
+    return st
+}
+
+// partialStats estimates stats for a stream that ended early. Ollama sends
+// one token per chunk, so the chunk count stands in for eval_count, and the
+// time since the first token for eval_duration.
+func partialStats(chunks int, start, firstToken time.Time) *generationStats {
+    st := &generationStats{Tokens: chunks, TotalMs: time.Since(start).Milliseconds(), Partial: true}
+    if !firstToken.IsZero() {
+        eval := time.Since(firstToken)
+        st.EvalMs = eval.Milliseconds()
+        if eval > 0 {
+            st.TokensPerSecond = float64(chunks) / eval.Seconds()
+        }
+    }
+    return st
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// maxStreamLine bounds a single NDJSON line from Ollama. Chunks are
+// normally a few tokens, so anything near this is a broken upstream.
+const maxStreamLine = 1 << 20
+
+// sseRetryAfter is sent with the 503 for streams over the connection cap.
+const sseRetryAfter = 5
+
+// streamSlots caps how many SSE connections are open at once. Streams can
+// sit open for minutes, and each one holds a socket and file descriptor.
+type streamSlots struct {
+    limit  int64 // 0 means no cap
+    active atomic.Int64
+}
+
+// acquire takes a slot, or writes 503 with Retry-After and returns false.
+func (s *streamSlots) acquire(w http.ResponseWriter) bool {
+    if n := s.active.Add(1); s.limit > 0 && n > s.limit {
+        s.active.Add(-1)
+        w.Header().Set("Retry-After", strconv.Itoa(sseRetryAfter))
+        jsonError(w, "too many streaming connections, try again shortly", http.StatusServiceUnavailable)
+        return false
+    }
+    return true
+}
+
+func (s *streamSlots) release() { s.active.Add(-1) }
+
+// sseWriter writes Server-Sent Events and flushes after each one. Events
+// are numbered from 1 in the order sent, so a client knows exactly how far
+// it got; a new writer, and so each generation, starts again at 1.
+type sseWriter struct {
+    w       io.Writer
+    flusher http.Flusher
+    // longest data line written; see splitData
+    maxFrame int
+    lastID   int64
+}
+
+func newSSEWriter(w http.ResponseWriter, maxFrame int) *sseWriter {
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("X-Accel-Buffering", "no")
+    flusher, _ := w.(http.Flusher)
+    return &sseWriter{w: w, flusher: flusher, maxFrame: maxFrame}
+}
+
+// send writes one event with v encoded as JSON under the next ID. An empty
+// event name sends a plain "message" event. Data longer than maxFrame goes
+// out as several data: lines, which clients join back together with
+// newlines as the SSE spec requires.
+func (s *sseWriter) send(event string, v interface{}) error {
+    data, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    s.lastID++
+    var frame bytes.Buffer
+    fmt.Fprintf(&frame, "id: %d\n", s.lastID)
+    if event != "" {
+        fmt.Fprintf(&frame, "event: %s\n", event)
+    }
+    for _, line := range splitData(data, s.maxFrame) {
+        frame.WriteString("data: ")
+        frame.Write(line)
+        frame.WriteByte('\n')
+    }
+    frame.WriteByte('\n')
+    if _, err := s.w.Write(frame.Bytes()); err != nil {
+        return err
+    }
+    if s.flusher != nil {
+        s.flusher.Flush()
+    }
+    return nil
+}
+
+// splitData breaks encoded JSON into lines of at most max bytes. Because
+// the client rejoins lines with "\n", breaks are only made between JSON
+// tokens, where a newline is insignificant whitespace, never inside a
+// string. A single string longer than max stays on one line; token text is
+// split beforehand by splitToken so that doesn't happen for message events.
+func splitData(data []byte, max int) [][]byte {
+    if max <= 0 || len(data) <= max {
+        return [][]byte{data}
+    }
+    var lines [][]byte
+    start, lastBreak := 0, -1
+    inString, escaped := false, false
+    for i, c := range data {
+        if i-start >= max && lastBreak > start {
+            lines = append(lines, data[start:lastBreak])
+            start = lastBreak
+        }
+        switch {
+        case escaped:
+            escaped = false
+        case inString && c == '\\':
+            escaped = true
+        case c == '"':
+            inString = !inString
+        case !inString && (c == ',' || c == ':' || c == '{' || c == '['):
+            lastBreak = i + 1
+        }
+    }
+    return append(lines, data[start:])
+}
+
+// tokenOverhead is the size of {"token":""} around the token text.
+const tokenOverhead = len(`{"token":""}`)
+
+// splitToken cuts token into pieces whose encoded message event fits in
+// max bytes, on UTF-8 boundaries. The client appends tokens, so sending a
+// huge chunk as several message events is invisible to it.
+func splitToken(token string, max int) []string {
+    budget := max - tokenOverhead
+    if max <= 0 || len(token) <= budget/6 {
+        return []string{token} // fits even if every byte needs \u00XX
+    }
+    if enc, _ := json.Marshal(token); len(enc)-2 <= budget {
+        return []string{token}
+    }
+    var pieces []string
+    start, size := 0, 0
+    for i, r := range token {
+        enc, _ := json.Marshal(string(r))
+        n := len(enc) - 2
+        if size+n > budget && i > start {
+            pieces = append(pieces, token[start:i])
+            start, size = i, 0
+        }
+        size += n
+    }
+    return append(pieces, token[start:])
+}
+
+// streamResponse relays Ollama's NDJSON stream to the client as SSE.
+//
+// Each upstream line is read only after the previous event has been
+// written and flushed. Writes block once the client's TCP window is full,
+// so a slow reader throttles how fast we pull from Ollama instead of
+// piling chunks up in memory; at most one line (maxStreamLine) is held.
+//
+// If Ollama fails after some tokens were sent, the terminal error event
+// says so, so the client can keep what it has and mark it incomplete.
+//
+// With plan.HideReasoning a leading <think> block is withheld: the client
+// gets a single "thinking" event when it starts and then only the answer.
+// With plan.Trim blank lines before the answer are dropped, and so is the
+// whitespace after it; indentation is left alone. With plan.ASCII the text
+// is rewritten to ASCII as it goes; see asciiFilter.
+//
+// Text goes out as plan.Flush says; see tokenBatcher. Whatever is held is
+// sent before the stream's last event, however it ends.
+//
+// With plan.RepeatMaxLines identical consecutive lines beyond that many are
+// dropped, and the done event reports them under "repetition". With
+// plan.RepeatAbort the first line too many ends the generation instead: the
+// done event has done_reason "repetition" and is followed by estimated stats.
+//
+// Reasoning Ollama sends apart from the answer, because the request had a
+// thinking budget, is joined back in front of it first; see thinkingJoiner.
+//
+// Every plan.Progress while text is arriving a "progress" event reports the
+// chunks received so far, and the num_predict cap if there is one, for a
+// live counter.
+//
+// The last event is always "stats": Ollama's counters after done, or an
+// estimate marked partial after an error.
+//
+// The text sent is also written to record, when it isn't nil, and to
+// spool. With plan.Spool set to file it only goes to spool: the client gets
+// the progress events and the stream's last event says where to download
+// the reply, as does every way the stream can end.
+//
+// It returns how many bytes of text reached the client and how the stream
+// ended, for the audit log, and the tokens generated: Ollama's eval_count,
+// or the chunks received when the stream didn't finish.
+func streamResponse(sse *sseWriter, upstream io.Reader, plan *chatPlan, maxFrame int, ab *streamAbort, record *strings.Builder, spool *spooledReply) (sent int, outcome string, tokens int) {
+    var thinking thinkingJoiner
+    var reasoning *reasoningFilter
+    if plan.HideReasoning {
+        reasoning = &reasoningFilter{}
+    }
+    repeats := newRepeatFilter(plan.RepeatMaxLines)
+    var trim *trimFilter
+    if plan.Trim {
+        trim = &trimFilter{}
+    }
+    var ascii *asciiFilter
+    if plan.ASCII != asciiOff {
+        ascii = &asciiFilter{mode: plan.ASCII}
+    }
+    // The html format needs the whole answer, rendered once at the end.
+    full := record
+    if full == nil && plan.Format == formatHTML {
+        full = &strings.Builder{}
+    }
+    batch := newTokenBatcher(plan.Flush, plan.FlushInterval)
+    send := func(token string) bool {
+        if token == "" {
+            return true
+        }
+        if spool != nil {
+            spool.write(token)
+        }
+        if plan.Spool != spoolFile {
+            for _, piece := range splitToken(token, maxFrame) {
+                if err := sse.send("", map[string]string{"token": piece}); err != nil {
+                    log.Printf("Client went away mid-stream: %v", err)
+                    return false
+                }
+            }
+        }
+        sent += len(token)
+        if full != nil {
+            full.WriteString(token)
+        }
+        return true
+    }
+    emit := func(token string) bool { return send(batch.add(token)) }
+
+    start := time.Now()
+    var firstToken time.Time
+    chunks := 0
+    lastProgress := start
+    maxTokens := intOption(plan.Upstream.Options, "num_predict")
+
+    // fail ends the stream with an error and, since Ollama never sent its
+    // final counters, our own estimate of the stats so far.
+    fail := func(msg string) {
+        send(batch.flush())
+        ev := map[string]interface{}{
+            "error":          msg,
+            "partial":        sent > 0,
+            "partial_length": sent,
+        }
+        if spool != nil {
+            ev["spool"] = spool.finish()
+        }
+        sse.send("error", ev)
+        sse.send("stats", partialStats(chunks, start, firstToken))
+    }
+
+    scanner := bufio.NewScanner(upstream)
+    scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+    for scanner.Scan() {
+        var chunk ChatResponse
+        if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+            log.Printf("Failed to parse Ollama stream chunk: %s", scanner.Text())
+            fail(fmt.Sprintf("Invalid response from Ollama: %v", err))
+            return sent, "upstream_error", chunks
+        }
+        if chunk.Error != "" {
+            log.Printf("Ollama error mid-stream after %d bytes: %s", sent, chunk.Error)
+            fail(fmt.Sprintf("Ollama error: %s", chunk.Error))
+            return sent, "upstream_error", chunks
+        }
+
+        if chunk.Response != "" || chunk.Thinking != "" {
+            if chunks == 0 {
+                firstToken = time.Now()
+            }
+            chunks++
+        }
+
+        token := thinking.join(chunk.Thinking, chunk.Response)
+        if chunk.Done {
+            token += thinking.close()
+        }
+        if reasoning != nil {
+            var started bool
+            token, started = reasoning.feed(token)
+            if started {
+                if err := sse.send("thinking", map[string]bool{"thinking": true}); err != nil {
+                    log.Printf("Client went away mid-stream: %v", err)
+                    return sent, "client_gone", chunks
+                }
+            }
+            if chunk.Done {
+                token += reasoning.flush()
+            }
+        }
+        if repeats != nil {
+            token = repeats.feed(token)
+            if chunk.Done {
+                token += repeats.flush()
+            }
+        }
+        if ascii != nil {
+            token = ascii.feed(token)
+        }
+        if trim != nil {
+            token = trim.feed(token)
+        }
+        if !emit(token) {
+            return sent, "client_gone", chunks
+        }
+        if chunk.Done && !send(batch.flush()) {
+            return sent, "client_gone", chunks
+        }
+        if plan.Progress > 0 && !chunk.Done && chunks > 0 && time.Since(lastProgress) >= plan.Progress {
+            lastProgress = time.Now()
+            progress := map[string]interface{}{"tokens": chunks}
+            if maxTokens > 0 {
+                progress["max_tokens"] = maxTokens
+            }
+            if err := sse.send("progress", progress); err != nil {
+                log.Printf("Client went away mid-stream: %v", err)
+                return sent, "client_gone", chunks
+            }
+        }
+
+        aborted := repeats != nil && plan.RepeatAbort && repeats.note != nil
+        if chunk.Done || aborted {
+            reason := doneReason(chunk.DoneReason, chunk.EvalCount, maxTokens)
+            done := map[string]interface{}{
+                "done_reason": reason,
+                "truncated":   reason == "length",
+                "format":      plan.Format,
+                "created_at":  time.Now().UTC(),
+            }
+            if aborted {
+                send(batch.flush())
+                log.Printf("Stopping a stream that repeats %q after %d bytes", repeats.note.Line, sent)
+                repeats.note.Aborted = true
+                done["done_reason"] = "repetition"
+            }
+            if full != nil {
+                done["html"] = renderMarkdown(full.String())
+            }
+            if plan.PromptTruncated != nil {
+                done["prompt_truncated"] = plan.PromptTruncated
+            }
+            if plan.Warnings != nil {
+                done["warnings"] = plan.Warnings
+            }
+            if plan.Fallback != nil {
+                done["fallback"] = plan.Fallback
+            }
+            if repeats != nil && repeats.note != nil {
+                done["repetition"] = repeats.note
+            }
+            if plan.Metadata != nil {
+                done["metadata"] = plan.Metadata
+            }
+            if plan.ShowOptions {
+                done["resolved_options"] = resolvedOptions(plan)
+            }
+            if spool != nil {
+                done["spool"] = spool.finish()
+            }
+            sse.send("done", done)
+            if aborted {
+                sse.send("stats", partialStats(chunks, start, firstToken))
+                return sent, "repetition", chunks
+            }
+            sse.send("stats", statsFrom(&chunk))
+            return sent, "ok", chunk.EvalCount
+        }
+    }
+
+    if ab.aborted.Load() {
+        send(batch.flush())
+        log.Printf("Stream aborted by the client after %d bytes", sent)
+        ev := map[string]interface{}{"reason": "client_abort", "partial_length": sent}
+        if spool != nil {
+            ev["spool"] = spool.finish()
+        }
+        sse.send("cancelled", ev)
+        sse.send("stats", partialStats(chunks, start, firstToken))
+        return sent, "cancelled", chunks
+    }
+
+    err := scanner.Err()
+    // The upstream call is made with the client's context, so a client
+    // that went away ends it too.
+    if errors.Is(err, context.Canceled) {
+        log.Printf("Client went away after %d bytes", sent)
+        return sent, "client_gone", chunks
+    }
+    if err == nil {
+        err = io.ErrUnexpectedEOF
+    }
+    log.Printf("Ollama stream ended early after %d bytes: %v", sent, err)
+    fail(fmt.Sprintf("Ollama stream ended early: %v", err))
+    return sent, "upstream_error", chunks
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "unicode/utf8"
+)
+
+// sseEvent is one parsed Server-Sent Event; data lines are joined with
+// newlines as a browser would.
+type sseEvent struct {
+    id, event, data string
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+    t.Helper()
+    var events []sseEvent
+    for _, frame := range strings.Split(body, "\n\n") {
+        if frame == "" {
+            continue
+        }
+        var ev sseEvent
+        var data []string
+        for _, line := range strings.Split(frame, "\n") {
+            field, value, _ := strings.Cut(line, ": ")
+            switch field {
+            case "id":
+                ev.id = value
+            case "event":
+                ev.event = value
+            case "data":
+                data = append(data, value)
+            default:
+                t.Fatalf("unexpected SSE line %q", line)
+            }
+        }
+        ev.data = strings.Join(data, "\n")
+        events = append(events, ev)
+    }
+    return events
+}
+
+// text joins the token events, which is the reply the client shows.
+func text(t *testing.T, events []sseEvent) string {
+    t.Helper()
+    var b strings.Builder
+    for _, ev := range events {
+        if ev.event != "" {
+            continue
+        }
+        var msg map[string]string
+        if err := json.Unmarshal([]byte(ev.data), &msg); err != nil {
+            t.Fatalf("message event %q: %v", ev.data, err)
+        }
+        b.WriteString(msg["token"])
+    }
+    return b.String()
+}
+
+// last returns the data of the last event named name, decoded.
+func last(t *testing.T, events []sseEvent, name string) map[string]interface{} {
+    t.Helper()
+    for i := len(events) - 1; i >= 0; i-- {
+        if events[i].event == name {
+            var v map[string]interface{}
+            if err := json.Unmarshal([]byte(events[i].data), &v); err != nil {
+                t.Fatalf("%s event %q: %v", name, events[i].data, err)
+            }
+            return v
+        }
+    }
+    t.Fatalf("no %s event in %+v", name, events)
+    return nil
+}
+
+// ndjson is an Ollama stream of chunks.
+func ndjson(chunks ...ChatResponse) string {
+    var b strings.Builder
+    for _, c := range chunks {
+        line, _ := json.Marshal(c)
+        b.Write(line)
+        b.WriteByte('\n')
+    }
+    return b.String()
+}
+
+// tokens is an Ollama stream sending each piece as a chunk, then done.
+func tokens(pieces ...string) string {
+    var chunks []ChatResponse
+    for _, p := range pieces {
+        chunks = append(chunks, ChatResponse{Response: p})
+    }
+    return ndjson(append(chunks, ChatResponse{Done: true, DoneReason: "stop", EvalCount: len(pieces)})...)
+}
+
+// streamPlan is a plan for a stream with every filter off.
+func streamPlan() *chatPlan {
+    return &chatPlan{Flush: flushToken, ASCII: asciiOff, Format: formatRaw}
+}
+
+// runStream relays upstream through streamResponse and returns the events
+// the client got and how the stream ended.
+func runStream(t *testing.T, plan *chatPlan, upstream string, maxFrame int) ([]sseEvent, string) {
+    t.Helper()
+    w := httptest.NewRecorder()
+    _, outcome, _ := streamResponse(newSSEWriter(w, maxFrame), strings.NewReader(upstream), plan, maxFrame, &streamAbort{}, nil, nil)
+    return parseSSE(t, w.Body.String()), outcome
+}
+
+func TestStreamResponse(t *testing.T) {
+    events, outcome := runStream(t, streamPlan(), tokens("Hel", "lo", " world"), 0)
+    if outcome != "ok" {
+        t.Errorf("outcome = %q, want ok", outcome)
+    }
+    if got := text(t, events); got != "Hello world" {
+        t.Errorf("text = %q, want %q", got, "Hello world")
+    }
+    if done := last(t, events, "done"); done["done_reason"] != "stop" || done["truncated"] != false {
+        t.Errorf("done = %v", done)
+    }
+    if events[len(events)-1].event != "stats" {
+        t.Errorf("last event = %q, want stats", events[len(events)-1].event)
+    }
+    for i, ev := range events {
+        if want := strconv.Itoa(i + 1); ev.id != want {
+            t.Errorf("event %d has id %q, want %q", i, ev.id, want)
+        }
+    }
+}
+
+// endlessStream is an Ollama stream that sends chunks until stop is set,
+// then a done chunk, counting the bytes handed out.
+type endlessStream struct {
+    read    atomic.Int64
+    stop    atomic.Bool
+    pending []byte
+    done    bool
+}
+
+func (s *endlessStream) Read(p []byte) (int, error) {
+    if len(s.pending) == 0 {
+        switch {
+        case s.done:
+            return 0, io.EOF
+        case s.stop.Load():
+            s.pending = []byte(ndjson(ChatResponse{Done: true, DoneReason: "stop"}))
+            s.done = true
+        default:
+            s.pending = []byte(ndjson(ChatResponse{Response: strings.Repeat("x", 1000)}))
+        }
+    }
+    n := copy(p, s.pending)
+    s.pending = s.pending[n:]
+    s.read.Add(int64(n))
+    return n, nil
+}
+
+func TestStreamResponseBackPressure(t *testing.T) {
+    upstream := &endlessStream{}
+    client, sink := io.Pipe()
+    sse := &sseWriter{w: sink}
+    finished := make(chan string, 1)
+    go func() {
+        _, outcome, _ := streamResponse(sse, upstream, streamPlan(), 0, &streamAbort{}, nil, nil)
+        sink.Close()
+        finished <- outcome
+    }()
+
+    // Nothing is read by the client, so the first write blocks and no more
+    // than the scanner's buffer may be pulled from Ollama.
+    const bound = 128 << 10
+    time.Sleep(200 * time.Millisecond)
+    stalled := upstream.read.Load()
+    if stalled > bound {
+        t.Fatalf("read %d bytes from Ollama while the client read nothing, want at most %d", stalled, bound)
+    }
+
+    // A slow client reading a few events lets through about as much.
+    events := bufio.NewReader(client)
+    for i := 0; i < 200; i++ {
+        if _, err := events.ReadString('\n'); err != nil {
+            t.Fatal(err)
+        }
+    }
+    time.Sleep(100 * time.Millisecond)
+    if n := upstream.read.Load(); n > stalled+bound {
+        t.Errorf("read %d bytes from Ollama after the client took a few events, want at most %d", n, stalled+bound)
+    }
+
+    upstream.stop.Store(true)
+    io.Copy(io.Discard, events)
+    select {
+    case outcome := <-finished:
+        if outcome != "ok" {
+            t.Errorf("outcome = %q, want ok", outcome)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("stream didn't end once the client read it all")
+    }
+}
+
+func TestStreamResponseUpstreamFailure(t *testing.T) {
+    partial := ndjson(ChatResponse{Response: "Hello"}, ChatResponse{Response: " wor"})
+    tests := []struct {
+        name     string
+        upstream string
+        message  string
+    }{
+        {"error chunk", partial + ndjson(ChatResponse{Error: "model runner crashed"}), "Ollama error: model runner crashed"},
+        {"invalid chunk", partial + "{\"response\": tru\n", "Invalid response from Ollama"},
+        {"cut off", partial, "Ollama stream ended early"},
+    }
+    for _, tt := range tests {
+        events, outcome := runStream(t, streamPlan(), tt.upstream, 0)
+        if outcome != "upstream_error" {
+            t.Errorf("%s: outcome = %q, want upstream_error", tt.name, outcome)
+        }
+        if got := text(t, events); got != "Hello wor" {
+            t.Errorf("%s: client got %q before the error, want %q", tt.name, got, "Hello wor")
+        }
+        ev := last(t, events, "error")
+        if msg, _ := ev["error"].(string); !strings.Contains(msg, tt.message) {
+            t.Errorf("%s: error = %q, want it to contain %q", tt.name, msg, tt.message)
+        }
+        if ev["partial"] != true || ev["partial_length"] != float64(len("Hello wor")) {
+            t.Errorf("%s: error event = %v, want partial with partial_length 9", tt.name, ev)
+        }
+        if stats := last(t, events, "stats"); stats["partial"] != true || events[len(events)-1].event != "stats" {
+            t.Errorf("%s: want partial stats last, got %v", tt.name, stats)
+        }
+    }
+
+    events, _ := runStream(t, streamPlan(), ndjson(ChatResponse{Error: "model not found"}), 0)
+    if ev := last(t, events, "error"); ev["partial"] != false {
+        t.Errorf("error before any text = %v, want partial false", ev)
+    }
+}
+
+func TestSplitData(t *testing.T) {
+    v := map[string]interface{}{"a": "one, two: three", "list": []int{1, 2, 3, 4, 5, 6, 7, 8}, "nested": map[string]string{"x": "{[\"quoted\"]}"}}
+    data, _ := json.Marshal(v)
+    for _, max := range []int{0, 8, 16, 32, len(data)} {
+        lines := splitData(data, max)
+        joined := string(bytes.Join(lines, []byte("\n")))
+        var back map[string]interface{}
+        if err := json.Unmarshal([]byte(joined), &back); err != nil {
+            t.Errorf("max %d: rejoined lines aren't the same JSON: %v\n%s", max, err, joined)
+        }
+        if strings.ReplaceAll(joined, "\n", "") != string(data) {
+            t.Errorf("max %d: lines %q don't add up to the data", max, lines)
+        }
+        for _, line := range lines {
+            if max > 0 && len(line) > max && !strings.Contains(string(line), `"`) {
+                t.Errorf("max %d: line %q is over the limit without a long string to excuse it", max, line)
+            }
+        }
+    }
+}
+
+func TestSplitToken(t *testing.T) {
+    const max = 64
+    token := strings.Repeat("日本語 \"quoted\" \\ ", 40)
+    pieces := splitToken(token, max)
+    if len(pieces) < 2 {
+        t.Fatalf("a %d-byte token came back in %d piece(s)", len(token), len(pieces))
+    }
+    if strings.Join(pieces, "") != token {
+        t.Error("pieces don't add up to the token")
+    }
+    for _, p := range pieces {
+        enc, _ := json.Marshal(map[string]string{"token": p})
+        if len(enc) > max {
+            t.Errorf("piece %q encodes to %d bytes, over %d", p, len(enc), max)
+        }
+        if !utf8.ValidString(p) {
+            t.Errorf("piece %q splits a UTF-8 sequence", p)
+        }
+    }
+    if got := splitToken("short", max); len(got) != 1 || got[0] != "short" {
+        t.Errorf("splitToken(short) = %q", got)
+    }
+}
+
+func TestStreamResponseLargeChunk(t *testing.T) {
+    const maxFrame = 256
+    big := strings.Repeat("0123456789abcdé\n", 500)
+    events, outcome := runStream(t, streamPlan(), tokens("start ", big, " end"), maxFrame)
+    if outcome != "ok" {
+        t.Fatalf("outcome = %q", outcome)
+    }
+    if got := text(t, events); got != "start "+big+" end" {
+        t.Errorf("reassembled text differs from what Ollama sent (%d bytes, want %d)", len(got), len(big)+10)
+    }
+    w := httptest.NewRecorder()
+    streamResponse(newSSEWriter(w, maxFrame), strings.NewReader(tokens(big)), streamPlan(), maxFrame, &streamAbort{}, nil, nil)
+    for _, line := range strings.Split(w.Body.String(), "\n") {
+        if len(line) > len("data: ")+maxFrame {
+            t.Errorf("SSE line of %d bytes, over the %d-byte frame limit", len(line), maxFrame)
+        }
+    }
+}
+
+func TestStreamResponseTrim(t *testing.T) {
+    plan := streamPlan()
+    plan.Trim = true
+    events, _ := runStream(t, plan, tokens("\n", "\n\n", "Answer", " here", "\n", "\n"), 0)
+    if got := text(t, events); got != "Answer here" {
+        t.Errorf("trimmed stream = %q, want %q", got, "Answer here")
+    }
+    for _, ev := range events {
+        if ev.event == "" && strings.TrimSpace(ev.data) == `{"token":"\n"}` {
+            t.Errorf("a whitespace-only chunk went out: %q", ev.data)
+        }
+    }
+
+    events, _ = runStream(t, streamPlan(), tokens("\n", "Answer", "\n"), 0)
+    if got := text(t, events); got != "\nAnswer\n" {
+        t.Errorf("untrimmed stream = %q", got)
+    }
+}
+
+func TestChatStreamKeepsIndentation(t *testing.T) {
+    code := "    if x {\n\t\treturn  1\n    }\n"
+    var pieces []string
+    for _, r := range code {
+        pieces = append(pieces, string(r))
+    }
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": func(w http.ResponseWriter, r *http.Request) {
+            io.WriteString(w, tokens(append([]string{"\n", " \n"}, pieces...)...))
+        },
+    })
+    for _, flush := range []string{flushToken, flushNewline} {
+        chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "TRIM_RESPONSES", "true"))
+        w := chat.post(`{"prompt": "code", "stream": true, "flush": "` + flush + `"}`)
+        if got, want := text(t, parseSSE(t, w.Body.String())), strings.TrimRight(code, "\n"); got != want {
+            t.Errorf("flush %s: streamed %q, want %q", flush, got, want)
+        }
+    }
+    if !strings.Contains(htmlTemplate, "white-space: pre-wrap") {
+        t.Error("the UI doesn't keep whitespace in messages")
+    }
+}
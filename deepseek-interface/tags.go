@@ -0,0 +1,96 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "sort"
+    "sync"
+)
+
+// A request to /chat or /v1/chat/completions can carry a "tag", such as a
+// team or project, and /metrics and /stats add up its requests and
+// generated tokens per tag for showback. With REQUEST_TAGS set only those
+// tags are accepted. Without it any tag that fits tagPattern is, and past
+// maxTrackedTags new tags are counted under tagOther, so clients can't
+// grow the metrics without bound.
+
+const (
+    maxTrackedTags = 100
+    tagOther       = "other"
+)
+
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// parseRequestTags reads REQUEST_TAGS, a comma-separated allow-list.
+func parseRequestTags(list string) (map[string]bool, error) {
+    tags := parseKeySet(list)
+    for tag := range tags {
+        if !tagPattern.MatchString(tag) {
+            return nil, fmt.Errorf("REQUEST_TAGS: %q must be 1-64 letters, digits, '.', '-' or '_'", tag)
+        }
+    }
+    return tags, nil
+}
+
+// checkTag accepts an empty tag, for an untagged request, or one that fits
+// tagPattern and the allow-list.
+func checkTag(cfg *config, tag string) error {
+    switch {
+    case tag == "":
+    case !tagPattern.MatchString(tag):
+        return badRequest("tag must be 1-64 letters, digits, '.', '-' or '_'")
+    case len(cfg.RequestTags) > 0 && !cfg.RequestTags[tag]:
+        return badRequest("unknown tag %q", tag)
+    }
+    return nil
+}
+
+// tagCounts is one tag's usage since the server started.
+type tagCounts struct {
+    Requests int64 `json:"requests"`
+    Tokens   int64 `json:"tokens"`
+}
+
+type tagUsage struct {
+    mu   sync.Mutex
+    tags map[string]*tagCounts
+}
+
+func newTagUsage() *tagUsage {
+    return &tagUsage{tags: make(map[string]*tagCounts)}
+}
+
+// add counts a finished request and the tokens it generated. Untagged
+// requests aren't counted.
+func (u *tagUsage) add(tag string, tokens int) {
+    if tag == "" {
+        return
+    }
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    c, ok := u.tags[tag]
+    if !ok && len(u.tags) >= maxTrackedTags {
+        tag = tagOther
+        c, ok = u.tags[tag]
+    }
+    if !ok {
+        c = &tagCounts{}
+        u.tags[tag] = c
+    }
+    c.Requests++
+    c.Tokens += int64(tokens)
+}
+
+// snapshot returns the counts by tag, and the tags in order.
+func (u *tagUsage) snapshot() (map[string]tagCounts, []string) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    counts := make(map[string]tagCounts, len(u.tags))
+    names := make([]string, 0, len(u.tags))
+    for tag, c := range u.tags {
+        counts[tag] = *c
+        names = append(names, tag)
+    }
+    sort.Strings(names)
+    return counts, names
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestTagUsage(t *testing.T) {
+    u := newTagUsage()
+    u.add("team-a", 5)
+    u.add("team-b", 1)
+    u.add("team-a", 7)
+    u.add("", 100)
+    counts, names := u.snapshot()
+    if strings.Join(names, ",") != "team-a,team-b" {
+        t.Errorf("tags = %q, want team-a and team-b; untagged requests aren't counted", names)
+    }
+    if got := counts["team-a"]; got != (tagCounts{Requests: 2, Tokens: 12}) {
+        t.Errorf("team-a = %+v, want 2 requests and 12 tokens", got)
+    }
+
+    u = newTagUsage()
+    for i := 0; i < maxTrackedTags; i++ {
+        u.add(fmt.Sprintf("t%d", i), 1)
+    }
+    u.add("late", 3)
+    u.add("later", 4)
+    u.add("t0", 1)
+    counts, names = u.snapshot()
+    if len(names) != maxTrackedTags+1 {
+        t.Errorf("%d tags tracked, want %d and %s", len(names), maxTrackedTags, tagOther)
+    }
+    if got := counts[tagOther]; got != (tagCounts{Requests: 2, Tokens: 7}) {
+        t.Errorf("%s = %+v, want the two new tags past the limit", tagOther, got)
+    }
+    if got := counts["t0"]; got.Requests != 2 {
+        t.Errorf("t0 = %+v, want a tracked tag still counted under its name", got)
+    }
+}
+
+func TestCheckTag(t *testing.T) {
+    open := testConfig(t)
+    listed := testConfig(t, "REQUEST_TAGS", "team-a,team-b")
+    tests := []struct {
+        cfg  *config
+        tag  string
+        want string
+    }{
+        {open, "", ""},
+        {open, "anything.goes_1", ""},
+        {open, "has space", "tag must be 1-64 letters"},
+        {open, strings.Repeat("x", 65), "tag must be 1-64 letters"},
+        {listed, "", ""},
+        {listed, "team-b", ""},
+        {listed, "team-c", `unknown tag "team-c"`},
+    }
+    for _, tt := range tests {
+        err := checkTag(tt.cfg, tt.tag)
+        if tt.want == "" {
+            if err != nil {
+                t.Errorf("checkTag(%q) = %v", tt.tag, err)
+            }
+            continue
+        }
+        wantRequestError(t, err, http.StatusBadRequest, tt.want)
+    }
+
+    if err := configError(t, "REQUEST_TAGS", "team-a,bad tag"); err == nil {
+        t.Error("REQUEST_TAGS with a space in a tag was accepted")
+    }
+}
+
+func TestChatTagAggregation(t *testing.T) {
+    ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+        "/api/generate": reply(ChatResponse{Response: "ok", Done: true, DoneReason: "stop", EvalCount: 5}),
+    })
+    cfg := testConfig(t, "OLLAMA_URL", ollama.URL, "REQUEST_TAGS", "team-a,team-b")
+    chat := newTestChat(t, cfg)
+    for _, body := range []string{
+        `{"prompt": "one", "tag": "team-a"}`,
+        `{"prompt": "two", "tag": "team-a"}`,
+        `{"prompt": "three", "tag": "team-b"}`,
+        `{"prompt": "four"}`,
+    } {
+        if w := chat.post(body); w.Code != http.StatusOK {
+            t.Fatalf("%s: status %d: %s", body, w.Code, w.Body.String())
+        }
+    }
+    if w := chat.post(`{"prompt": "five", "tag": "team-c"}`); w.Code != http.StatusBadRequest {
+        t.Errorf("unlisted tag: status %d, want 400", w.Code)
+    }
+
+    w := httptest.NewRecorder()
+    statsHandler(newLatencyTracker(cfg), &streamSlots{}, newPulls(cfg), nil, chat.tags)(w, httptest.NewRequest("GET", "/stats", nil))
+    var stats struct {
+        Tags map[string]tagCounts `json:"tags"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+        t.Fatal(err)
+    }
+    want := map[string]tagCounts{"team-a": {Requests: 2, Tokens: 10}, "team-b": {Requests: 1, Tokens: 5}}
+    if len(stats.Tags) != len(want) || stats.Tags["team-a"] != want["team-a"] || stats.Tags["team-b"] != want["team-b"] {
+        t.Errorf("/stats tags = %+v, want %+v", stats.Tags, want)
+    }
+
+    w = httptest.NewRecorder()
+    metricsHandler(chat.adm, newAdmission(1, false), newLatencyTracker(cfg), &streamSlots{}, chat.limits, chat.flights, nil, chat.tags)(w, httptest.NewRequest("GET", "/metrics", nil))
+    for _, line := range []string{
+        `deepseek_tag_requests_total{tag="team-a"} 2`,
+        `deepseek_tag_tokens_total{tag="team-a"} 10`,
+        `deepseek_tag_requests_total{tag="team-b"} 1`,
+    } {
+        if !strings.Contains(w.Body.String(), line+"\n") {
+            t.Errorf("/metrics is missing %s", line)
+        }
+    }
+}
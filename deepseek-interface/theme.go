@@ -0,0 +1,82 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strings"
+)
+
+// theme is the branding and defaults for one named UI. Each file in
+// THEMES_DIR (team-a.json -> /ui/team-a) overrides fields of defaultTheme.
+type theme struct {
+    Title          string `json:"title"`
+    Heading        string `json:"heading"`
+    Placeholder    string `json:"placeholder"`
+    AssistantName  string `json:"assistant_name"`
+    UserColor      string `json:"user_color"`
+    AssistantColor string `json:"assistant_color"`
+    DefaultModel   string `json:"default_model"`
+}
+
+var defaultTheme = theme{
+    Title:          "DeepSeek Local Interface",
+    Heading:        "🧠 DeepSeek Local Interface",
+    Placeholder:    "Ask DeepSeek something...",
+    AssistantName:  "DeepSeek",
+    UserColor:      "#e3f2fd",
+    AssistantColor: "#f1f8e9",
+}
+
+var themeName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+var indexTemplate = template.Must(template.New("index").Parse(htmlTemplate))
+
+func loadThemes(dir string) (map[string]theme, error) {
+    themes := make(map[string]theme)
+    if dir == "" {
+        return themes, nil
+    }
+    files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+    for _, file := range files {
+        name := strings.TrimSuffix(filepath.Base(file), ".json")
+        if !themeName.MatchString(name) {
+            return nil, fmt.Errorf("theme file %s: name must be lowercase letters, digits, - or _", file)
+        }
+        data, err := os.ReadFile(file)
+        if err != nil {
+            return nil, err
+        }
+        t := defaultTheme
+        if err := json.Unmarshal(data, &t); err != nil {
+            return nil, fmt.Errorf("theme file %s: %w", file, err)
+        }
+        themes[name] = t
+    }
+    log.Printf("Loaded %d theme(s) from %s", len(themes), dir)
+    return themes, nil
+}
+
+// indexHandler serves the chat UI. The theme comes from /ui/<name> or
+// ?theme=<name>; unknown names get the default theme.
+func indexHandler(themes map[string]theme) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        name := r.URL.Query().Get("theme")
+        if rest, ok := strings.CutPrefix(r.URL.Path, "/ui/"); ok {
+            name = strings.Trim(rest, "/")
+        }
+        t, ok := themes[name]
+        if !ok {
+            t = defaultTheme
+        }
+        indexTemplate.Execute(w, t)
+    }
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// Thinking budgets for THINKING_BUDGET and the per-request
+// "thinking_budget" field, sent to Ollama as "think". Ollama takes a level,
+// not a token count: low, medium and high limit how long a model that
+// supports levels reasons, and off turns reasoning off on models that can
+// skip it. Without a budget the model does what it does by default.
+const (
+    thinkingOff    = "off"
+    thinkingLow    = "low"
+    thinkingMedium = "medium"
+    thinkingHigh   = "high"
+)
+
+func parseThinkingBudget(s string) (string, error) {
+    switch s {
+    case "", thinkingOff, thinkingLow, thinkingMedium, thinkingHigh:
+        return s, nil
+    }
+    if _, err := strconv.Atoi(s); err == nil {
+        return "", fmt.Errorf("thinking_budget must be off, low, medium or high; Ollama has no token budget for reasoning")
+    }
+    return "", fmt.Errorf("thinking_budget must be off, low, medium or high, got %q", s)
+}
+
+// thinkValue is the "think" field for a budget, nil for none.
+func thinkValue(budget string) interface{} {
+    switch budget {
+    case "":
+        return nil
+    case thinkingOff:
+        return false
+    }
+    return budget
+}
+
+// thinkingUnsupported reports whether resp is Ollama refusing "think" for a
+// model that can't think. Any other response is left readable as it was.
+func thinkingUnsupported(resp *http.Response) bool {
+    if resp.StatusCode != http.StatusBadRequest {
+        return false
+    }
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    resp.Body = io.NopCloser(bytes.NewReader(body))
+    return strings.Contains(string(body), "does not support thinking")
+}
+
+// thinkingJoiner puts the reasoning Ollama sends in a separate "thinking"
+// field when "think" is set back in front of the answer as a <think>
+// block, the way models that aren't asked to think write it, so
+// hide_reasoning and the UI treat both alike.
+type thinkingJoiner struct {
+    open bool
+}
+
+// join returns one chunk's text with its thinking.
+func (j *thinkingJoiner) join(thinking, response string) string {
+    var out string
+    if thinking != "" {
+        if !j.open {
+            out, j.open = thinkOpen, true
+        }
+        out += thinking
+    }
+    if response != "" {
+        out += j.close()
+    }
+    return out + response
+}
+
+// close ends a <think> block still open.
+func (j *thinkingJoiner) close() string {
+    if !j.open {
+        return ""
+    }
+    j.open = false
+    return thinkClose
+}
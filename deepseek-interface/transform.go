@@ -0,0 +1,112 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "strings"
+    "unicode"
+)
+
+// transformSpec is one entry of the "transforms" list in CONFIG_FILE.
+type transformSpec struct {
+    Name        string `json:"name"`
+    Pattern     string `json:"pattern,omitempty"`
+    Replacement string `json:"replacement,omitempty"`
+}
+
+type transform func(string) string
+
+// pipeline is an ordered list of transforms applied to the final response
+// text before it is returned to the client.
+type pipeline []transform
+
+func (p pipeline) apply(s string) string {
+    for _, t := range p {
+        s = t(s)
+    }
+    return s
+}
+
+// then returns p followed by more, leaving p itself alone.
+func (p pipeline) then(more ...transform) pipeline {
+    return append(p[:len(p):len(p)], more...)
+}
+
+// trimReply trims a reply for TRIM_RESPONSES. It is strings.TrimSpace
+// except at the start, where only blank lines go: a reply that opens with
+// indented code keeps the indentation of its first line.
+func trimReply(s string) string {
+    return trimBlankLines(strings.TrimRightFunc(s, unicode.IsSpace))
+}
+
+// trimBlankLines drops the lines before s's first visible text that hold
+// nothing but whitespace.
+func trimBlankLines(s string) string {
+    lead := s[:len(s)-len(strings.TrimLeftFunc(s, unicode.IsSpace))]
+    return s[strings.LastIndexByte(lead, '\n')+1:]
+}
+
+// trimFilter is the streaming counterpart of trimReply: it drops blank
+// lines before the first visible text, and holds back trailing whitespace
+// until more text follows, so the whitespace at the very end is never sent.
+// Whitespace within the reply, indentation included, goes out as it came.
+type trimFilter struct {
+    started bool
+    pending string
+}
+
+func (f *trimFilter) feed(token string) string {
+    if !f.started {
+        // Until the first visible text only the last line's whitespace is
+        // kept, as the indentation that text may need.
+        token = trimBlankLines(f.pending + token)
+        if strings.TrimLeftFunc(token, unicode.IsSpace) == "" {
+            f.pending = token
+            return ""
+        }
+        f.started = true
+        f.pending = ""
+    }
+    token = f.pending + token
+    out := strings.TrimRightFunc(token, unicode.IsSpace)
+    f.pending = token[len(out):]
+    return out
+}
+
+var thinkBlock = regexp.MustCompile(`(?s)<think>.*?</think>`)
+
+// stripReasoning drops <think>...</think> blocks emitted by reasoning
+// models such as deepseek-r1.
+func stripReasoning(s string) string {
+    return thinkBlock.ReplaceAllString(s, "")
+}
+
+func normalizeNewlines(s string) string {
+    return strings.ReplaceAll(s, "\r\n", "\n")
+}
+
+func buildPipeline(specs []transformSpec) (pipeline, error) {
+    var p pipeline
+    for i, spec := range specs {
+        switch spec.Name {
+        case "strip_reasoning":
+            p = append(p, stripReasoning)
+        case "trim":
+            p = append(p, strings.TrimSpace)
+        case "normalize_newlines":
+            p = append(p, normalizeNewlines)
+        case "regex_replace":
+            re, err := regexp.Compile(spec.Pattern)
+            if err != nil {
+                return nil, fmt.Errorf("transform %d (regex_replace): %w", i, err)
+            }
+            replacement := spec.Replacement
+            p = append(p, func(s string) string {
+                return re.ReplaceAllString(s, replacement)
+            })
+        default:
+            return nil, fmt.Errorf("transform %d: unknown transform %q", i, spec.Name)
+        }
+    }
+    return p, nil
+}
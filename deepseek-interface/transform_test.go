@@ -0,0 +1,127 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestTransforms(t *testing.T) {
+    tests := []struct {
+        name string
+        fn   transform
+        in   string
+        want string
+    }{
+        {"strip_reasoning", stripReasoning, "<think>hmm\nmaybe</think>Answer", "Answer"},
+        {"strip_reasoning several", stripReasoning, "<think>a</think>one <think>b</think>two", "one two"},
+        {"strip_reasoning none", stripReasoning, "plain", "plain"},
+        {"normalize_newlines", normalizeNewlines, "a\r\nb\r\n", "a\nb\n"},
+        {"normalize_newlines lone CR", normalizeNewlines, "a\rb", "a\rb"},
+    }
+    for _, tt := range tests {
+        if got := tt.fn(tt.in); got != tt.want {
+            t.Errorf("%s(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestBuildPipeline(t *testing.T) {
+    p, err := buildPipeline([]transformSpec{
+        {Name: "strip_reasoning"},
+        {Name: "regex_replace", Pattern: `(?i)colour`, Replacement: "color"},
+        {Name: "trim"},
+        {Name: "normalize_newlines"},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    in := "<think>x</think>\n  Colour\r\nchart  \n"
+    if got, want := p.apply(in), "color\nchart"; got != want {
+        t.Errorf("apply(%q) = %q, want %q", in, got, want)
+    }
+
+    // Order matters: trimming before the reasoning is stripped leaves the
+    // whitespace that followed it.
+    p, err = buildPipeline([]transformSpec{{Name: "trim"}, {Name: "strip_reasoning"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, want := p.apply("<think>x</think>\nA"), "\nA"; got != want {
+        t.Errorf("trim then strip_reasoning = %q, want %q", got, want)
+    }
+
+    if p, err := buildPipeline(nil); err != nil || p.apply(" as is ") != " as is " {
+        t.Errorf("empty pipeline changed its input or failed: %v", err)
+    }
+}
+
+func TestBuildPipelineErrors(t *testing.T) {
+    tests := []struct {
+        specs []transformSpec
+        want  string
+    }{
+        {[]transformSpec{{Name: "shout"}}, `transform 0: unknown transform "shout"`},
+        {[]transformSpec{{Name: "trim"}, {Name: "regex_replace", Pattern: "("}}, "transform 1 (regex_replace)"},
+    }
+    for _, tt := range tests {
+        _, err := buildPipeline(tt.specs)
+        if err == nil || !strings.Contains(err.Error(), tt.want) {
+            t.Errorf("buildPipeline(%+v) error = %v, want %q", tt.specs, err, tt.want)
+        }
+    }
+}
+
+func TestPipelineThenLeavesOriginal(t *testing.T) {
+    base := make(pipeline, 1, 4)
+    base[0] = strings.TrimSpace
+    a := base.then(strings.ToUpper)
+    b := base.then(strings.ToLower)
+    if got := a.apply(" Mixed "); got != "MIXED" {
+        t.Errorf("first extension = %q, want MIXED", got)
+    }
+    if got := b.apply(" Mixed "); got != "mixed" {
+        t.Errorf("second extension = %q, want mixed", got)
+    }
+    if len(base) != 1 {
+        t.Errorf("base pipeline grew to %d transforms", len(base))
+    }
+}
+
+func TestTrimReply(t *testing.T) {
+    tests := []struct{ in, want string }{
+        {"\n\nHello.\n\n", "Hello."},
+        {"  \t\n Hello. \n", " Hello."},
+        {"Hello.", "Hello."},
+        {"\n \n\t\n", ""},
+        {"", ""},
+        {"Line one\n\nLine two  \n", "Line one\n\nLine two"},
+    }
+    for _, tt := range tests {
+        if got := trimReply(tt.in); got != tt.want {
+            t.Errorf("trimReply(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestTrimFilter(t *testing.T) {
+    tests := []struct {
+        chunks []string
+        want   string
+    }{
+        {[]string{"\n", "\n", "Hello", " world", "\n\n"}, "Hello world"},
+        {[]string{" ", "\n", " ", "\n", "Hi"}, "Hi"},
+        {[]string{"Hi", "  ", "there", " \n"}, "Hi  there"},
+        {[]string{"\n\n", "  "}, ""},
+        {[]string{"a\n", "\n", "b"}, "a\n\nb"},
+    }
+    for _, tt := range tests {
+        f := &trimFilter{}
+        var b strings.Builder
+        for _, c := range tt.chunks {
+            b.WriteString(f.feed(c))
+        }
+        if b.String() != tt.want {
+            t.Errorf("trimFilter over %q = %q, want %q", tt.chunks, b.String(), tt.want)
+        }
+    }
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+    "unicode"
+)
+
+// An optional second pass translates a reply into TRANSLATE_TARGET when it
+// came back in some other language. It is deliberately narrow: non-streaming
+// /chat only, fenced code blocks are never sent to the translator, and any
+// failure returns the reply untranslated.
+
+// languageNames are the targets we can both name for the translation
+// prompt and recognise in a reply.
+var languageNames = map[string]string{
+    "en": "English", "es": "Spanish", "fr": "French", "de": "German",
+    "it": "Italian", "pt": "Portuguese", "id": "Indonesian", "nl": "Dutch",
+    "ru": "Russian", "zh": "Chinese", "ja": "Japanese", "ko": "Korean",
+    "ar": "Arabic",
+}
+
+// stopwords are a handful of very common words per Latin-script language,
+// enough to tell which one a paragraph of prose is in.
+var stopwords = map[string][]string{
+    "en": {"the", "and", "is", "to", "of", "that", "it", "you", "with", "for"},
+    "es": {"el", "la", "que", "de", "y", "es", "los", "en", "por", "una"},
+    "fr": {"le", "la", "les", "et", "est", "que", "des", "une", "pour", "dans"},
+    "de": {"der", "die", "und", "ist", "das", "nicht", "mit", "ein", "zu", "den"},
+    "it": {"il", "che", "di", "e", "la", "per", "non", "una", "sono", "gli"},
+    "pt": {"o", "que", "de", "e", "não", "uma", "para", "com", "os", "é"},
+    "id": {"yang", "dan", "ini", "itu", "dengan", "untuk", "tidak", "dari", "ada", "di"},
+    "nl": {"de", "het", "een", "en", "van", "is", "niet", "dat", "op", "zijn"},
+}
+
+// translateMinWords is the fewest words of prose a reply needs before its
+// language is guessed; short replies are left alone.
+const translateMinWords = 8
+
+var fencedBlock = regexp.MustCompile("(?s)```.*?(```|$)")
+
+// detectLanguage guesses the language of s, or returns "" when unsure.
+// Non-Latin scripts are recognised by script; Latin-script languages by
+// which stopword list matches most words.
+func detectLanguage(s string) string {
+    s = fencedBlock.ReplaceAllString(s, " ")
+    var letters int
+    scripts := map[string]int{}
+    for _, r := range s {
+        if !unicode.IsLetter(r) {
+            continue
+        }
+        letters++
+        switch {
+        case unicode.Is(unicode.Hangul, r):
+            scripts["ko"]++
+        case unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r):
+            scripts["ja"]++
+        case unicode.Is(unicode.Han, r):
+            scripts["zh"]++
+        case unicode.Is(unicode.Cyrillic, r):
+            scripts["ru"]++
+        case unicode.Is(unicode.Arabic, r):
+            scripts["ar"]++
+        }
+    }
+    if letters == 0 {
+        return ""
+    }
+    // Kana mixed into Han text means Japanese.
+    if scripts["ja"] > 0 && scripts["ja"]+scripts["zh"] > letters/2 {
+        return "ja"
+    }
+    for _, lang := range []string{"ko", "zh", "ru", "ar"} {
+        if scripts[lang] > letters/2 {
+            return lang
+        }
+    }
+
+    words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) })
+    if len(words) < translateMinWords {
+        return ""
+    }
+    best, bestHits, second := "", 0, 0
+    for lang, list := range stopwords {
+        hits := 0
+        for _, w := range words {
+            for _, sw := range list {
+                if w == sw {
+                    hits++
+                    break
+                }
+            }
+        }
+        if hits > bestHits {
+            best, bestHits, second = lang, hits, bestHits
+        } else if hits > second {
+            second = hits
+        }
+    }
+    // Require a clear winner; closely related languages share stopwords.
+    if bestHits < 2 || bestHits < second*3/2 {
+        return ""
+    }
+    return best
+}
+
+// protectCode swaps fenced code blocks for numbered placeholders, returning
+// the text to translate and the blocks to put back.
+func protectCode(s string) (string, []string) {
+    var blocks []string
+    out := fencedBlock.ReplaceAllStringFunc(s, func(b string) string {
+        blocks = append(blocks, b)
+        return fmt.Sprintf("[[CODE%d]]", len(blocks)-1)
+    })
+    return out, blocks
+}
+
+// restoreCode puts the code blocks back, failing if the translator lost or
+// duplicated any placeholder.
+func restoreCode(s string, blocks []string) (string, error) {
+    for i, b := range blocks {
+        ph := fmt.Sprintf("[[CODE%d]]", i)
+        if strings.Count(s, ph) != 1 {
+            return "", fmt.Errorf("translation dropped code block %d", i)
+        }
+        s = strings.Replace(s, ph, b, 1)
+    }
+    return s, nil
+}
+
+// translation describes a translated reply in the /chat response.
+type translation struct {
+    From     string `json:"from"`
+    To       string `json:"to"`
+    Model    string `json:"model"`
+    Original string `json:"original"`
+}
+
+// translateReply returns text in cfg.TranslateTarget. When the reply is
+// already in that language, its language can't be told, or translating
+// fails, text comes back unchanged with a nil info, and reason says why
+// for the log.
+func translateReply(cfg *config, text string, timeout time.Duration) (out string, info *translation, reason string) {
+    from := detectLanguage(text)
+    switch {
+    case from == "":
+        return text, nil, "language not detected"
+    case from == cfg.TranslateTarget:
+        return text, nil, ""
+    }
+
+    prose, blocks := protectCode(text)
+    url, err := cfg.modelAPI(cfg.TranslateModel, "/api/generate")
+    if err != nil {
+        return text, nil, err.Error()
+    }
+    target := languageNames[cfg.TranslateTarget]
+    body, _ := json.Marshal(ChatRequest{
+        Model: cfg.TranslateModel,
+        System: "Translate the user's text from " + languageNames[from] + " into " + target +
+            ". Reply with the translation only. Keep Markdown formatting, and copy placeholders such as [[CODE0]] exactly as they are.",
+        Prompt:  prose,
+        Options: map[string]interface{}{"temperature": 0},
+    })
+    client := &http.Client{Timeout: timeout}
+    resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return text, nil, err.Error()
+    }
+    defer resp.Body.Close()
+    var tr ChatResponse
+    if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+        return text, nil, "invalid response: " + err.Error()
+    }
+    if resp.StatusCode != http.StatusOK || tr.Error != "" {
+        return text, nil, fmt.Sprintf("status %d %s", resp.StatusCode, tr.Error)
+    }
+    translated, err := restoreCode(strings.TrimSpace(tr.Response), blocks)
+    if err != nil {
+        return text, nil, err.Error()
+    }
+    return translated, &translation{From: from, To: cfg.TranslateTarget, Model: cfg.TranslateModel, Original: text}, ""
+}
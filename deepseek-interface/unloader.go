@@ -0,0 +1,165 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// unloader is the warmer's opposite: it asks Ollama to drop models nobody
+// has used for a while, so a shared machine gets its GPU memory back
+// without waiting for Ollama's own keep-alive. Models in WARM_MODELS are
+// never unloaded; keeping them resident is the warmer's job.
+type unloader struct {
+    cfg  *config
+    idle time.Duration
+    keep map[string]bool
+
+    mu       sync.Mutex
+    lastUsed map[string]time.Time
+    active   map[string]int
+    // models we unloaded; seeing one loaded again means something other
+    // than this server is using it, so its idle time starts over
+    unloaded map[string]bool
+}
+
+func newUnloader(cfg *config) *unloader {
+    u := &unloader{
+        cfg:      cfg,
+        idle:     cfg.UnloadIdle,
+        keep:     make(map[string]bool),
+        lastUsed: make(map[string]time.Time),
+        active:   make(map[string]int),
+        unloaded: make(map[string]bool),
+    }
+    for _, m := range cfg.WarmModels {
+        u.keep[withTag(m)] = true
+    }
+    return u
+}
+
+// withTag adds Ollama's implied ":latest", so a request for "llama3" and
+// /api/ps reporting "llama3:latest" refer to the same model.
+func withTag(model string) string {
+    if !strings.Contains(model, ":") {
+        return model + ":latest"
+    }
+    return model
+}
+
+// use marks model as busy until the returned func is called. A nil
+// unloader (the feature is off) tracks nothing.
+func (u *unloader) use(model string) func() {
+    if u == nil {
+        return func() {}
+    }
+    model = withTag(model)
+    u.mu.Lock()
+    u.active[model]++
+    u.mu.Unlock()
+    return func() {
+        u.mu.Lock()
+        defer u.mu.Unlock()
+        if u.active[model]--; u.active[model] == 0 {
+            delete(u.active, model)
+        }
+        u.lastUsed[model] = time.Now()
+    }
+}
+
+// idleSince reports when model was last used, or startup if it hasn't been
+// used since, and whether it is idle at all.
+func (u *unloader) idleSince(model string) (time.Time, bool) {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    if u.active[model] > 0 {
+        return time.Time{}, false
+    }
+    if u.unloaded[model] {
+        delete(u.unloaded, model)
+        u.lastUsed[model] = time.Now()
+    }
+    if t, ok := u.lastUsed[model]; ok {
+        return t, true
+    }
+    return startedAt, true
+}
+
+// run checks the loaded models until ctx is done, often enough that a model
+// is unloaded within about a quarter of the idle period of going idle.
+func (u *unloader) run(ctx context.Context) {
+    if len(u.keep) > 0 {
+        log.Printf("Unloading models idle for %s, except warm models %v", u.idle, u.cfg.WarmModels)
+    } else {
+        log.Printf("Unloading models idle for %s", u.idle)
+    }
+    every := u.idle / 4
+    if every > time.Minute {
+        every = time.Minute
+    }
+    ticker := time.NewTicker(every)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        u.sweep(ctx)
+    }
+}
+
+func (u *unloader) sweep(ctx context.Context) {
+    loaded, err := loadedModels(ctx, u.cfg)
+    if err != nil {
+        log.Printf("Unloader: cannot list loaded models: %v", err)
+        return
+    }
+    for model := range loaded {
+        if u.keep[model] {
+            continue
+        }
+        since, idle := u.idleSince(model)
+        if !idle || time.Since(since) < u.idle {
+            continue
+        }
+        if err := unloadModel(ctx, u.cfg, model); err != nil {
+            if ctx.Err() == nil {
+                log.Printf("Unloader: failed to unload %s: %v", model, err)
+            }
+            continue
+        }
+        log.Printf("Unloader: unloaded %s, idle for %s", model, time.Since(since).Round(time.Second))
+        u.mu.Lock()
+        u.unloaded[model] = true
+        u.mu.Unlock()
+    }
+}
+
+// unloadModel asks Ollama to evict model now: a generate call with no
+// prompt and keep_alive 0.
+func unloadModel(ctx context.Context, cfg *config, model string) error {
+    body, _ := json.Marshal(map[string]interface{}{"model": model, "keep_alive": 0})
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, "POST", cfg.ollamaAPI("/api/generate"), bytes.NewBuffer(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("Ollama responded with status %d", resp.StatusCode)
+    }
+    return nil
+}
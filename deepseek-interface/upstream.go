@@ -0,0 +1,148 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "sync/atomic"
+    "time"
+)
+
+// defaultRetryAfter is how long to wait on an upstream 429 that doesn't
+// say.
+const defaultRetryAfter = time.Second
+
+// rateLimitCounters tell apart requests we turned away ourselves from those
+// Ollama, or a gateway in front of it, turned away.
+type rateLimitCounters struct {
+    local    atomic.Int64 // our own 429s, e.g. the per-session cap
+    upstream atomic.Int64 // 429s received from upstream
+    retried  atomic.Int64 // upstream 429s we waited out and retried
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP
+// date. ok is false when the header is missing or unreadable.
+func parseRetryAfter(v string) (d time.Duration, ok bool) {
+    if v == "" {
+        return 0, false
+    }
+    if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+        return time.Duration(n) * time.Second, true
+    }
+    if t, err := http.ParseTime(v); err == nil {
+        if d = time.Until(t); d < 0 {
+            d = 0
+        }
+        return d, true
+    }
+    return 0, false
+}
+
+// errUpstreamAttempts is returned instead of making a call to Ollama once
+// the request has made MAX_UPSTREAM_ATTEMPTS of them.
+var errUpstreamAttempts = errors.New("gave up: this request reached MAX_UPSTREAM_ATTEMPTS calls to Ollama")
+
+// upstreamAttempts counts the calls to Ollama made for one client request.
+// Retries, fallbacks and backends each add their own attempts, and this is
+// the one cap on all of them together. It travels in the request's
+// context, so whatever makes a call can count it.
+type upstreamAttempts struct {
+    max int
+    n   atomic.Int32
+}
+
+type upstreamAttemptsKey struct{}
+
+// withAttemptCap gives ctx a count of upstream attempts capped at max, or
+// returns it unchanged when max is 0.
+func withAttemptCap(ctx context.Context, max int) context.Context {
+    if max == 0 {
+        return ctx
+    }
+    return context.WithValue(ctx, upstreamAttemptsKey{}, &upstreamAttempts{max: max})
+}
+
+// takeAttempt counts one upstream call against ctx's cap, or returns
+// errUpstreamAttempts when the cap has been reached.
+func takeAttempt(ctx context.Context) error {
+    a, _ := ctx.Value(upstreamAttemptsKey{}).(*upstreamAttempts)
+    if a != nil && int(a.n.Add(1)) > a.max {
+        return errUpstreamAttempts
+    }
+    return nil
+}
+
+// postUpstream POSTs body to url, waiting out upstream 429s and retrying
+// up to cfg.Upstream429Retries times when the requested wait is within
+// cfg.Upstream429MaxWait. The last response is returned as is, so a 429
+// that isn't retried reaches the caller with its Retry-After intact, along
+// with the number of retries made, for the X-Upstream-Retries header. Each
+// call counts against ctx's MAX_UPSTREAM_ATTEMPTS, and a 429 is passed on
+// as well when the cap leaves no attempt to retry it with; see takeAttempt.
+// The calls are made with ctx, so a client that goes away, or is cancelled
+// while queued or aborted, stops Ollama generating for it.
+func postUpstream(ctx context.Context, cfg *config, client *http.Client, url string, body []byte, limits *rateLimitCounters) (*http.Response, int, error) {
+    if err := takeAttempt(ctx); err != nil {
+        return nil, 0, err
+    }
+    for attempt := 0; ; attempt++ {
+        req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+        if err != nil {
+            return nil, attempt, err
+        }
+        req.Header.Set("Content-Type", "application/json")
+        resp, err := client.Do(req)
+        if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+            return resp, attempt, err
+        }
+        limits.upstream.Add(1)
+        wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+        if !ok {
+            wait = defaultRetryAfter
+        }
+        if attempt >= cfg.Upstream429Retries || wait > cfg.Upstream429MaxWait {
+            log.Printf("Upstream rate limited %s, passing 429 to client (retry after %s)", url, wait)
+            return resp, attempt, nil
+        }
+        if takeAttempt(ctx) != nil {
+            log.Printf("Upstream rate limited %s, passing 429 to client: MAX_UPSTREAM_ATTEMPTS reached", url)
+            return resp, attempt, nil
+        }
+        io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+        log.Printf("Upstream rate limited %s, retrying in %s", url, wait)
+        limits.retried.Add(1)
+
+        timer := time.NewTimer(wait)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return nil, attempt + 1, ctx.Err()
+        }
+    }
+}
+
+// reportUpstreamRetries tells the client in X-Upstream-Retries how many
+// upstream 429s were waited out for its request, 0 included, and logs it
+// when there were any.
+func reportUpstreamRetries(w http.ResponseWriter, r *http.Request, retries int) {
+    w.Header().Set("X-Upstream-Retries", strconv.Itoa(retries))
+    if retries > 0 {
+        log.Printf("%s %s took %d upstream retries", r.Method, r.URL.Path, retries)
+    }
+}
+
+// upstreamRetryAfter is the Retry-After to give the client for an upstream
+// 429, rounded up to whole seconds.
+func upstreamRetryAfter(resp *http.Response) string {
+    wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+    if !ok {
+        wait = defaultRetryAfter
+    }
+    return strconv.Itoa(int((wait + time.Second - 1) / time.Second))
+}
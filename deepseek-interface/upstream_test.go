@@ -0,0 +1,200 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// limitedOllama answers the first limited calls with 429 and Retry-After,
+// then 200, and counts the calls.
+func limitedOllama(t *testing.T, limited int32, retryAfter string) (*httptest.Server, *atomic.Int32) {
+    t.Helper()
+    calls := &atomic.Int32{}
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if calls.Add(1) <= limited {
+            if retryAfter != "" {
+                w.Header().Set("Retry-After", retryAfter)
+            }
+            http.Error(w, "slow down", http.StatusTooManyRequests)
+            return
+        }
+        w.Write([]byte(`{"response": "ok", "done": true}`))
+    }))
+    t.Cleanup(ts.Close)
+    return ts, calls
+}
+
+func TestPostUpstreamRetries429(t *testing.T) {
+    ts, calls := limitedOllama(t, 2, "0")
+    cfg := testConfig(t, "UPSTREAM_429_RETRIES", "2", "UPSTREAM_429_MAX_WAIT", "1s")
+    limits := &rateLimitCounters{}
+
+    resp, retries, err := postUpstream(context.Background(), cfg, ts.Client(), ts.URL, []byte(`{}`), limits)
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || retries != 2 || calls.Load() != 3 {
+        t.Errorf("got %d after %d retries and %d calls, want 200 after 2 and 3", resp.StatusCode, retries, calls.Load())
+    }
+    if limits.upstream.Load() != 2 || limits.retried.Load() != 2 || limits.local.Load() != 0 {
+        t.Errorf("counters upstream %d retried %d local %d, want 2, 2, 0", limits.upstream.Load(), limits.retried.Load(), limits.local.Load())
+    }
+}
+
+func TestPostUpstreamPassesOn429(t *testing.T) {
+    tests := []struct {
+        name       string
+        limited    int32
+        retryAfter string
+        retries    int
+        calls      int32
+    }{
+        {"wait too long", 1, "30", 0, 1},
+        {"retries used up", 5, "0", 2, 3},
+    }
+    for _, tt := range tests {
+        ts, calls := limitedOllama(t, tt.limited, tt.retryAfter)
+        cfg := testConfig(t, "UPSTREAM_429_RETRIES", "2", "UPSTREAM_429_MAX_WAIT", "10s")
+        resp, retries, err := postUpstream(context.Background(), cfg, ts.Client(), ts.URL, []byte(`{}`), &rateLimitCounters{})
+        if err != nil {
+            t.Fatalf("%s: %v", tt.name, err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusTooManyRequests || retries != tt.retries || calls.Load() != tt.calls {
+            t.Errorf("%s: got %d after %d retries and %d calls, want 429 after %d and %d", tt.name, resp.StatusCode, retries, calls.Load(), tt.retries, tt.calls)
+        }
+        if got := upstreamRetryAfter(resp); got != tt.retryAfter {
+            t.Errorf("%s: Retry-After passed on = %q, want %q", tt.name, got, tt.retryAfter)
+        }
+    }
+}
+
+func TestPostUpstreamCancelledWhileWaiting(t *testing.T) {
+    ts, calls := limitedOllama(t, 1, "5")
+    cfg := testConfig(t, "UPSTREAM_429_RETRIES", "2", "UPSTREAM_429_MAX_WAIT", "10s")
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+    _, _, err := postUpstream(ctx, cfg, ts.Client(), ts.URL, []byte(`{}`), &rateLimitCounters{})
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Errorf("err = %v, want the context's", err)
+    }
+    if elapsed := time.Since(start); elapsed > 2*time.Second || calls.Load() != 1 {
+        t.Errorf("gave up after %v and %d calls, want promptly after 1", elapsed, calls.Load())
+    }
+}
+
+func TestParseRetryAfter(t *testing.T) {
+    tests := []struct {
+        header string
+        want   time.Duration
+        ok     bool
+    }{
+        {"", 0, false},
+        {"0", 0, true},
+        {"120", 2 * time.Minute, true},
+        {"-1", 0, false},
+        {"soon", 0, false},
+        {"Mon, 01 Jan 2001 00:00:00 GMT", 0, true},
+    }
+    for _, tt := range tests {
+        got, ok := parseRetryAfter(tt.header)
+        if got != tt.want || ok != tt.ok {
+            t.Errorf("parseRetryAfter(%q) = %s, %v; want %s, %v", tt.header, got, ok, tt.want, tt.ok)
+        }
+    }
+    future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+    if got, ok := parseRetryAfter(future); !ok || got < 59*time.Minute || got > time.Hour {
+        t.Errorf("parseRetryAfter(an hour from now) = %s, %v", got, ok)
+    }
+}
+
+func TestChatPassesOnUpstream429(t *testing.T) {
+    ts, _ := limitedOllama(t, 1, "30")
+    chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ts.URL))
+    w := chat.post(`{"prompt": "hi"}`)
+    if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+        t.Errorf("/chat = %d with Retry-After %q, want 429 with 30", w.Code, w.Header().Get("Retry-After"))
+    }
+    if chat.limits.upstream.Load() != 1 || chat.limits.local.Load() != 0 {
+        t.Errorf("counted %d upstream and %d local 429s, want 1 and 0", chat.limits.upstream.Load(), chat.limits.local.Load())
+    }
+}
+
+func TestTakeAttempt(t *testing.T) {
+    ctx := withAttemptCap(context.Background(), 2)
+    for i := 0; i < 2; i++ {
+        if err := takeAttempt(ctx); err != nil {
+            t.Fatalf("attempt %d: %v", i+1, err)
+        }
+    }
+    if err := takeAttempt(ctx); !errors.Is(err, errUpstreamAttempts) {
+        t.Errorf("attempt 3 = %v, want errUpstreamAttempts", err)
+    }
+
+    ctx = withAttemptCap(context.Background(), 0)
+    for i := 0; i < 100; i++ {
+        if err := takeAttempt(ctx); err != nil {
+            t.Fatalf("uncapped attempt %d: %v", i+1, err)
+        }
+    }
+}
+
+func TestChatAttemptCapAcrossRetriesAndFallbacks(t *testing.T) {
+    file := configFile(t, `{"models": {"a:7b": {"fallbacks": ["b:7b", "c:7b"]}}}`)
+    tests := []struct {
+        max   string
+        code  int
+        calls []string
+    }{
+        // a:7b is rate limited once and then fails, b:7b fails, c:7b answers.
+        {"0", http.StatusOK, []string{"a:7b", "a:7b", "b:7b", "c:7b"}},
+        {"4", http.StatusOK, []string{"a:7b", "a:7b", "b:7b", "c:7b"}},
+        {"3", http.StatusServiceUnavailable, []string{"a:7b", "a:7b", "b:7b"}},
+        {"1", http.StatusServiceUnavailable, []string{"a:7b"}},
+    }
+    for _, tt := range tests {
+        var limited atomic.Bool
+        ollama := newFakeOllama(t, map[string]http.HandlerFunc{
+            "/api/generate": func(w http.ResponseWriter, r *http.Request) {
+                var req ChatRequest
+                json.NewDecoder(r.Body).Decode(&req)
+                if req.Model == "a:7b" && !limited.Swap(true) {
+                    w.Header().Set("Retry-After", "0")
+                    http.Error(w, "slow down", http.StatusTooManyRequests)
+                    return
+                }
+                if req.Model != "c:7b" {
+                    http.Error(w, `{"error": "failed"}`, http.StatusInternalServerError)
+                    return
+                }
+                json.NewEncoder(w).Encode(ChatResponse{Response: "from c:7b", Done: true, DoneReason: "stop"})
+            },
+        })
+        chat := newTestChat(t, testConfig(t, "OLLAMA_URL", ollama.URL, "CONFIG_FILE", file,
+            "FALLBACK_MAX_ATTEMPTS", "3", "UPSTREAM_429_RETRIES", "1", "UPSTREAM_429_MAX_WAIT", "1s", "MAX_UPSTREAM_ATTEMPTS", tt.max))
+        w := chat.post(`{"prompt": "hi", "model": "a:7b"}`)
+        if w.Code != tt.code {
+            t.Errorf("cap %s: status %d, want %d: %s", tt.max, w.Code, tt.code, w.Body.String())
+        }
+        if tt.code == http.StatusServiceUnavailable && !strings.Contains(w.Body.String(), "MAX_UPSTREAM_ATTEMPTS") {
+            t.Errorf("cap %s: error %q doesn't name MAX_UPSTREAM_ATTEMPTS", tt.max, w.Body.String())
+        }
+        var calls []string
+        for _, req := range ollama.requests("/api/generate") {
+            calls = append(calls, req["model"].(string))
+        }
+        if strings.Join(calls, " ") != strings.Join(tt.calls, " ") {
+            t.Errorf("cap %s: models asked = %q, want %q", tt.max, calls, tt.calls)
+        }
+    }
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// warmer keeps a set of models resident in Ollama by loading each one in
+// turn every interval. Models are touched one at a time, with a pause in
+// between, so several large models don't all try to load into VRAM at once.
+type warmer struct {
+    cfg      *config
+    models   []string
+    interval time.Duration
+    delay    time.Duration
+
+    // whether each model was resident after the last round, so a model
+    // that stays warm is only logged once
+    warm map[string]bool
+
+    // set once the startup round has finished, for WARM_BLOCK_READINESS
+    preloaded atomic.Bool
+}
+
+func newWarmer(cfg *config) *warmer {
+    return &warmer{
+        cfg:      cfg,
+        models:   cfg.WarmModels,
+        interval: cfg.WarmInterval,
+        delay:    cfg.WarmDelay,
+        warm:     make(map[string]bool),
+    }
+}
+
+// run warms every model straight away and then every interval until ctx
+// is done. ctx is the shutdown signal, so a pod stopped while a large model
+// is still loading gives up on the load instead of waiting for it.
+func (w *warmer) run(ctx context.Context) {
+    log.Printf("Keeping %d model(s) warm every %s: %v", len(w.models), w.interval, w.models)
+    start := time.Now()
+    w.round(ctx)
+    if ctx.Err() != nil {
+        log.Printf("Warmer: startup preload cancelled after %s", time.Since(start).Round(time.Millisecond))
+        return
+    }
+    log.Printf("Warmer: startup preload finished in %s", time.Since(start).Round(time.Millisecond))
+    w.preloaded.Store(true)
+
+    ticker := time.NewTicker(w.interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+        w.round(ctx)
+    }
+}
+
+// round checks which models Ollama currently has loaded and pings each
+// configured model so its keep-alive is renewed.
+func (w *warmer) round(ctx context.Context) {
+    loaded, err := loadedModels(ctx, w.cfg)
+    if err != nil {
+        log.Printf("Warmer: cannot list loaded models: %v", err)
+    }
+    for i, model := range w.models {
+        if i > 0 {
+            select {
+            case <-ctx.Done():
+                return
+            case <-time.After(w.delay):
+            }
+        }
+
+        // Only log transitions when /api/ps told us the real state.
+        known := err == nil
+        resident := known && loaded[model]
+        if known && !resident {
+            log.Printf("Warmer: %s is cold, loading", model)
+        } else if known && !w.warm[model] {
+            log.Printf("Warmer: %s is warm", model)
+        }
+
+        start := time.Now()
+        if perr := pingModel(ctx, w.cfg, model); perr != nil {
+            if ctx.Err() == nil {
+                log.Printf("Warmer: failed to load %s: %v", model, perr)
+            }
+            w.warm[model] = false
+            continue
+        }
+        if known && !resident {
+            log.Printf("Warmer: %s loaded in %s", model, time.Since(start).Round(time.Millisecond))
+        }
+        w.warm[model] = true
+    }
+}
+
+// loadedModels returns the models Ollama currently holds in memory, via
+// /api/ps.
+func loadedModels(ctx context.Context, cfg *config) (map[string]bool, error) {
+    return loadedModelsAt(ctx, cfg.ollamaAPI("/api/ps"))
+}
+
+// loadedModelsAt is loadedModels for the /api/ps at psURL, such as one
+// backend's.
+func loadedModelsAt(ctx context.Context, psURL string) (map[string]bool, error) {
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    reply, err := fetchPS(ctx, psURL)
+    if err != nil {
+        return nil, err
+    }
+    return parsePS(reply)
+}
+
+// fetchPS reads the /api/ps answer at psURL to the end, so it can be
+// shared with requests waiting on the same call.
+func fetchPS(ctx context.Context, psURL string) (*bufferedReply, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", psURL, nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    return bufferReply(resp)
+}
+
+// parsePS returns the models an /api/ps answer lists as in memory.
+func parsePS(reply *bufferedReply) (map[string]bool, error) {
+    if reply.status != http.StatusOK {
+        return nil, fmt.Errorf("Ollama responded with status %d", reply.status)
+    }
+
+    var ps struct {
+        Models []struct {
+            Name string `json:"name"`
+        } `json:"models"`
+    }
+    if err := json.Unmarshal(reply.body, &ps); err != nil {
+        return nil, err
+    }
+    loaded := make(map[string]bool, len(ps.Models))
+    for _, m := range ps.Models {
+        loaded[m.Name] = true
+    }
+    return loaded, nil
+}
+
+// pingModel asks the Ollama serving model to load it without generating
+// anything. A generate call with no prompt loads the model and resets its
+// keep-alive.
+func pingModel(ctx context.Context, cfg *config, model string) error {
+    generateURL, err := cfg.modelAPI(model, "/api/generate")
+    if err != nil {
+        return err
+    }
+    return pingModelAt(ctx, generateURL, model)
+}
+
+// pingModelAt is pingModel for the /api/generate at generateURL, such as
+// the one backend a request was sent to.
+func pingModelAt(ctx context.Context, generateURL, model string) error {
+    body, _ := json.Marshal(map[string]interface{}{"model": model})
+    req, err := http.NewRequestWithContext(ctx, "POST", generateURL, bytes.NewBuffer(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+
+    // Loading a big model from disk can take minutes.
+    client := &http.Client{Timeout: 5 * time.Minute}
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("Ollama responded with status %d", resp.StatusCode)
+    }
+    return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// loadingOllama is an Ollama that lists nothing as loaded and takes until
+// release is closed, or the caller gives up, to load a model.
+func loadingOllama(t *testing.T, loading chan<- string, release <-chan struct{}) *httptest.Server {
+    t.Helper()
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/api/ps":
+            w.Write([]byte(`{"models": []}`))
+        case "/api/generate":
+            var req struct{ Model string }
+            json.NewDecoder(r.Body).Decode(&req)
+            loading <- req.Model
+            select {
+            case <-release:
+                w.Write([]byte(`{"done": true}`))
+            case <-r.Context().Done():
+            }
+        default:
+            http.NotFound(w, r)
+        }
+    }))
+    t.Cleanup(ts.Close)
+    return ts
+}
+
+func TestWarmerShutdownCancelsPreload(t *testing.T) {
+    loading, release := make(chan string, 1), make(chan struct{})
+    defer close(release)
+    ts := loadingOllama(t, loading, release)
+    cfg := testConfig(t, "OLLAMA_URL", ts.URL, "WARM_MODELS", "big:70b,small:1b", "WARM_DELAY", "0")
+    w := newWarmer(cfg)
+
+    ctx, shutdown := context.WithCancel(context.Background())
+    done := make(chan struct{})
+    go func() {
+        w.run(ctx)
+        close(done)
+    }()
+    if model := <-loading; model != "big:70b" {
+        t.Fatalf("first model loaded = %q, want big:70b", model)
+    }
+
+    shutdown()
+    select {
+    case <-done:
+    case <-time.After(2 * time.Second):
+        t.Fatal("warmer kept loading after shutdown")
+    }
+    if w.preloaded.Load() {
+        t.Error("a cancelled preload was reported as finished")
+    }
+    select {
+    case model := <-loading:
+        t.Errorf("warmer went on to load %s after shutdown", model)
+    default:
+    }
+}
+
+func TestWarmerGatesReadiness(t *testing.T) {
+    loading, release := make(chan string, 2), make(chan struct{})
+    ts := loadingOllama(t, loading, release)
+    cfg := testConfig(t, "OLLAMA_URL", ts.URL, "WARM_MODELS", "big:70b", "WARM_INTERVAL", "1h")
+    w := newWarmer(cfg)
+    ready := healthHandler(&drainer{}, newHealthChecker(cfg), w, &atomic.Bool{})
+
+    ctx, shutdown := context.WithCancel(context.Background())
+    defer shutdown()
+    go w.run(ctx)
+    <-loading
+
+    rec := httptest.NewRecorder()
+    ready(rec, httptest.NewRequest("GET", "/healthz", nil))
+    var result healthResult
+    json.NewDecoder(rec.Body).Decode(&result)
+    if rec.Code != http.StatusServiceUnavailable || result.Status != healthWarming {
+        t.Errorf("readiness during the preload = %d %q, want 503 %q", rec.Code, result.Status, healthWarming)
+    }
+
+    close(release)
+    deadline := time.Now().Add(2 * time.Second)
+    for !w.preloaded.Load() {
+        if time.Now().After(deadline) {
+            t.Fatal("preload never finished")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    rec = httptest.NewRecorder()
+    ready(rec, httptest.NewRequest("GET", "/healthz", nil))
+    json.NewDecoder(rec.Body).Decode(&result)
+    if result.Status == healthWarming {
+        t.Error("readiness still says warming after the preload finished")
+    }
+}